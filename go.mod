@@ -10,13 +10,13 @@ require (
 	github.com/ije/rex v1.10.12
 	github.com/mileusna/useragent v1.3.4
 	go.etcd.io/bbolt v1.3.8
+	golang.org/x/net v0.21.0
 )
 
 require (
 	github.com/andybalholm/brotli v1.1.0 // indirect
 	github.com/rs/cors v1.10.1 // indirect
 	golang.org/x/crypto v0.21.0 // indirect
-	golang.org/x/net v0.21.0 // indirect
 	golang.org/x/sys v0.18.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
 )
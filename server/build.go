@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -12,6 +13,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/evanw/esbuild/pkg/api"
@@ -35,6 +37,7 @@ type BuildTask struct {
 	Target     string
 	Dev        bool
 	Bundle     bool
+	Standalone bool
 	NoBundle   bool
 	npm        NpmPackageInfo
 	esm        *ESMBuild
@@ -49,11 +52,13 @@ type BuildTask struct {
 	smOffset   int
 	subBuilds  *StringSet
 	subTasks   []chan struct{}
+	inputs     []string
 }
 
 func (task *BuildTask) Build() (esm *ESMBuild, err error) {
-	pkgVersionName := task.Pkg.VersionName()
-	task.wd = path.Join(cfg.WorkDir, fmt.Sprintf("npm/%s", pkgVersionName))
+	task.wd = getWorkDir(task.Pkg)
+	// the install directory can't be evicted by the gc during the build
+	defer workDirs.use(task.wd)()
 	err = ensureDir(task.wd)
 	if err != nil {
 		return
@@ -74,6 +79,14 @@ func (task *BuildTask) Build() (esm *ESMBuild, err error) {
 			return
 		}
 		npmrc.WriteString(fmt.Sprintf("%s:_authToken=${ESM_NPM_TOKEN}\n", tokenReg))
+	} else if cfg.NpmRegistry != "" && cfg.GitlabToken != "" && isGitlabRegistry(cfg.NpmRegistry) {
+		var tokenReg string
+		tokenReg, err = removeHttpPrefix(cfg.NpmRegistry)
+		if err != nil {
+			log.Errorf("Invalid npm registry in config: %v", err)
+			return
+		}
+		npmrc.WriteString(fmt.Sprintf("//%s:_authToken=${ESM_GITLAB_TOKEN}\n", tokenReg))
 	}
 	if cfg.NpmRegistry != "" && cfg.NpmUser != "" && cfg.NpmPassword != "" {
 		var tokenReg string
@@ -85,23 +98,47 @@ func (task *BuildTask) Build() (esm *ESMBuild, err error) {
 		npmrc.WriteString(fmt.Sprintf("%s:username=${ESM_NPM_USER}\n", tokenReg))
 		npmrc.WriteString(fmt.Sprintf("%s:_password=${ESM_NPM_PASSWORD}\n", tokenReg))
 	}
+	if cfg.TypesRegistry != "" {
+		npmrc.WriteString(fmt.Sprintf("@types:registry=%s\n", cfg.TypesRegistry))
+		if cfg.TypesRegistryToken != "" {
+			var tokenReg string
+			tokenReg, err = removeHttpPrefix(cfg.TypesRegistry)
+			if err != nil {
+				log.Errorf("Invalid types registry in config: %v", err)
+				return
+			}
+			npmrc.WriteString(fmt.Sprintf("%s:_authToken=${ESM_TYPES_REGISTRY_TOKEN}\n", tokenReg))
+		}
+	}
+	npmrc.WriteString(npmScopesRc())
 	err = os.WriteFile(path.Join(task.wd, ".npmrc"), npmrc.Bytes(), 0644)
 	if err != nil {
 		log.Errorf("Failed to create .npmrc file: %v", err)
 		return
 	}
 
-	if !task.Pkg.FromGithub && !strings.HasPrefix(task.Pkg.Name, "@jsr/") {
+	if !task.Pkg.FromGithub && !strings.HasPrefix(task.Pkg.Name, "@jsr/") && !isNonRegistryVersion(task.Pkg.Version) {
 		var info NpmPackageInfo
 		info, err = fetchPackageInfo(task.Pkg.Name, task.Pkg.Version)
 		if err != nil {
 			return
 		}
 		task.deprecated = info.Deprecated
+
+		// warm the package info of the dependencies while installing the package
+		var prefetch sync.WaitGroup
+		prefetch.Add(1)
+		go func() {
+			defer prefetch.Done()
+			prefetchDependencies(info)
+		}()
+		defer prefetch.Wait()
 	}
 
 	task.stage = "install"
-	err = installPackage(task.wd, task.Pkg)
+	// the build is shared by the clients of the build queue, so the install isn't canceled with a request,
+	// it's still killed after `cfg.InstallTimeout`
+	err = installPackage(context.Background(), task.wd, task.Pkg)
 	if err != nil {
 		return
 	}
@@ -159,6 +196,10 @@ func (task *BuildTask) build() (err error) {
 	task.npm = npm
 	task.esm = esm
 
+	for _, name := range task.undeclaredConditions(npm) {
+		log.Debugf("build(%s): the condition '%s' is not declared by the exports of '%s'", task.ID(), name, npm.Name)
+	}
+
 	if task.Target == "types" {
 		if npm.Types != "" {
 			dts := npm.Name + "@" + npm.Version + path.Join("/", npm.Types)
@@ -191,7 +232,7 @@ func (task *BuildTask) build() (err error) {
 			wd:     task.resolveDir,
 		}
 		if !formJson {
-			err = installPackage(task.wd, t.Pkg)
+			err = installPackage(context.Background(), task.wd, t.Pkg)
 			if err != nil {
 				return
 			}
@@ -236,13 +277,35 @@ func (task *BuildTask) build() (err error) {
 	if npm.Module == "" {
 		buf := bytes.NewBuffer(nil)
 		fmt.Fprintf(buf, `import * as __module from "%s";`, moduleName)
-		if len(esm.NamedExports) > 0 {
-			fmt.Fprintf(buf, `export const { %s } = __module;`, strings.Join(esm.NamedExports, ","))
+		if task.Args.exports.Len() > 0 {
+			// only the members of the `?exports` query are exported, the member that is not exported by
+			// the cjs module is rejected instead of exporting `undefined` (unless the cjs lexer failed)
+			names := []string{}
+			for _, name := range task.Args.exports.SortedValues() {
+				if name != "default" {
+					if err == nil && !includes(esm.NamedExports, name) {
+						err = newRegistryError(ErrInvalidSpecifier, "'%s' is not exported by '%s'", name, moduleName)
+						return
+					}
+					names = append(names, name)
+				}
+			}
+			if len(names) > 0 {
+				fmt.Fprintf(buf, `export const { %s } = __module;`, strings.Join(names, ","))
+			}
+			if task.Args.exports.Has("default") {
+				fmt.Fprintf(buf, "const { default: __default, ...__rest } = __module;")
+				fmt.Fprintf(buf, "export default (__default !== undefined ? __default : __rest);")
+			}
+		} else {
+			if len(esm.NamedExports) > 0 {
+				fmt.Fprintf(buf, `export const { %s } = __module;`, strings.Join(esm.NamedExports, ","))
+			}
+			fmt.Fprintf(buf, "const { default: __default, ...__rest } = __module;")
+			fmt.Fprintf(buf, "export default (__default !== undefined ? __default : __rest);")
+			// Default reexport all members from original module to prevent missing named exports members
+			fmt.Fprintf(buf, `export * from "%s";`, moduleName)
 		}
-		fmt.Fprintf(buf, "const { default: __default, ...__rest } = __module;")
-		fmt.Fprintf(buf, "export default (__default !== undefined ? __default : __rest);")
-		// Default reexport all members from original module to prevent missing named exports members
-		fmt.Fprintf(buf, `export * from "%s";`, moduleName)
 		input = &api.StdinOptions{
 			Contents:   buf.String(),
 			ResolveDir: task.wd,
@@ -251,7 +314,7 @@ func (task *BuildTask) build() (err error) {
 	} else {
 		if task.Args.exports.Len() > 0 {
 			buf := bytes.NewBuffer(nil)
-			fmt.Fprintf(buf, `export { %s } from "%s";`, strings.Join(task.Args.exports.Values(), ","), moduleName)
+			fmt.Fprintf(buf, `export { %s } from "%s";`, strings.Join(task.Args.exports.SortedValues(), ","), moduleName)
 			input = &api.StdinOptions{
 				Contents:   buf.String(),
 				ResolveDir: task.wd,
@@ -276,10 +339,7 @@ func (task *BuildTask) build() (err error) {
 		}
 	}
 
-	nodeEnv := "production"
-	if task.Dev {
-		nodeEnv = "development"
-	}
+	nodeEnv := task.nodeEnv()
 	define := map[string]string{
 		"__filename":                  fmt.Sprintf(`"/_virtual/esm.sh/%s"`, task.ID()),
 		"__dirname":                   fmt.Sprintf(`"/_virtual/esm.sh/%s"`, path.Dir(task.ID())),
@@ -297,12 +357,13 @@ func (task *BuildTask) build() (err error) {
 		"global.require.resolve":      "__rResolve$",
 		"global.process.env.NODE_ENV": fmt.Sprintf(`"%s"`, nodeEnv),
 	}
-	if task.Target == "node" {
+	if task.isNodeTarget() {
 		define = map[string]string{}
 	}
 	imports := []string{}
 	browserExclude := map[string]*StringSet{}
 	implicitExternal := newStringSet()
+	jsonImports := newStringSet()
 
 	esmPlugin := api.Plugin{
 		Name: "esm",
@@ -310,6 +371,23 @@ func (task *BuildTask) build() (err error) {
 			build.OnResolve(
 				api.OnResolveOptions{Filter: ".*"},
 				func(args api.OnResolveArgs) (api.OnResolveResult, error) {
+					// the injected `process` and `Buffer` of `standalone` mode
+					if args.Kind == api.ResolveEntryPoint && strings.HasPrefix(args.Path, "node-lib:") {
+						return api.OnResolveResult{
+							Path:        strings.TrimPrefix(args.Path, "node-lib:"),
+							Namespace:   "node-lib",
+							SideEffects: api.SideEffectsFalse,
+						}, nil
+					}
+
+					// resolve the chunks imported by the inlined node libs
+					if args.Namespace == "node-lib" && isLocalSpecifier(args.Path) {
+						return api.OnResolveResult{
+							Path:      path.Join(path.Dir(args.Importer), args.Path),
+							Namespace: "node-lib",
+						}, nil
+					}
+
 					// ban file urls
 					if strings.HasPrefix(args.Path, "file:") {
 						return api.OnResolveResult{
@@ -318,6 +396,22 @@ func (task *BuildTask) build() (err error) {
 						}, nil
 					}
 
+					// the bun builtin modules, e.g. `bun:sqlite`
+					if strings.HasPrefix(args.Path, "bun:") && task.Target == "bun" {
+						return api.OnResolveResult{
+							Path:     args.Path,
+							External: true,
+						}, nil
+					}
+
+					// the `electron` module is provided by the electron runtime
+					if task.isElectronTarget() && task.Pkg.Name != "electron" && (args.Path == "electron" || strings.HasPrefix(args.Path, "electron/")) {
+						return api.OnResolveResult{
+							Path:     args.Path,
+							External: true,
+						}, nil
+					}
+
 					// skip http modules
 					if strings.HasPrefix(args.Path, "data:") || strings.HasPrefix(args.Path, "https:") || strings.HasPrefix(args.Path, "http:") {
 						return api.OnResolveResult{
@@ -353,12 +447,22 @@ func (task *BuildTask) build() (err error) {
 					// normalize specifier
 					specifier := strings.TrimPrefix(args.Path, "node:")
 					specifier = strings.TrimPrefix(specifier, "npm:")
+					specifier = normalizeJsrSpecifier(specifier)
 
 					// bundle "@babel/runtime/*"
 					if (args.Kind == api.ResolveJSRequireCall || !noBundle) && task.npm.Name != "@babel/runtime" && (strings.HasPrefix(specifier, "@babel/runtime/") || strings.Contains(args.Importer, "/@babel/runtime/")) {
 						return api.OnResolveResult{}, nil
 					}
 
+					// the optional dependency that is not installed for the build platform,
+					// the error is thrown when it's required, e.g. in a `try...catch` block
+					if task.isOptionalDependencyMissing(specifier) {
+						return api.OnResolveResult{
+							Path:      getPkgName(specifier),
+							Namespace: "optional-dependency",
+						}, nil
+					}
+
 					// resolve alias in dependencies
 					// follow https://docs.npmjs.com/cli/v10/configuring-npm/package-json#git-urls-as-dependencies
 					// e.g. "@mark/html": "npm:@jsr/mark__html@^1.0.0"
@@ -378,15 +482,43 @@ func (task *BuildTask) build() (err error) {
 							if pPath != "" {
 								specifier += "/" + pPath
 							}
+						} else if strings.HasPrefix(v, "jsr:") {
+							// e.g. "@std/encoding": "jsr:^1.0.0" or "encoding": "jsr:@std/encoding@^1.0.0"
+							if strings.HasPrefix(v, "jsr:@") {
+								specifier = normalizeJsrSpecifier(v)
+							} else {
+								specifier = normalizeJsrSpecifier("jsr:" + pName + "@" + v[4:])
+							}
+							if pPath != "" {
+								specifier += "/" + pPath
+							}
 						} else if strings.HasPrefix(v, "git+ssh://") || strings.HasPrefix(v, "git+https://") || strings.HasPrefix(v, "git://") {
 							gitUrl, err := url.Parse(v)
-							if err != nil || gitUrl.Hostname() != "github.com" {
-								// todo: support more git hosts
+							if err != nil {
 								return api.OnResolveResult{
 									Path:     fmt.Sprintf("/error.js?type=unsupported-file-dependency&name=%s&importer=%s", v, task.Pkg),
 									External: true,
 								}, nil
 							}
+							if gitUrl.Hostname() != "github.com" {
+								// the git url of other hosts, e.g. "git+https://gitlab.com/org/repo.git#v1.0.0"
+								pkg := Pkg{
+									Name:      pName,
+									Version:   v,
+									SubModule: toModuleBareName(pPath, true),
+									SubPath:   pPath,
+								}
+								importPkg := pkg
+								importPkg.Version = url.QueryEscape(v)
+								resolvedPath := task.getImportPath(importPkg, encodeBuildArgsPrefix(task.Args, pkg, false))
+								if args.Kind != api.ResolveJSDynamicImport {
+									task.imports = append(task.imports, [2]string{resolvedPath, resolvedPath})
+								}
+								return api.OnResolveResult{
+									Path:     resolvedPath,
+									External: true,
+								}, nil
+							}
 							repo := strings.TrimSuffix(gitUrl.Path[1:], ".git")
 							if gitUrl.Scheme == "git+ssh" {
 								repo = gitUrl.Port() + "/" + repo
@@ -402,6 +534,9 @@ func (task *BuildTask) build() (err error) {
 								Path:     path,
 								External: true,
 							}, nil
+						} else if strings.HasPrefix(v, "gitlab:") {
+							// the gitlab package is installed with the package by pnpm, bundle it
+							return api.OnResolveResult{}, nil
 						} else if strings.HasPrefix(v, "github:") || strings.ContainsRune(v, '/') {
 							repo, version := utils.SplitByLastByte(v, '#')
 							pkg := Pkg{
@@ -420,6 +555,12 @@ func (task *BuildTask) build() (err error) {
 								External: true,
 							}, nil
 						}
+					} else if v, ok := npm.PeerDependencies[pName]; ok && strings.HasPrefix(v, "npm:") {
+						// e.g. "react-dom": "npm:@preact/compat@^17" in `peerDependencies`
+						specifier = v[4:]
+						if pPath != "" {
+							specifier += "/" + pPath
+						}
 					}
 
 					// resolve specifier with package `imports` field
@@ -440,10 +581,12 @@ func (task *BuildTask) build() (err error) {
 								}
 							}
 						}
+						// e.g. "@std/path": "jsr:@std/path@^1.0.0" in the import map of a JSR package
+						specifier = normalizeJsrSpecifier(strings.TrimPrefix(specifier, "npm:"))
 					}
 
 					// resolve specifier with package `browser` field
-					if len(npm.Browser) > 0 && !task.isServerTarget() {
+					if len(npm.Browser) > 0 && task.useBrowserField() {
 						spec := specifier
 						if strings.HasPrefix(specifier, "./") || strings.HasPrefix(specifier, "../") || specifier == ".." {
 							fullFilepath := filepath.Join(args.ResolveDir, specifier)
@@ -469,19 +612,31 @@ func (task *BuildTask) build() (err error) {
 					}
 
 					// resolve specifier by checking `?alias` query
+					aliased := false
 					if len(task.Args.alias) > 0 {
 						if name, ok := task.Args.alias[specifier]; ok {
 							specifier = name
+							aliased = true
 						} else {
 							pkgName, _, subpath := splitPkgPath(specifier)
 							if subpath != "" {
 								if name, ok := task.Args.alias[pkgName]; ok {
 									specifier = name + "/" + subpath
+									aliased = true
 								}
 							}
 						}
 					}
 
+					// replace the node builtin module with the polyfill package,
+					// see the `?node-polyfills` query and the `nodePolyfills` config
+					if nodejsInternalModules[specifier] {
+						if pkg, ok := task.getNodePolyfill(specifier); ok && pkg != "" {
+							specifier = pkg
+							aliased = true
+						}
+					}
+
 					// ignore native node packages like 'fsevent'
 					for _, name := range nativeNodePackages {
 						if specifier == name || strings.HasPrefix(specifier, name+"/") {
@@ -495,6 +650,10 @@ func (task *BuildTask) build() (err error) {
 								} else if v, ok := npm.PeerDependencies[pkgName]; ok {
 									version = v
 								}
+								if aliasName, aliasVersion, ok := parseNpmAlias(version); ok {
+									pkgName, version = aliasName, aliasVersion
+								}
+								version = task.overrideVersion(pkgName, version)
 								if !regexpFullVersion.MatchString(version) {
 									p, _, err := getPackageInfo(task.resolveDir, pkgName, version)
 									if err == nil {
@@ -544,11 +703,31 @@ func (task *BuildTask) build() (err error) {
 
 					// bundles json module
 					if strings.HasSuffix(fullFilepath, ".json") && existsFile(fullFilepath) {
+						// import the json module with the `type: "json"` attribute with `?assert=json` query, only the
+						// default import is available with the attribute, the named imports are bundled
+						if task.Args.assertJSON && args.Kind == api.ResolveJSImportStatement && isDefaultOnlyImport(args.Importer, args.Path) {
+							if url, ok := task.getRawFileURL(fullFilepath); ok {
+								jsonImports.Add(url)
+								return api.OnResolveResult{
+									Path:     url,
+									External: true,
+								}, nil
+							}
+						}
 						return api.OnResolveResult{}, nil
 					}
 
 					// embed wasm as WebAssembly.Module
 					if strings.HasSuffix(fullFilepath, ".wasm") && existsFile(fullFilepath) {
+						// import the wasm module from the CDN with `?external-wasm` query
+						if task.Args.externalWasm && args.Kind == api.ResolveJSImportStatement {
+							if url, ok := task.getRawFileURL(fullFilepath); ok {
+								return api.OnResolveResult{
+									Path:     url + "?module",
+									External: true,
+								}, nil
+							}
+						}
 						return api.OnResolveResult{
 							Path:      fullFilepath,
 							Namespace: "wasm",
@@ -572,17 +751,27 @@ func (task *BuildTask) build() (err error) {
 
 					// it's nodejs internal module
 					if nodejsInternalModules[specifier] {
+						if task.inlineNodeLib(specifier) {
+							return api.OnResolveResult{
+								Path:      "node/" + specifier + ".js",
+								Namespace: "node-lib",
+							}, nil
+						}
 						return api.OnResolveResult{
 							Path:     task.resolveExternalModule(specifier, args.Kind),
 							External: true,
 						}, nil
 					}
 
-					// bundles all dependencies in `bundle` mode, apart from peer dependencies and `?external` query
-					if task.Bundle && !task.Args.external.Has(getPkgName(specifier)) && !implicitExternal.Has(specifier) {
+					// bundles all dependencies in `bundle` mode, apart from peer dependencies and `?external` query,
+					// the peer dependencies are bundled as well in `standalone` mode, the dependencies pinned by
+					// `?deps` query are imported from the CDN if the installed version doesn't match,
+					// the aliased dependencies are always imported from the CDN since the alias
+					// target may not be installed in the build directory
+					if task.Bundle && !aliased && !task.Args.external.Has(getPkgName(specifier)) && !task.Args.external.Has("*") && !implicitExternal.Has(specifier) {
 						pkgName := getPkgName(specifier)
 						_, ok := npm.PeerDependencies[pkgName]
-						if !ok {
+						if (!ok || task.Standalone) && task.isPinnedVersionInstalled(pkgName) {
 							return api.OnResolveResult{}, nil
 						}
 					}
@@ -739,6 +928,53 @@ func (task *BuildTask) build() (err error) {
 				},
 			)
 
+			// rewrite the wasm urls relative to `import.meta.url` with `?external-wasm` query
+			if task.Args.externalWasm {
+				build.OnLoad(
+					api.OnLoadOptions{Filter: `\.(js|mjs|cjs)$`, Namespace: "file"},
+					func(args api.OnLoadArgs) (ret api.OnLoadResult, err error) {
+						data, err := os.ReadFile(args.Path)
+						if err != nil || !bytes.Contains(data, []byte("import.meta.url")) || !bytes.Contains(data, []byte(".wasm")) {
+							// let esbuild load the file
+							return ret, nil
+						}
+						dir := filepath.Dir(args.Path)
+						contents := string(rewriteWasmURLs(data, func(filename string) (string, bool) {
+							return task.getRawFileURL(filepath.Join(dir, filename))
+						}))
+						return api.OnLoadResult{Contents: &contents, Loader: api.LoaderJS, ResolveDir: dir}, nil
+					},
+				)
+			}
+
+			// for the missing optional dependency
+			build.OnLoad(
+				api.OnLoadOptions{Filter: ".*", Namespace: "optional-dependency"},
+				func(args api.OnLoadArgs) (ret api.OnLoadResult, err error) {
+					contents := fmt.Sprintf(`throw new Error("[esm.sh] The optional dependency \"%s\" is not installed for %s-%s");`, args.Path, hostPlatform(), hostArch())
+					return api.OnLoadResult{Contents: &contents, Loader: api.LoaderJS}, nil
+				},
+			)
+
+			// for the node libs inlined in `standalone` mode
+			build.OnLoad(
+				api.OnLoadOptions{Filter: ".*", Namespace: "node-lib"},
+				func(args api.OnLoadArgs) (ret api.OnLoadResult, err error) {
+					contents, ok := nodeLibs[args.Path]
+					if !ok {
+						switch args.Path {
+						case "__process.js":
+							contents = `export { default as __Process$ } from "./node/process.js";`
+						case "__buffer.js":
+							contents = `export { Buffer as __Buffer$ } from "./node/buffer.js";`
+						default:
+							contents = "export default {};"
+						}
+					}
+					return api.OnLoadResult{Contents: &contents, Loader: api.LoaderJS}, nil
+				},
+			)
+
 			// for browser exclude
 			build.OnLoad(
 				api.OnLoadOptions{Filter: ".*", Namespace: "browser-exclude"},
@@ -761,16 +997,18 @@ func (task *BuildTask) build() (err error) {
 		Bundle:            true,
 		Format:            api.FormatESModule,
 		Target:            targets[task.Target],
+		Engines:           customTargetEngines[task.Target],
 		Platform:          api.PlatformBrowser,
 		MinifyWhitespace:  !task.Dev,
 		MinifyIdentifiers: !task.Dev,
 		MinifySyntax:      !task.Dev,
 		KeepNames:         task.Args.keepNames,         // prevent class/function names erasing
 		IgnoreAnnotations: task.Args.ignoreAnnotations, // some libs maybe use wrong side-effect annotations
-		Conditions:        task.Args.conditions.Values(),
+		Conditions:        task.getConditions(),
 		Plugins:           []api.Plugin{esmPlugin},
 		SourceRoot:        "/",
 		Sourcemap:         api.SourceMapExternal,
+		Metafile:          true,
 	}
 	// ignore features that can not be polyfilled
 	options.Supported = map[string]bool{
@@ -788,18 +1026,27 @@ func (task *BuildTask) build() (err error) {
 		".woff":  api.LoaderDataURL,
 		".woff2": api.LoaderDataURL,
 	}
-	if task.Target == "node" {
+	if task.isNodeTarget() {
 		options.Platform = api.PlatformNode
 	} else {
 		options.Define = define
+		// inline `process` and `Buffer` instead of importing them from the CDN
+		if task.inlineNodeLib("process") {
+			options.Inject = append(options.Inject, "node-lib:__process.js")
+		}
+		if task.inlineNodeLib("buffer") {
+			options.Inject = append(options.Inject, "node-lib:__buffer.js")
+		}
 	}
 	if !task.isDenoTarget() {
 		options.JSX = api.JSXAutomatic
-		if task.Args.jsxRuntime != nil {
-			if task.Args.external.Has(task.Args.jsxRuntime.Name) || task.Args.external.Has("*") {
-				options.JSXImportSource = task.Args.jsxRuntime.Name
+		if jsxRuntime := task.getJSXRuntime(); jsxRuntime != nil {
+			if task.Args.external.Has(jsxRuntime.Name) || task.Args.external.Has("*") {
+				options.JSXImportSource = path.Join(jsxRuntime.Name, jsxRuntime.SubModule)
+			} else if jsxRuntime.Version == "" {
+				options.JSXImportSource = task.CdnOrigin + cfg.CdnBasePath + "/" + path.Join(jsxRuntime.Name, jsxRuntime.SubModule)
 			} else {
-				options.JSXImportSource = "https://esm.sh/" + task.Args.jsxRuntime.String()
+				options.JSXImportSource = task.CdnOrigin + cfg.CdnBasePath + "/" + jsxRuntime.String()
 			}
 		} else if task.Args.external.Has("react") {
 			options.JSXImportSource = "react"
@@ -843,6 +1090,11 @@ rebuild:
 			a := strings.Split(msg, "\"")
 			if len(a) > 4 {
 				path, exportName := a[1], a[3]
+				// the member of the `?exports` query is not exported by the module
+				if loc := result.Errors[0].Location; loc != nil && input != nil && filepath.Base(loc.File) == input.Sourcefile {
+					err = newRegistryError(ErrInvalidSpecifier, "'%s' is not exported by '%s'", exportName, moduleName)
+					return
+				}
 				if strings.HasPrefix(path, "browser-exclude:") && exportName != "default" {
 					path = strings.TrimPrefix(path, "browser-exclude:")
 					exports, ok := browserExclude[path]
@@ -867,6 +1119,9 @@ rebuild:
 		}
 	}
 
+	// the input files of the bundle for the lockfile snapshot
+	task.inputs = getMetafileInputs(result.Metafile)
+
 	for _, file := range result.OutputFiles {
 		if strings.HasSuffix(file.Path, ".js") {
 			jsContent := file.Contents
@@ -889,6 +1144,10 @@ rebuild:
 			}
 			imports = imports[:i]
 
+			if jsonImports.Len() > 0 {
+				jsContent = addJSONImportAttributes(jsContent, jsonImports.Values())
+			}
+
 			// remove shebang
 			if bytes.HasPrefix(jsContent, []byte("#!/")) {
 				jsContent = jsContent[bytes.IndexByte(jsContent, '\n')+1:]
@@ -896,18 +1155,22 @@ rebuild:
 			}
 
 			// add nodejs compatibility
-			if task.Target != "node" {
+			if !task.isNodeTarget() {
 				ids := newStringSet()
 				for _, r := range regexpGlobalIdent.FindAll(jsContent, -1) {
 					ids.Add(string(r))
 				}
-				if ids.Has("__Process$") {
+				if ids.Has("__Process$") && !task.inlineNodeLib("process") {
 					if task.Args.external.Has("node:process") || task.Args.external.Has("*") {
 						fmt.Fprintf(header, `import __Process$ from "node:process";%s`, EOL)
 					} else if task.Target == "denonext" {
 						fmt.Fprintf(header, `import __Process$ from "node:process";%s`, EOL)
 					} else if task.Target == "deno" {
 						fmt.Fprintf(header, `import __Process$ from "https://deno.land/std@%s/node/process.ts";%s`, task.Args.denoStdVersion, EOL)
+					} else if pkg, ok := task.getNodePolyfill("process"); !ok {
+						fmt.Fprintf(header, `import __Process$ from "node:process";%s`, EOL)
+					} else if pkg != "" {
+						fmt.Fprintf(header, `import __Process$ from "%s";%s`, task.resolveExternalModule(pkg, api.ResolveJSImportStatement), EOL)
 					} else {
 						var browserExclude bool
 						if len(npm.Browser) > 0 {
@@ -920,13 +1183,17 @@ rebuild:
 						}
 					}
 				}
-				if ids.Has("__Buffer$") {
+				if ids.Has("__Buffer$") && !task.inlineNodeLib("buffer") {
 					if task.Args.external.Has("node:buffer") || task.Args.external.Has("*") {
 						fmt.Fprintf(header, `import { Buffer as __Buffer$ } from "node:buffer";%s`, EOL)
 					} else if task.Target == "denonext" {
 						fmt.Fprintf(header, `import { Buffer as __Buffer$ } from "node:buffer";%s`, EOL)
 					} else if task.Target == "deno" {
 						fmt.Fprintf(header, `import { Buffer as __Buffer$ } from "https://deno.land/std@%s/node/buffer.ts";%s`, task.Args.denoStdVersion, EOL)
+					} else if pkg, ok := task.getNodePolyfill("buffer"); !ok {
+						fmt.Fprintf(header, `import { Buffer as __Buffer$ } from "node:buffer";%s`, EOL)
+					} else if pkg != "" {
+						fmt.Fprintf(header, `import { Buffer as __Buffer$ } from "%s";%s`, task.resolveExternalModule(pkg, api.ResolveJSImportStatement), EOL)
 					} else {
 						var browserExclude bool
 						if len(npm.Browser) > 0 {
@@ -987,7 +1254,7 @@ rebuild:
 									wd:     task.resolveDir,
 								}
 								if !formJson {
-									e = installPackage(task.wd, t.Pkg)
+									e = installPackage(context.Background(), task.wd, t.Pkg)
 								}
 								if e == nil {
 									m, _, _, e := t.analyze(true)
@@ -1029,6 +1296,17 @@ rebuild:
 			finalContent.Write(header.Bytes())
 			finalContent.Write(jsContent)
 
+			// down-level the output to ES5 with swc, the source map is dropped
+			if task.Target == "es5" {
+				var code []byte
+				code, err = transformES5(finalContent.Bytes(), !task.Dev)
+				if err != nil {
+					return
+				}
+				finalContent = bytes.NewBuffer(code)
+				dropSourceMap = true
+			}
+
 			if task.deprecated != "" {
 				fmt.Fprintf(finalContent, `console.warn("[npm] %%cdeprecated%%c %s@%s: %s", "color:red", "");%s`, task.Pkg.Name, task.Pkg.Version, strings.ReplaceAll(task.deprecated, "\"", "\\\""), "\n")
 			}
@@ -1055,7 +1333,7 @@ rebuild:
 				return
 			}
 			esm.PackageCSS = true
-		} else if strings.HasSuffix(file.Path, ".js.map") {
+		} else if strings.HasSuffix(file.Path, ".js.map") && task.Target != "es5" {
 			var sourceMap map[string]interface{}
 			if json.Unmarshal(file.Contents, &sourceMap) == nil {
 				if mapping, ok := sourceMap["mappings"].(string); ok {
@@ -1135,12 +1413,14 @@ func (task *BuildTask) resolveExternalModule(specifier string, kind api.ResolveK
 	if nodejsInternalModules[specifier] {
 		if task.Args.external.Has("node:"+specifier) || task.Args.external.Has("*") {
 			resolvedPath = fmt.Sprintf("node:%s", specifier)
-		} else if task.Target == "node" {
+		} else if task.Target == "node" || task.Target == "electron-main" || (task.Target == "bun" && !bunUnspportedNodeModules[specifier]) {
 			resolvedPath = fmt.Sprintf("node:%s", specifier)
 		} else if task.Target == "denonext" && !denoNextUnspportedNodeModules[specifier] {
 			resolvedPath = fmt.Sprintf("node:%s", specifier)
 		} else if task.Target == "deno" {
 			resolvedPath = fmt.Sprintf("https://deno.land/std@%s/node/%s.ts", task.Args.denoStdVersion, specifier)
+		} else if _, ok := task.getNodePolyfill(specifier); !ok {
+			resolvedPath = fmt.Sprintf("node:%s", specifier)
 		} else {
 			resolvedPath = fmt.Sprintf("%s/node/%s.js", cfg.CdnBasePath, specifier)
 		}
@@ -1171,6 +1451,7 @@ func (task *BuildTask) resolveExternalModule(specifier string, kind api.ResolveK
 				Target:     task.Target,
 				Dev:        task.Dev,
 				Bundle:     task.Bundle,
+				Standalone: task.Standalone,
 				NoBundle:   task.NoBundle,
 				wd:         task.wd,
 				deprecated: task.deprecated,
@@ -1198,7 +1479,7 @@ func (task *BuildTask) resolveExternalModule(specifier string, kind api.ResolveK
 	}
 
 	// replace some npm polyfills with native APIs
-	if specifier == "node-fetch" && task.Target != "node" {
+	if specifier == "node-fetch" && !task.isNodeTarget() {
 		resolvedPath = fmt.Sprintf("%s/npm_node-fetch.js", cfg.CdnBasePath)
 		return
 	}
@@ -1219,10 +1500,22 @@ func (task *BuildTask) resolveExternalModule(specifier string, kind api.ResolveK
 			version = v
 		} else if v, ok := task.npm.PeerDependencies[pkgName]; ok {
 			version = v
+		} else if v, ok := task.npm.OptionalDependencies[pkgName]; ok {
+			version = v
 		} else {
 			version = "latest"
 		}
 	}
+	// the npm alias dependency, e.g. `"react-dom": "npm:@preact/compat@^17"`
+	if aliasName, aliasVersion, ok := parseNpmAlias(version); ok {
+		pkgName, version = aliasName, aliasVersion
+	}
+	// use the version defined in the `overrides` config
+	version = task.overrideVersion(pkgName, version)
+	// use the version of the dependency that is bundled in the package tarball
+	if p, ok := task.getBundledDependencyInfo(pkgName); ok {
+		version = p.Version
+	}
 	// use version defined in `?deps` query if it exists
 	for _, dep := range task.Args.deps {
 		if pkgName == dep.Name {
@@ -1246,11 +1539,16 @@ func (task *BuildTask) resolveExternalModule(specifier string, kind api.ResolveK
 		SubModule: toModuleBareName(subpath, true),
 	}
 	args := BuildArgs{
-		alias:      task.Args.alias,
-		conditions: task.Args.conditions,
-		deps:       task.Args.deps,
-		external:   task.Args.external,
-		exports:    newStringSet(),
+		alias:           task.Args.alias,
+		assertJSON:      task.Args.assertJSON,
+		conditions:      task.Args.conditions,
+		deps:            task.Args.deps,
+		exactConditions: task.Args.exactConditions,
+		external:        task.Args.external,
+		externalWasm:    task.Args.externalWasm,
+		exports:         newStringSet(),
+		nodePolyfills:   task.Args.nodePolyfills,
+		parents:         task.overrideParents(),
 	}
 	fixBuildArgs(&args, pkg)
 	resolvedPath = task.getImportPath(pkg, encodeBuildArgsPrefix(args, pkg, false))
@@ -1262,13 +1560,21 @@ func (task *BuildTask) storeToDB() {
 	if err != nil {
 		log.Errorf("db: %v", err)
 	}
+	task.storeLockfile()
 }
 
 func (task *BuildTask) checkDTS() {
 	name := task.Pkg.Name
 	submodule := task.Pkg.SubModule
 	var dts string
-	if task.npm.Types != "" {
+	if t := task.Args.types; t != nil && !strings.HasPrefix(name, "@types/") {
+		// use the types package specified by the `?types` query
+		p, _, err := getPackageInfo(task.resolveDir, t.Name, t.Version)
+		if err == nil {
+			prefix := encodeBuildArgsPrefix(task.Args, Pkg{Name: p.Name}, true)
+			dts = task.toTypesPath(task.wd, p, "", prefix, submodule)
+		}
+	} else if task.npm.Types != "" {
 		dts = task.toTypesPath(task.wd, task.npm, "", encodeBuildArgsPrefix(task.Args, task.Pkg, true), submodule)
 	} else if !strings.HasPrefix(name, "@types/") {
 		versions := []string{"latest"}
@@ -10,15 +10,21 @@ import (
 
 type BuildArgs struct {
 	alias             map[string]string
+	assertJSON        bool
 	conditions        *StringSet
 	denoStdVersion    string
 	deps              PkgSlice
+	exactConditions   bool
 	exports           *StringSet
 	external          *StringSet
+	externalWasm      bool
 	ignoreAnnotations bool
 	ignoreRequire     bool
 	jsxRuntime        *Pkg
 	keepNames         bool
+	nodePolyfills     map[string]string
+	parents           []string
+	types             *Pkg
 }
 
 func decodeBuildArgsPrefix(raw string) (args BuildArgs, err error) {
@@ -44,7 +50,7 @@ func decodeBuildArgsPrefix(raw string) (args BuildArgs, err error) {
 				for _, p := range strings.Split(strings.TrimPrefix(strings.TrimPrefix(p, "d/"), "deps:"), ",") {
 					m, _, err := validatePkgPath(p)
 					if err != nil {
-						if strings.HasSuffix(err.Error(), "not found") {
+						if isNotFoundError(err) {
 							continue
 						}
 						return args, err
@@ -72,6 +78,21 @@ func decodeBuildArgsPrefix(raw string) (args BuildArgs, err error) {
 				if e == nil {
 					args.jsxRuntime = &p
 				}
+			} else if strings.HasPrefix(p, "np/") {
+				args.nodePolyfills = map[string]string{}
+				for _, p := range strings.Split(strings.TrimPrefix(p, "np/"), ",") {
+					if p != "" {
+						name, pkg := utils.SplitByFirstByte(p, ':')
+						args.nodePolyfills[name] = pkg
+					}
+				}
+			} else if strings.HasPrefix(p, "p/") {
+				args.parents = strings.Split(strings.TrimPrefix(p, "p/"), ",")
+			} else if strings.HasPrefix(p, "ty/") {
+				p, _, e := validatePkgPath(strings.TrimPrefix(p, "ty/"))
+				if e == nil {
+					args.types = &p
+				}
 			} else {
 				switch p {
 				case "ir":
@@ -80,6 +101,12 @@ func decodeBuildArgsPrefix(raw string) (args BuildArgs, err error) {
 					args.keepNames = true
 				case "ia":
 					args.ignoreAnnotations = true
+				case "aj":
+					args.assertJSON = true
+				case "ew":
+					args.externalWasm = true
+				case "xc":
+					args.exactConditions = true
 				}
 			}
 		}
@@ -145,6 +172,9 @@ func encodeBuildArgsPrefix(args BuildArgs, pkg Pkg, isDts bool) string {
 		if len(ss) > 0 {
 			ss.Sort()
 			lines = append(lines, fmt.Sprintf("c/%s", strings.Join(ss, ",")))
+			if args.exactConditions {
+				lines = append(lines, "xc")
+			}
 		}
 	}
 	if !isDts {
@@ -160,9 +190,42 @@ func encodeBuildArgsPrefix(args BuildArgs, pkg Pkg, isDts bool) string {
 		if args.ignoreAnnotations {
 			lines = append(lines, "ia")
 		}
+		if args.assertJSON {
+			lines = append(lines, "aj")
+		}
+		if args.externalWasm {
+			lines = append(lines, "ew")
+		}
+		if args.nodePolyfills != nil {
+			var ss sort.StringSlice
+			for name, pkg := range args.nodePolyfills {
+				if pkg != "" {
+					ss = append(ss, fmt.Sprintf("%s:%s", name, pkg))
+				} else {
+					ss = append(ss, name)
+				}
+			}
+			ss.Sort()
+			lines = append(lines, fmt.Sprintf("np/%s", strings.Join(ss, ",")))
+		}
+		// the `nodePolyfills` config changes the builds as well, it's only encoded to identify the builds
+		// and ignored by the decoder
+		if npc := getNodePolyfillsConfig(); len(npc) > 0 {
+			lines = append(lines, fmt.Sprintf("npc/%s", strings.Join(npc, ",")))
+		}
+		if len(args.parents) > 0 {
+			// the order of the parents chain matters
+			lines = append(lines, fmt.Sprintf("p/%s", strings.Join(args.parents, ",")))
+		}
+		if args.types != nil {
+			lines = append(lines, fmt.Sprintf("ty/%s", args.types.String()))
+		}
 	}
 	if args.jsxRuntime != nil {
 		lines = append(lines, fmt.Sprintf("jsx/%s", args.jsxRuntime.String()))
+	} else if cfg != nil && cfg.JsxImportSource != "" {
+		// the `jsxImportSource` config is only encoded to identify the builds and ignored by the decoder
+		lines = append(lines, fmt.Sprintf("jsxc/%s", cfg.JsxImportSource))
 	}
 	if len(lines) > 0 {
 		return fmt.Sprintf("X-%s/", btoaUrl(strings.Join(lines, "\n")))
@@ -180,9 +243,19 @@ func fixBuildArgs(args *BuildArgs, pkg Pkg) {
 					alias[from] = to
 				}
 			}
+			// the whole dependency tree of the alias target is built against the alias as well
 			for _, to := range alias {
-				pkgName, _, _ := splitPkgPath(to)
-				depTree.Add(pkgName)
+				pkgName, version, _ := splitPkgPath(to)
+				if version == "" {
+					if dep, ok := args.deps.Get(pkgName); ok {
+						version = dep.Version
+					} else {
+						version = "latest"
+					}
+				}
+				for _, name := range walkDeps(depTree, Pkg{Name: pkgName, Version: version}) {
+					depTree.Add(name)
+				}
 			}
 			args.alias = alias
 		}
@@ -198,7 +271,8 @@ func fixBuildArgs(args *BuildArgs, pkg Pkg) {
 		if args.external.Len() > 0 {
 			external := newStringSet()
 			for _, name := range args.external.Values() {
-				if depTree.Has(name) {
+				// the node builtin modules can be imported by any dependency
+				if depTree.Has(name) || strings.HasPrefix(name, "node:") {
 					external.Add(name)
 				}
 			}
@@ -218,7 +292,10 @@ func walkDeps(marker *StringSet, pkg Pkg) (deps []string) {
 	}
 	pkgDeps := map[string]string{}
 	for name, version := range p.Dependencies {
-		pkgDeps[name] = version
+		// skip the dependencies bundled in the package tarball
+		if !includes(p.BundledDependencies, name) {
+			pkgDeps[name] = version
+		}
 	}
 	for name, version := range p.PeerDependencies {
 		pkgDeps[name] = version
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"net/http"
+	"strings"
 	"testing"
 )
 
@@ -25,11 +27,16 @@ func TestEncodeBuildArgs(t *testing.T) {
 			external:          external,
 			exports:           exports,
 			conditions:        conditions,
+			exactConditions:   true,
 			denoStdVersion:    "0.128.0",
 			jsxRuntime:        &Pkg{Version: "18.2.0", Name: "react"},
 			ignoreRequire:     true,
 			keepNames:         true,
 			ignoreAnnotations: true,
+			assertJSON:        true,
+			externalWasm:      true,
+			nodePolyfills:     map[string]string{"buffer": "buffer@6.0.3", "process": ""},
+			parents:           []string{"z", "y"},
 		},
 		Pkg{Name: "foo"},
 		false,
@@ -38,6 +45,9 @@ func TestEncodeBuildArgs(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	if strings.Join(args.parents, ">") != "z>y" {
+		t.Fatalf("invalid parents %v", args.parents)
+	}
 	if len(args.alias) != 1 || args.alias["a"] != "b" {
 		t.Fatal("invalid alias")
 	}
@@ -50,7 +60,7 @@ func TestEncodeBuildArgs(t *testing.T) {
 	if args.exports.Len() != 2 {
 		t.Fatal("invalid exports")
 	}
-	if args.conditions.Len() != 1 {
+	if args.conditions.Len() != 1 || !args.exactConditions {
 		t.Fatal("invalid conditions")
 	}
 	if args.denoStdVersion != "0.128.0" {
@@ -68,4 +78,84 @@ func TestEncodeBuildArgs(t *testing.T) {
 	if !args.ignoreAnnotations {
 		t.Fatal("ignoreAnnotations should be true")
 	}
+	if !args.assertJSON || !args.externalWasm {
+		t.Fatal("assertJSON and externalWasm should be true")
+	}
+	if len(args.nodePolyfills) != 2 || args.nodePolyfills["buffer"] != "buffer@6.0.3" || args.nodePolyfills["process"] != "" {
+		t.Fatalf("invalid nodePolyfills %v", args.nodePolyfills)
+	}
+	args, err = decodeBuildArgsPrefix(encodeBuildArgsPrefix(BuildArgs{nodePolyfills: map[string]string{}, external: newStringSet(), exports: newStringSet(), conditions: newStringSet()}, Pkg{Name: "foo"}, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args.nodePolyfills == nil || len(args.nodePolyfills) != 0 {
+		t.Fatal("nodePolyfills should be an empty map with `?no-node-polyfills`")
+	}
+}
+
+func TestFixBuildArgsExternal(t *testing.T) {
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/foo/1.0.0":
+			w.Write([]byte(`{"name":"foo","version":"1.0.0","dependencies":{"bar":"1.0.0"}}`))
+		case "/bar/1.0.0":
+			w.Write([]byte(`{"name":"bar","version":"1.0.0"}`))
+		default:
+			w.WriteHeader(404)
+		}
+	})
+
+	external := newStringSet()
+	for _, name := range []string{"bar", "baz", "node:buffer"} {
+		external.Add(name)
+	}
+	args := BuildArgs{external: external}
+	fixBuildArgs(&args, Pkg{Name: "foo", Version: "1.0.0"})
+	if args.external.Len() != 2 || !args.external.Has("bar") || !args.external.Has("node:buffer") {
+		t.Fatalf("invalid external %v", args.external.Values())
+	}
+}
+
+func TestFixBuildArgsAlias(t *testing.T) {
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/foo/1.0.0":
+			w.Write([]byte(`{"name":"foo","version":"1.0.0","peerDependencies":{"react":"^18.0.0"}}`))
+		case "/preact/10.0.0":
+			w.Write([]byte(`{"name":"preact","version":"10.0.0","dependencies":{"preact-render-to-string":"6.0.0"}}`))
+		default:
+			w.WriteHeader(404)
+		}
+	})
+
+	args := BuildArgs{
+		alias:    map[string]string{"react": "preact@10.0.0/compat", "vue": "preact@10.0.0/compat"},
+		external: newStringSet(),
+		deps: PkgSlice{
+			Pkg{Name: "preact", Version: "10.0.0"},
+			Pkg{Name: "preact-render-to-string", Version: "6.0.0"},
+			Pkg{Name: "lodash", Version: "4.17.21"},
+		},
+	}
+	fixBuildArgs(&args, Pkg{Name: "foo", Version: "1.0.0"})
+	if len(args.alias) != 1 || args.alias["react"] != "preact@10.0.0/compat" {
+		t.Fatalf("invalid alias %v", args.alias)
+	}
+	if len(args.deps) != 2 || args.deps.String() != "preact@10.0.0,preact-render-to-string@6.0.0" {
+		t.Fatalf("invalid deps %v", args.deps)
+	}
+
+	// the alias target without version is walked at the version pinned by the `?deps` query
+	args = BuildArgs{
+		alias:    map[string]string{"react": "preact/compat"},
+		external: newStringSet(),
+		deps: PkgSlice{
+			Pkg{Name: "preact", Version: "10.0.0"},
+			Pkg{Name: "preact-render-to-string", Version: "6.0.0"},
+		},
+	}
+	fixBuildArgs(&args, Pkg{Name: "foo", Version: "1.0.0"})
+	if len(args.deps) != 2 || args.deps.String() != "preact@10.0.0,preact-render-to-string@6.0.0" {
+		t.Fatalf("invalid deps %v", args.deps)
+	}
 }
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
 	"encoding/json"
@@ -8,6 +9,8 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/evanw/esbuild/pkg/api"
@@ -37,7 +40,9 @@ func (task *BuildTask) ID() string {
 	if task.Dev {
 		name += ".development"
 	}
-	if task.Bundle {
+	if task.Standalone {
+		name += ".standalone"
+	} else if task.Bundle {
 		name += ".bundle"
 	} else if task.NoBundle {
 		name += ".nobundle"
@@ -97,6 +102,24 @@ func (task *BuildTask) getImportPath(pkg Pkg, buildArgsPrefix string) string {
 	)
 }
 
+// newDefaultBuildTask creates the build task of the package without the build args,
+// which is the same as the task of the module request without the query.
+func newDefaultBuildTask(pkg Pkg, target string) *BuildTask {
+	return &BuildTask{
+		Args: BuildArgs{
+			alias:          map[string]string{},
+			conditions:     newStringSet(),
+			denoStdVersion: denoStdVersion,
+			deps:           PkgSlice{},
+			exports:        newStringSet(),
+			external:       newStringSet(),
+		},
+		CdnOrigin: cfg.CdnOrigin,
+		Pkg:       pkg,
+		Target:    target,
+	}
+}
+
 func (task *BuildTask) getSavepath() string {
 	id := task.ID()
 	return normalizeSavePath(path.Join("builds", id))
@@ -114,19 +137,56 @@ func normalizeSavePath(pathname string) string {
 	return strings.Join(segs, "/")
 }
 
+// isOptionalDependencyMissing returns true if the specifier is an optional dependency of the package that is not
+// installed, e.g. the platform-specific binary packages (`@esbuild/darwin-arm64`) skipped for the build host.
+func (task *BuildTask) isOptionalDependencyMissing(specifier string) bool {
+	pkgName := getPkgName(specifier)
+	if _, ok := task.npm.OptionalDependencies[pkgName]; !ok {
+		return false
+	}
+	candidates := []string{path.Join(task.resolveDir, "node_modules", pkgName)}
+	// the dependencies are installed in the `node_modules` of the package, or next to the package by pnpm
+	if pkgDir, err := filepath.EvalSymlinks(path.Join(task.resolveDir, "node_modules", task.npm.Name)); err == nil {
+		candidates = append(candidates, path.Join(pkgDir, "node_modules", pkgName))
+		if strings.HasSuffix(pkgDir, "/"+task.npm.Name) {
+			candidates = append(candidates, path.Join(strings.TrimSuffix(pkgDir, task.npm.Name), pkgName))
+		}
+	}
+	for _, dir := range candidates {
+		if existsFile(path.Join(dir, "package.json")) {
+			return false
+		}
+	}
+	return true
+}
+
 func (task *BuildTask) getPackageInfo(name string) (pkg Pkg, p NpmPackageInfo, fromPackageJSON bool, err error) {
 	pkgName, _, subpath := splitPkgPath(name)
+	if bp, ok := task.getBundledDependencyInfo(pkgName); ok {
+		pkg = Pkg{
+			Name:      bp.Name,
+			Version:   bp.Version,
+			SubPath:   subpath,
+			SubModule: toModuleBareName(subpath, true),
+		}
+		return pkg, bp, true, nil
+	}
+	wd := task.resolveDir
 	var version string
 	if pkg, ok := task.Args.deps.Get(pkgName); ok {
+		// don't use the version installed in the build directory for the dependency pinned by the `?deps` query
+		wd = ""
 		version = pkg.Version
 	} else if v, ok := task.npm.Dependencies[pkgName]; ok {
 		version = v
 	} else if v, ok = task.npm.PeerDependencies[pkgName]; ok {
 		version = v
+	} else if v, ok = task.npm.OptionalDependencies[pkgName]; ok {
+		version = v
 	} else {
 		version = "latest"
 	}
-	p, fromPackageJSON, err = getPackageInfo(task.resolveDir, pkgName, version)
+	p, fromPackageJSON, err = getPackageInfo(wd, pkgName, version)
 	if err == nil {
 		pkg = Pkg{
 			Name:      p.Name,
@@ -138,14 +198,245 @@ func (task *BuildTask) getPackageInfo(name string) (pkg Pkg, p NpmPackageInfo, f
 	return
 }
 
+// getBundledDependencyInfo returns the package info of a dependency that is shipped inside the
+// package tarball(`bundleDependencies`), it's read from the installed package directory instead
+// of being resolved from the registry.
+func (task *BuildTask) getBundledDependencyInfo(pkgName string) (p NpmPackageInfo, ok bool) {
+	if task.packageDir == "" || !includes(task.npm.BundledDependencies, pkgName) {
+		return
+	}
+	err := parseJSONFile(path.Join(task.packageDir, "node_modules", pkgName, "package.json"), &p)
+	if err != nil {
+		return
+	}
+	patchPackageInfo(&p)
+	return p, true
+}
+
+// isPinnedVersionInstalled returns false if the dependency is pinned by the `?deps` query with a version
+// different from the one installed in the build directory, the dependency should be imported from the CDN
+// rather than being bundled then.
+func (task *BuildTask) isPinnedVersionInstalled(pkgName string) bool {
+	dep, ok := task.Args.deps.Get(pkgName)
+	if !ok {
+		return true
+	}
+	pkgJsonPath, ok := lookupInstalledPackage(task.resolveDir, pkgName, dep.Version)
+	if !ok {
+		return false
+	}
+	var p NpmPackageInfo
+	if parseJSONFile(pkgJsonPath, &p) != nil {
+		return false
+	}
+	return p.Version == dep.Version
+}
+
 func (task *BuildTask) isServerTarget() bool {
-	return task.Target == "deno" || task.Target == "denonext" || task.Target == "node"
+	return task.Target == "deno" || task.Target == "denonext" || task.isNodeTarget()
+}
+
+// isNodeTarget returns true if the target runs the node builtin modules natively, i.e. `node`, `bun` and
+// `electron-main`.
+func (task *BuildTask) isNodeTarget() bool {
+	return task.Target == "node" || task.Target == "bun" || task.Target == "electron-main"
+}
+
+func (task *BuildTask) isElectronTarget() bool {
+	return task.Target == "electron" || task.Target == "electron-main"
 }
 
 func (task *BuildTask) isDenoTarget() bool {
 	return task.Target == "deno" || task.Target == "denonext"
 }
 
+// inlineNodeLib returns true if the node builtin module is inlined from the embedded node libs in `standalone` mode
+// instead of importing the `/node/*.js` polyfill from the CDN.
+func (task *BuildTask) inlineNodeLib(specifier string) bool {
+	if !task.Standalone || task.Args.external.Has("node:"+specifier) || task.Args.external.Has("*") {
+		return false
+	}
+	switch task.Target {
+	case "node", "deno", "electron-main":
+		return false
+	case "denonext":
+		return denoNextUnspportedNodeModules[specifier]
+	case "bun":
+		return bunUnspportedNodeModules[specifier]
+	}
+	pkg, ok := task.getNodePolyfill(specifier)
+	return ok && pkg == ""
+}
+
+// nodePolyfillDisabled is the value of the `nodePolyfills` config and the `?node-polyfills` query that disables
+// the polyfill of the builtin module, e.g. `"fs": "false"` or `?node-polyfills=fs:false`.
+const nodePolyfillDisabled = "false"
+
+// getNodePolyfill returns the polyfill of the node builtin module for the browser targets, it's configured by the
+// `?node-polyfills` query and the `nodePolyfills` config. An empty `pkg` means the polyfill of esm.sh is used, and
+// `ok` is false if the builtin module is not polyfilled (the `false` value of the config or the query, or the module
+// that is not listed in the query).
+func (task *BuildTask) getNodePolyfill(name string) (pkg string, ok bool) {
+	if task.isServerTarget() {
+		return "", true
+	}
+	ok = true
+	if cfg != nil {
+		if p, has := cfg.NodePolyfills[name]; has {
+			if p == nodePolyfillDisabled {
+				ok = false
+			} else {
+				pkg = p
+			}
+		}
+	}
+	if task.Args.nodePolyfills != nil {
+		p, has := task.Args.nodePolyfills[name]
+		if !has || p == nodePolyfillDisabled {
+			return "", false
+		}
+		if p != "" {
+			pkg = p
+		}
+		ok = true
+	}
+	// the polyfill package has the same name as the builtin module, e.g. `buffer`
+	if pkgName, version, subPath := splitPkgPath(pkg); pkg != "" && version == "" && nodejsInternalModules[pkgName] {
+		pkg = pkgName + "@latest"
+		if subPath != "" {
+			pkg += "/" + subPath
+		}
+	}
+	return
+}
+
+// getNodePolyfillsConfig returns the `nodePolyfills` config in the form of `name:pkg` sorted by the name, it's
+// encoded in the build args since the config changes the builds.
+func getNodePolyfillsConfig() []string {
+	if cfg == nil || len(cfg.NodePolyfills) == 0 {
+		return nil
+	}
+	var ss sort.StringSlice
+	for name, pkg := range cfg.NodePolyfills {
+		ss = append(ss, name+":"+pkg)
+	}
+	ss.Sort()
+	return ss
+}
+
+// useBrowserField returns true if the `browser` field of package.json should be applied,
+// it's ignored for server targets or if the `node`/`deno` condition is specified by the `?conditions` query.
+func (task *BuildTask) useBrowserField() bool {
+	if task.isServerTarget() {
+		return false
+	}
+	return !task.Args.conditions.Has("node") && !task.Args.conditions.Has("deno")
+}
+
+// overrideVersion returns the version of the dependency defined in the `overrides` config,
+// the ancestors of the build task and the package itself are the parents chain of the dependency.
+func (task *BuildTask) overrideVersion(pkgName string, version string) string {
+	if cfg == nil || pkgName == task.Pkg.Name {
+		return version
+	}
+	parents := append(append([]string{}, task.Args.parents...), task.Pkg.Name)
+	if v, ok := cfg.Overrides.Match(parents, pkgName); ok {
+		return v
+	}
+	return version
+}
+
+// overrideParents returns the parents chain passed to the dependencies of the build task, only the
+// packages that have nested overrides are kept to avoid the different build ids of the same module.
+func (task *BuildTask) overrideParents() []string {
+	if cfg == nil || len(cfg.Overrides) == 0 {
+		return nil
+	}
+	var parents []string
+	for _, name := range append(append([]string{}, task.Args.parents...), task.Pkg.Name) {
+		if cfg.Overrides.HasScope(name) {
+			parents = append(parents, name)
+		}
+	}
+	return parents
+}
+
+// nodeEnv returns the `NODE_ENV` of the build, which is also used as the export condition
+// (`development` or `production`) of the package and all its dependencies.
+// The `development` condition of the `?conditions` query switches the build to development as well,
+// otherwise the `production` condition may win over it by the declared order of the `exports`.
+func (task *BuildTask) nodeEnv() string {
+	if task.Dev || task.Args.conditions.Has("development") {
+		return "development"
+	}
+	return "production"
+}
+
+// getJSXRuntime returns the package of the jsx runtime that is specified by the `?jsx-import-source` query or
+// the `jsxImportSource` config, the version pinned by the `?deps` query is used for the config.
+func (task *BuildTask) getJSXRuntime() *Pkg {
+	if task.Args.jsxRuntime != nil {
+		return task.Args.jsxRuntime
+	}
+	if cfg == nil || cfg.JsxImportSource == "" {
+		return nil
+	}
+	pkg, _, err := ParseSpecifier(cfg.JsxImportSource)
+	if err != nil {
+		return nil
+	}
+	if dep, ok := task.Args.deps.Get(pkg.Name); ok {
+		pkg.Version = dep.Version
+	}
+	return &pkg
+}
+
+// getConditions returns the export conditions applied to the dependencies resolved by esbuild.
+func (task *BuildTask) getConditions() []string {
+	if task.hasExactConditions() {
+		return task.Args.conditions.Values()
+	}
+	return append(task.Args.conditions.Values(), task.nodeEnv())
+}
+
+// hasExactConditions returns true if the `?exact-conditions` query is set with the `?conditions` query,
+// then the conditions are the exact condition set of the resolution instead of the extra conditions,
+// e.g. `?conditions=worker,import,default&exact-conditions`.
+func (task *BuildTask) hasExactConditions() bool {
+	return task.Args.exactConditions && task.Args.conditions.Len() > 0
+}
+
+// undeclaredConditions returns the conditions of the `?conditions` query that are not declared
+// by the `exports` of the package, which never match.
+func (task *BuildTask) undeclaredConditions(p NpmPackageInfo) []string {
+	if task.Args.conditions.Len() == 0 {
+		return nil
+	}
+	declared := newStringSet()
+	var walk func(exports interface{})
+	walk = func(exports interface{}) {
+		om, ok := exports.(*orderedMap)
+		if !ok {
+			return
+		}
+		for e := om.l.Front(); e != nil; e = e.Next() {
+			key, value := om.Entry(e)
+			if !strings.HasPrefix(key, ".") {
+				declared.Add(key)
+			}
+			walk(value)
+		}
+	}
+	walk(p.Exports)
+	var conditions []string
+	for _, name := range task.Args.conditions.SortedValues() {
+		if name != "default" && !declared.Has(name) {
+			conditions = append(conditions, name)
+		}
+	}
+	return conditions
+}
+
 func (task *BuildTask) analyze(forceCjsOnly bool) (esm *ESMBuild, npm NpmPackageInfo, reexport string, err error) {
 	wd := task.wd
 	pkg := task.Pkg
@@ -155,6 +446,7 @@ func (task *BuildTask) analyze(forceCjsOnly bool) (esm *ESMBuild, npm NpmPackage
 	if err != nil {
 		return
 	}
+	patchPackageInfo(&p)
 
 	npm = task.normalizeNpmPackage(p)
 	esm = &ESMBuild{}
@@ -234,78 +526,7 @@ func (task *BuildTask) analyze(forceCjsOnly bool) (esm *ESMBuild, npm NpmPackage
 				}
 				// reslove sub-module using `exports` conditions if exists
 				if npm.Exports != nil && !isTsx {
-					if om, ok := npm.Exports.(*orderedMap); ok {
-						for e := om.l.Front(); e != nil; e = e.Next() {
-							name, exports := om.Entry(e)
-							if name == "./"+pkg.SubModule || name == "./"+pkg.SubModule+".js" || name == "./"+pkg.SubModule+".mjs" {
-								/**
-								exports: {
-									"./lib/core": {
-										"require": "./lib/core.js",
-										"import": "./esm/core.js"
-									},
-								"./lib/core.js": {
-										"require": "./lib/core.js",
-										"import": "./esm/core.js"
-									}
-								}
-								*/
-								task.resolveConditions(&npm, exports, npm.Type)
-								break
-							} else if strings.HasSuffix(name, "*") && strings.HasPrefix("./"+pkg.SubModule, strings.TrimSuffix(name, "*")) {
-								/**
-								exports: {
-									"./lib/languages/*": {
-										"require": "./lib/languages/*.js",
-										"import": "./esm/languages/*.js"
-									},
-								}
-								*/
-								suffix := strings.TrimPrefix("./"+pkg.SubModule, strings.TrimSuffix(name, "*"))
-								hitExports := false
-								if om, ok := exports.(*orderedMap); ok {
-									newExports := newOrderedMap()
-									for e := om.l.Front(); e != nil; e = e.Next() {
-										key, value := om.Entry(e)
-										if s, ok := value.(string); ok && s != name {
-											newExports.Set(key, strings.Replace(s, "*", suffix, -1))
-											hitExports = true
-										}
-										/**
-										exports: {
-											"./*": {
-												"types": "./*.d.ts",
-												"import": {
-													"types": "./esm/*.d.mts",
-													"default": "./esm/*.mjs"
-												},
-												"default": "./*.js"
-											}
-										}
-										*/
-										if s, ok := value.(map[string]interface{}); ok {
-											subNewDefinies := newOrderedMap()
-											for subKey, subValue := range s {
-												if s1, ok := subValue.(string); ok && s1 != name {
-													subNewDefinies.Set(subKey, strings.Replace(s1, "*", suffix, -1))
-													hitExports = true
-												}
-											}
-											newExports.Set(key, subNewDefinies)
-										}
-									}
-									exports = newExports
-								} else if s, ok := exports.(string); ok {
-									exports = strings.Replace(s, "*", suffix, -1)
-									hitExports = true
-								}
-								if hitExports {
-									task.resolveConditions(&npm, exports, npm.Type)
-									break
-								}
-							}
-						}
-					}
+					task.resolveSubModuleExports(&npm, pkg.SubModule)
 				}
 			}
 		}
@@ -315,10 +536,7 @@ func (task *BuildTask) analyze(forceCjsOnly bool) (esm *ESMBuild, npm NpmPackage
 		return
 	}
 
-	nodeEnv := "production"
-	if task.Dev {
-		nodeEnv = "development"
-	}
+	nodeEnv := task.nodeEnv()
 
 	if npm.Module != "" && !forceCjsOnly {
 		modulePath, namedExports, erro := esmLexer(wd, npm.Name, npm.Module)
@@ -360,7 +578,7 @@ func (task *BuildTask) analyze(forceCjsOnly bool) (esm *ESMBuild, npm NpmPackage
 				pkgs[i] = n + "@" + v
 				i++
 			}
-			err = pnpmInstall(wd, pkgs...)
+			err = installPackages(context.Background(), wd, pkgs...)
 			if err != nil {
 				return
 			}
@@ -430,7 +648,13 @@ func (task *BuildTask) normalizeNpmPackage(p NpmPackageInfo) NpmPackageInfo {
 		}
 	}
 
+	// the `exports` field is authoritative for the root entry if it defines one,
+	// the legacy `main`/`module` fields are ignored in that case.
+	// see https://nodejs.org/api/packages.html#main-entry-point-export
+	rootExported := false
 	if exports := p.Exports; exports != nil {
+		main, module := p.Main, p.Module
+		p.Main, p.Module = "", ""
 		if om, ok := exports.(*orderedMap); ok {
 			v, ok := om.m["."]
 			if ok {
@@ -442,11 +666,14 @@ func (task *BuildTask) normalizeNpmPackage(p NpmPackageInfo) NpmPackageInfo {
 						}
 					}
 					exports: {
-						".": "./esm/index.js"
+						".": "./esm/index.js",
+						"./sub": {
+							"import": "./esm/sub.js"
+						}
 					}
 				*/
 				task.resolveConditions(&p, v, p.Type)
-			} else {
+			} else if !isSubpathExports(om) {
 				/*
 					exports: {
 						"require": "./cjs/index.js",
@@ -461,10 +688,20 @@ func (task *BuildTask) normalizeNpmPackage(p NpmPackageInfo) NpmPackageInfo {
 			*/
 			task.resolveConditions(&p, s, p.Type)
 		}
+		rootExported = p.Main != "" || p.Module != ""
+		if !rootExported {
+			p.Main, p.Module = main, module
+		}
 	}
 
 	nmDir := path.Join(task.wd, "node_modules")
-	if p.Module == "" {
+	if p.Main != "" {
+		p.Main = resolveDirIndex(path.Join(nmDir, p.Name), p.Main)
+	}
+	if p.Module != "" {
+		p.Module = resolveDirIndex(path.Join(nmDir, p.Name), p.Module)
+	}
+	if p.Module == "" && !rootExported {
 		if p.JsNextMain != "" && existsFile(path.Join(nmDir, p.Name, p.JsNextMain)) {
 			p.Module = p.JsNextMain
 		} else if p.ES2015 != "" && existsFile(path.Join(nmDir, p.Name, p.ES2015)) {
@@ -491,7 +728,10 @@ func (task *BuildTask) normalizeNpmPackage(p NpmPackageInfo) NpmPackageInfo {
 		p.Main = "." + utils.CleanPath(p.Main)
 	}
 
-	if !task.isServerTarget() {
+	if !task.useBrowserField() {
+		// never swap in the browser replacements
+		p.Browser = nil
+	} else {
 		var browserModule string
 		var browserMain string
 		if p.Module != "" {
@@ -505,7 +745,7 @@ func (task *BuildTask) normalizeNpmPackage(p NpmPackageInfo) NpmPackageInfo {
 				browserMain = m
 			}
 		}
-		if browserModule == "" && browserMain == "" {
+		if browserModule == "" && browserMain == "" && !rootExported {
 			if m := p.Browser["."]; m != "" && existsFile(path.Join(nmDir, p.Name, m)) {
 				isEsm, _, _ := validateJS(path.Join(nmDir, p.Name, m))
 				if isEsm {
@@ -563,8 +803,268 @@ func (task *BuildTask) normalizeNpmPackage(p NpmPackageInfo) NpmPackageInfo {
 	return p
 }
 
+// resolveSubModuleExports resolves the sub-module using the subpath `exports` of the package,
+// returns false if no subpath matches.
+func (task *BuildTask) resolveSubModuleExports(npm *NpmPackageInfo, subModule string) bool {
+	m := getExportsMap(npm)
+	if m == nil {
+		return false
+	}
+	for _, name := range []string{"./" + subModule, "./" + subModule + ".js", "./" + subModule + ".mjs"} {
+		/**
+		exports: {
+			"./lib/core": {
+				"require": "./lib/core.js",
+				"import": "./esm/core.js"
+			},
+			"./lib/core.js": {
+				"require": "./lib/core.js",
+				"import": "./esm/core.js"
+			},
+			"./lib/util": "./lib/util.js"
+		}
+		*/
+		if exports, ok := m.subpaths[name]; ok {
+			task.resolveConditions(npm, exports, npm.Type)
+			return true
+		}
+	}
+	for _, pattern := range m.patterns {
+		/**
+		exports: {
+			"./lib/languages/*": {
+				"require": "./lib/languages/*.js",
+				"import": "./esm/languages/*.js"
+			},
+			"./*": {
+				"types": "./*.d.ts",
+				"import": {
+					"types": "./esm/*.d.mts",
+					"default": "./esm/*.mjs"
+				},
+				"default": "./*.js"
+			}
+		}
+		*/
+		if strings.HasPrefix("./"+subModule, pattern.prefix) {
+			suffix := strings.TrimPrefix("./"+subModule, pattern.prefix)
+			if exports, ok := expandExportsPattern(pattern.exports, suffix); ok {
+				task.resolveConditions(npm, exports, npm.Type)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resolveStyleExports resolves the stylesheet entry of the package (or the sub-module) using the `style`,
+// `sass` or `css` condition of the `exports`, the style conditions in the given conditions are preferred.
+// returns false if no style condition matches.
+func resolveStyleExports(npm *NpmPackageInfo, subModule string, conditions []string) (string, bool) {
+	om, ok := npm.Exports.(*orderedMap)
+	if !ok {
+		return "", false
+	}
+	var exports interface{}
+	if isSubpathExports(om) {
+		m := getExportsMap(npm)
+		name := "."
+		if subModule != "" {
+			name = "./" + subModule
+		}
+		if v, ok := m.subpaths[name]; ok {
+			exports = v
+		} else if subModule != "" {
+			for _, pattern := range m.patterns {
+				if strings.HasPrefix(name, pattern.prefix) {
+					if v, ok := expandExportsPattern(pattern.exports, strings.TrimPrefix(name, pattern.prefix)); ok {
+						exports = v
+						break
+					}
+				}
+			}
+		}
+	} else if subModule == "" {
+		exports = om
+	}
+	var styleConditions []string
+	for _, c := range conditions {
+		if c == "style" || c == "sass" || c == "css" {
+			styleConditions = append(styleConditions, c)
+		}
+	}
+	if len(styleConditions) == 0 {
+		styleConditions = []string{"style", "sass", "css"}
+	}
+	for _, c := range styleConditions {
+		if entry, ok := matchStyleCondition(exports, c, false); ok {
+			return entry, true
+		}
+	}
+	return "", false
+}
+
+// matchStyleCondition finds the entry of the style condition in the conditional `exports`,
+// the condition can be nested in other conditions like `{ "import": { "style": "./index.css" } }`.
+func matchStyleCondition(exports interface{}, condition string, matched bool) (string, bool) {
+	if s, ok := exports.(string); ok {
+		return s, matched && s != ""
+	}
+	om, ok := exports.(*orderedMap)
+	if !ok {
+		return "", false
+	}
+	for e := om.l.Front(); e != nil; e = e.Next() {
+		key, value := om.Entry(e)
+		if key == "types" || key == "typings" {
+			continue
+		}
+		if entry, ok := matchStyleCondition(value, condition, matched || key == condition); ok {
+			return entry, true
+		}
+	}
+	return "", false
+}
+
+// exportsMap is the normalized subpath `exports` of a package.
+type exportsMap struct {
+	subpaths map[string]interface{}
+	patterns []exportsPattern // sorted by the prefix length in descending order
+}
+
+type exportsPattern struct {
+	prefix  string
+	exports interface{}
+}
+
+// getExportsMap returns the normalized subpath `exports` of the package, it's computed once
+// and cached by `name@version` in a bounded LRU cache since the exact version of a package is immutable.
+func getExportsMap(npm *NpmPackageInfo) *exportsMap {
+	om, ok := npm.Exports.(*orderedMap)
+	if !ok {
+		return nil
+	}
+	if !regexpFullVersion.MatchString(npm.Version) {
+		return newExportsMap(om)
+	}
+	key := npm.Name + "@" + npm.Version
+	if v, ok := exportsMaps.Get(key); ok {
+		return v.(*exportsMap)
+	}
+	return exportsMaps.GetOrAdd(key, newExportsMap(om)).(*exportsMap)
+}
+
+func newExportsMap(om *orderedMap) *exportsMap {
+	m := &exportsMap{subpaths: map[string]interface{}{}}
+	for e := om.l.Front(); e != nil; e = e.Next() {
+		name, exports := om.Entry(e)
+		if strings.HasSuffix(name, "*") {
+			m.patterns = append(m.patterns, exportsPattern{strings.TrimSuffix(name, "*"), exports})
+		} else if strings.HasSuffix(name, "/") && name != "./" {
+			// the deprecated folder mapping like `"./lib/": "./src/lib/"` is treated as `"./lib/*": "./src/lib/*"`
+			if exports, ok := toExportsPattern(exports); ok {
+				m.patterns = append(m.patterns, exportsPattern{name, exports})
+			}
+		} else {
+			m.subpaths[name] = exports
+		}
+	}
+	// the pattern with the longest prefix wins, see https://nodejs.org/api/packages.html#subpath-patterns
+	sort.SliceStable(m.patterns, func(i, j int) bool {
+		return len(m.patterns[i].prefix) > len(m.patterns[j].prefix)
+	})
+	return m
+}
+
+// expandExportsPattern replaces the `*` of the pattern exports with the given suffix
+func expandExportsPattern(exports interface{}, suffix string) (interface{}, bool) {
+	if s, ok := exports.(string); ok {
+		return strings.Replace(s, "*", suffix, -1), true
+	}
+	om, ok := exports.(*orderedMap)
+	if !ok {
+		return nil, false
+	}
+	hit := false
+	newExports := newOrderedMap()
+	for e := om.l.Front(); e != nil; e = e.Next() {
+		key, value := om.Entry(e)
+		if v, ok := expandExportsPattern(value, suffix); ok {
+			newExports.Set(key, v)
+			hit = true
+		}
+	}
+	return newExports, hit
+}
+
+// toExportsPattern appends `*` to the folder targets (end with "/") of the folder mapping exports
+func toExportsPattern(exports interface{}) (interface{}, bool) {
+	if s, ok := exports.(string); ok {
+		if strings.HasSuffix(s, "/") {
+			return s + "*", true
+		}
+		return nil, false
+	}
+	om, ok := exports.(*orderedMap)
+	if !ok {
+		return nil, false
+	}
+	hit := false
+	newExports := newOrderedMap()
+	for e := om.l.Front(); e != nil; e = e.Next() {
+		key, value := om.Entry(e)
+		if v, ok := toExportsPattern(value); ok {
+			newExports.Set(key, v)
+			hit = true
+		}
+	}
+	return newExports, hit
+}
+
+// isSubpathExports returns true if the keys of the `exports` object are subpaths(start with ".")
+// instead of conditions.
+func isSubpathExports(om *orderedMap) bool {
+	for e := om.l.Front(); e != nil; e = e.Next() {
+		if key := e.Value.(string); !strings.HasPrefix(key, ".") {
+			return false
+		}
+	}
+	return om.l.Len() > 0
+}
+
+// resolveDirIndex resolves the entry pointing to a directory to the index file of the directory
+// like Node.js legacy resolution does, e.g. `"main": "./lib"` is resolved to `./lib/index.js`.
+func resolveDirIndex(pkgDir string, entry string) string {
+	fp := path.Join(pkgDir, entry)
+	if existsFile(fp) || !existsDir(fp) {
+		return entry
+	}
+	for _, ext := range []string{".js", ".mjs", ".cjs"} {
+		if existsFile(fp + ext) {
+			return entry
+		}
+	}
+	var p NpmPackageJSON
+	if parseJSONFile(path.Join(fp, "package.json"), &p) == nil && p.Main != "" {
+		main := "./" + path.Join(entry, p.Main)
+		if existsFile(path.Join(pkgDir, main)) {
+			return main
+		}
+		if existsDir(path.Join(pkgDir, main)) && path.Clean(main) != path.Clean(entry) {
+			return resolveDirIndex(pkgDir, main)
+		}
+	}
+	for _, index := range []string{"index.js", "index.mjs", "index.cjs"} {
+		if existsFile(path.Join(fp, index)) {
+			return "./" + path.Join(entry, index)
+		}
+	}
+	return entry
+}
+
+// resolveConditions resolves the entry of the conditional `exports`, returns false if no condition matches.
 // see https://nodejs.org/api/packages.html
-func (task *BuildTask) resolveConditions(p *NpmPackageInfo, exports interface{}, pType string) {
+func (task *BuildTask) resolveConditions(p *NpmPackageInfo, exports interface{}, pType string) bool {
 	s, ok := exports.(string)
 	if ok {
 		if pType == "module" {
@@ -572,12 +1072,12 @@ func (task *BuildTask) resolveConditions(p *NpmPackageInfo, exports interface{},
 		} else {
 			p.Main = s
 		}
-		return
+		return true
 	}
 
 	om, ok := exports.(*orderedMap)
 	if !ok {
-		return
+		return false
 	}
 
 	for e := om.l.Front(); e != nil; e = e.Next() {
@@ -594,6 +1094,26 @@ func (task *BuildTask) resolveConditions(p *NpmPackageInfo, exports interface{},
 		}
 	}
 
+	if task.hasExactConditions() {
+		for e := om.l.Front(); e != nil; e = e.Next() {
+			key, value := om.Entry(e)
+			if !task.Args.conditions.Has(key) {
+				continue
+			}
+			t := pType
+			switch key {
+			case "module", "import":
+				t = "module"
+			case "require":
+				t = "commonjs"
+			}
+			if task.resolveConditions(p, value, t) {
+				return true
+			}
+		}
+		return false
+	}
+
 	targetConditions := []string{"browser"}
 	conditions := []string{"module", "import", "es2015"}
 	_, hasRequireCondition := om.m["require"]
@@ -611,27 +1131,37 @@ func (task *BuildTask) resolveConditions(p *NpmPackageInfo, exports interface{},
 		}
 	case "node":
 		targetConditions = []string{"node"}
+	case "bun":
+		targetConditions = []string{"bun", "node"}
+	case "electron":
+		targetConditions = []string{"electron", "browser"}
+	case "electron-main":
+		targetConditions = []string{"electron", "node"}
 	}
-	if task.Dev {
-		targetConditions = append(targetConditions, "development")
-	}
+	targetConditions = append(targetConditions, task.nodeEnv())
 	if task.Args.conditions.Len() > 0 {
 		targetConditions = append(task.Args.conditions.Values(), targetConditions...)
 	}
-	for _, condition := range append(targetConditions, conditions...) {
-		v, ok := om.m[condition]
-		if ok {
-			task.resolveConditions(p, v, "module")
-			return
+	esmConditions := append(append([]string{}, targetConditions...), conditions...)
+	cjsConditions := append(append([]string{}, targetConditions...), "require", "node", "default")
+
+	// the conditions are matched in the declared order of the `exports` object and the first match wins,
+	// a matched condition is skipped if its nested conditions don't match.
+	// the ES module conditions are always preferred over the CommonJS conditions.
+	// see https://nodejs.org/api/packages.html#conditional-exports
+	for e := om.l.Front(); e != nil; e = e.Next() {
+		key, value := om.Entry(e)
+		if includes(esmConditions, key) && task.resolveConditions(p, value, "module") {
+			return true
 		}
 	}
-	for _, condition := range append(targetConditions, "require", "node", "default") {
-		v, ok := om.m[condition]
-		if ok {
-			task.resolveConditions(p, v, "commonjs")
-			break
+	for e := om.l.Front(); e != nil; e = e.Next() {
+		key, value := om.Entry(e)
+		if includes(cjsConditions, key) && task.resolveConditions(p, value, "commonjs") {
+			return true
 		}
 	}
+	return false
 }
 
 func queryESMBuild(id string) (*ESMBuild, bool) {
@@ -691,6 +1221,13 @@ func esmLexer(wd string, packageName string, moduleSpecifier string) (resolvedNa
 		}
 	}
 
+	// some packages set the `module` field to a CommonJS file (e.g. both `main` and `module`
+	// point to the same file), fall back to the CommonJS interop without parsing the file
+	if isCommonJSFile(path.Join(pkgDir, resolvedName)) {
+		err = errors.New("not a module")
+		return
+	}
+
 	isESM, _namedExports, err := validateJS(path.Join(pkgDir, resolvedName))
 	if err != nil {
 		return
@@ -705,6 +1242,19 @@ func esmLexer(wd string, packageName string, moduleSpecifier string) (resolvedNa
 	return
 }
 
+// isCommonJSFile checks whether the file is a CommonJS module by a lightweight heuristic:
+// it uses `module.exports` or `exports.*` without any `import`/`export` statement.
+func isCommonJSFile(filename string) bool {
+	if !endsWith(filename, ".js", ".cjs") {
+		return false
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return false
+	}
+	return !regexpESMSyntax.Match(data) && regexpCJSExports.Match(data)
+}
+
 func validateJS(filename string) (isESM bool, namedExports []string, err error) {
 	data, err := os.ReadFile(filename)
 	if err != nil {
@@ -756,3 +1306,80 @@ func minify(code string, target api.Target, loader api.Loader) ([]byte, error) {
 	}
 	return ret.Code, nil
 }
+
+// getRawFileURL returns the url of the file installed in the `node_modules` directory,
+// the file must be published by the package to be served as a raw file.
+func (task *BuildTask) getRawFileURL(filename string) (url string, ok bool) {
+	rel, err := filepath.Rel(filepath.Join(task.resolveDir, "node_modules"), filename)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return
+	}
+	// the package in the virtual store of pnpm, e.g. `.pnpm/foo@1.0.0/node_modules/foo/data.json`
+	if strings.HasPrefix(rel, ".pnpm/") {
+		a := strings.Split(rel, "/node_modules/")
+		rel = a[len(a)-1]
+	}
+	pkgName, _, subPath := splitPkgPath(rel)
+	if subPath == "" {
+		return
+	}
+	var p NpmPackageInfo
+	err = parseJSONFile(path.Join(strings.TrimSuffix(filename, "/"+subPath), "package.json"), &p)
+	if err != nil || p.Version == "" || !isPublishedFile(p, subPath) {
+		return
+	}
+	pkg := Pkg{Name: pkgName, Version: p.Version}
+	if pkgName == task.Pkg.Name {
+		pkg = task.Pkg
+	}
+	return fmt.Sprintf("%s/%s/%s", cfg.CdnBasePath, pkg.VersionName(), subPath), true
+}
+
+// isDefaultOnlyImport checks whether the json module is only imported by the default import (`import data from "./data.json"`)
+// in the importer, the named imports and the re-exports are not available with the `type: "json"` attribute.
+func isDefaultOnlyImport(importer string, specifier string) bool {
+	code, err := os.ReadFile(importer)
+	if err != nil {
+		return false
+	}
+	found := false
+	for _, m := range regexpImportFrom.FindAllSubmatch(code, -1) {
+		if string(m[3]) != specifier {
+			continue
+		}
+		if string(m[1]) != "import" || !regexpJSIdent.Match(m[2]) {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+// addJSONImportAttributes adds the `type: "json"` attribute to the imports of the json modules,
+// since esbuild drops the import attributes of the external modules.
+func addJSONImportAttributes(js []byte, urls []string) []byte {
+	set := newStringSet(urls...)
+	return regexpFromSpecifier.ReplaceAllFunc(js, func(m []byte) []byte {
+		if !set.Has(string(regexpFromSpecifier.FindSubmatch(m)[1])) {
+			return m
+		}
+		return []byte(string(m) + ` with{type:"json"}`)
+	})
+}
+
+// rewriteWasmURLs rewrites the relative wasm urls of the `new URL("./foo.wasm", import.meta.url)` expressions,
+// the `resolve` function returns the url of the wasm file on the CDN.
+func rewriteWasmURLs(js []byte, resolve func(filename string) (string, bool)) []byte {
+	return regexpWasmURL.ReplaceAllFunc(js, func(m []byte) []byte {
+		a := regexpWasmURL.FindSubmatch(m)
+		filename := string(a[2])
+		if strings.HasPrefix(filename, "/") || strings.Contains(filename, ":") {
+			return m
+		}
+		url, ok := resolve(filename)
+		if !ok {
+			return m
+		}
+		return []byte(fmt.Sprintf(`new URL("%s", import.meta.url)`, url))
+	})
+}
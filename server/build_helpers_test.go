@@ -0,0 +1,964 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+func newTestBuildTask(target string) *BuildTask {
+	return &BuildTask{
+		Args: BuildArgs{
+			conditions: newStringSet(),
+			exports:    newStringSet(),
+			external:   newStringSet(),
+		},
+		Target: target,
+	}
+}
+
+func parseTestPackageJSON(t *testing.T, data string) NpmPackageInfo {
+	var p NpmPackageInfo
+	if err := json.Unmarshal([]byte(data), &p); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestMixedSubpathExports(t *testing.T) {
+	task := newTestBuildTask("es2022")
+	p := parseTestPackageJSON(t, `{
+		"name": "foo",
+		"version": "1.0.0",
+		"exports": {
+			".": "./index.js",
+			"./sub": { "import": "./sub.mjs" }
+		}
+	}`)
+
+	npm := task.normalizeNpmPackage(p)
+	if npm.Main != "./index.js" || npm.Module != "" {
+		t.Fatalf("invalid root entry: main=%q module=%q", npm.Main, npm.Module)
+	}
+
+	if !task.resolveSubModuleExports(&npm, "sub") {
+		t.Fatal("subpath './sub' should be resolved")
+	}
+	if npm.Module != "./sub.mjs" {
+		t.Fatalf("invalid sub entry: module=%q", npm.Module)
+	}
+}
+
+func TestBundledDependencies(t *testing.T) {
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected registry request: %s", r.URL.Path)
+		w.WriteHeader(404)
+	})
+
+	for _, field := range []string{"bundleDependencies", "bundledDependencies"} {
+		p := parseTestPackageJSON(t, `{"name":"foo","version":"1.0.0","dependencies":{"bar":"^1.0.0"},"`+field+`":["bar"]}`)
+		if !includes(p.BundledDependencies, "bar") {
+			t.Fatalf("`%s` should be parsed", field)
+		}
+	}
+
+	packageDir := t.TempDir()
+	ensureDir(path.Join(packageDir, "node_modules", "bar"))
+	err := os.WriteFile(path.Join(packageDir, "node_modules", "bar", "package.json"), []byte(`{"name":"bar","version":"2.0.0"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	task := newTestBuildTask("es2022")
+	task.Pkg = Pkg{Name: "foo", Version: "1.0.0"}
+	task.packageDir = packageDir
+	task.npm = parseTestPackageJSON(t, `{"name":"foo","version":"1.0.0","dependencies":{"bar":"^1.0.0"},"bundleDependencies":true}`)
+
+	pkg, _, fromPackageJSON, err := task.getPackageInfo("bar/baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg.String() != "bar@2.0.0/baz" || !fromPackageJSON {
+		t.Fatalf("invalid bundled dependency %v", pkg)
+	}
+
+	resolvedPath := task.resolveExternalModule("bar", api.ResolveJSImportStatement)
+	if !strings.Contains(resolvedPath, "/bar@2.0.0/") {
+		t.Fatalf("invalid resolved path %q", resolvedPath)
+	}
+}
+
+func TestExportsSugarEntry(t *testing.T) {
+	task := newTestBuildTask("es2022")
+
+	npm := task.normalizeNpmPackage(parseTestPackageJSON(t, `{
+		"name": "foo",
+		"version": "1.0.0",
+		"main": "./main.js",
+		"module": "./module.mjs",
+		"exports": "./a.js"
+	}`))
+	if npm.Main != "./a.js" || npm.Module != "" {
+		t.Fatalf("invalid root entry: main=%q module=%q", npm.Main, npm.Module)
+	}
+
+	npm = task.normalizeNpmPackage(parseTestPackageJSON(t, `{
+		"name": "foo",
+		"version": "1.0.0",
+		"type": "module",
+		"main": "./main.js",
+		"exports": { ".": "./a.js" }
+	}`))
+	if npm.Module != "./a.js" || npm.Main != "" {
+		t.Fatalf("invalid root entry: main=%q module=%q", npm.Main, npm.Module)
+	}
+
+	// fallback to the legacy fields if the `exports` doesn't define the root entry
+	npm = task.normalizeNpmPackage(parseTestPackageJSON(t, `{
+		"name": "foo",
+		"version": "1.0.0",
+		"main": "./main.js",
+		"exports": { "./sub": "./sub.js" }
+	}`))
+	if npm.Main != "./main.js" {
+		t.Fatalf("invalid root entry: main=%q", npm.Main)
+	}
+}
+
+func TestDevConditions(t *testing.T) {
+	wd := t.TempDir()
+	files := map[string]string{
+		"node_modules/foo/package.json": `{"name":"foo","version":"1.0.0","exports":{"development":"./dev.js","production":"./prod.js","default":"./prod.js"}}`,
+		"node_modules/foo/dev.js":       `export { bar } from "bar"; export const foo = "foo-dev";`,
+		"node_modules/foo/prod.js":      `export { bar } from "bar"; export const foo = "foo-prod";`,
+		"node_modules/bar/package.json": `{"name":"bar","version":"1.0.0","exports":{"development":"./dev.js","production":"./prod.js","default":"./prod.js"}}`,
+		"node_modules/bar/dev.js":       `export const bar = "bar-dev";`,
+		"node_modules/bar/prod.js":      `export const bar = "bar-prod";`,
+	}
+	for name, content := range files {
+		ensureDir(path.Dir(path.Join(wd, name)))
+		if err := os.WriteFile(path.Join(wd, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, dev := range []bool{true, false} {
+		task := newTestBuildTask("es2022")
+		task.Dev = dev
+		nodeEnv := task.nodeEnv()
+		suffix := "-prod"
+		if dev {
+			suffix = "-dev"
+		}
+
+		npm := task.normalizeNpmPackage(parseTestPackageJSON(t, files["node_modules/foo/package.json"]))
+		if entry := npm.Main + npm.Module; entry != "./"+suffix[1:]+".js" {
+			t.Fatalf("invalid %s entry %q", nodeEnv, entry)
+		}
+
+		ret := api.Build(api.BuildOptions{
+			Stdin:      &api.StdinOptions{Contents: `export * from "foo";`, ResolveDir: wd},
+			Bundle:     true,
+			Format:     api.FormatESModule,
+			Conditions: task.getConditions(),
+		})
+		if len(ret.Errors) > 0 {
+			t.Fatal(ret.Errors[0].Text)
+		}
+		code := string(ret.OutputFiles[0].Contents)
+		if !strings.Contains(code, "foo"+suffix) || !strings.Contains(code, "bar"+suffix) {
+			t.Fatalf("all packages should be resolved with the `%s` condition:\n%s", nodeEnv, code)
+		}
+	}
+}
+
+func TestMainDirIndex(t *testing.T) {
+	wd := t.TempDir()
+	for name, content := range map[string]string{
+		"node_modules/foo/lib/index.js":      `module.exports = "foo"`,
+		"node_modules/bar/lib/package.json":  `{"main":"./bar.js"}`,
+		"node_modules/bar/lib/bar.js":        `module.exports = "bar"`,
+		"node_modules/baz/esm/index.mjs":     `export default "baz"`,
+		"node_modules/qux/lib.js":            `module.exports = "qux"`,
+		"node_modules/qux/lib/index.js":      `module.exports = "qux"`,
+		"node_modules/self/lib/package.json": `{"main":"."}`,
+		"node_modules/self/lib/index.js":     `module.exports = "self"`,
+	} {
+		ensureDir(path.Dir(path.Join(wd, name)))
+		if err := os.WriteFile(path.Join(wd, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	task := newTestBuildTask("es2022")
+	task.wd = wd
+	for _, c := range []struct {
+		packageJSON string
+		main        string
+		module      string
+	}{
+		{`{"name":"foo","version":"1.0.0","main":"./lib"}`, "./lib/index.js", ""},
+		{`{"name":"bar","version":"1.0.0","main":"lib"}`, "./lib/bar.js", ""},
+		{`{"name":"baz","version":"1.0.0","module":"./esm"}`, "", "./esm/index.mjs"},
+		{`{"name":"qux","version":"1.0.0","main":"./lib"}`, "./lib", ""},
+		{`{"name":"self","version":"1.0.0","main":"./lib"}`, "./lib/index.js", ""},
+	} {
+		npm := task.normalizeNpmPackage(parseTestPackageJSON(t, c.packageJSON))
+		if npm.Main != c.main || npm.Module != c.module {
+			t.Fatalf("invalid entry of %s: main=%q module=%q", npm.Name, npm.Main, npm.Module)
+		}
+	}
+}
+
+func TestExportsMapCache(t *testing.T) {
+	data := `{
+		"name": "exports-map",
+		"version": "1.0.0",
+		"exports": {
+			".": "./index.js",
+			"./*": "./dist/*.js",
+			"./lib/*": { "import": "./esm/lib/*.mjs" },
+			"./lib/core": { "import": "./esm/core.mjs" }
+		}
+	}`
+	task := newTestBuildTask("es2022")
+	for subModule, expected := range map[string]string{
+		"lib/core": "./esm/core.mjs",
+		"lib/util": "./esm/lib/util.mjs",
+		"foo":      "./dist/foo.js",
+	} {
+		npm := parseTestPackageJSON(t, data)
+		if !task.resolveSubModuleExports(&npm, subModule) {
+			t.Fatalf("subpath './%s' should be resolved", subModule)
+		}
+		if entry := npm.Main + npm.Module; entry != expected {
+			t.Fatalf("invalid entry of './%s': %q, should be %q", subModule, entry, expected)
+		}
+	}
+
+	// the exports map is computed once per package version
+	a := parseTestPackageJSON(t, data)
+	b := parseTestPackageJSON(t, data)
+	if getExportsMap(&a) != getExportsMap(&b) {
+		t.Fatal("the exports map should be cached")
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	c := newLRUCache(2)
+	c.GetOrAdd("a", 1)
+	c.GetOrAdd("b", 2)
+	if v := c.GetOrAdd("a", 3); v != 1 {
+		t.Fatalf("the existing value should be returned, got %v", v)
+	}
+	// `b` is the least recently used entry
+	c.GetOrAdd("c", 3)
+	if _, ok := c.Get("b"); ok {
+		t.Fatal("'b' should be evicted")
+	}
+	if v, ok := c.Get("a"); !ok || v != 1 {
+		t.Fatal("'a' should be kept")
+	}
+	if c.Len() != 2 {
+		t.Fatalf("invalid cache size %d", c.Len())
+	}
+}
+
+func BenchmarkResolveSubModuleExports(b *testing.B) {
+	var npm NpmPackageInfo
+	err := json.Unmarshal([]byte(`{
+		"name": "exports-map-bench",
+		"version": "1.0.0",
+		"exports": {
+			".": "./index.js",
+			"./lib/*": { "import": "./esm/lib/*.mjs", "require": "./lib/*.js" },
+			"./lib/core": { "import": "./esm/core.mjs", "require": "./lib/core.js" }
+		}
+	}`), &npm)
+	if err != nil {
+		b.Fatal(err)
+	}
+	task := newTestBuildTask("es2022")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p := npm
+		task.resolveSubModuleExports(&p, "lib/util")
+	}
+}
+
+func TestConditionsOrder(t *testing.T) {
+	task := newTestBuildTask("es2022")
+	for _, c := range []struct {
+		exports string
+		main    string
+		module  string
+	}{
+		// `require` is skipped for the import-mode resolution
+		{`{"require": "./cjs.js", "import": "./esm.mjs"}`, "", "./esm.mjs"},
+		// the first matched condition wins
+		{`{"import": "./esm.mjs", "browser": "./browser.js"}`, "", "./esm.mjs"},
+		{`{"browser": "./browser.mjs", "import": "./esm.mjs"}`, "", "./browser.mjs"},
+		// `default` is only used when no earlier condition matched
+		{`{"node": "./node.js", "require": "./cjs.js", "default": "./default.mjs", "import": "./esm.mjs"}`, "", "./default.mjs"},
+		{`{"import": "./esm.mjs", "default": "./default.mjs"}`, "", "./esm.mjs"},
+		// the matched condition is skipped if its nested conditions don't match
+		{`{"import": {"react-server": "./server.mjs"}, "browser": "./browser.mjs"}`, "", "./browser.mjs"},
+		// fallback to CommonJS conditions in the declared order
+		{`{"node": "./node.js", "require": "./cjs.js"}`, "./node.js", ""},
+		{`{"require": "./cjs.js", "node": "./node.js"}`, "./cjs.js", ""},
+	} {
+		npm := task.normalizeNpmPackage(parseTestPackageJSON(t, `{"name":"foo","version":"1.0.0","exports":{".":`+c.exports+`}}`))
+		if npm.Main != c.main || npm.Module != c.module {
+			t.Fatalf("invalid entry of %s: main=%q module=%q", c.exports, npm.Main, npm.Module)
+		}
+	}
+}
+
+func TestBunTarget(t *testing.T) {
+	if target := getBuildTargetByUA("Bun/1.1.8"); target != "bun" {
+		t.Fatalf("invalid build target of bun: %s", target)
+	}
+
+	task := newTestBuildTask("bun")
+	for _, c := range []struct {
+		exports string
+		main    string
+		module  string
+	}{
+		{`{"bun": "./bun.mjs", "node": "./node.mjs", "default": "./index.mjs"}`, "", "./bun.mjs"},
+		{`{"browser": "./browser.mjs", "node": "./node.mjs", "default": "./index.mjs"}`, "", "./node.mjs"},
+	} {
+		npm := task.normalizeNpmPackage(parseTestPackageJSON(t, `{"name":"foo","version":"1.0.0","exports":{".":`+c.exports+`}}`))
+		if npm.Main != c.main || npm.Module != c.module {
+			t.Fatalf("invalid entry of %s: main=%q module=%q", c.exports, npm.Main, npm.Module)
+		}
+	}
+
+	cfg = &config.Config{}
+	defer func() { cfg = nil }()
+	if p := task.resolveExternalModule("fs", api.ResolveJSImportStatement); p != "node:fs" {
+		t.Fatalf("invalid resolved path of fs: %s", p)
+	}
+	if p := task.resolveExternalModule("repl", api.ResolveJSImportStatement); p != "/node/repl.js" {
+		t.Fatalf("invalid resolved path of repl: %s", p)
+	}
+}
+
+func TestElectronTarget(t *testing.T) {
+	if target := getBuildTargetByUA("Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) foo/1.0.0 Chrome/120.0.6099.291 Electron/28.3.3 Safari/537.36"); target != "electron" {
+		t.Fatalf("invalid build target of electron: %s", target)
+	}
+
+	exports := `{"electron": {"node": "./main.mjs", "default": "./renderer.mjs"}, "default": "./index.mjs"}`
+	for target, module := range map[string]string{"electron": "./renderer.mjs", "electron-main": "./main.mjs", "es2022": "./index.mjs"} {
+		task := newTestBuildTask(target)
+		npm := task.normalizeNpmPackage(parseTestPackageJSON(t, `{"name":"foo","version":"1.0.0","type":"module","exports":{".":`+exports+`}}`))
+		if npm.Module != module {
+			t.Fatalf("invalid entry of the target %s: module=%q", target, npm.Module)
+		}
+	}
+
+	cfg = &config.Config{}
+	defer func() { cfg = nil }()
+	for target, resolvedPath := range map[string]string{"electron": "/node/fs.js", "electron-main": "node:fs"} {
+		task := newTestBuildTask(target)
+		if p := task.resolveExternalModule("fs", api.ResolveJSImportStatement); p != resolvedPath {
+			t.Fatalf("invalid resolved path of fs for the target %s: %s", target, p)
+		}
+	}
+}
+
+func TestIgnoreBrowserField(t *testing.T) {
+	data := `{"name":"foo","version":"1.0.0","main":"./node.js","browser":{"./node.js":"./browser.js","fs":false}}`
+
+	task := newTestBuildTask("es2022")
+	npm := task.normalizeNpmPackage(parseTestPackageJSON(t, data))
+	if npm.Main != "./browser.js" || len(npm.Browser) == 0 {
+		t.Fatalf("invalid browser entry: main=%q", npm.Main)
+	}
+
+	for _, task := range []*BuildTask{newTestBuildTask("node"), newTestBuildTask("deno"), newTestBuildTask("es2022")} {
+		if task.Target == "es2022" {
+			task.Args.conditions.Add("node")
+		}
+		npm := task.normalizeNpmPackage(parseTestPackageJSON(t, data))
+		if npm.Main != "./node.js" || len(npm.Browser) > 0 {
+			t.Fatalf("the `browser` field should be ignored for target %s: main=%q", task.Target, npm.Main)
+		}
+	}
+}
+
+func TestCustomConditions(t *testing.T) {
+	p := parseTestPackageJSON(t, `{
+		"name": "foo",
+		"version": "1.0.0",
+		"exports": {
+			".": {
+				"react-native": "./native.js",
+				"electron": { "node-addons": "./addons.js" },
+				"default": "./index.mjs"
+			}
+		}
+	}`)
+	// custom conditions are retained in the cached package info
+	p = parseTestPackageJSON(t, string(mustEncodeJSON(p)))
+
+	for condition, expected := range map[string]string{
+		"":             "./index.mjs",
+		"react-native": "./native.js",
+		"electron":     "./index.mjs",
+	} {
+		task := newTestBuildTask("es2022")
+		if condition != "" {
+			task.Args.conditions.Add(condition)
+		}
+		npm := task.normalizeNpmPackage(p)
+		if entry := npm.Main + npm.Module; entry != expected {
+			t.Fatalf("invalid entry with condition %q: %q, should be %q", condition, entry, expected)
+		}
+	}
+
+	task := newTestBuildTask("es2022")
+	task.Args.conditions.Add("electron")
+	task.Args.conditions.Add("node-addons")
+	npm := task.normalizeNpmPackage(p)
+	if entry := npm.Main + npm.Module; entry != "./addons.js" {
+		t.Fatalf("invalid entry with nested custom conditions: %q", entry)
+	}
+}
+
+func TestOverrideVersion(t *testing.T) {
+	var overrides config.Overrides
+	err := json.Unmarshal([]byte(`{"bar": "1.0.0", "foo": {"bar": "1.2.3"}}`), &overrides)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = &config.Config{Overrides: overrides}
+	defer func() { cfg = nil }()
+
+	for parent, expected := range map[string]string{
+		"foo": "1.2.3",
+		"qux": "1.0.0",
+		"bar": "^0.1.0",
+	} {
+		task := newTestBuildTask("es2022")
+		task.Pkg = Pkg{Name: parent, Version: "1.0.0"}
+		if version := task.overrideVersion("bar", "^0.1.0"); version != expected {
+			t.Fatalf("invalid version of 'bar' under '%s': %q, should be %q", parent, version, expected)
+		}
+	}
+
+	// the nested override applies under the ancestors chain `foo>qux>bar`
+	err = json.Unmarshal([]byte(`{"bar": "1.0.0", "foo": {"qux": {"bar": "2.0.0"}}}`), &overrides)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Overrides = overrides
+
+	foo := newTestBuildTask("es2022")
+	foo.Pkg = Pkg{Name: "foo", Version: "1.0.0"}
+	foo.Args.parents = []string{"baz"}
+	parents := foo.overrideParents()
+	if strings.Join(parents, ">") != "foo" {
+		t.Fatalf("invalid parents chain %v", parents)
+	}
+	for chain, expected := range map[string]string{
+		"foo":     "2.0.0",
+		"baz>foo": "2.0.0",
+		"":        "1.0.0",
+		"bar":     "1.0.0",
+	} {
+		task := newTestBuildTask("es2022")
+		task.Pkg = Pkg{Name: "qux", Version: "1.0.0"}
+		if chain != "" {
+			task.Args.parents = strings.Split(chain, ">")
+		}
+		if version := task.overrideVersion("bar", "^0.1.0"); version != expected {
+			t.Fatalf("invalid version of 'bar' under '%s>qux': %q, should be %q", chain, version, expected)
+		}
+	}
+	qux := newTestBuildTask("es2022")
+	qux.Pkg = Pkg{Name: "qux", Version: "1.0.0"}
+	qux.Args.parents = parents
+	if parents := qux.overrideParents(); strings.Join(parents, ">") != "foo>qux" {
+		t.Fatalf("invalid parents chain %v", parents)
+	}
+}
+
+func TestFakeModuleEntry(t *testing.T) {
+	wd := t.TempDir()
+	pkgDir := path.Join(wd, "node_modules", "foo")
+	for name, content := range map[string]string{
+		"package.json": `{"name":"foo","version":"1.0.0","main":"index.js","module":"index.js"}`,
+		"index.js":     "\"use strict\";\nconst bar = require(\"./bar\");\nmodule.exports = { bar };\n",
+		"esm.js":       "// module.exports = {}\nimport bar from \"./bar\";\nexport { bar };\n",
+		"minified.js":  `const a=1;export{a as default};`,
+		"meta.js":      `exports.url = import.meta.url;`,
+	} {
+		ensureDir(path.Dir(path.Join(pkgDir, name)))
+		if err := os.WriteFile(path.Join(pkgDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the `module` entry is a CommonJS file
+	_, _, err := esmLexer(wd, "foo", "index.js")
+	if err == nil || err.Error() != "not a module" {
+		t.Fatalf("the CommonJS module entry should be rejected by the esm lexer: %v", err)
+	}
+
+	for name, isCJS := range map[string]bool{
+		"index.js":    true,
+		"esm.js":      false,
+		"minified.js": false,
+		"meta.js":     false,
+	} {
+		if isCommonJSFile(path.Join(pkgDir, name)) != isCJS {
+			t.Fatalf("isCommonJSFile(%s) should be %v", name, isCJS)
+		}
+	}
+	if _, namedExports, err := esmLexer(wd, "foo", "esm.js"); err != nil || !includes(namedExports, "bar") {
+		t.Fatalf("invalid esm lexer result of 'esm.js': %v, %v", namedExports, err)
+	}
+}
+
+func TestExportsFolderMapping(t *testing.T) {
+	data := `{
+		"name": "exports-folder-mapping",
+		"version": "1.0.0",
+		"exports": {
+			".": "./index.js",
+			"./lib/": "./src/lib/",
+			"./esm/": { "import": "./dist/esm/", "require": "./dist/cjs/" }
+		}
+	}`
+	task := newTestBuildTask("es2022")
+	for subModule, expected := range map[string]string{
+		"lib/foo.js":         "./src/lib/foo.js",
+		"lib/nested/deep.js": "./src/lib/nested/deep.js",
+		"esm/bar.mjs":        "./dist/esm/bar.mjs",
+	} {
+		npm := parseTestPackageJSON(t, data)
+		if !task.resolveSubModuleExports(&npm, subModule) {
+			t.Fatalf("subpath './%s' should be resolved", subModule)
+		}
+		if entry := npm.Main + npm.Module; entry != expected {
+			t.Fatalf("invalid entry of './%s': %q, should be %q", subModule, entry, expected)
+		}
+	}
+
+	npm := parseTestPackageJSON(t, data)
+	if task.resolveSubModuleExports(&npm, "src/lib/foo.js") {
+		t.Fatal("subpath './src/lib/foo.js' should not be resolved")
+	}
+}
+
+func TestExactConditions(t *testing.T) {
+	p := parseTestPackageJSON(t, `{
+		"name": "foo",
+		"version": "1.0.0",
+		"type": "module",
+		"exports": {
+			".": {
+				"browser": "./browser.js",
+				"worker": "./worker.js",
+				"import": "./index.js",
+				"default": "./index.cjs"
+			}
+		}
+	}`)
+
+	task := newTestBuildTask("es2022")
+	npm := task.normalizeNpmPackage(p)
+	if npm.Module != "./browser.js" {
+		t.Fatalf("invalid entry: module=%q, should be './browser.js'", npm.Module)
+	}
+
+	// the extra conditions are added to the default conditions, the first matched one in the `exports` wins
+	task = newTestBuildTask("es2022")
+	task.Args.conditions.Add("worker")
+	npm = task.normalizeNpmPackage(p)
+	if npm.Module != "./browser.js" {
+		t.Fatalf("invalid entry: module=%q, should be './browser.js'", npm.Module)
+	}
+
+	// the `default` condition doesn't make the conditions exact
+	task = newTestBuildTask("es2022")
+	task.Args.conditions.Add("worker")
+	task.Args.conditions.Add("default")
+	npm = task.normalizeNpmPackage(p)
+	if npm.Module != "./browser.js" {
+		t.Fatalf("invalid entry: module=%q, should be './browser.js'", npm.Module)
+	}
+
+	// the conditions are the exact condition set with the `?exact-conditions` query
+	task.Args.exactConditions = true
+	npm = task.normalizeNpmPackage(p)
+	if npm.Module != "./worker.js" {
+		t.Fatalf("invalid entry: module=%q, should be './worker.js'", npm.Module)
+	}
+	if conditions := task.getConditions(); len(conditions) != 2 || !includes(conditions, "worker") || !includes(conditions, "default") {
+		t.Fatalf("invalid esbuild conditions: %v", conditions)
+	}
+
+	task.Args.conditions.Add("edge-light")
+	if undeclared := task.undeclaredConditions(p); len(undeclared) != 1 || undeclared[0] != "edge-light" {
+		t.Fatalf("invalid undeclared conditions: %v", undeclared)
+	}
+}
+
+func TestExplicitTypesVersion(t *testing.T) {
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/@types/foo/1.2.3":
+			w.Write([]byte(`{"name":"@types/foo","version":"1.2.3","types":"index.d.ts"}`))
+		default:
+			w.WriteHeader(404)
+		}
+	})
+
+	newTask := func(types *Pkg) *BuildTask {
+		task := newTestBuildTask("esnext")
+		task.Pkg = Pkg{Name: "foo", Version: "2.0.0"}
+		task.Args.types = types
+		task.npm = NpmPackageInfo{Name: "foo", Version: "2.0.0", Types: "index.d.ts"}
+		task.esm = &ESMBuild{}
+		task.wd = t.TempDir()
+		task.resolveDir = task.wd
+		return task
+	}
+
+	// use the types of the package by default
+	task := newTask(nil)
+	task.checkDTS()
+	if task.esm.Dts != "foo@2.0.0/index.d.ts" {
+		t.Fatalf("invalid dts %q", task.esm.Dts)
+	}
+
+	// use the types package specified by the `?types` query, the runtime version is not changed
+	task = newTask(&Pkg{Name: "@types/foo", Version: "1.2.3"})
+	task.checkDTS()
+	if task.esm.Dts != "@types/foo@1.2.3/index.d.ts" {
+		t.Fatalf("invalid dts %q", task.esm.Dts)
+	}
+	if task.Pkg.Version != "2.0.0" {
+		t.Fatalf("invalid runtime version %q", task.Pkg.Version)
+	}
+
+	// the `?types` query is a part of the build id
+	args, err := decodeBuildArgsPrefix(encodeBuildArgsPrefix(task.Args, task.Pkg, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args.types == nil || args.types.String() != "@types/foo@1.2.3" {
+		t.Fatalf("invalid types arg %v", args.types)
+	}
+}
+
+func TestNpmAliasDependencies(t *testing.T) {
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/@preact/compat" {
+			t.Errorf("unexpected registry request: %s", r.URL.Path)
+			w.WriteHeader(404)
+			return
+		}
+		w.Write([]byte(`{"dist-tags":{"latest":"17.1.2"},"versions":{"17.1.2":{"name":"@preact/compat","version":"17.1.2"}}}`))
+	})
+
+	info, _, err := getPackageInfo("", "react-dom", "npm:@preact/compat@^17")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "@preact/compat" || info.Version != "17.1.2" {
+		t.Fatalf("invalid alias package info %s@%s", info.Name, info.Version)
+	}
+
+	task := newTestBuildTask("es2022")
+	task.Pkg = Pkg{Name: "foo", Version: "1.0.0"}
+	task.npm = parseTestPackageJSON(t, `{
+		"name": "foo",
+		"version": "1.0.0",
+		"dependencies": { "react-dom": "npm:@preact/compat@^17" },
+		"peerDependencies": { "react": "npm:@preact/compat" }
+	}`)
+
+	pkg, _, _, err := task.getPackageInfo("react-dom/client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg.String() != "@preact/compat@17.1.2/client" {
+		t.Fatalf("invalid alias dependency %v", pkg)
+	}
+	for _, specifier := range []string{"react-dom", "react"} {
+		resolvedPath := task.resolveExternalModule(specifier, api.ResolveJSImportStatement)
+		if !strings.Contains(resolvedPath, "/@preact/compat@17.1.2/") {
+			t.Fatalf("invalid resolved path of %s: %q", specifier, resolvedPath)
+		}
+	}
+}
+
+func TestStandaloneNodeLibs(t *testing.T) {
+	task := newTestBuildTask("es2022")
+	task.Pkg = Pkg{Name: "foo", Version: "1.0.0"}
+	task.Bundle = true
+	if task.inlineNodeLib("buffer") {
+		t.Fatal("the node libs should not be inlined in `bundle` mode")
+	}
+
+	task.Standalone = true
+	if id := task.ID(); id != "foo@1.0.0/es2022/foo.standalone.mjs" {
+		t.Fatalf("invalid build id %q", id)
+	}
+	if !task.inlineNodeLib("buffer") {
+		t.Fatal("the node libs should be inlined in `standalone` mode")
+	}
+	task.Args.external.Add("node:buffer")
+	if task.inlineNodeLib("buffer") || !task.inlineNodeLib("process") {
+		t.Fatal("the externalized node libs should not be inlined")
+	}
+
+	for target, inlined := range map[string]bool{"node": false, "bun": false, "deno": false, "denonext": false, "es2015": true} {
+		task := newTestBuildTask(target)
+		task.Standalone = true
+		if task.inlineNodeLib("process") != inlined {
+			t.Fatalf("invalid inlineNodeLib(\"process\") of the target %s", target)
+		}
+	}
+}
+
+func TestJSONImportAttributes(t *testing.T) {
+	cfg = &config.Config{}
+	defer func() { cfg = nil }()
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"node_modules/.pnpm/foo@1.0.0/node_modules/foo/package.json":       `{"name":"foo","version":"1.0.0"}`,
+		"node_modules/.pnpm/foo@1.0.0/node_modules/foo/data.json":          `{}`,
+		"node_modules/.pnpm/@s+bar@2.0.0/node_modules/@s/bar/package.json": `{"name":"@s/bar","version":"2.0.0","files":["lib"]}`,
+		"node_modules/.pnpm/@s+bar@2.0.0/node_modules/@s/bar/lib/a.json":   `{}`,
+		"node_modules/.pnpm/@s+bar@2.0.0/node_modules/@s/bar/b.json":       `{}`,
+	} {
+		ensureDir(path.Dir(path.Join(dir, name)))
+		if err := os.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	task := newTestBuildTask("es2022")
+	task.Pkg = Pkg{Name: "foo", Version: "1.0.0"}
+	task.resolveDir = dir
+	for name, expected := range map[string]string{
+		".pnpm/foo@1.0.0/node_modules/foo/data.json":        "/foo@1.0.0/data.json",
+		".pnpm/@s+bar@2.0.0/node_modules/@s/bar/lib/a.json": "/@s/bar@2.0.0/lib/a.json",
+		".pnpm/@s+bar@2.0.0/node_modules/@s/bar/b.json":     "",
+	} {
+		url, _ := task.getRawFileURL(path.Join(dir, "node_modules", name))
+		if url != expected {
+			t.Fatalf("invalid url %q of %s, should be %q", url, name, expected)
+		}
+	}
+
+	js := addJSONImportAttributes([]byte(`import a from"/foo@1.0.0/data.json";import b from "/foo@1.0.0/b.js";import c from "/foo@1.0.0/data.json";`), []string{"/foo@1.0.0/data.json"})
+	if string(js) != `import a from"/foo@1.0.0/data.json" with{type:"json"};import b from "/foo@1.0.0/b.js";import c from "/foo@1.0.0/data.json" with{type:"json"};` {
+		t.Fatalf("invalid import attributes: %s", js)
+	}
+
+	for code, expected := range map[string]bool{
+		`import data from "./data.json";`:                                       true,
+		"import data from './data.json'\nimport b from './b.json'":              true,
+		`import { version } from "./data.json";`:                                false,
+		`import data, { version } from "./data.json";`:                          false,
+		`import * as data from "./data.json";`:                                  false,
+		`import data from "./data.json";export { default } from "./data.json";`: false,
+		`const data = await import("./data.json");`:                             false,
+	} {
+		importer := path.Join(t.TempDir(), "index.js")
+		if err := os.WriteFile(importer, []byte(code), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if ok := isDefaultOnlyImport(importer, "./data.json"); ok != expected {
+			t.Fatalf("invalid default-only import of %q: %v", code, ok)
+		}
+	}
+}
+
+func TestRewriteWasmURLs(t *testing.T) {
+	js := rewriteWasmURLs([]byte(`const a = new URL("./a.wasm", import.meta.url);
+const b = new URL( '../b.wasm' , import.meta.url );
+const c = new URL("https://example.com/c.wasm", import.meta.url);
+const d = new URL("./missing.wasm", import.meta.url);
+const e = new URL("./e.js", import.meta.url);`), func(filename string) (string, bool) {
+		if filename == "./missing.wasm" {
+			return "", false
+		}
+		return path.Join("/foo@1.0.0/dist", filename), true
+	})
+	if string(js) != `const a = new URL("/foo@1.0.0/dist/a.wasm", import.meta.url);
+const b = new URL("/foo@1.0.0/b.wasm", import.meta.url);
+const c = new URL("https://example.com/c.wasm", import.meta.url);
+const d = new URL("./missing.wasm", import.meta.url);
+const e = new URL("./e.js", import.meta.url);` {
+		t.Fatalf("invalid wasm urls: %s", js)
+	}
+}
+
+func TestJSXRuntime(t *testing.T) {
+	cfg = &config.Config{}
+	defer func() { cfg = nil }()
+
+	task := newTestBuildTask("es2022")
+	if task.getJSXRuntime() != nil {
+		t.Fatal("the jsx runtime should be nil without the query and the config")
+	}
+
+	cfg.JsxImportSource = "solid-js/h"
+	if pkg := task.getJSXRuntime(); pkg == nil || pkg.Name != "solid-js" || pkg.Version != "" || pkg.SubModule != "h" {
+		t.Fatalf("invalid jsx runtime of the config: %+v", pkg)
+	}
+
+	// the version is pinned by the `?deps` query
+	task.Args.deps = PkgSlice{{Name: "solid-js", Version: "1.8.0"}}
+	if pkg := task.getJSXRuntime(); pkg == nil || pkg.String() != "solid-js@1.8.0/h" {
+		t.Fatalf("invalid jsx runtime of the config: %+v", pkg)
+	}
+
+	// the config is encoded in the build args
+	prefix := encodeBuildArgsPrefix(task.Args, Pkg{Name: "foo"}, false)
+	if args, err := decodeBuildArgsPrefix(prefix); prefix == "" || err != nil || args.jsxRuntime != nil {
+		t.Fatalf("invalid build args prefix %q: %v", prefix, err)
+	}
+	cfg.JsxImportSource = "preact"
+	if p := encodeBuildArgsPrefix(task.Args, Pkg{Name: "foo"}, false); p == prefix {
+		t.Fatal("the build args prefix should be changed with the config")
+	}
+
+	// the `?jsx-import-source` query takes precedence over the config
+	task.Args.jsxRuntime = &Pkg{Name: "preact", Version: "10.19.0"}
+	if pkg := task.getJSXRuntime(); pkg == nil || pkg.String() != "preact@10.19.0" {
+		t.Fatalf("invalid jsx runtime of the query: %+v", pkg)
+	}
+}
+
+func TestDevelopmentCondition(t *testing.T) {
+	wd := t.TempDir()
+	files := map[string]string{
+		"node_modules/foo/package.json": `{"name":"foo","version":"1.0.0","exports":{"production":"./prod.js","development":"./dev.js","default":"./prod.js"}}`,
+		"node_modules/foo/dev.js":       `export const foo = "foo-dev";`,
+		"node_modules/foo/prod.js":      `export const foo = "foo-prod";`,
+	}
+	for name, content := range files {
+		ensureDir(path.Dir(path.Join(wd, name)))
+		if err := os.WriteFile(path.Join(wd, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	task := newTestBuildTask("es2022")
+	task.Args.conditions.Add("development")
+	if task.nodeEnv() != "development" {
+		t.Fatalf("invalid node env %q, should be 'development'", task.nodeEnv())
+	}
+
+	npm := task.normalizeNpmPackage(parseTestPackageJSON(t, files["node_modules/foo/package.json"]))
+	if entry := npm.Main + npm.Module; entry != "./dev.js" {
+		t.Fatalf("invalid entry %q, should be './dev.js'", entry)
+	}
+
+	ret := api.Build(api.BuildOptions{
+		Stdin:      &api.StdinOptions{Contents: `export * from "foo";`, ResolveDir: wd},
+		Bundle:     true,
+		Format:     api.FormatESModule,
+		Conditions: task.getConditions(),
+	})
+	if len(ret.Errors) > 0 {
+		t.Fatal(ret.Errors[0].Text)
+	}
+	if code := string(ret.OutputFiles[0].Contents); !strings.Contains(code, "foo-dev") {
+		t.Fatalf("the package should be resolved with the `development` condition:\n%s", code)
+	}
+}
+
+func TestPinnedDeps(t *testing.T) {
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/react/18.2.0":
+			w.Write([]byte(`{"name":"react","version":"18.2.0"}`))
+		default:
+			w.WriteHeader(404)
+		}
+	})
+
+	wd := t.TempDir()
+	for name, version := range map[string]string{"react": "18.3.1", "scheduler": "0.23.0"} {
+		ensureDir(path.Join(wd, "node_modules", name))
+		err := os.WriteFile(path.Join(wd, "node_modules", name, "package.json"), []byte(`{"name":"`+name+`","version":"`+version+`"}`), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	task := newTestBuildTask("es2022")
+	task.resolveDir = wd
+	task.npm = parseTestPackageJSON(t, `{"name":"foo","version":"1.0.0","dependencies":{"react":"^18.0.0","scheduler":"^0.23.0"}}`)
+	task.Args.deps = PkgSlice{{Name: "react", Version: "18.2.0"}, {Name: "scheduler", Version: "0.23.0"}}
+
+	if task.isPinnedVersionInstalled("react") {
+		t.Fatal("react@18.3.1 is installed but react@18.2.0 is pinned")
+	}
+	if !task.isPinnedVersionInstalled("scheduler") || !task.isPinnedVersionInstalled("lodash") {
+		t.Fatal("scheduler and lodash should be bundled")
+	}
+	pkg, _, _, err := task.getPackageInfo("react")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg.String() != "react@18.2.0" {
+		t.Fatalf("invalid pinned dependency %v", pkg)
+	}
+}
+
+func TestNodePolyfills(t *testing.T) {
+	cfg = &config.Config{NodePolyfills: map[string]string{"buffer": "buffer@6.0.3", "fs": "false", "os": ""}}
+	defer func() { cfg = nil }()
+
+	// an empty value means the polyfill of esm.sh, `false` disables the polyfill
+	task := newTestBuildTask("es2022")
+	for name, expected := range map[string]string{"buffer": "buffer@6.0.3", "process": "", "os": "", "fs": "-"} {
+		pkg, ok := task.getNodePolyfill(name)
+		if (expected == "-" && ok) || (expected != "-" && (!ok || pkg != expected)) {
+			t.Fatalf("invalid polyfill of %s: %q %v", name, pkg, ok)
+		}
+	}
+
+	// the `?node-polyfills` query overrides the config
+	task.Args.nodePolyfills = map[string]string{"process": "process", "fs": "", "buffer": "", "os": "false"}
+	for name, expected := range map[string]string{"buffer": "buffer@6.0.3", "process": "process@latest", "fs": "", "os": "-", "events": "-"} {
+		pkg, ok := task.getNodePolyfill(name)
+		if (expected == "-" && ok) || (expected != "-" && (!ok || pkg != expected)) {
+			t.Fatalf("invalid polyfill of %s: %q %v", name, pkg, ok)
+		}
+	}
+
+	// the config is encoded in the build args
+	prefix := encodeBuildArgsPrefix(newTestBuildTask("es2022").Args, Pkg{Name: "foo"}, false)
+	if args, err := decodeBuildArgsPrefix(prefix); prefix == "" || err != nil || args.nodePolyfills != nil {
+		t.Fatalf("invalid build args prefix %q: %v", prefix, err)
+	}
+	cfg.NodePolyfills["fs"] = ""
+	if p := encodeBuildArgsPrefix(newTestBuildTask("es2022").Args, Pkg{Name: "foo"}, false); p == prefix {
+		t.Fatal("the build args prefix should be changed with the config")
+	}
+
+	// the node builtin modules are not polyfilled for the server targets
+	task = newTestBuildTask("denonext")
+	task.Args.nodePolyfills = map[string]string{}
+	if pkg, ok := task.getNodePolyfill("buffer"); !ok || pkg != "" {
+		t.Fatalf("invalid polyfill of buffer for denonext: %q %v", pkg, ok)
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// the timeout of the longpoll request of the changes feed
+const changesFeedTimeout = 30 * time.Second
+
+// changesFeedResponse defines the response of the CouchDB `_changes` feed
+type changesFeedResponse struct {
+	Results []struct {
+		ID      string          `json:"id"`
+		Seq     json.RawMessage `json:"seq"`
+		Deleted bool            `json:"deleted"`
+	} `json:"results"`
+	LastSeq json.RawMessage `json:"last_seq"`
+}
+
+// followChangesFeed follows the CouchDB `_changes` feed of the registry (e.g. `https://replicate.npmjs.com/_changes`)
+// and invalidates the cached metadata of the changed packages, so the new published versions are picked up
+// without waiting for the cache ttl. It returns when the context is canceled.
+func followChangesFeed(ctx context.Context, feedURL string) {
+	client := &http.Client{
+		Timeout:   changesFeedTimeout + 30*time.Second,
+		Transport: &http.Transport{Proxy: proxyFromConfig},
+	}
+	since := "now"
+	backoff := time.Second
+	for {
+		next, err := pollChangesFeed(ctx, client, feedURL, since)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Warnf("changes feed: %v, retry in %v", err, backoff)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = time.Second
+		since = next
+	}
+}
+
+// pollChangesFeed requests the changes since the sequence, and returns the last sequence of the changes.
+func pollChangesFeed(ctx context.Context, client *http.Client, feedURL string, since string) (lastSeq string, err error) {
+	u, err := url.Parse(feedURL)
+	if err != nil {
+		return
+	}
+	q := u.Query()
+	q.Set("feed", "longpoll")
+	q.Set("since", since)
+	q.Set("timeout", fmt.Sprintf("%d", changesFeedTimeout.Milliseconds()))
+	q.Set("limit", "1000")
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var ret changesFeedResponse
+	err = json.NewDecoder(resp.Body).Decode(&ret)
+	if err != nil {
+		return
+	}
+	for _, change := range ret.Results {
+		if change.ID == "" || strings.HasPrefix(change.ID, "_design/") {
+			continue
+		}
+		// the exact versions are immutable unless the package is unpublished
+		if change.Deleted {
+			err = InvalidatePackageWithVersions(change.ID)
+		} else {
+			err = InvalidatePackage(change.ID)
+		}
+		if err != nil {
+			log.Errorf("changes feed: invalidate %s: %v", change.ID, err)
+		}
+	}
+	lastSeq = parseChangesSeq(ret.LastSeq)
+	if lastSeq == "" {
+		// keep the sequence if the feed returns nothing
+		lastSeq = since
+	}
+	return lastSeq, nil
+}
+
+// parseChangesSeq parses the sequence of the changes feed, it's a number (CouchDB 1.x) or a string (CouchDB 2.x+).
+func parseChangesSeq(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	var n json.Number
+	if json.Unmarshal(raw, &n) == nil {
+		return n.String()
+	}
+	return ""
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestChangesFeed(t *testing.T) {
+	var requests int32
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte(`{"dist-tags":{"latest":"1.0.0"},"versions":{"1.0.0":{"name":"foo","version":"1.0.0"}}}`))
+	})
+
+	var published int32
+	var lock sync.Mutex
+	var sinces []string
+	feed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("feed") != "longpoll" {
+			t.Errorf("unexpected feed %q", q.Get("feed"))
+		}
+		lock.Lock()
+		sinces = append(sinces, q.Get("since"))
+		lock.Unlock()
+		if q.Get("since") == "now" {
+			w.Write([]byte(`{"results":[],"last_seq":"1-abc"}`))
+			return
+		}
+		if atomic.LoadInt32(&published) == 1 && q.Get("since") == "1-abc" {
+			w.Write([]byte(`{"results":[{"seq":"2-abc","id":"foo","changes":[{"rev":"2-x"}]},{"seq":"3-abc","id":"_design/app"}],"last_seq":"2-abc"}`))
+			return
+		}
+		// the long poll times out without changes
+		select {
+		case <-r.Context().Done():
+		case <-time.After(50 * time.Millisecond):
+		}
+		w.Write([]byte(`{"results":[],"last_seq":"` + q.Get("since") + `"}`))
+	}))
+	defer feed.Close()
+
+	if _, err := fetchPackageInfo("foo", "latest"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		followChangesFeed(ctx, feed.URL+"/_changes")
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// the cached metadata is kept until the package is published
+	time.Sleep(100 * time.Millisecond)
+	if _, err := fetchPackageInfo("foo", "latest"); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("expected 1 registry request, got %d", n)
+	}
+
+	atomic.StoreInt32(&published, 1)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := cache.Get("npm:foo@latest"); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the cached metadata should be invalidated by the changes feed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := fetchPackageInfo("foo", "latest"); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Fatalf("expected 2 registry requests, got %d", n)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if sinces[0] != "now" || sinces[1] != "1-abc" {
+		t.Fatalf("invalid sequences %v", sinces)
+	}
+}
@@ -46,12 +46,9 @@ func initCJSLexerWorkDirectory() (err error) {
 	}
 
 	// install services
-	cmd := exec.Command("pnpm", "i", "enhanced-resolve@5.16.0", "esm-cjs-lexer@0.10.0")
-	cmd.Dir = wd
-	var output []byte
-	output, err = cmd.CombinedOutput()
+	err = installPackages(context.Background(), wd, "enhanced-resolve@5.16.0", "esm-cjs-lexer@0.10.0")
 	if err != nil {
-		err = fmt.Errorf("install services: %v %s", err, string(output))
+		err = fmt.Errorf("install services: %v", err)
 		return
 	}
 
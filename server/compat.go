@@ -1,6 +1,7 @@
 package server
 
 import (
+	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
@@ -27,6 +28,10 @@ var targets = map[string]api.Target{
 	"deno":     api.ESNext,
 	"denonext": api.ESNext,
 	"node":     api.ESNext,
+	"bun":      api.ESNext,
+	// the electron renderer process and main process
+	"electron":      api.ESNext,
+	"electron-main": api.ESNext,
 }
 
 var browsers = map[string]api.EngineName{
@@ -38,6 +43,108 @@ var browsers = map[string]api.EngineName{
 	"safari":  api.EngineSafari,
 }
 
+// the engines of the esbuild `--target` option, e.g. `chrome109`
+var esbuildEngines = map[string]api.EngineName{
+	"chrome":  api.EngineChrome,
+	"deno":    api.EngineDeno,
+	"edge":    api.EngineEdge,
+	"firefox": api.EngineFirefox,
+	"hermes":  api.EngineHermes,
+	"ie":      api.EngineIE,
+	"ios":     api.EngineIOS,
+	"node":    api.EngineNode,
+	"opera":   api.EngineOpera,
+	"rhino":   api.EngineRhino,
+	"safari":  api.EngineSafari,
+}
+
+var (
+	regexpCustomTargetName = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+	regexpEngineVersion    = regexp.MustCompile(`^([a-z]+)(\d+(?:\.\d+){0,2})$`)
+)
+
+// the esbuild engines of the custom build targets defined by `cfg.Targets`
+var customTargetEngines = map[string][]api.Engine{}
+
+// the names of the route prefixes and the build path segments that can't be used as custom targets
+var reservedTargetNames = map[string]bool{
+	"build":        true,
+	"dist":         true,
+	"embed":        true,
+	"error":        true,
+	"esma-target":  true,
+	"favicon":      true,
+	"gh":           true,
+	"jsr":          true,
+	"lib":          true,
+	"node":         true,
+	"node_modules": true,
+	"pr":           true,
+	"raw":          true,
+	"readyz":       true,
+	"server":       true,
+	"src":          true,
+	"status":       true,
+	"tgz":          true,
+	"transform":    true,
+	"types":        true,
+	"x":            true,
+}
+
+// parseEsbuildTarget parses the value of the esbuild `--target` option, e.g. "es2020,chrome109,safari15.6"
+func parseEsbuildTarget(value string) (target api.Target, engines []api.Engine, err error) {
+	target = api.ESNext
+	for _, part := range strings.Split(value, ",") {
+		part = strings.ToLower(strings.TrimSpace(part))
+		// the `es5` target is down-leveled by swc, which is not applied to the custom targets
+		if t, ok := targets[part]; ok && strings.HasPrefix(part, "es") && part != "es5" {
+			target = t
+			continue
+		}
+		m := regexpEngineVersion.FindStringSubmatch(part)
+		if m == nil {
+			return 0, nil, fmt.Errorf("invalid target '%s'", part)
+		}
+		name, ok := esbuildEngines[m[1]]
+		if !ok {
+			return 0, nil, fmt.Errorf("unknown engine '%s'", m[1])
+		}
+		engines = append(engines, api.Engine{Name: name, Version: m[2]})
+	}
+	return
+}
+
+// registerES5Target registers the `es5` target, it's built as ES2015 by esbuild, then the output
+// is down-leveled by swc.
+func registerES5Target() {
+	targets["es5"] = api.ES2015
+}
+
+// registerCustomTargets registers the custom build targets defined by the deployment,
+// e.g. `{"modern": "chrome109,safari15"}`, the builds of the custom target are stored in `/<name>/`.
+func registerCustomTargets(defs map[string]string) error {
+	for name, value := range defs {
+		if !regexpCustomTargetName.MatchString(name) {
+			return fmt.Errorf("invalid target name '%s'", name)
+		}
+		if _, ok := targets[name]; ok || reservedTargetNames[name] {
+			return fmt.Errorf("target '%s' is reserved", name)
+		}
+		target, engines, err := parseEsbuildTarget(value)
+		if err != nil {
+			return fmt.Errorf("target '%s': %v", name, err)
+		}
+		// check the engines by esbuild
+		ret := api.Transform("", api.TransformOptions{Target: target, Engines: engines})
+		if len(ret.Errors) > 0 {
+			return fmt.Errorf("target '%s': %s", name, ret.Errors[0].Text)
+		}
+		targets[name] = target
+		customTargetEngines[name] = engines
+	}
+	return nil
+}
+
 var jsFeatures = []compat.JSFeature{
 	compat.ArbitraryModuleNamespaceNames,
 	compat.ArraySpread,
@@ -196,7 +303,13 @@ func getBuildTargetByUA(ua string) string {
 		}
 		return "denonext"
 	}
-	if ua == "undici" || strings.HasPrefix(ua, "Node/") || strings.HasPrefix(ua, "Bun/") {
+	if strings.HasPrefix(ua, "Bun/") {
+		return "bun"
+	}
+	if strings.Contains(ua, " Electron/") {
+		return "electron"
+	}
+	if ua == "undici" || strings.HasPrefix(ua, "Node/") {
 		return "node"
 	}
 	name, version := getBrowserInfo(ua)
@@ -10,31 +10,81 @@ import (
 	"runtime"
 	"strings"
 
+	"github.com/Masterminds/semver/v3"
 	"github.com/ije/gox/utils"
 )
 
 type Config struct {
-	Port               uint16    `json:"port,omitempty"`
-	TlsPort            uint16    `json:"tlsPort,omitempty"`
-	WorkDir            string    `json:"workDir,omitempty"`
-	CdnBasePath        string    `json:"cdnBasePath,omitempty"`
-	CdnOrigin          string    `json:"cdnOrigin,omitempty"`
-	AuthSecret         string    `json:"authSecret,omitempty"`
-	AllowList          AllowList `json:"allowList,omitempty"`
-	BanList            BanList   `json:"banList,omitempty"`
-	DisableCompression bool      `json:"disableCompression,omitempty"`
-	BuildConcurrency   uint16    `json:"buildConcurrency,omitempty"`
-	BuildWaitTimeout   uint16    `json:"buildWaitTimeout,omitempty"`
-	Cache              string    `json:"cache,omitempty"`
-	Storage            string    `json:"storage,omitempty"`
-	Database           string    `json:"database,omitempty"`
-	LogDir             string    `json:"logDir,omitempty"`
-	LogLevel           string    `json:"logLevel,omitempty"`
-	NpmPassword        string    `json:"npmPassword,omitempty"`
-	NpmRegistry        string    `json:"npmRegistry,omitempty"`
-	NpmRegistryScope   string    `json:"npmRegistryScope,omitempty"`
-	NpmToken           string    `json:"npmToken,omitempty"`
-	NpmUser            string    `json:"npmUser,omitempty"`
+	Port                        uint16            `json:"port,omitempty"`
+	TlsPort                     uint16            `json:"tlsPort,omitempty"`
+	WorkDir                     string            `json:"workDir,omitempty"`
+	CdnBasePath                 string            `json:"cdnBasePath,omitempty"`
+	CdnOrigin                   string            `json:"cdnOrigin,omitempty"`
+	AuthSecret                  string            `json:"authSecret,omitempty"`
+	AllowList                   AllowList         `json:"allowList,omitempty"`
+	BanList                     BanList           `json:"banList,omitempty"`
+	DisableCompression          bool              `json:"disableCompression,omitempty"`
+	FallbackDistTags            []string          `json:"fallbackDistTags,omitempty"`
+	FrozenLockfile              bool              `json:"frozenLockfile,omitempty"`
+	Installer                   string            `json:"installer,omitempty"`
+	NativeInstall               bool              `json:"nativeInstall,omitempty"`
+	PackageStore                bool              `json:"packageStore,omitempty"`
+	NativeJsr                   bool              `json:"nativeJsr,omitempty"`
+	BuildConcurrency            uint16            `json:"buildConcurrency,omitempty"`
+	BuildWaitTimeout            uint16            `json:"buildWaitTimeout,omitempty"`
+	InstallConcurrency          uint16            `json:"installConcurrency,omitempty"`
+	InstallTimeout              int               `json:"installTimeout,omitempty"`
+	Cache                       string            `json:"cache,omitempty"`
+	CacheReplica                string            `json:"cacheReplica,omitempty"`
+	CacheReplicaFillTTL         int               `json:"cacheReplicaFillTTL,omitempty"`
+	CacheTTLJitter              int               `json:"cacheTTLJitter,omitempty"`
+	NotFoundCacheTTL            int               `json:"notFoundCacheTTL,omitempty"`
+	DistTagCacheTTL             map[string]int    `json:"distTagCacheTTL,omitempty"`
+	StaleCacheTTL               int               `json:"staleCacheTTL,omitempty"`
+	Storage                     string            `json:"storage,omitempty"`
+	Database                    string            `json:"database,omitempty"`
+	LogDir                      string            `json:"logDir,omitempty"`
+	LogLevel                    string            `json:"logLevel,omitempty"`
+	MaxPackumentBytes           int64             `json:"maxPackumentBytes,omitempty"`
+	NpmDiskQuota                int64             `json:"npmDiskQuota,omitempty"`
+	MinVersions                 map[string]string `json:"minVersions,omitempty"`
+	NodeVersion                 string            `json:"nodeVersion,omitempty"`
+	NpmPassword                 string            `json:"npmPassword,omitempty"`
+	NpmRegistry                 string            `json:"npmRegistry,omitempty"`
+	NpmRegistryMirrors          []string          `json:"npmRegistryMirrors,omitempty"`
+	NpmRegistryScope            string            `json:"npmRegistryScope,omitempty"`
+	NpmScopes                   NpmScopes         `json:"npmScopes,omitempty"`
+	NpmToken                    string            `json:"npmToken,omitempty"`
+	NpmUser                     string            `json:"npmUser,omitempty"`
+	GithubToken                 string            `json:"githubToken,omitempty"`
+	GitlabToken                 string            `json:"gitlabToken,omitempty"`
+	Overrides                   Overrides         `json:"overrides,omitempty"`
+	PnpmBinary                  string            `json:"pnpmBinary,omitempty"`
+	PnpmArgs                    []string          `json:"pnpmArgs,omitempty"`
+	PnpmNodeLinker              string            `json:"pnpmNodeLinker,omitempty"`
+	Proxy                       string            `json:"proxy,omitempty"`
+	NoProxy                     string            `json:"noProxy,omitempty"`
+	RegistryMaxIdleConnsPerHost uint16            `json:"registryMaxIdleConnsPerHost,omitempty"`
+	RegistryIdleConnTimeout     uint16            `json:"registryIdleConnTimeout,omitempty"`
+	RegistryKeepAlive           uint16            `json:"registryKeepAlive,omitempty"`
+	RegistryBreakerThreshold    uint16            `json:"registryBreakerThreshold,omitempty"`
+	RegistryBreakerCooldown     uint16            `json:"registryBreakerCooldown,omitempty"`
+	RegistryMaxConcurrency      uint16            `json:"registryMaxConcurrency,omitempty"`
+	RegistryRetryMaxWait        uint16            `json:"registryRetryMaxWait,omitempty"`
+	SelfTestPackage             string            `json:"selfTestPackage,omitempty"`
+	ChangesFeed                 string            `json:"changesFeed,omitempty"`
+	PatchesDir                  string            `json:"patchesDir,omitempty"`
+	Preload                     []string          `json:"preload,omitempty"`
+	Targets                     map[string]string `json:"targets,omitempty"`
+	JsxImportSource             string            `json:"jsxImportSource,omitempty"`
+	NodePolyfills               map[string]string `json:"nodePolyfills,omitempty"`
+	Es5Transform                bool              `json:"es5Transform,omitempty"`
+	TypesRegistry               string            `json:"typesRegistry,omitempty"`
+	TypesRegistryToken          string            `json:"typesRegistryToken,omitempty"`
+	VersionCooldown             uint16            `json:"versionCooldown,omitempty"`
+	// WorkDirFor returns the install directory of the package by its version name (e.g. `react@18.2.0`
+	// or `gh/owner/repo@sha`), default is `$WorkDir/npm/$VersionName`. It can only be set programmatically.
+	WorkDirFor func(pkgVersionName string) string `json:"-"`
 }
 
 type BanList struct {
@@ -56,6 +106,98 @@ type AllowScope struct {
 	Name string `json:"name"`
 }
 
+// NpmScopes is the registries and the credentials of the scoped packages, keyed by the scope (e.g. `@my-scope`).
+type NpmScopes map[string]NpmScope
+
+type NpmScope struct {
+	// Registry is the registry of the scope, default is the `npmRegistry`.
+	Registry string `json:"registry,omitempty"`
+	Token    string `json:"token,omitempty"`
+	User     string `json:"user,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// Overrides is the npm-style `overrides` map of the dependencies, the value is either a version
+// that applies everywhere, or a nested map that applies only to the dependencies of the package.
+type Overrides map[string]Override
+
+type Override struct {
+	// Version overrides the version of the package itself, it is the `.` key of a nested map.
+	Version string
+	// Deps overrides the versions of the dependencies of the package.
+	Deps Overrides
+}
+
+func (o *Override) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &o.Version)
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	for key, raw := range m {
+		if key == "." {
+			if err := json.Unmarshal(raw, &o.Version); err != nil {
+				return err
+			}
+			continue
+		}
+		var ov Override
+		if err := json.Unmarshal(raw, &ov); err != nil {
+			return err
+		}
+		if o.Deps == nil {
+			o.Deps = Overrides{}
+		}
+		o.Deps[key] = ov
+	}
+	return nil
+}
+
+func (o Override) MarshalJSON() ([]byte, error) {
+	if len(o.Deps) == 0 {
+		return json.Marshal(o.Version)
+	}
+	m := make(map[string]Override, len(o.Deps)+1)
+	for key, ov := range o.Deps {
+		m[key] = ov
+	}
+	if o.Version != "" {
+		m["."] = Override{Version: o.Version}
+	}
+	return json.Marshal(m)
+}
+
+// Match returns the overridden version of the package `name` that is a dependency of the
+// `parents` chain (from the outermost parent to the direct parent).
+// Top-level overrides apply everywhere, a nested override applies only under its parent,
+// and the override scoped to the closer parent wins.
+func (o Overrides) Match(parents []string, name string) (version string, ok bool) {
+	if ov, found := o[name]; found && ov.Version != "" {
+		version, ok = ov.Version, true
+	}
+	for i, parent := range parents {
+		if ov, found := o[parent]; found && len(ov.Deps) > 0 {
+			if v, matched := ov.Deps.Match(parents[i+1:], name); matched {
+				version, ok = v, true
+			}
+		}
+	}
+	return
+}
+
+// HasScope returns true if the package `name` has nested overrides at any level, i.e. it matters
+// in the `parents` chain of the Match method.
+func (o Overrides) HasScope(name string) bool {
+	for key, ov := range o {
+		if len(ov.Deps) > 0 && (key == name || ov.Deps.HasScope(name)) {
+			return true
+		}
+	}
+	return false
+}
+
 // Load loads config from the given file. Panic if failed to load.
 func Load(filename string) (*Config, error) {
 	var (
@@ -149,12 +291,40 @@ func fixConfig(c *Config) *Config {
 	if c.BuildConcurrency == 0 {
 		c.BuildConcurrency = uint16(runtime.NumCPU())
 	}
+	if c.InstallConcurrency == 0 {
+		c.InstallConcurrency = 8
+	}
+	if c.InstallTimeout == 0 {
+		c.InstallTimeout = 5 * 60 // 5 minutes
+	}
 	if c.BuildWaitTimeout == 0 {
 		c.BuildWaitTimeout = 30 // seconds
 	}
 	if c.Cache == "" {
 		c.Cache = "memory:default"
 	}
+	if c.CacheTTLJitter == 0 {
+		c.CacheTTLJitter = 10 // percent
+	}
+	if c.NotFoundCacheTTL == 0 {
+		c.NotFoundCacheTTL = 60 // seconds
+	}
+	if c.CacheReplicaFillTTL == 0 {
+		c.CacheReplicaFillTTL = 60 // seconds
+	}
+	if c.StaleCacheTTL == 0 {
+		c.StaleCacheTTL = 7 * 24 * 60 * 60 // 7 days
+	}
+	if c.NodeVersion != "" {
+		if _, e := semver.NewVersion(c.NodeVersion); e != nil {
+			panic("invalid node version: " + c.NodeVersion)
+		}
+	}
+	for tag, ttl := range c.DistTagCacheTTL {
+		if ttl <= 0 {
+			panic(fmt.Sprintf("invalid cache ttl of dist-tag '%s': %d", tag, ttl))
+		}
+	}
 	if c.Database == "" {
 		c.Database = fmt.Sprintf("bolt:%s", path.Join(c.WorkDir, "esm.db"))
 	}
@@ -167,6 +337,29 @@ func fixConfig(c *Config) *Config {
 	if c.LogLevel == "" {
 		c.LogLevel = "info"
 	}
+	if c.Installer == "" {
+		c.Installer = "pnpm"
+	} else if c.Installer != "pnpm" && c.Installer != "npm" && c.Installer != "yarn" && c.Installer != "bun" {
+		panic("invalid installer: " + c.Installer)
+	}
+	if c.PnpmNodeLinker != "" && c.PnpmNodeLinker != "isolated" && c.PnpmNodeLinker != "hoisted" && c.PnpmNodeLinker != "pnp" {
+		panic("invalid pnpm node-linker: " + c.PnpmNodeLinker)
+	}
+	if c.Proxy != "" {
+		u, e := url.Parse(c.Proxy)
+		if e != nil {
+			panic("invalid proxy url: " + e.Error())
+		}
+		if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5" {
+			panic("invalid proxy url: unsupported scheme " + u.Scheme)
+		}
+	}
+	if c.NpmDiskQuota < 0 {
+		panic("invalid npmDiskQuota: must be a positive number")
+	}
+	if c.MaxPackumentBytes == 0 {
+		c.MaxPackumentBytes = 50 * 1024 * 1024 // 50MB
+	}
 	if c.NpmRegistry != "" {
 		_, e := url.Parse(c.NpmRegistry)
 		if e != nil {
@@ -181,6 +374,41 @@ func fixConfig(c *Config) *Config {
 			}
 		}
 	}
+	for i, mirror := range c.NpmRegistryMirrors {
+		_, e := url.Parse(mirror)
+		if e != nil {
+			panic("invalid npm registry mirror url: " + e.Error())
+		}
+		c.NpmRegistryMirrors[i] = strings.TrimRight(mirror, "/") + "/"
+	}
+	for _, rule := range append(append([]string{}, c.BanList.Packages...), c.AllowList.Packages...) {
+		if e := validatePackageRule(rule); e != nil {
+			panic(fmt.Sprintf("invalid package rule '%s': %v", rule, e))
+		}
+	}
+	for _, scope := range c.BanList.Scopes {
+		if _, e := path.Match(scope.Name, ""); e != nil {
+			panic("invalid ban scope: " + scope.Name)
+		}
+	}
+	for _, scope := range c.AllowList.Scopes {
+		if _, e := path.Match(scope.Name, ""); e != nil {
+			panic("invalid allow scope: " + scope.Name)
+		}
+	}
+	for scope, s := range c.NpmScopes {
+		if !strings.HasPrefix(scope, "@") || strings.Contains(scope, "/") {
+			panic("invalid npm scope: " + scope)
+		}
+		if s.Registry != "" {
+			u, e := url.Parse(s.Registry)
+			if e != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				panic("invalid registry url of npm scope " + scope + ": " + s.Registry)
+			}
+			s.Registry = strings.TrimRight(s.Registry, "/") + "/"
+			c.NpmScopes[scope] = s
+		}
+	}
 	if c.NpmToken == "" {
 		c.NpmToken = os.Getenv("NPM_TOKEN")
 	}
@@ -190,9 +418,28 @@ func fixConfig(c *Config) *Config {
 	if c.NpmUser == "" {
 		c.NpmUser = os.Getenv("NPM_USER")
 	}
+	if c.GithubToken == "" {
+		c.GithubToken = os.Getenv("GITHUB_TOKEN")
+	}
+	if c.GitlabToken == "" {
+		c.GitlabToken = os.Getenv("GITLAB_TOKEN")
+	}
 	if c.NpmPassword == "" {
 		c.NpmPassword = os.Getenv("NPM_PASSWORD")
 	}
+	if c.TypesRegistry == "" {
+		c.TypesRegistry = os.Getenv("TYPES_REGISTRY")
+	}
+	if c.TypesRegistry != "" {
+		_, e := url.Parse(c.TypesRegistry)
+		if e != nil {
+			panic("invalid types registry url: " + e.Error())
+		}
+		c.TypesRegistry = strings.TrimRight(c.TypesRegistry, "/") + "/"
+	}
+	if c.TypesRegistryToken == "" {
+		c.TypesRegistryToken = os.Getenv("TYPES_REGISTRY_TOKEN")
+	}
 	return c
 }
 
@@ -220,17 +467,19 @@ func extractPackageName(packageName string) (fullNameWithoutVersion string, scop
 // IsPackageBanned Checking if the package is banned.
 // The `packages` list is the highest priority ban rule to match,
 // so the `excludes` list in the `scopes` list won't take effect if the package is banned in `packages` list
+// The rule with a version range (e.g. `lodash@<4.17.21`) only bans the exact versions in the range.
 func (banList *BanList) IsPackageBanned(fullName string) bool {
 	fullNameWithoutVersion, scope, nameWithoutVersionScope := extractPackageName(fullName)
+	_, version := splitPackageVersion(fullName)
 
 	for _, p := range banList.Packages {
-		if fullNameWithoutVersion == p {
+		if matchPackageRule(p, fullNameWithoutVersion, version, false) {
 			return true
 		}
 	}
 
 	for _, s := range banList.Scopes {
-		if scope == s.Name {
+		if matchScope(s.Name, scope) {
 			return !isPackageExcluded(nameWithoutVersionScope, s.Excludes)
 		}
 	}
@@ -241,21 +490,24 @@ func (banList *BanList) IsPackageBanned(fullName string) bool {
 // IsPackageAllowed Checking if the package is allowed.
 // The `packages` list is the highest priority allow rule to match,
 // so the `includes` list in the `scopes` list won't take effect if the package is allowed in `packages` list
+// The rule with a version range (e.g. `react@^18`) allows the unresolved versions like `latest`,
+// the exact version is checked after the resolution.
 func (allowList *AllowList) IsPackageAllowed(fullName string) bool {
 	if len(allowList.Packages) == 0 && len(allowList.Scopes) == 0 {
 		return true
 	}
 
 	fullNameWithoutVersion, scope, _ := extractPackageName(fullName)
+	_, version := splitPackageVersion(fullName)
 
 	for _, p := range allowList.Packages {
-		if fullNameWithoutVersion == p {
+		if matchPackageRule(p, fullNameWithoutVersion, version, true) {
 			return true
 		}
 	}
 
 	for _, s := range allowList.Scopes {
-		if scope == s.Name {
+		if matchScope(s.Name, scope) {
 			return true
 		}
 	}
@@ -263,6 +515,61 @@ func (allowList *AllowList) IsPackageAllowed(fullName string) bool {
 	return false
 }
 
+// splitPackageVersion splits the version of the package, e.g. `@github/faker@1.0.0/es2022/faker.mjs` -> (`@github/faker`, `1.0.0`)
+func splitPackageVersion(fullName string) (name string, version string) {
+	if i := strings.LastIndexByte(fullName, '@'); i > 0 {
+		version, _, _ = strings.Cut(fullName[i+1:], "/")
+		return fullName[:i], version
+	}
+	return fullName, ""
+}
+
+// matchPackageRule checks whether the package matches the rule of the `packages` list, the rule is a package
+// name or a glob pattern (e.g. `@github/*`) with an optional semver range (e.g. `lodash@<4.17.21`).
+// The unresolved version (e.g. a range or a dist-tag) matches the range only if `anyVersion` is true.
+func matchPackageRule(rule string, name string, version string, anyVersion bool) bool {
+	ruleName, ruleRange := splitPackageVersion(rule)
+	if ruleName != name {
+		if ok, _ := path.Match(ruleName, name); !ok {
+			return false
+		}
+	}
+	if ruleRange == "" {
+		return true
+	}
+	v, err := semver.StrictNewVersion(version)
+	if err != nil {
+		return anyVersion
+	}
+	c, err := semver.NewConstraint(ruleRange)
+	return err == nil && c.Check(v)
+}
+
+// validatePackageRule checks the glob pattern and the semver range of the rule.
+func validatePackageRule(rule string) error {
+	ruleName, ruleRange := splitPackageVersion(rule)
+	if _, err := path.Match(ruleName, ""); err != nil {
+		return err
+	}
+	if ruleRange != "" {
+		_, err := semver.NewConstraint(ruleRange)
+		return err
+	}
+	return nil
+}
+
+// matchScope checks whether the scope matches the scope name or the glob pattern, e.g. `@github-*`.
+func matchScope(pattern string, scope string) bool {
+	if scope == "" {
+		return false
+	}
+	if pattern == scope {
+		return true
+	}
+	ok, _ := path.Match(pattern, scope)
+	return ok
+}
+
 func isPackageExcluded(name string, excludes []string) bool {
 	for _, exclude := range excludes {
 		if name == exclude {
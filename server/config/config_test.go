@@ -1,6 +1,7 @@
 package config
 
 import (
+	"encoding/json"
 	"testing"
 )
 
@@ -205,6 +206,38 @@ func TestAllowList_IsPackageAllowed(t *testing.T) {
 			args: args{fullName: "@faker/perfect"},
 			want: false,
 		},
+		{
+			name: "AllowedByVersionRange",
+			allowList: AllowList{
+				Packages: []string{"react@^18.0.0"},
+			},
+			args: args{fullName: "react@18.2.0"},
+			want: true,
+		},
+		{
+			name: "NotAllowedOutOfVersionRange",
+			allowList: AllowList{
+				Packages: []string{"react@^18.0.0"},
+			},
+			args: args{fullName: "react@19.0.0"},
+			want: false,
+		},
+		{
+			name: "AllowedUnresolvedVersion",
+			allowList: AllowList{
+				Packages: []string{"react@^18.0.0"},
+			},
+			args: args{fullName: "react@latest"},
+			want: true,
+		},
+		{
+			name: "AllowedByScopeGlob",
+			allowList: AllowList{
+				Scopes: []AllowScope{{Name: "@my-*"}},
+			},
+			args: args{fullName: "@my-org/perfect@1.0.0"},
+			want: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -273,6 +306,62 @@ func TestBanList_IsPackageBanned(t *testing.T) {
 			args: args{fullName: "@github/faker@1.0.0"},
 			want: true,
 		},
+		{
+			name: "BannedByVersionRange",
+			banList: BanList{
+				Packages: []string{"lodash@<4.17.21"},
+			},
+			args: args{fullName: "lodash@4.17.20"},
+			want: true,
+		},
+		{
+			name: "BannedByVersionRangeWithSubPath",
+			banList: BanList{
+				Packages: []string{"lodash@<4.17.21"},
+			},
+			args: args{fullName: "lodash@4.17.20/es2022/lodash.mjs"},
+			want: true,
+		},
+		{
+			name: "NotBannedOutOfVersionRange",
+			banList: BanList{
+				Packages: []string{"lodash@<4.17.21"},
+			},
+			args: args{fullName: "lodash@4.17.21"},
+			want: false,
+		},
+		{
+			name: "NotBannedUnresolvedVersion",
+			banList: BanList{
+				Packages: []string{"lodash@<4.17.21"},
+			},
+			args: args{fullName: "lodash@^4.0.0"},
+			want: false,
+		},
+		{
+			name: "BannedByPackageGlob",
+			banList: BanList{
+				Packages: []string{"@github/fake*"},
+			},
+			args: args{fullName: "@github/faker@1.0.0"},
+			want: true,
+		},
+		{
+			name: "BannedByScopeGlob",
+			banList: BanList{
+				Scopes: []BanScope{{Name: "@evil-*"}},
+			},
+			args: args{fullName: "@evil-corp/faker@1.0.0"},
+			want: true,
+		},
+		{
+			name: "ScopeGlobNotMatchUnscoped",
+			banList: BanList{
+				Scopes: []BanScope{{Name: "*"}},
+			},
+			args: args{fullName: "faker@1.0.0"},
+			want: false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -282,3 +371,52 @@ func TestBanList_IsPackageBanned(t *testing.T) {
 		})
 	}
 }
+
+func TestOverrides(t *testing.T) {
+	var c Config
+	err := json.Unmarshal([]byte(`{
+		"overrides": {
+			"bar": "1.0.0",
+			"foo": {
+				".": "2.0.0",
+				"bar": "1.2.3",
+				"baz": {
+					"bar": "1.3.0"
+				}
+			}
+		}
+	}`), &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		parents []string
+		name    string
+		version string
+	}{
+		{nil, "bar", "1.0.0"},
+		{[]string{"qux"}, "bar", "1.0.0"},
+		{[]string{"foo"}, "bar", "1.2.3"},
+		{[]string{"foo", "qux"}, "bar", "1.2.3"},
+		{[]string{"foo", "baz"}, "bar", "1.3.0"},
+		{[]string{"baz"}, "bar", "1.0.0"},
+		{nil, "foo", "2.0.0"},
+		{[]string{"qux"}, "baz", ""},
+	}
+	for _, tt := range tests {
+		version, ok := c.Overrides.Match(tt.parents, tt.name)
+		if version != tt.version || ok != (tt.version != "") {
+			t.Errorf("Match(%v, %s) = %q, should be %q", tt.parents, tt.name, version, tt.version)
+		}
+	}
+	// overrides are retained after re-encoding
+	var c2 Config
+	data, _ := json.Marshal(c)
+	if err := json.Unmarshal(data, &c2); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c2.Overrides.Match([]string{"foo", "baz"}, "bar"); v != "1.3.0" || c2.Overrides["foo"].Version != "2.0.0" {
+		t.Errorf("invalid overrides after re-encoding: %s", data)
+	}
+}
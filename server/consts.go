@@ -30,6 +30,7 @@ var assetExts = map[string]bool{
 	"yaml":       true,
 	"pdf":        true,
 	"txt":        true,
+	"data":       true,
 	"glsl":       true,
 	"frag":       true,
 	"vert":       true,
@@ -245,7 +245,9 @@ func (task *BuildTask) transformDTS(dts string, aliasDepsPrefix string, marker *
 				}
 				res = strings.TrimPrefix(typesPath, info.Name+"@"+info.Version+"/")
 			} else {
-				if subpath != "" {
+				if subpath != "" && info.Name == "@types/node" {
+					res = resolveNodeTypes(resolveDir, subpath)
+				} else if subpath != "" {
 					res = subpath
 				} else if info.Types != "" {
 					res = utils.CleanPath(info.Types)[1:]
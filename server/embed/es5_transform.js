@@ -0,0 +1,39 @@
+const { transformSync } = require("@swc/core");
+
+function transformES5({ code, minify }) {
+  const ret = transformSync(code, {
+    filename: "module.mjs",
+    isModule: true,
+    sourceMaps: false,
+    minify: !!minify,
+    jsc: {
+      target: "es5",
+      parser: { syntax: "ecmascript" },
+      minify: minify ? { compress: true, mangle: true } : undefined,
+    },
+  });
+  return { code: ret.code };
+}
+
+function readStdin() {
+  return new Promise((resolve) => {
+    let buf = "";
+    process.stdin.setEncoding("utf8");
+    process.stdin.on("data", (chunk) => (buf += chunk));
+    process.stdin.on("end", () => resolve(buf));
+  });
+}
+
+async function main() {
+  try {
+    const input = JSON.parse(await readStdin());
+    process.stdout.write(JSON.stringify(transformES5(input)));
+  } catch (err) {
+    process.stdout.write(
+      JSON.stringify({ error: err.message, stack: err.stack }),
+    );
+  }
+  process.exit(0);
+}
+
+main();
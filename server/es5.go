@@ -0,0 +1,86 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"time"
+)
+
+const swcVersion = "1.7.26"
+
+// initES5TransformerWorkDirectory installs the swc transformer that down-levels the build output of the `es5`
+// target, since esbuild can't emit ES5 code.
+func initES5TransformerWorkDirectory() (err error) {
+	wd := path.Join(cfg.WorkDir, "es5")
+	err = ensureDir(wd)
+	if err != nil {
+		return err
+	}
+
+	err = installPackages(context.Background(), wd, "@swc/core@"+swcVersion)
+	if err != nil {
+		err = fmt.Errorf("install swc: %v", err)
+		return
+	}
+
+	js, err := embedFS.ReadFile("server/embed/es5_transform.js")
+	if err != nil {
+		panic(err)
+	}
+	err = os.WriteFile(path.Join(wd, "es5_transform.js"), js, 0644)
+	return
+}
+
+type es5TransformResult struct {
+	Code  string `json:"code"`
+	Error string `json:"error"`
+	Stack string `json:"stack"`
+}
+
+// transformES5 down-levels the ES2015 code to ES5 with swc, the import/export statements are kept.
+func transformES5(code []byte, minify bool) (ret []byte, err error) {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	var outBuf bytes.Buffer
+	var errBuf bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, "node", "es5_transform.js")
+	cmd.Dir = path.Join(cfg.WorkDir, "es5")
+	cmd.Stdin = bytes.NewBuffer(mustEncodeJSON(map[string]interface{}{
+		"code":   string(code),
+		"minify": minify,
+	}))
+	cmd.Stdout = &outBuf
+	cmd.Stderr = &errBuf
+
+	err = cmd.Run()
+	if err != nil {
+		if errBuf.Len() > 0 {
+			err = fmt.Errorf("es5Transform: %s", errBuf.String())
+		}
+		return
+	}
+
+	var r es5TransformResult
+	err = json.Unmarshal(outBuf.Bytes(), &r)
+	if err != nil {
+		return
+	}
+	if r.Error != "" {
+		if r.Stack != "" {
+			log.Errorf("[es5Transform] %s\n---\n%s\n---", r.Error, r.Stack)
+		}
+		return nil, errors.New("es5Transform: " + r.Error)
+	}
+
+	log.Debugf("[es5Transform] transform %d bytes in %s", len(code), time.Since(start))
+	return []byte(r.Code), nil
+}
@@ -2,11 +2,14 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
@@ -161,14 +164,15 @@ func esmHandler() rex.Handle {
 				t, ok := el.Value.(*queueTask)
 				if ok {
 					m := map[string]interface{}{
-						"bundle":    t.Bundle,
-						"clients":   t.clients,
-						"createdAt": t.createdAt.Format(http.TimeFormat),
-						"dev":       t.Dev,
-						"inProcess": t.inProcess,
-						"pkg":       t.Pkg.String(),
-						"stage":     t.stage,
-						"target":    t.Target,
+						"bundle":     t.Bundle,
+						"standalone": t.Standalone,
+						"clients":    t.clients,
+						"createdAt":  t.createdAt.Format(http.TimeFormat),
+						"dev":        t.Dev,
+						"inProcess":  t.inProcess,
+						"pkg":        t.Pkg.String(),
+						"stage":      t.stage,
+						"target":     t.Target,
 					}
 					if !t.startedAt.IsZero() {
 						m["startedAt"] = t.startedAt.Format(http.TimeFormat)
@@ -184,10 +188,26 @@ func esmHandler() rex.Handle {
 
 			header.Set("Cache-Control", ccMustRevalidate)
 			return map[string]interface{}{
-				"buildQueue": q[:i],
-				"version":    VERSION,
-				"uptime":     time.Since(startTime).String(),
+				"buildQueue":       q[:i],
+				"registryBreakers": getRegistryBreakersStatus(),
+				"locks": map[string]int{
+					"fetch":   fetchLocks.Len(),
+					"install": installLocks.Len(),
+				},
+				"npmWorkDir":   workDirs.status(),
+				"installQueue": installSemaphore.Status(),
+				"version":      VERSION,
+				"uptime":       time.Since(startTime).String(),
+			}
+
+		case "/readyz":
+			c, cancel := context.WithTimeout(ctx.R.Context(), 10*time.Second)
+			defer cancel()
+			header.Set("Cache-Control", ccMustRevalidate)
+			if err := SelfTest(c); err != nil {
+				return rex.Status(503, err.Error())
 			}
+			return "ok"
 
 		case "/esma-target":
 			header.Set("Cache-Control", ccMustRevalidate)
@@ -238,6 +258,17 @@ func esmHandler() rex.Handle {
 			return rex.Content("favicon.ico", startTime, bytes.NewReader(favicon))
 		}
 
+		// the status of the package, e.g. `/status/react@18.2.0?target=es2022`
+		if strings.HasPrefix(pathname, "/status/") && strings.ContainsRune(strings.TrimPrefix(pathname, "/status/@"), '@') {
+			pkg, _, err := validatePkgPath(strings.TrimPrefix(pathname, "/status"))
+			if err != nil {
+				return rex.Status(getErrorStatus(err), err.Error())
+			}
+			target, _ := getBuildTarget(ctx.R, ctx.Form.Value("target"))
+			header.Set("Cache-Control", ccMustRevalidate)
+			return getPackageStatus(pkg, target)
+		}
+
 		// strip loc suffix
 		if strings.ContainsRune(pathname, ':') {
 			pathname = regexpLocPath.ReplaceAllString(pathname, "$1")
@@ -301,12 +332,8 @@ func esmHandler() rex.Handle {
 				return rex.Status(http.StatusNotModified, "")
 			}
 
-			// determine build target by `?target` query or `User-Agent` header
-			target := strings.ToLower(ctx.Form.Value("target"))
-			targetViaUA := targets[target] == 0
-			if targetViaUA {
-				target = getBuildTargetByUA(userAgent)
-			}
+			// determine build target by `?target` query, `X-Esm-Target`/`Accept` header or `User-Agent` header
+			target, targetVary := getBuildTarget(ctx.R, ctx.Form.Value("target"))
 			if target == "deno" || target == "denonext" {
 				header.Set("Content-Type", ctTypescript)
 			} else {
@@ -317,8 +344,8 @@ func esmHandler() rex.Handle {
 				data = code
 				header.Set("Content-Type", ctJavascript)
 			}
-			if targetViaUA {
-				addVary(header, "User-Agent")
+			if targetVary != "" {
+				addVary(header, targetVary)
 			}
 			if ctx.Form.Value("v") != "" {
 				header.Set("Cache-Control", ccImmutable)
@@ -429,25 +456,44 @@ func esmHandler() rex.Handle {
 		} else if strings.HasPrefix(pathname, "/gh/*") {
 			external.Add("*")
 			pathname = "/gh/" + pathname[5:]
+		} else if strings.HasPrefix(pathname, "/tgz/") {
+			// the path is unescaped and cleaned by the router, use the raw path to keep the escaped tarball url
+			pathname = strings.TrimPrefix(ctx.R.URL.EscapedPath(), cfg.CdnBasePath)
+		}
+
+		// bypass the cached package info of the ranges and dist-tags by the `?fresh` query, e.g. to resolve
+		// the version just published, the exact versions and the build files are never refreshed
+		if ctx.Form.Has("fresh") && !strings.HasPrefix(pathname, "/gh/") && !strings.HasPrefix(pathname, "/tgz/") {
+			specifier := pathname
+			if strings.HasPrefix(specifier, "/jsr/@") {
+				specifier = "jsr:" + specifier[5:]
+			}
+			name, version, subPath := splitPkgPath(specifier)
+			if validatePackageName(name) && !regexpFullVersion.MatchString(version) && !isNonRegistryVersion(version) && !hasTargetSegment(subPath) {
+				err := refreshPackageInfo(name)
+				if err != nil {
+					log.Error("refresh package info:", err)
+				}
+			}
 		}
 
 		// get package info
 		reqPkg, extraQuery, err := validatePkgPath(pathname)
 		if err != nil {
-			status := 500
+			if errors.Is(err, ErrPackageForbidden) {
+				return forbiddenJS(ctx, err.Error())
+			}
+			status := getErrorStatus(err)
 			message := err.Error()
 			if message == "invalid path" {
 				status = 400
-			} else if strings.HasSuffix(message, "not found") {
-				status = 404
 			}
 			return rex.Status(status, message)
 		}
 
-		pkgAllowed := cfg.AllowList.IsPackageAllowed(reqPkg.Name)
-		pkgBanned := cfg.BanList.IsPackageBanned(reqPkg.Name)
-		if !pkgAllowed || pkgBanned {
-			return rex.Status(403, "forbidden")
+		err = checkPackagePolicy(reqPkg.Name, reqPkg.Version)
+		if err != nil {
+			return forbiddenJS(ctx, err.Error())
 		}
 
 		pathHasTargetSegment := hasTargetSegment(reqPkg.SubPath)
@@ -455,9 +501,10 @@ func esmHandler() rex.Handle {
 		// fix urls related to `import.meta.url`
 		if pathHasTargetSegment && endsWith(reqPkg.SubPath, ".wasm", ".json") {
 			extname := path.Ext(reqPkg.SubPath)
-			dir := path.Join(cfg.WorkDir, "npm", reqPkg.Name+"@"+reqPkg.Version)
+			dir := getWorkDir(reqPkg)
+			defer workDirs.use(dir)()
 			if !existsDir(dir) {
-				err := installPackage(dir, reqPkg)
+				err := installPackage(ctx.R.Context(), dir, reqPkg)
 				if err != nil {
 					return rex.Status(500, err.Error())
 				}
@@ -513,6 +560,11 @@ func esmHandler() rex.Handle {
 					types = info.Main
 				}
 				url += "/" + types
+			} else if reqPkg.Name == "@types/node" {
+				// resolve the subpath types of `@types/node`, e.g. `@types/node/stream` -> `stream.d.ts`
+				dir := getWorkDir(reqPkg)
+				defer workDirs.use(dir)()
+				url = fmt.Sprintf("%s%s/%s/%s", cdnOrigin, cfg.CdnBasePath, reqPkg.VersionName(), resolveNodeTypes(dir, reqPkg.SubModule))
 			} else {
 				url += "~.d.ts"
 			}
@@ -525,6 +577,24 @@ func esmHandler() rex.Handle {
 			return rex.Redirect(url, http.StatusMovedPermanently)
 		}
 
+		// redirect to the stylesheet entry of the `exports` by `?css` or `?conditions=style|sass|css` query
+		if !pathHasTargetSegment && !reqPkg.FromGithub && (ctx.Form.Has("css") || ctx.Form.Has("conditions")) {
+			conditions := strings.Split(ctx.Form.Value("conditions"), ",")
+			for i, c := range conditions {
+				conditions[i] = strings.TrimSpace(c)
+			}
+			if ctx.Form.Has("css") || includes(conditions, "style") || includes(conditions, "sass") || includes(conditions, "css") {
+				info, _, err := getPackageInfo(getWorkDir(reqPkg), reqPkg.Name, reqPkg.Version)
+				if err != nil {
+					return rex.Status(getErrorStatus(err), err.Error())
+				}
+				if entry, ok := resolveStyleExports(&info, reqPkg.SubModule, conditions); ok {
+					url := fmt.Sprintf("%s%s/%s/%s", cdnOrigin, cfg.CdnBasePath, reqPkg.VersionName(), strings.TrimPrefix(entry, "./"))
+					return rex.Redirect(url, http.StatusFound)
+				}
+			}
+		}
+
 		ghPrefix := ""
 		if reqPkg.FromGithub {
 			ghPrefix = "/gh"
@@ -598,8 +668,6 @@ func esmHandler() rex.Handle {
 			case ".js", ".mjs", ".jsx", ".ts", ".mts", ".tsx":
 				if endsWith(pathname, ".d.ts", ".d.mts") {
 					reqType = "types"
-				} else if ctx.R.URL.Query().Has("raw") {
-					reqType = "raw"
 				} else if pathHasTargetSegment {
 					reqType = "builds"
 				}
@@ -626,21 +694,26 @@ func esmHandler() rex.Handle {
 					reqType = "raw"
 				}
 			}
+			// serve the file as-is without transformation with `?raw` query
+			if ctx.R.URL.Query().Has("raw") {
+				reqType = "raw"
+			}
 		}
 
 		// serve raw dist or npm dist files like CSS/map etc..
 		if reqType == "raw" {
-			installDir := fmt.Sprintf("npm/%s", reqPkg.VersionName())
-			savePath := path.Join(cfg.WorkDir, installDir, "node_modules", reqPkg.Name, reqPkg.SubPath)
+			installDir := getWorkDir(reqPkg)
+			defer workDirs.use(installDir)()
+			savePath := path.Join(installDir, "node_modules", reqPkg.Name, reqPkg.SubPath)
 			fi, err := os.Lstat(savePath)
 			if err != nil {
 				if os.IsExist(err) {
 					return rex.Status(500, err.Error())
 				}
 				// if the file not found, try to install the package
-				err = installPackage(path.Join(cfg.WorkDir, installDir), reqPkg)
+				err = installPackage(ctx.R.Context(), installDir, reqPkg)
 				if err != nil {
-					return rex.Status(500, err.Error())
+					return rex.Status(getErrorStatus(err), err.Error())
 				}
 				// recheck the file
 				fi, err = os.Lstat(savePath)
@@ -651,6 +724,29 @@ func esmHandler() rex.Handle {
 					return rex.Status(404, "File Not Found")
 				}
 			}
+			if !fi.Mode().IsRegular() {
+				return rex.Status(404, "File Not Found")
+			}
+			// only the files published by the `files` field of package.json are served
+			var p NpmPackageInfo
+			err = parseJSONFile(path.Join(installDir, "node_modules", reqPkg.Name, "package.json"), &p)
+			if err != nil || !isPublishedFile(p, reqPkg.SubPath) {
+				return rex.Status(404, "File Not Found")
+			}
+			// serve the json/text file as a JS module with `?module` query
+			if ctx.Form.Has("module") && !ctx.R.URL.Query().Has("raw") && endsWith(savePath, ".json", ".txt", ".data") {
+				data, err := os.ReadFile(savePath)
+				if err != nil {
+					return rex.Status(500, err.Error())
+				}
+				code, err := toDataModule(savePath, data)
+				if err != nil {
+					return rex.Status(400, err.Error())
+				}
+				header.Set("Cache-Control", ccImmutable)
+				header.Set("Content-Type", ctJavascript)
+				return rex.Content(savePath+".js", fi.ModTime(), bytes.NewReader(code))
+			}
 			content, err := os.Open(savePath)
 			if err != nil {
 				if os.IsExist(err) {
@@ -664,9 +760,23 @@ func esmHandler() rex.Handle {
 			} else if endsWith(savePath, ".ts", ".mts", ".tsx") {
 				header.Set("Content-Type", ctTypescript)
 			}
+			header.Set("Accept-Ranges", "bytes")
+			if ctx.R.Header.Get("Range") != "" {
+				// serve the partial content without compression, the `Content-Range` header
+				// describes the raw bytes of the file
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					defer content.Close()
+					http.ServeContent(w, r, savePath, fi.ModTime(), content)
+				})
+			}
 			return rex.Content(savePath, fi.ModTime(), content) // auto closed
 		}
 
+		// serve the lockfile snapshot of the build file with `?lockfile` query
+		if pathHasTargetSegment && reqType == "builds" && ctx.Form.Has("lockfile") {
+			return serveBuildLockfile(ctx, normalizeSavePath(path.Join(reqType, pathname)))
+		}
+
 		// serve build files
 		if pathHasTargetSegment && (reqType == "builds" || reqType == "types") {
 			savePath := path.Join(reqType, pathname)
@@ -694,16 +804,16 @@ func esmHandler() rex.Handle {
 				header.Set("Cache-Control", ccImmutable)
 				if ctx.Form.Has("worker") && reqType == "builds" {
 					moduleUrl := fmt.Sprintf("%s%s%s", cdnOrigin, cfg.CdnBasePath, pathname)
-					return fmt.Sprintf(
-						`export default function workerFactory(injectOrOptions) { const options = typeof injectOrOptions === "string" ? { inject: injectOrOptions }: injectOrOptions ?? {}; const { inject, name = "%s" } = options; const blob = new Blob(['import * as $module from "%s";', inject].filter(Boolean), { type: "application/javascript" }); return new Worker(URL.createObjectURL(blob), { type: "module", name })}`,
-						moduleUrl,
-						moduleUrl,
-					)
+					return workerFactoryJS(moduleUrl, ctx.Form.Value("worker") == "shared")
 				}
 				r, err := fs.OpenFile(savePath)
 				if err != nil {
 					return rex.Status(500, err.Error())
 				}
+				// strip the source map comment with `?no-sourcemap` query
+				if ctx.Form.Has("no-sourcemap") && reqType == "builds" && endsWith(pathname, ".js", ".mjs") {
+					return serveBuildFileWithoutSourceMap(savePath, fi.ModTime(), r)
+				}
 				return rex.Content(savePath, fi.ModTime(), r) // auto closed
 			}
 		}
@@ -717,7 +827,13 @@ func esmHandler() rex.Handle {
 					name, to := utils.SplitByFirstByte(p, ':')
 					name = strings.TrimSpace(name)
 					to = strings.TrimSpace(to)
-					if name != "" && to != "" && name != reqPkg.Name {
+					if name == "" || to == "" {
+						continue
+					}
+					if !validatePackageName(name) || !validatePackageName(getPkgName(to)) {
+						return rex.Status(400, fmt.Sprintf("Invalid alias query: %s", p))
+					}
+					if name != reqPkg.Name {
 						alias[name] = to
 					}
 				}
@@ -732,7 +848,7 @@ func esmHandler() rex.Handle {
 				if p != "" {
 					m, _, err := validatePkgPath(p)
 					if err != nil {
-						if strings.HasSuffix(err.Error(), "not found") {
+						if isNotFoundError(err) {
 							continue
 						}
 						return rex.Status(400, fmt.Sprintf("Invalid deps query: %v not found", p))
@@ -765,19 +881,23 @@ func esmHandler() rex.Handle {
 		if ctx.Form.Has("conditions") {
 			for _, p := range strings.Split(ctx.Form.Value("conditions"), ",") {
 				p = strings.TrimSpace(p)
-				if p != "" {
-					conditions.Add(p)
+				if p == "" {
+					continue
+				}
+				if !regexpConditionName.MatchString(p) {
+					return rex.Status(400, fmt.Sprintf("Invalid conditions query: invalid condition '%s'", p))
 				}
+				conditions.Add(p)
 			}
 		}
-
-		// determine build target by `?target` query or `User-Agent` header
-		target := strings.ToLower(ctx.Form.Value("target"))
-		targetViaUA := targets[target] == 0
-		if targetViaUA {
-			target = getBuildTargetByUA(userAgent)
+		exactConditions := ctx.Form.Has("exact-conditions")
+		if exactConditions && conditions.Len() == 0 {
+			return rex.Status(400, "Invalid exact-conditions query: the conditions query is required")
 		}
 
+		// determine build target by `?target` query, `X-Esm-Target`/`Accept` header or `User-Agent` header
+		target, targetVary := getBuildTarget(ctx.R, ctx.Form.Value("target"))
+
 		// check deno/std version by `?deno-std=VER` query
 		dsv := denoStdVersion
 		fv := ctx.Form.Value("deno-std")
@@ -793,30 +913,82 @@ func esmHandler() rex.Handle {
 				external.Add("*")
 				break
 			}
-			if p != "" {
-				external.Add(p)
+			if p == "" {
+				continue
+			}
+			if strings.HasPrefix(p, "node:") {
+				if !nodejsInternalModules[p[5:]] {
+					return rex.Status(400, fmt.Sprintf("Invalid external query: '%s' is not a node builtin module", p))
+				}
+			} else if !validatePackageName(getPkgName(p)) {
+				// the sub-modules are allowed, e.g. `react/jsx-runtime`
+				return rex.Status(400, fmt.Sprintf("Invalid external query: invalid package name '%s'", p))
+			}
+			external.Add(p)
+		}
+
+		// check `?node-polyfills` and `?no-node-polyfills` query
+		var nodePolyfills map[string]string = nil
+		if ctx.Form.Has("no-node-polyfills") {
+			nodePolyfills = map[string]string{}
+		} else if ctx.Form.Has("node-polyfills") {
+			nodePolyfills = map[string]string{}
+			for _, p := range strings.Split(ctx.Form.Value("node-polyfills"), ",") {
+				p = strings.TrimSpace(p)
+				if p == "" {
+					continue
+				}
+				name, pkg := utils.SplitByFirstByte(strings.TrimPrefix(p, "node:"), ':')
+				if !nodejsInternalModules[name] {
+					return rex.Status(400, fmt.Sprintf("Invalid node-polyfills query: '%s' is not a node builtin module", name))
+				}
+				if pkg != "" && pkg != nodePolyfillDisabled && !validatePackageName(getPkgName(pkg)) {
+					return rex.Status(400, fmt.Sprintf("Invalid node-polyfills query: invalid package name '%s'", pkg))
+				}
+				nodePolyfills[name] = pkg
 			}
 		}
 
-		// check `?jsx-rutnime` query
+		// check `?jsx-import-source` query, `?jsx-runtime` is an alias
 		var jsxRuntime *Pkg = nil
-		if v := ctx.Form.Value("jsx-runtime"); v != "" {
+		for _, key := range []string{"jsx-import-source", "jsx-runtime"} {
+			if v := ctx.Form.Value(key); v != "" {
+				m, _, err := validatePkgPath(v)
+				if err != nil {
+					return rex.Status(400, fmt.Sprintf("Invalid %s query: %v not found", key, v))
+				}
+				jsxRuntime = &m
+				break
+			}
+		}
+
+		// check `?types` query, e.g. `?types=@types/foo@1.2` uses the types of `@types/foo@1.2`
+		// instead of the types resolved by the version of the package
+		var types *Pkg = nil
+		if v := ctx.Form.Value("types"); v != "" {
 			m, _, err := validatePkgPath(v)
-			if err != nil {
-				return rex.Status(400, fmt.Sprintf("Invalid jsx-runtime query: %v not found", v))
+			if err != nil || !strings.HasPrefix(m.Name, "@types/") {
+				return rex.Status(400, fmt.Sprintf("Invalid types query: %v not found", v))
 			}
-			jsxRuntime = &m
+			types = &m
 		}
 
 		isPkgCss := ctx.Form.Has("css")
-		bundle := (ctx.Form.Has("bundle") && ctx.Form.Value("bundle") != "false") || ctx.Form.Has("standalone")
-		noBundle := !bundle && (ctx.Form.Has("no-bundle") || ctx.Form.Value("bundle") == "false")
-		isDev := ctx.Form.Has("dev")
 		isWorker := ctx.Form.Has("worker")
+		isSharedWorker := ctx.Form.Value("worker") == "shared"
+		standalone := ctx.Form.Has("standalone") || ctx.Form.Value("bundle") == "all"
+		noBundleQuery := ctx.Form.Has("no-bundle") || ctx.Form.Value("bundle") == "false"
+		// the worker loads the bundled module by default to avoid the waterfall of the dependency imports
+		bundle := (ctx.Form.Has("bundle") && ctx.Form.Value("bundle") != "false") || standalone || (isWorker && !noBundleQuery)
+		noBundle := !bundle && noBundleQuery
+		isDev := ctx.Form.Has("dev") || ctx.Form.Value("minify") == "false"
+		noSourceMap := ctx.Form.Has("no-sourcemap")
 		noCheck := ctx.Form.Has("no-check") || ctx.Form.Has("no-dts")
 		ignoreRequire := ctx.Form.Has("ignore-require") || reqPkg.Name == "@unocss/preset-icons"
 		keepNames := ctx.Form.Has("keep-names")
 		ignoreAnnotations := ctx.Form.Has("ignore-annotations")
+		assertJSON := ctx.Form.Value("assert") == "json"
+		externalWasm := ctx.Form.Has("external-wasm")
 
 		// force react/jsx-dev-runtime and react-refresh into `dev` mode
 		if !isDev && ((reqPkg.Name == "react" && reqPkg.SubModule == "jsx-dev-runtime") || reqPkg.Name == "react-refresh") {
@@ -825,15 +997,20 @@ func esmHandler() rex.Handle {
 
 		buildArgs := BuildArgs{
 			alias:             alias,
+			assertJSON:        assertJSON,
 			conditions:        conditions,
+			exactConditions:   exactConditions,
 			denoStdVersion:    dsv,
 			deps:              deps,
 			exports:           exports,
 			external:          external,
+			externalWasm:      externalWasm,
 			ignoreAnnotations: ignoreAnnotations,
 			ignoreRequire:     ignoreRequire,
 			jsxRuntime:        jsxRuntime,
 			keepNames:         keepNames,
+			nodePolyfills:     nodePolyfills,
+			types:             types,
 		}
 
 		// parse `X-` prefix
@@ -876,6 +1053,10 @@ func esmHandler() rex.Handle {
 						if strings.HasSuffix(submodule, ".bundle") {
 							submodule = strings.TrimSuffix(submodule, ".bundle")
 							bundle = true
+						} else if strings.HasSuffix(submodule, ".standalone") {
+							submodule = strings.TrimSuffix(submodule, ".standalone")
+							bundle = true
+							standalone = true
 						} else if strings.HasSuffix(submodule, ".nobundle") {
 							submodule = strings.TrimSuffix(submodule, ".nobundle")
 							noBundle = true
@@ -965,13 +1146,14 @@ func esmHandler() rex.Handle {
 		}
 
 		task := &BuildTask{
-			Args:      buildArgs,
-			CdnOrigin: cdnOrigin,
-			Pkg:       reqPkg,
-			Target:    target,
-			Dev:       isDev,
-			Bundle:    bundle,
-			NoBundle:  noBundle,
+			Args:       buildArgs,
+			CdnOrigin:  cdnOrigin,
+			Pkg:        reqPkg,
+			Target:     target,
+			Dev:        isDev,
+			Bundle:     bundle,
+			Standalone: standalone,
+			NoBundle:   noBundle,
 		}
 
 		buildId := task.ID()
@@ -995,6 +1177,10 @@ func esmHandler() rex.Handle {
 					if strings.HasSuffix(msg, " not found") {
 						return rex.Status(404, msg)
 					}
+					// the member of the `?exports` query is not exported by the module
+					if errors.Is(output.err, ErrInvalidSpecifier) {
+						return rex.Status(400, msg)
+					}
 					return throwErrorJS(ctx, output.err.Error(), false)
 				}
 				esm = output.meta
@@ -1005,6 +1191,11 @@ func esmHandler() rex.Handle {
 			}
 		}
 
+		// serve the lockfile snapshot of the build with `?lockfile` query
+		if ctx.Form.Has("lockfile") {
+			return serveBuildLockfile(ctx, task.getSavepath())
+		}
+
 		// should redirect to `*.d.ts` file
 		if esm.TypesOnly {
 			dtsUrl := fmt.Sprintf("%s%s/%s", cdnOrigin, cfg.CdnBasePath, esm.Dts)
@@ -1047,12 +1238,10 @@ func esmHandler() rex.Handle {
 			if endsWith(savePath, ".mjs", ".js") {
 				header.Set("Content-Type", ctJavascript)
 				if isWorker {
-					moduleUrl := fmt.Sprintf("%s%s/%s", cdnOrigin, cfg.CdnBasePath, buildId)
-					return fmt.Sprintf(
-						`export default function workerFactory(injectOrOptions) { const options = typeof injectOrOptions === "string" ? { inject: injectOrOptions }: injectOrOptions ?? {}; const { inject, name = "%s" } = options; const blob = new Blob(['import * as $module from "%s";', inject].filter(Boolean), { type: "application/javascript" }); return new Worker(URL.createObjectURL(blob), { type: "module", name })}`,
-						moduleUrl,
-						moduleUrl,
-					)
+					return workerFactoryJS(fmt.Sprintf("%s%s/%s", cdnOrigin, cfg.CdnBasePath, buildId), isSharedWorker)
+				}
+				if noSourceMap {
+					return serveBuildFileWithoutSourceMap(savePath, fi.ModTime(), f)
 				}
 			}
 			return rex.Content(savePath, fi.ModTime(), f) // auto closed
@@ -1061,13 +1250,15 @@ func esmHandler() rex.Handle {
 		buf := bytes.NewBuffer(nil)
 		fmt.Fprintf(buf, `/* esm.sh - %v */%s`, reqPkg, EOL)
 
+		// pass the `?no-sourcemap` query to the build file
+		buildPath := buildId
+		if noSourceMap {
+			buildPath += "?no-sourcemap"
+		}
+
 		if isWorker {
-			moduleUrl := fmt.Sprintf("%s%s/%s", cdnOrigin, cfg.CdnBasePath, buildId)
-			fmt.Fprintf(buf,
-				`export default function workerFactory(injectOrOptions) { const options = typeof injectOrOptions === "string" ? { inject: injectOrOptions }: injectOrOptions ?? {}; const { inject, name = "%s" } = options; const blob = new Blob(['import * as $module from "%s";', inject].filter(Boolean), { type: "application/javascript" }); return new Worker(URL.createObjectURL(blob), { type: "module", name })}`,
-				moduleUrl,
-				moduleUrl,
-			)
+			moduleUrl := fmt.Sprintf("%s%s/%s", cdnOrigin, cfg.CdnBasePath, buildPath)
+			buf.WriteString(workerFactoryJS(moduleUrl, isSharedWorker))
 		} else {
 			if len(esm.Deps) > 0 {
 				// TODO: lookup deps of deps?
@@ -1079,12 +1270,12 @@ func esmHandler() rex.Handle {
 				}
 			}
 			header.Set("X-Esm-Id", buildId)
-			fmt.Fprintf(buf, `export * from "%s/%s";%s`, cfg.CdnBasePath, buildId, EOL)
+			fmt.Fprintf(buf, `export * from "%s/%s";%s`, cfg.CdnBasePath, buildPath, EOL)
 			if (esm.FromCJS || esm.HasExportDefault) && (exports.Len() == 0 || exports.Has("default")) {
-				fmt.Fprintf(buf, `export { default } from "%s/%s";%s`, cfg.CdnBasePath, buildId, EOL)
+				fmt.Fprintf(buf, `export { default } from "%s/%s";%s`, cfg.CdnBasePath, buildPath, EOL)
 			}
 			if esm.FromCJS && exports.Len() > 0 {
-				fmt.Fprintf(buf, `import __cjs_exports$ from "%s/%s";%s`, cfg.CdnBasePath, buildId, EOL)
+				fmt.Fprintf(buf, `import __cjs_exports$ from "%s/%s";%s`, cfg.CdnBasePath, buildPath, EOL)
 				fmt.Fprintf(buf, `export const { %s } = __cjs_exports$;%s`, strings.Join(exports.Values(), ", "), EOL)
 			}
 		}
@@ -1093,8 +1284,8 @@ func esmHandler() rex.Handle {
 			dtsUrl := fmt.Sprintf("%s%s/%s", cdnOrigin, cfg.CdnBasePath, esm.Dts)
 			header.Set("X-TypeScript-Types", dtsUrl)
 		}
-		if targetViaUA {
-			addVary(header, "User-Agent")
+		if targetVary != "" {
+			addVary(header, targetVary)
 		}
 		header.Set("Cache-Control", ccImmutable)
 		header.Set("Content-Length", strconv.Itoa(buf.Len()))
@@ -1122,6 +1313,35 @@ func getCdnOrign(ctx *rex.Context) string {
 	return cdnOrigin
 }
 
+// getBuildTarget returns the build target of the request, the `?target` query takes precedence
+// over the `X-Esm-Target` header and the `target` parameter of the `Accept` header, and then the
+// target is determined by the `User-Agent` header. The returned `vary` is the header that the
+// target depends on, it's empty if the target is specified by the query.
+func getBuildTarget(r *http.Request, query string) (target string, vary string) {
+	target = strings.ToLower(query)
+	if targets[target] > 0 {
+		return target, ""
+	}
+	// the target depends on the absence of the headers with higher priority as well,
+	// so the response varies on all the headers that are consulted
+	target = strings.ToLower(strings.TrimSpace(r.Header.Get("X-Esm-Target")))
+	if targets[target] > 0 {
+		return target, "X-Esm-Target"
+	}
+	if accept := r.Header.Get("Accept"); accept != "" {
+		for _, part := range strings.Split(accept, ",") {
+			_, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err == nil {
+				target = strings.ToLower(params["target"])
+				if targets[target] > 0 {
+					return target, "X-Esm-Target, Accept"
+				}
+			}
+		}
+	}
+	return getBuildTargetByUA(r.UserAgent()), "X-Esm-Target, Accept, User-Agent"
+}
+
 func addVary(header http.Header, key string) {
 	vary := header.Get("Vary")
 	if vary == "" {
@@ -1141,6 +1361,24 @@ func hasTargetSegment(path string) bool {
 	return false
 }
 
+// getErrorStatus returns the http status code of the error returned by the registry.
+func getErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidSpecifier):
+		return 400
+	case isNotFoundError(err):
+		return 404
+	case errors.Is(err, ErrUnauthorized), errors.Is(err, ErrPackageForbidden):
+		return 403
+	case errors.Is(err, ErrRegistryUnavailable), errors.Is(err, ErrIntegrityMismatch):
+		return 502
+	case errors.Is(err, context.DeadlineExceeded):
+		return 504
+	default:
+		return 500
+	}
+}
+
 func throwErrorJS(ctx *rex.Context, message string, static bool) interface{} {
 	buf := bytes.NewBuffer(nil)
 	fmt.Fprintf(buf, "/* esm.sh - error */\n")
@@ -1155,6 +1393,82 @@ func throwErrorJS(ctx *rex.Context, message string, static bool) interface{} {
 	return rex.Status(500, buf)
 }
 
+// toDataModule converts the json or text file to a JS module that exports the data as default.
+func toDataModule(filename string, data []byte) ([]byte, error) {
+	buf := bytes.NewBufferString("/* esm.sh - data module */\nexport default ")
+	if strings.HasSuffix(filename, ".json") {
+		if !json.Valid(data) {
+			return nil, fmt.Errorf("invalid json file '%s'", path.Base(filename))
+		}
+		buf.Write(bytes.TrimSpace(data))
+	} else {
+		buf.Write(bytes.TrimSpace(mustEncodeJSON(string(data))))
+	}
+	buf.WriteString(";\n")
+	return buf.Bytes(), nil
+}
+
+// workerFactoryJS returns the module that exports a factory creating a `Worker` (or a `SharedWorker`) from the
+// module url, the worker script is a blob url that imports the module to bypass the cross-origin restriction
+// of the worker.
+func workerFactoryJS(moduleUrl string, shared bool) string {
+	return fmt.Sprintf(
+		`export default function workerFactory(injectOrOptions) { const options = typeof injectOrOptions === "string" ? { inject: injectOrOptions }: injectOrOptions ?? {}; const { inject, name = "%s", shared = %v } = options; const blob = new Blob(['import * as $module from "%s";', inject].filter(Boolean), { type: "application/javascript" }); const url = URL.createObjectURL(blob); return shared ? new SharedWorker(url, { type: "module", name }) : new Worker(url, { type: "module", name })}`,
+		moduleUrl,
+		shared,
+		moduleUrl,
+	)
+}
+
+// serveBuildFileWithoutSourceMap serves the build file without the trailing `//# sourceMappingURL=` comment.
+func serveBuildFileWithoutSourceMap(savePath string, modTime time.Time, r io.ReadCloser) interface{} {
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return rex.Status(500, err.Error())
+	}
+	return rex.Content(savePath, modTime, bytes.NewReader(stripSourceMappingURL(data)))
+}
+
+// stripSourceMappingURL removes the `//# sourceMappingURL=` comment at the end of the js.
+func stripSourceMappingURL(js []byte) []byte {
+	i := bytes.LastIndex(js, []byte("//# sourceMappingURL="))
+	if i >= 0 && !bytes.ContainsRune(bytes.TrimSpace(js[i:]), '\n') {
+		return bytes.TrimRight(js[:i], " \t")
+	}
+	return js
+}
+
+// serveBuildLockfile serves the lockfile snapshot saved alongside the build artifact.
+func serveBuildLockfile(ctx *rex.Context, savePath string) interface{} {
+	lockfilePath := savePath + ".lock.json"
+	fi, err := fs.Stat(lockfilePath)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return rex.Status(404, "Lockfile not found")
+		}
+		return rex.Status(500, err.Error())
+	}
+	f, err := fs.OpenFile(lockfilePath)
+	if err != nil {
+		return rex.Status(500, err.Error())
+	}
+	ctx.W.Header().Set("Content-Type", "application/json; charset=utf-8")
+	ctx.W.Header().Set("Cache-Control", ccImmutable)
+	return rex.Content(lockfilePath, fi.ModTime(), f) // auto closed
+}
+
+// forbiddenJS returns a module that throws the error of the forbidden package.
+func forbiddenJS(ctx *rex.Context, message string) interface{} {
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, "/* esm.sh - forbidden */\n")
+	fmt.Fprintf(buf, "throw new Error(%s);\n", bytes.TrimSpace(mustEncodeJSON("[esm.sh] "+message)))
+	fmt.Fprintf(buf, "export default null;\n")
+	ctx.W.Header().Set("Cache-Control", ccMustRevalidate)
+	ctx.W.Header().Set("Content-Type", ctJavascript)
+	return rex.Status(403, buf)
+}
+
 func getTypesRoot(cdnOrigin string) string {
 	url, err := url.Parse(cdnOrigin)
 	if err != nil {
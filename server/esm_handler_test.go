@@ -0,0 +1,420 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/ije/rex"
+)
+
+func TestGetBuildTarget(t *testing.T) {
+	r := httptest.NewRequest("GET", "/react", nil)
+	r.Header.Set("User-Agent", "curl/8.0.0")
+	if target, vary := getBuildTarget(r, ""); target != "esnext" || vary != "X-Esm-Target, Accept, User-Agent" {
+		t.Fatalf("invalid target(%s, %s), should be 'esnext' via 'User-Agent'", target, vary)
+	}
+
+	r.Header.Set("X-Esm-Target", "es2020")
+	if target, vary := getBuildTarget(r, ""); target != "es2020" || vary != "X-Esm-Target" {
+		t.Fatalf("invalid target(%s, %s), should be 'es2020' via 'X-Esm-Target'", target, vary)
+	}
+
+	r.Header.Del("X-Esm-Target")
+	r.Header.Set("Accept", "text/html, application/javascript; target=es2017")
+	if target, vary := getBuildTarget(r, ""); target != "es2017" || vary != "X-Esm-Target, Accept" {
+		t.Fatalf("invalid target(%s, %s), should be 'es2017' via 'Accept'", target, vary)
+	}
+
+	// the `?target` query takes precedence
+	if target, vary := getBuildTarget(r, "ES2022"); target != "es2022" || vary != "" {
+		t.Fatalf("invalid target(%s, %s), should be 'es2022' via query", target, vary)
+	}
+}
+
+func TestBuildTargetVary(t *testing.T) {
+	cfg = &config.Config{}
+	defer func() { cfg = nil }()
+	defer func(efs EmbedFS) { embedFS = efs }(embedFS)
+	dir := t.TempDir()
+	embedFS = &DevFS{cwd: dir}
+	ensureDir(path.Join(dir, "server/embed"))
+	if err := os.WriteFile(path.Join(dir, "server/embed/run.ts"), []byte(`export const run = () => {}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	router := &rex.Router{}
+	router.Use(esmHandler())
+	for _, c := range []struct {
+		header string
+		value  string
+		vary   string
+	}{
+		{"User-Agent", "curl/8.0.0", "X-Esm-Target, Accept, User-Agent"},
+		{"Accept", "application/javascript; target=es2020", "X-Esm-Target, Accept"},
+		{"X-Esm-Target", "es2020", "X-Esm-Target"},
+	} {
+		r := httptest.NewRequest("GET", "/run", nil)
+		r.Header.Set(c.header, c.value)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != 200 {
+			t.Fatalf("GET /run: status %d, %s", w.Code, w.Body.String())
+		}
+		if vary := w.Header().Get("Vary"); vary != c.vary {
+			t.Fatalf("invalid Vary header via '%s': %q, should be %q", c.header, vary, c.vary)
+		}
+	}
+}
+
+func TestES5Target(t *testing.T) {
+	r := httptest.NewRequest("GET", "/react", nil)
+	r.Header.Set("User-Agent", "curl/8.0.0")
+	if target, _ := getBuildTarget(r, "es5"); target != "esnext" {
+		t.Fatalf("invalid target(%s), the `es5` target should be disabled by default", target)
+	}
+
+	registerES5Target()
+	t.Cleanup(func() { delete(targets, "es5") })
+	if target, vary := getBuildTarget(r, "es5"); target != "es5" || vary != "" {
+		t.Fatalf("invalid target(%s, %s), should be 'es5' via query", target, vary)
+	}
+	if err := registerCustomTargets(map[string]string{"es5": "chrome109"}); err == nil {
+		t.Fatal("the `es5` target should be reserved")
+	}
+	if err := registerCustomTargets(map[string]string{"legacy": "es5"}); err == nil {
+		t.Fatal("the `es5` target can't be used by the custom targets")
+	}
+}
+
+func TestCustomTargets(t *testing.T) {
+	t.Cleanup(func() {
+		for name := range customTargetEngines {
+			delete(targets, name)
+			delete(customTargetEngines, name)
+		}
+	})
+	for _, defs := range []map[string]string{
+		{"Modern": "chrome109"},
+		{"es2022": "chrome109"},
+		{"types": "chrome109"},
+		{"gh": "chrome109"},
+		{"lib": "chrome109"},
+		{"node": "chrome109"},
+		{"modern": "chrome109,netscape4"},
+		{"modern": "chrome"},
+		{"modern": "es5"},
+	} {
+		if err := registerCustomTargets(defs); err == nil {
+			t.Fatalf("%v should be rejected", defs)
+		}
+	}
+	err := registerCustomTargets(map[string]string{
+		"modern":        "chrome109, safari15.6",
+		"legacy":        "chrome79",
+		"es2019-chrome": "es2019,chrome109",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if targets["modern"] != targets["esnext"] || targets["legacy"] != targets["esnext"] || targets["es2019-chrome"] != targets["es2019"] || len(customTargetEngines["modern"]) != 2 {
+		t.Fatalf("invalid custom targets: %v", customTargetEngines)
+	}
+
+	r := httptest.NewRequest("GET", "/react", nil)
+	r.Header.Set("X-Esm-Target", "modern")
+	if target, vary := getBuildTarget(r, ""); target != "modern" || vary != "X-Esm-Target" {
+		t.Fatalf("invalid target(%s, %s), should be 'modern' via 'X-Esm-Target'", target, vary)
+	}
+	if !hasTargetSegment("react@18.2.0/legacy/react.mjs") {
+		t.Fatal("the custom target should be a target segment")
+	}
+
+	// the nullish coalescing assignment is not supported by chrome79
+	code, err := transform(TransofrmInput{Code: "let a; a ??= 1; export default a;", Target: "legacy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(code, "??=") {
+		t.Fatalf("the code should be transformed for chrome79: %s", code)
+	}
+	code, err = transform(TransofrmInput{Code: "let a; a ??= 1; export default a;", Target: "modern"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(code, "??=") {
+		t.Fatalf("the code should not be transformed for chrome109: %s", code)
+	}
+}
+
+func TestServeRawFile(t *testing.T) {
+	cfg = &config.Config{WorkDir: t.TempDir()}
+	defer func() { cfg = nil }()
+
+	wasm := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00, 0xff, 0xfe}
+	pkgDir := path.Join(cfg.WorkDir, "npm/foo@1.0.0/node_modules/foo")
+	for name, content := range map[string][]byte{
+		"package.json":     []byte(`{"name":"foo","version":"1.0.0","main":"./lib/main","files":["dist","!dist/secret.json"]}`),
+		"lib/main.js":      []byte(`module.exports = "foo"`),
+		"dist/data.json":   []byte(`{ "b": 1,   "a": [2] }`),
+		"dist/index.js":    []byte(`export const foo = "foo"`),
+		"dist/bin.wasm":    wasm,
+		"dist/secret.json": []byte(`{}`),
+		"src/index.ts":     []byte(`export const foo: string = "foo"`),
+	} {
+		ensureDir(path.Dir(path.Join(pkgDir, name)))
+		if err := os.WriteFile(path.Join(pkgDir, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	router := &rex.Router{}
+	router.Use(esmHandler())
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		return w
+	}
+
+	for url, expected := range map[string]struct {
+		contentType string
+		body        []byte
+	}{
+		"/foo@1.0.0/dist/data.json?raw": {"application/json", []byte(`{ "b": 1,   "a": [2] }`)},
+		"/foo@1.0.0/dist/bin.wasm?raw":  {"application/wasm", wasm},
+		"/foo@1.0.0/dist/index.js?raw":  {ctJavascript, []byte(`export const foo = "foo"`)},
+		"/foo@1.0.0/lib/main.js?raw":    {ctJavascript, []byte(`module.exports = "foo"`)},
+	} {
+		w := get(url)
+		if w.Code != 200 {
+			t.Fatalf("GET %s: status %d, %s", url, w.Code, w.Body.String())
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, expected.contentType) {
+			t.Fatalf("GET %s: invalid content type %q, should be %q", url, ct, expected.contentType)
+		}
+		if !bytes.Equal(w.Body.Bytes(), expected.body) {
+			t.Fatalf("GET %s: the file is transformed: %q", url, w.Body.Bytes())
+		}
+	}
+
+	// the files not published by the `files` field are not served
+	for _, url := range []string{"/foo@1.0.0/src/index.ts?raw", "/foo@1.0.0/dist/secret.json?raw", "/foo@1.0.0/dist?raw"} {
+		if w := get(url); w.Code != 404 {
+			t.Fatalf("GET %s: status %d, should be 404", url, w.Code)
+		}
+	}
+
+	// the files are not served without a readable package.json
+	if err := os.Remove(path.Join(pkgDir, "package.json")); err != nil {
+		t.Fatal(err)
+	}
+	if w := get("/foo@1.0.0/dist/index.js?raw"); w.Code != 404 {
+		t.Fatalf("GET /foo@1.0.0/dist/index.js?raw: status %d, should be 404", w.Code)
+	}
+}
+
+func TestServeDataModule(t *testing.T) {
+	cfg = &config.Config{WorkDir: t.TempDir()}
+	defer func() { cfg = nil }()
+
+	pkgDir := path.Join(cfg.WorkDir, "npm/foo@1.0.0/node_modules/foo")
+	for name, content := range map[string]string{
+		"package.json":    `{"name":"foo","version":"1.0.0"}`,
+		"data.json":       "{ \"a\": [1, 2] }\n",
+		"broken.json":     `{ "a": `,
+		"LICENSE.txt":     "MIT \"</script>\"\n",
+		"dict/words.data": "foo\nbar",
+	} {
+		ensureDir(path.Dir(path.Join(pkgDir, name)))
+		if err := os.WriteFile(path.Join(pkgDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	router := &rex.Router{}
+	router.Use(esmHandler())
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		return w
+	}
+
+	for url, expected := range map[string]string{
+		"/foo@1.0.0/data.json?module":       `export default { "a": [1, 2] };`,
+		"/foo@1.0.0/LICENSE.txt?module":     `export default "MIT \"\u003c/script\u003e\"\n";`,
+		"/foo@1.0.0/dict/words.data?module": `export default "foo\nbar";`,
+	} {
+		w := get(url)
+		if w.Code != 200 {
+			t.Fatalf("GET %s: status %d, %s", url, w.Code, w.Body.String())
+		}
+		if ct := w.Header().Get("Content-Type"); ct != ctJavascript {
+			t.Fatalf("GET %s: invalid content type %q", url, ct)
+		}
+		if !strings.Contains(w.Body.String(), expected) {
+			t.Fatalf("GET %s: invalid module %q, should contain %q", url, w.Body.String(), expected)
+		}
+	}
+
+	if w := get("/foo@1.0.0/broken.json?module"); w.Code != 400 {
+		t.Fatalf("GET /foo@1.0.0/broken.json?module: status %d, should be 400", w.Code)
+	}
+	if w := get("/foo@1.0.0/data.json?module&raw"); w.Body.String() != "{ \"a\": [1, 2] }\n" {
+		t.Fatalf("GET /foo@1.0.0/data.json?module&raw: the file is transformed: %q", w.Body.String())
+	}
+}
+
+func TestServeRawFileRange(t *testing.T) {
+	cfg = &config.Config{WorkDir: t.TempDir()}
+	defer func() { cfg = nil }()
+
+	data := []byte(strings.Repeat(`{"key":"value"},`, 256))
+	pkgDir := path.Join(cfg.WorkDir, "npm/foo-range@1.0.0/node_modules/foo-range")
+	for name, content := range map[string][]byte{
+		"package.json":   []byte(`{"name":"foo-range","version":"1.0.0"}`),
+		"dist/data.json": data,
+	} {
+		ensureDir(path.Dir(path.Join(pkgDir, name)))
+		if err := os.WriteFile(path.Join(pkgDir, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	router := &rex.Router{}
+	router.Use(esmHandler())
+	get := func(url string, rangeHeader string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", url, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		req.Header.Set("Range", rangeHeader)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/foo-range@1.0.0/dist/data.json?raw", "bytes=0-9")
+	if w.Code != 206 {
+		t.Fatalf("status %d, should be 206: %s", w.Code, w.Body.String())
+	}
+	if cr := w.Header().Get("Content-Range"); cr != fmt.Sprintf("bytes 0-9/%d", len(data)) {
+		t.Fatalf("invalid content range %q", cr)
+	}
+	if ar := w.Header().Get("Accept-Ranges"); ar != "bytes" {
+		t.Fatalf("invalid accept ranges %q", ar)
+	}
+	if ce := w.Header().Get("Content-Encoding"); ce != "" {
+		t.Fatalf("the partial content should not be compressed: %q", ce)
+	}
+	if !bytes.Equal(w.Body.Bytes(), data[:10]) {
+		t.Fatalf("invalid partial content %q", w.Body.Bytes())
+	}
+
+	w = get("/foo-range@1.0.0/dist/data.json?raw", "bytes=99999-")
+	if w.Code != 416 {
+		t.Fatalf("status %d, should be 416", w.Code)
+	}
+}
+
+func TestServeStyleExports(t *testing.T) {
+	cfg = &config.Config{WorkDir: t.TempDir()}
+	defer func() { cfg = nil }()
+
+	pkgDir := path.Join(cfg.WorkDir, "npm/foo-styles@1.0.0/node_modules/foo-styles")
+	for name, content := range map[string]string{
+		"package.json": `{
+			"name": "foo-styles",
+			"version": "1.0.0",
+			"exports": {
+				".": {
+					"types": "./dist/index.d.ts",
+					"style": "./dist/foo.css",
+					"sass": "./src/foo.scss",
+					"import": "./dist/index.js"
+				},
+				"./theme": {
+					"import": {
+						"style": "./dist/theme.css",
+						"default": "./dist/theme.js"
+					}
+				},
+				"./package.json": "./package.json"
+			}
+		}`,
+		"dist/index.js":  `export const foo = "foo"`,
+		"dist/foo.css":   `.foo { color: red; }`,
+		"dist/theme.css": `.theme { color: blue; }`,
+		"src/foo.scss":   `$color: red; .foo { color: $color; }`,
+	} {
+		ensureDir(path.Dir(path.Join(pkgDir, name)))
+		if err := os.WriteFile(path.Join(pkgDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	router := &rex.Router{}
+	router.Use(esmHandler())
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		return w
+	}
+
+	for url, expected := range map[string]string{
+		"/foo-styles@1.0.0?css":             "/foo-styles@1.0.0/dist/foo.css",
+		"/foo-styles@1.0.0?conditions=sass": "/foo-styles@1.0.0/src/foo.scss",
+		"/foo-styles@1.0.0/theme?css":       "/foo-styles@1.0.0/dist/theme.css",
+	} {
+		w := get(url)
+		if w.Code != 302 {
+			t.Fatalf("GET %s: status %d, should be 302: %s", url, w.Code, w.Body.String())
+		}
+		if location := w.Header().Get("Location"); !strings.HasSuffix(location, expected) {
+			t.Fatalf("GET %s: invalid location %q, should be %q", url, location, expected)
+		}
+	}
+
+	w := get("/foo-styles@1.0.0/dist/foo.css")
+	if w.Code != 200 || w.Body.String() != `.foo { color: red; }` {
+		t.Fatalf("GET /foo-styles@1.0.0/dist/foo.css: status %d, %s", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/css") {
+		t.Fatalf("GET /foo-styles@1.0.0/dist/foo.css: invalid content type %q", ct)
+	}
+
+	// no style condition for the sub-module
+	info, _, err := getPackageInfo(path.Join(cfg.WorkDir, "npm/foo-styles@1.0.0"), "foo-styles", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry, ok := resolveStyleExports(&info, "package.json", nil); ok {
+		t.Fatalf("unexpected style entry %q of 'foo-styles/package.json'", entry)
+	}
+}
+
+func TestWorkerFactoryJS(t *testing.T) {
+	js := workerFactoryJS("https://esm.sh/foo@1.0.0/es2022/foo.bundle.mjs", false)
+	if !strings.Contains(js, `'import * as $module from "https://esm.sh/foo@1.0.0/es2022/foo.bundle.mjs";'`) || !strings.Contains(js, "shared = false") {
+		t.Fatalf("invalid worker factory: %s", js)
+	}
+	js = workerFactoryJS("https://esm.sh/foo@1.0.0/es2022/foo.bundle.mjs", true)
+	if !strings.Contains(js, "shared = true") || !strings.Contains(js, "new SharedWorker(url, ") {
+		t.Fatalf("invalid shared worker factory: %s", js)
+	}
+}
+
+func TestStripSourceMappingURL(t *testing.T) {
+	for js, expected := range map[string]string{
+		"export default 1;\n//# sourceMappingURL=index.mjs.map":          "export default 1;\n",
+		"export default 1;\n//# sourceMappingURL=index.mjs.map\n":        "export default 1;\n",
+		"const s = \"//# sourceMappingURL=x.map\";\nexport default s;\n": "const s = \"//# sourceMappingURL=x.map\";\nexport default s;\n",
+		"export default 1;\n": "export default 1;\n",
+	} {
+		if ret := string(stripSourceMappingURL([]byte(js))); ret != expected {
+			t.Fatalf("stripSourceMappingURL(%q) = %q, should be %q", js, ret, expected)
+		}
+	}
+}
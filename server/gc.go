@@ -0,0 +1,279 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the interval of the disk usage check of the npm working directory
+const workDirGCInterval = 10 * time.Minute
+
+// workDirGC evicts the least-recently-used install directories (`name@version`) of the npm working directory
+// and the packages of the content-addressable store when the disk usage exceeds the quota, the directories
+// used by the in-flight builds are never evicted.
+type workDirGC struct {
+	lock sync.Mutex
+	// the count of the users of the install directories
+	refs map[string]int
+	// the disk usage of the directories tracked at install time
+	sizes map[string]int64
+	// the last disk usage and the count of the evicted directories
+	usage   int64
+	evicted int
+}
+
+var workDirs = &workDirGC{refs: map[string]int{}, sizes: map[string]int64{}}
+
+// use marks the install directory as in use and records the access time, it returns the function
+// to release the directory. The path in the install directory is resolved to the install directory.
+func (gc *workDirGC) use(dir string) (release func()) {
+	dir = getInstallDirOf(dir)
+	gc.lock.Lock()
+	gc.refs[dir]++
+	gc.lock.Unlock()
+
+	// the modification time of the directory is used as the last-access time
+	now := time.Now()
+	os.Chtimes(dir, now, now)
+
+	return func() {
+		gc.lock.Lock()
+		gc.refs[dir]--
+		if gc.refs[dir] <= 0 {
+			delete(gc.refs, dir)
+		}
+		gc.lock.Unlock()
+	}
+}
+
+// track records the disk usage of the directory after the install, so the gc doesn't need to walk
+// the directories on every check.
+func (gc *workDirGC) track(dir string, size int64) {
+	gc.lock.Lock()
+	gc.sizes[dir] = size
+	gc.lock.Unlock()
+}
+
+// run watches the disk usage of the npm working directory and the package store until the context is canceled.
+func (gc *workDirGC) run(ctx context.Context, root string, storeRoot string, quota int64) {
+	ticker := time.NewTicker(workDirGCInterval)
+	defer ticker.Stop()
+	for {
+		gc.collect(root, storeRoot, quota)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type installDirInfo struct {
+	root       string
+	dir        string
+	size       int64
+	accessedAt time.Time
+}
+
+// collect evicts the least-recently-used install directories and store packages until the disk usage is under
+// 90% of the quota. The files hard-linked from the store are counted once, by the store package, while the
+// install directories count only their own files. Removing a directory frees only the files that are not linked
+// from elsewhere, so the freed bytes are measured at the eviction.
+func (gc *workDirGC) collect(root string, storeRoot string, quota int64) (evicted int) {
+	// remove the directories left by the interrupted evictions
+	for _, r := range []string{root, storeRoot} {
+		if r == "" {
+			continue
+		}
+		if trashDirs, err := filepath.Glob(path.Join(r, ".trash-*")); err == nil {
+			for _, dir := range trashDirs {
+				os.RemoveAll(dir)
+			}
+		}
+	}
+
+	dirs := listInstallDirs(root)
+	if storeRoot != "" {
+		dirs = append(dirs, listStoreDirs(storeRoot)...)
+	}
+	// the sizes of the directories tracked at install time are reused, the others (e.g. installed
+	// before the server started) are computed once
+	var usage int64
+	sizes := make(map[string]int64, len(dirs))
+	for i, d := range dirs {
+		gc.lock.Lock()
+		size, ok := gc.sizes[d.dir]
+		gc.lock.Unlock()
+		if !ok {
+			size = dirSize(d.dir, d.root == root)
+		}
+		dirs[i].size = size
+		sizes[d.dir] = size
+		usage += size
+	}
+	gc.lock.Lock()
+	// drop the sizes of the removed directories
+	for dir := range gc.sizes {
+		if _, ok := sizes[dir]; !ok {
+			delete(gc.sizes, dir)
+		}
+	}
+	for dir, size := range sizes {
+		gc.sizes[dir] = size
+	}
+	gc.usage = usage
+	gc.lock.Unlock()
+	if usage <= quota {
+		return
+	}
+
+	sort.Slice(dirs, func(i, j int) bool {
+		return dirs[i].accessedAt.Before(dirs[j].accessedAt)
+	})
+	target := quota / 10 * 9
+	staleSizes := false
+	for _, d := range dirs {
+		if usage <= target {
+			break
+		}
+		// move the directory out of the way while holding the lock, so the directory can't
+		// be used by a new build during the removal
+		trashDir := path.Join(d.root, fmt.Sprintf(".trash-%d", time.Now().UnixNano()))
+		gc.lock.Lock()
+		if gc.refs[d.dir] > 0 {
+			gc.lock.Unlock()
+			continue
+		}
+		err := os.Rename(d.dir, trashDir)
+		if err == nil {
+			delete(gc.sizes, d.dir)
+		}
+		gc.lock.Unlock()
+		if err != nil {
+			log.Warnf("gc: could not evict %s: %v", d.dir, err)
+			continue
+		}
+		freed := dirSize(trashDir, true)
+		os.RemoveAll(trashDir)
+		if d.root != root && freed < d.size {
+			// the files that are still linked are now owned by the install directories only
+			staleSizes = true
+		}
+		usage -= freed
+		evicted++
+		log.Debugf("gc: evicted %s (%d bytes)", d.dir, freed)
+	}
+
+	gc.lock.Lock()
+	if staleSizes {
+		// the install directories are sized again by the next collection
+		for dir := range gc.sizes {
+			if !strings.HasPrefix(dir, storeRoot+"/") {
+				delete(gc.sizes, dir)
+			}
+		}
+	}
+	gc.usage = usage
+	gc.evicted += evicted
+	gc.lock.Unlock()
+	log.Infof("gc: evicted %d install directories, the disk usage is %d/%d bytes", evicted, usage, quota)
+	return
+}
+
+// status returns the disk usage of the npm working directory and the count of the evicted directories.
+func (gc *workDirGC) status() map[string]interface{} {
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+	return map[string]interface{}{
+		"usage":   gc.usage,
+		"inUse":   len(gc.refs),
+		"evicted": gc.evicted,
+	}
+}
+
+// listInstallDirs lists the install directories (`name@version`, `@scope/name@version` or
+// `gh/owner/repo@ref`) of the npm working directory.
+func listInstallDirs(root string) (dirs []installDirInfo) {
+	return listInstallDirsOf(root, root)
+}
+
+func listInstallDirsOf(root string, dir string) (dirs []installDirInfo) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		subDir := path.Join(dir, entry.Name())
+		if strings.LastIndexByte(entry.Name(), '@') <= 0 {
+			// the scope or the owner directory
+			dirs = append(dirs, listInstallDirsOf(root, subDir)...)
+			continue
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		dirs = append(dirs, installDirInfo{root: root, dir: subDir, accessedAt: fi.ModTime()})
+	}
+	return
+}
+
+// listStoreDirs lists the packages of the content-addressable store (`$workDir/store/<hash>`), the modification
+// time of the package directory is updated when it's linked into an install directory.
+func listStoreDirs(root string) (dirs []installDirInfo) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		dirs = append(dirs, installDirInfo{root: root, dir: path.Join(root, entry.Name()), accessedAt: fi.ModTime()})
+	}
+	return
+}
+
+// getInstallDirOf returns the install directory (`name@version`) of the path in the npm working directory.
+func getInstallDirOf(fp string) string {
+	if cfg == nil {
+		return fp
+	}
+	root := path.Join(cfg.WorkDir, "npm")
+	if !strings.HasPrefix(fp, root+"/") {
+		return fp
+	}
+	segs := strings.Split(strings.TrimPrefix(fp, root+"/"), "/")
+	for i, seg := range segs {
+		if strings.LastIndexByte(seg, '@') > 0 {
+			return path.Join(root, strings.Join(segs[:i+1], "/"))
+		}
+	}
+	return fp
+}
+
+// dirSize returns the total size of the files in the directory. The files hard-linked from the package store
+// are skipped with `skipLinks` since they are counted by the store, so each file is counted once.
+func dirSize(dir string, skipLinks bool) (size int64) {
+	filepath.Walk(dir, func(_ string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() && (!skipLinks || getFileLinks(fi) <= 1) {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return
+}
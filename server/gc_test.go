@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/config"
+)
+
+func TestWorkDirGC(t *testing.T) {
+	root := t.TempDir()
+	gc := &workDirGC{refs: map[string]int{}, sizes: map[string]int64{}}
+	now := time.Now()
+	for i, name := range []string{"@scope/b@1.0.0", "a@1.0.0", "c@1.0.0"} {
+		dir := path.Join(root, name)
+		if err := os.MkdirAll(path.Join(dir, "node_modules"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path.Join(dir, "node_modules", "index.js"), []byte(strings.Repeat("x", 100)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if name == "@scope/b@1.0.0" {
+			// the least-recently-used directory is in use by a build
+			release := gc.use(dir)
+			defer release()
+		}
+		accessedAt := now.Add(time.Duration(i-3) * time.Hour)
+		os.Chtimes(dir, accessedAt, accessedAt)
+	}
+
+	if n := gc.collect(root, "", 300); n != 0 {
+		t.Fatalf("nothing should be evicted under the quota, got %d", n)
+	}
+	if n := gc.collect(root, "", 250); n != 1 {
+		t.Fatalf("expected 1 evicted directory, got %d", n)
+	}
+	if existsDir(path.Join(root, "a@1.0.0")) {
+		t.Fatal("the least-recently-used directory should be evicted")
+	}
+	if !existsDir(path.Join(root, "@scope/b@1.0.0")) || !existsDir(path.Join(root, "c@1.0.0")) {
+		t.Fatal("the directories in use or recently used should not be evicted")
+	}
+	status := gc.status()
+	if status["usage"] != int64(200) || status["evicted"] != 1 || status["inUse"] != 1 {
+		t.Fatalf("invalid status: %v", status)
+	}
+}
+
+func TestWorkDirGCWithStore(t *testing.T) {
+	root := t.TempDir()
+	storeRoot := t.TempDir()
+	gc := &workDirGC{refs: map[string]int{}, sizes: map[string]int64{}}
+	now := time.Now()
+
+	// the package in the store is hard-linked into the install directory
+	storeDir := path.Join(storeRoot, "0123abcd")
+	ensureDir(storeDir)
+	if err := os.WriteFile(path.Join(storeDir, "index.js"), []byte(strings.Repeat("x", 100)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	installDir := path.Join(root, "a@1.0.0")
+	if err := linkTree(storeDir, path.Join(installDir, "node_modules", "a")); err != nil {
+		t.Fatal(err)
+	}
+	// the orphan package in the store is the least recently used
+	orphanDir := path.Join(storeRoot, "4567cdef")
+	ensureDir(orphanDir)
+	if err := os.WriteFile(path.Join(orphanDir, "index.js"), []byte(strings.Repeat("x", 100)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i, dir := range []string{orphanDir, installDir, storeDir} {
+		accessedAt := now.Add(time.Duration(i-3) * time.Hour)
+		os.Chtimes(dir, accessedAt, accessedAt)
+	}
+
+	// the hard-linked file is counted once
+	if n := gc.collect(root, storeRoot, 200); n != 0 {
+		t.Fatalf("nothing should be evicted under the quota, got %d", n)
+	}
+	if status := gc.status(); status["usage"] != int64(200) {
+		t.Fatalf("invalid status: %v", status)
+	}
+	if n := gc.collect(root, storeRoot, 150); n != 1 {
+		t.Fatalf("expected 1 evicted directory, got %d", n)
+	}
+	if existsDir(orphanDir) || !existsDir(storeDir) || !existsDir(installDir) {
+		t.Fatal("the least-recently-used store package should be evicted")
+	}
+}
+
+func TestWorkDirGCEvictLinkedStore(t *testing.T) {
+	root := t.TempDir()
+	storeRoot := t.TempDir()
+	gc := &workDirGC{refs: map[string]int{}, sizes: map[string]int64{}}
+	now := time.Now()
+
+	// the least-recently-used store package is still hard-linked into an install directory
+	storeDir := path.Join(storeRoot, "0123abcd")
+	ensureDir(storeDir)
+	if err := os.WriteFile(path.Join(storeDir, "index.js"), []byte(strings.Repeat("x", 100)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	installDir := path.Join(root, "a@1.0.0")
+	if err := linkTree(storeDir, path.Join(installDir, "node_modules", "a")); err != nil {
+		t.Fatal(err)
+	}
+	recentDir := path.Join(root, "b@1.0.0")
+	ensureDir(recentDir)
+	if err := os.WriteFile(path.Join(recentDir, "index.js"), []byte(strings.Repeat("x", 50)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i, dir := range []string{storeDir, installDir, recentDir} {
+		accessedAt := now.Add(time.Duration(i-3) * time.Hour)
+		os.Chtimes(dir, accessedAt, accessedAt)
+	}
+
+	// evicting the store package frees nothing until the install directory is evicted too
+	if n := gc.collect(root, storeRoot, 120); n != 2 {
+		t.Fatalf("expected 2 evicted directories, got %d", n)
+	}
+	if existsDir(storeDir) || existsDir(installDir) || !existsDir(recentDir) {
+		t.Fatal("the store package and the install directory linking it should be evicted")
+	}
+	if status := gc.status(); status["usage"] != int64(50) {
+		t.Fatalf("invalid status: %v", status)
+	}
+}
+
+func TestWorkDirGCTrackedSize(t *testing.T) {
+	root := t.TempDir()
+	gc := &workDirGC{refs: map[string]int{}, sizes: map[string]int64{}}
+	dir := path.Join(root, "a@1.0.0")
+	ensureDir(path.Join(dir, "node_modules"))
+	if err := os.WriteFile(path.Join(dir, "node_modules", "index.js"), []byte(strings.Repeat("x", 100)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the size tracked at install time is used instead of walking the directory
+	gc.track(dir, 1000)
+	if n := gc.collect(root, "", 2000); n != 0 {
+		t.Fatalf("nothing should be evicted under the quota, got %d", n)
+	}
+	if status := gc.status(); status["usage"] != int64(1000) {
+		t.Fatalf("invalid status: %v", status)
+	}
+	if n := gc.collect(root, "", 500); n != 1 || len(gc.sizes) != 0 {
+		t.Fatalf("expected 1 evicted directory, got %d", n)
+	}
+}
+
+func TestWorkDirGCTrackFrozenInstall(t *testing.T) {
+	newTestPnpm(t)
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {})
+	cfg.WorkDir = t.TempDir()
+	cfg.FrozenLockfile = true
+	defer func(gc *workDirGC) { workDirs = gc }(workDirs)
+	workDirs = &workDirGC{refs: map[string]int{}, sizes: map[string]int64{}}
+
+	pkg := Pkg{Name: "foo", Version: "1.0.0"}
+	dir := path.Join(cfg.WorkDir, "npm", pkg.VersionName())
+	for name, content := range map[string]string{
+		"pnpm-lock.yaml":                "lockfileVersion: '6.0'",
+		"node_modules/foo/package.json": `{"name":"foo","version":"1.0.0"}`,
+		"node_modules/foo/index.js":     strings.Repeat("x", 100),
+	} {
+		ensureDir(path.Dir(path.Join(dir, name)))
+		if err := os.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the install from the frozen lockfile is sized for the quota
+	if err := installPackage(context.Background(), dir, pkg); err != nil {
+		t.Fatal(err)
+	}
+	if size := workDirs.sizes[dir]; size < 100 {
+		t.Fatalf("the size of the install directory should be tracked, got %d", size)
+	}
+}
+
+func TestGetInstallDirOf(t *testing.T) {
+	cfg = &config.Config{WorkDir: "/esmd"}
+	defer func() { cfg = nil }()
+
+	for fp, expected := range map[string]string{
+		"/esmd/npm/foo@1.0.0":                                   "/esmd/npm/foo@1.0.0",
+		"/esmd/npm/foo@1.0.0/node_modules/foo":                  "/esmd/npm/foo@1.0.0",
+		"/esmd/npm/@scope/foo@1.0.0/node_modules/.pnpm/x@1.0.0": "/esmd/npm/@scope/foo@1.0.0",
+		"/esmd/npm/gh/owner/repo@abcdef/node_modules":           "/esmd/npm/gh/owner/repo@abcdef",
+		"/custom/foo@1.0.0/node_modules":                        "/custom/foo@1.0.0/node_modules",
+	} {
+		if dir := getInstallDirOf(fp); dir != expected {
+			t.Fatalf("invalid install dir of %s: %s, should be %s", fp, dir, expected)
+		}
+	}
+}
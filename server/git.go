@@ -4,18 +4,22 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/esm-dev/esm.sh/server/storage"
 	"github.com/ije/gox/utils"
+	"github.com/ije/gox/valid"
 )
 
 type GitRef struct {
@@ -26,9 +30,8 @@ type GitRef struct {
 // list repo refs using `git ls-remote repo`
 func listRepoRefs(repo string) (refs []GitRef, err error) {
 	cacheKey := fmt.Sprintf("gh:%s", repo)
-	lock := getFetchLock(cacheKey)
-	lock.Lock()
-	defer lock.Unlock()
+	unlock := fetchLocks.Lock(cacheKey)
+	defer unlock()
 
 	// check cache firstly
 	if cache != nil {
@@ -42,56 +45,243 @@ func listRepoRefs(repo string) (refs []GitRef, err error) {
 		}
 	}
 
-	cmd := exec.Command("git", "ls-remote", repo)
-	out := bytes.NewBuffer(nil)
-	errOut := bytes.NewBuffer(nil)
-	cmd.Stdout = out
-	cmd.Stderr = errOut
-	err = cmd.Run()
+	// the refs of the github repositories are fetched by the smart HTTP protocol without git
+	if strings.HasPrefix(repo, ghOrigin+"/") {
+		refs, err = fetchRepoRefs(repo)
+		if err != nil {
+			return
+		}
+	} else {
+		var gitConfig []string
+		gitConfig, err = checkGitRepoURL(repo)
+		if err != nil {
+			return
+		}
+		args := append(gitConfig, "-c", "http.followRedirects=false", "ls-remote", "--end-of-options", repo)
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(append(os.Environ(), "GIT_TERMINAL_PROMPT=0"), proxyEnv()...)
+		out := bytes.NewBuffer(nil)
+		errOut := bytes.NewBuffer(nil)
+		cmd.Stdout = out
+		cmd.Stderr = errOut
+		err = cmd.Run()
+		if err != nil {
+			if errOut.Len() > 0 {
+				return nil, fmt.Errorf(errOut.String())
+			}
+			return nil, err
+		}
+		refs = []GitRef{}
+		for _, line := range strings.Split(out.String(), "\n") {
+			if line == "" {
+				continue
+			}
+			sha, ref := utils.SplitByLastByte(line, '\t')
+			refs = append(refs, GitRef{
+				Ref: ref,
+				Sha: sha,
+			})
+		}
+	}
+
+	if cache != nil {
+		cache.Set(cacheKey, mustEncodeJSON(refs), 10*time.Minute)
+	}
+	return
+}
+
+// fetchRepoRefs fetches the refs of the repository by the ref advertisement of the smart HTTP protocol,
+// which is the same as the output of `git ls-remote`.
+func fetchRepoRefs(repo string) (refs []GitRef, err error) {
+	res, err := newHttpClient(30 * time.Second).Get(strings.TrimSuffix(repo, ".git") + ".git/info/refs?service=git-upload-pack")
 	if err != nil {
-		if errOut.Len() > 0 {
-			return nil, fmt.Errorf(errOut.String())
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		if res.StatusCode == 401 || res.StatusCode == 404 {
+			return nil, newRegistryError(ErrPackageNotFound, "repository '%s' not found", repo)
 		}
-		return nil, err
+		return nil, fmt.Errorf("fetch refs of %s: %s", repo, res.Status)
 	}
 	refs = []GitRef{}
-	for _, line := range strings.Split(out.String(), "\n") {
-		if line == "" {
+	r := io.LimitReader(res.Body, 64*1024*1024)
+	lenBuf := make([]byte, 4)
+	for {
+		_, err = io.ReadFull(r, lenBuf)
+		if err == io.EOF {
+			return refs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var n uint64
+		n, err = strconv.ParseUint(string(lenBuf), 16, 16)
+		if err != nil {
+			return nil, fmt.Errorf("fetch refs of %s: invalid pkt-line", repo)
+		}
+		// the flush-pkt
+		if n < 4 {
+			continue
+		}
+		line := make([]byte, n-4)
+		_, err = io.ReadFull(r, line)
+		if err != nil {
+			return nil, err
+		}
+		// the service header, e.g. "# service=git-upload-pack"
+		if line[0] == '#' {
 			continue
 		}
-		sha, ref := utils.SplitByLastByte(line, '\t')
-		refs = append(refs, GitRef{
-			Ref: ref,
-			Sha: sha,
-		})
+		// the capabilities follow the first ref after a NUL byte
+		s, _, _ := strings.Cut(strings.TrimSuffix(string(line), "\n"), "\x00")
+		sha, ref, ok := strings.Cut(s, " ")
+		if ok && len(sha) == 40 {
+			refs = append(refs, GitRef{Ref: ref, Sha: sha})
+		}
+	}
+}
+
+// the origins of github, overridden by tests
+var (
+	ghOrigin         = "https://github.com"
+	ghApiOrigin      = "https://api.github.com"
+	ghCodeloadOrigin = "https://codeload.github.com"
+)
+
+// newGhApiRequest creates a request of the GitHub API authenticated with `cfg.GithubToken`.
+func newGhApiRequest(ctx context.Context, apiPath string, accept string) (req *http.Request, err error) {
+	req, err = http.NewRequestWithContext(ctx, "GET", ghApiOrigin+apiPath, nil)
+	if err != nil {
+		return
 	}
+	req.Header.Set("Accept", accept)
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	if cfg != nil && cfg.GithubToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.GithubToken)
+	}
+	return
+}
+
+// resolveGhRef resolves the ref (a tag, a branch or HEAD) of the github repository to the commit SHA by the GitHub API,
+// which is used instead of the ref advertisement to access the private repositories with `cfg.GithubToken`.
+func resolveGhRef(name string, ref string) (sha string, err error) {
+	cacheKey := fmt.Sprintf("gh-ref:%s#%s", name, ref)
+	unlock := fetchLocks.Lock(cacheKey)
+	defer unlock()
 
+	// check cache firstly
 	if cache != nil {
-		cache.Set(cacheKey, mustEncodeJSON(refs), 10*time.Minute)
+		var data []byte
+		data, err = cache.Get(cacheKey)
+		if err == nil {
+			return string(data), nil
+		}
+		if err != storage.ErrNotFound && err != storage.ErrExpired {
+			log.Error("cache:", err)
+		}
+	}
+
+	req, err := newGhApiRequest(context.Background(), fmt.Sprintf("/repos/%s/commits/%s", name, url.PathEscape(ref)), "application/vnd.github.sha")
+	if err != nil {
+		return
+	}
+	res, err := newHttpClient(30 * time.Second).Do(req)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 404 || res.StatusCode == 422 {
+		return "", newRegistryError(ErrVersionNotFound, "tag or branch not found")
+	}
+	if res.StatusCode != 200 {
+		return "", fmt.Errorf("resolve %s#%s: %s", name, ref, res.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(res.Body, 256))
+	if err != nil {
+		return
+	}
+	sha = strings.TrimSpace(string(data))
+	if len(sha) != 40 || !valid.IsHexString(sha) {
+		return "", fmt.Errorf("resolve %s#%s: invalid commit sha %q", name, ref, sha)
+	}
+
+	if cache != nil {
+		cache.Set(cacheKey, []byte(sha), 10*time.Minute)
 	}
 	return
 }
 
-func ghInstall(wd, name, hash string) (err error) {
-	c := &http.Client{
-		Timeout: 30 * time.Second,
+// fetchGhTarball downloads the tarball of the github repository at the ref and extracts it into the dir,
+// the tarball is downloaded by the GitHub API with `cfg.GithubToken` if it's set for the private repositories.
+func fetchGhTarball(ctx context.Context, name string, ref string, dir string) (err error) {
+	var req *http.Request
+	if cfg != nil && cfg.GithubToken != "" {
+		// the API redirects to codeload.github.com with a temporary token,
+		// the `Authorization` header is not forwarded to the other host.
+		req, err = newGhApiRequest(ctx, fmt.Sprintf("/repos/%s/tarball/%s", name, url.PathEscape(ref)), "application/vnd.github+json")
+	} else {
+		req, err = http.NewRequestWithContext(ctx, "GET", fmt.Sprintf(`%s/%s/tar.gz/%s`, ghCodeloadOrigin, name, ref), nil)
+	}
+	if err != nil {
+		return
 	}
-	url := fmt.Sprintf(`https://codeload.github.com/%s/tar.gz/%s`, name, hash)
-	res, err := c.Get(url)
+	res, err := newHttpClient(30 * time.Second).Do(req)
 	if err != nil {
 		return
 	}
 	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		if res.StatusCode == 404 {
+			return newRegistryError(ErrVersionNotFound, "gh install %s#%s: %s", name, ref, res.Status)
+		}
+		return fmt.Errorf("gh install %s#%s: %s", name, ref, res.Status)
+	}
+	return extractTarball(res.Body, dir)
+}
 
-	// unzip tarball
-	unziped, err := gzip.NewReader(res.Body)
+// ghInstall installs the github package by downloading the tarball of the commit from codeload.github.com
+// into `node_modules/{owner}/{repo}` without git, the dependencies of the package are installed by the installer.
+func ghInstall(ctx context.Context, wd string, pkg Pkg) (err error) {
+	ensureDir(wd)
+	tmpDir, err := os.MkdirTemp(wd, ".gh-")
 	if err != nil {
 		return
 	}
+	defer os.RemoveAll(tmpDir)
 
-	// extract tarball
+	err = fetchGhTarball(ctx, pkg.Name, pkg.Version, tmpDir)
+	if err != nil {
+		return
+	}
+	// the repository may not have the `package.json`
+	packageJsonFp := path.Join(tmpDir, "package.json")
+	if !existsFile(packageJsonFp) {
+		err = os.WriteFile(packageJsonFp, mustEncodeJSON(pkg), 0644)
+		if err != nil {
+			return
+		}
+	}
+	// the temporary directory is created with mode 0700
+	err = os.Chmod(tmpDir, 0755)
+	if err != nil {
+		return
+	}
+	return installRepoPackage(ctx, wd, pkg.Name, tmpDir)
+}
+
+// extractTarball extracts the gzipped tarball into the dir, the root dir of the tarball (e.g. `package/`)
+// is stripped, the dot files in the root and the entries that are not regular files are skipped.
+func extractTarball(r io.Reader, dir string) (err error) {
+	unziped, err := gzip.NewReader(r)
+	if err != nil {
+		return
+	}
+	err = ensureDir(dir)
+	if err != nil {
+		return
+	}
 	tr := tar.NewReader(unziped)
-	rootDir := path.Join(wd, "node_modules", name)
 	for {
 		h, err := tr.Next()
 		if err == io.EOF {
@@ -102,10 +292,13 @@ func ghInstall(wd, name, hash string) (err error) {
 		}
 		// strip tarball root dir
 		hname := strings.Join(strings.Split(h.Name, "/")[1:], "/")
-		if strings.HasPrefix(hname, ".") {
+		if hname == "" || strings.HasPrefix(hname, ".") {
+			continue
+		}
+		fp := path.Join(dir, hname)
+		if !strings.HasPrefix(fp, dir+"/") {
 			continue
 		}
-		fp := path.Join(rootDir, hname)
 		if h.Typeflag == tar.TypeDir {
 			ensureDir(fp)
 			continue
@@ -113,6 +306,11 @@ func ghInstall(wd, name, hash string) (err error) {
 		if h.Typeflag != tar.TypeReg {
 			continue
 		}
+		// the tarball may not contain the entries of the parent directories
+		err = ensureDir(path.Dir(fp))
+		if err != nil {
+			return err
+		}
 		f, err := os.OpenFile(fp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 		if err != nil {
 			return err
@@ -123,5 +321,348 @@ func ghInstall(wd, name, hash string) (err error) {
 			return err
 		}
 	}
+	return nil
+}
+
+// the origin of the GitLab API, overridden by tests
+var gitlabOrigin = "https://gitlab.com"
+
+// parseGitlabSpecifier parses the `gitlab:owner/repo#ref` specifier, the owner can be a group with subgroups.
+func parseGitlabSpecifier(specifier string) (repo string, ref string, ok bool) {
+	if !strings.HasPrefix(specifier, "gitlab:") {
+		return
+	}
+	repo, ref = utils.SplitByFirstByte(specifier[7:], '#')
+	segs := strings.Split(repo, "/")
+	if len(segs) < 2 {
+		return
+	}
+	for _, seg := range segs {
+		if seg == "" || seg == "." || seg == ".." {
+			return
+		}
+	}
+	ok = true
 	return
 }
+
+// resolveGitlabRef resolves the ref (a tag, a branch or HEAD) of the `gitlab:owner/repo#ref` specifier to the
+// commit SHA by the GitLab API, so the installed package and the builds are cached by the commit.
+func resolveGitlabRef(repo string, ref string) (sha string, err error) {
+	if ref == "" {
+		ref = "HEAD"
+	}
+	cacheKey := fmt.Sprintf("gitlab-ref:%s#%s", repo, ref)
+	unlock := fetchLocks.Lock(cacheKey)
+	defer unlock()
+
+	// check cache firstly
+	if cache != nil {
+		var data []byte
+		data, err = cache.Get(cacheKey)
+		if err == nil {
+			return string(data), nil
+		}
+		if err != storage.ErrNotFound && err != storage.ErrExpired {
+			log.Error("cache:", err)
+		}
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/api/v4/projects/%s/repository/commits/%s", gitlabOrigin, url.PathEscape(repo), url.PathEscape(ref)), nil)
+	if err != nil {
+		return
+	}
+	if cfg != nil && cfg.GitlabToken != "" {
+		req.Header.Set("PRIVATE-TOKEN", cfg.GitlabToken)
+	}
+	res, err := newHttpClient(30 * time.Second).Do(req)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 404 {
+		// the body is `{"message":"404 Project Not Found"}` or `{"message":"404 Commit Not Found"}`
+		var m struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(io.LimitReader(res.Body, 1024)).Decode(&m)
+		if strings.Contains(m.Message, "Project") {
+			return "", newRegistryError(ErrPackageNotFound, "gitlab: repository '%s' not found", repo)
+		}
+		return "", newRegistryError(ErrVersionNotFound, "gitlab: ref '%s' not found in '%s'", ref, repo)
+	}
+	if res.StatusCode != 200 {
+		return "", fmt.Errorf("resolve gitlab:%s#%s: %s", repo, ref, res.Status)
+	}
+	var commit struct {
+		ID string `json:"id"`
+	}
+	err = json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&commit)
+	if err != nil {
+		return
+	}
+	sha = commit.ID
+	if len(sha) != 40 || !valid.IsHexString(sha) {
+		return "", fmt.Errorf("resolve gitlab:%s#%s: invalid commit sha %q", repo, ref, sha)
+	}
+
+	if cache != nil {
+		cache.Set(cacheKey, []byte(sha), 10*time.Minute)
+	}
+	return
+}
+
+// gitlabInstall downloads the repository archive of the `gitlab:owner/repo#ref` specifier by the GitLab API
+// into `node_modules/{name}`, the private repositories are accessed with `cfg.GitlabToken`.
+func gitlabInstall(ctx context.Context, wd, name, specifier string) (err error) {
+	repo, ref, ok := parseGitlabSpecifier(specifier)
+	if !ok {
+		return fmt.Errorf("invalid gitlab specifier '%s'", specifier)
+	}
+	archiveURL := fmt.Sprintf("%s/api/v4/projects/%s/repository/archive.tar.gz", gitlabOrigin, url.PathEscape(repo))
+	if ref != "" {
+		archiveURL += "?sha=" + url.QueryEscape(ref)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", archiveURL, nil)
+	if err != nil {
+		return
+	}
+	if cfg.GitlabToken != "" {
+		req.Header.Set("PRIVATE-TOKEN", cfg.GitlabToken)
+	}
+	res, err := newHttpClient(30 * time.Second).Do(req)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("gitlab install %s: %s", specifier, res.Status)
+	}
+
+	ensureDir(wd)
+	tmpDir, err := os.MkdirTemp(wd, ".gitlab-")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	err = extractTarball(res.Body, tmpDir)
+	if err != nil {
+		return
+	}
+	if !existsFile(path.Join(tmpDir, "package.json")) {
+		return fmt.Errorf("gitlab install %s: package.json not found", specifier)
+	}
+	return installRepoPackage(ctx, wd, name, tmpDir)
+}
+
+// isGitlabRegistry returns true if the registry is a GitLab npm registry
+// (e.g. `https://gitlab.com/api/v4/packages/npm/`).
+func isGitlabRegistry(registry string) bool {
+	return strings.Contains(registry, "/api/v4/") && strings.Contains(registry, "/packages/npm/")
+}
+
+// parseGitURL parses the git URL specifier like `git+https://host/repo.git#ref&path:packages/foo`,
+// the optional `path:` parameter specifies the sub-directory of the package in the repository.
+func parseGitURL(specifier string) (repo string, ref string, subdir string, ok bool) {
+	if !strings.HasPrefix(specifier, "git+") && !strings.HasPrefix(specifier, "git://") {
+		return
+	}
+	repo, hash := utils.SplitByFirstByte(strings.TrimPrefix(specifier, "git+"), '#')
+	for _, p := range strings.Split(hash, "&") {
+		if strings.HasPrefix(p, "path:") {
+			subdir = strings.TrimPrefix(path.Clean("/"+p[5:]), "/")
+		} else if p != "" {
+			ref = p
+		}
+	}
+	ok = repo != ""
+	return
+}
+
+// checkGitRepoURL checks the repository url before running any git command against it to prevent the SSRF,
+// only the https urls of the public hosts are allowed. The returned config options pin the git process to the
+// checked addresses of the host, so the host can't be rebound to a private address by the DNS. Overridden by tests.
+var checkGitRepoURL = func(repo string) (gitConfig []string, err error) {
+	u, err := url.Parse(repo)
+	if err != nil || u.Scheme != "https" || u.User != nil || u.Hostname() == "" {
+		return nil, newRegistryError(ErrInvalidSpecifier, "git: unsupported repository url '%s'", repo)
+	}
+	ips, err := lookupPublicIPs(context.Background(), u.Hostname())
+	if err != nil {
+		return nil, newRegistryError(ErrInvalidSpecifier, "git: host '%s' is not allowed", u.Hostname())
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		if ip.To4() != nil {
+			addrs[i] = ip.String()
+		} else {
+			addrs[i] = "[" + ip.String() + "]"
+		}
+	}
+	return []string{"-c", fmt.Sprintf("http.curloptResolve=%s:%s:%s", u.Hostname(), port, strings.Join(addrs, ","))}, nil
+}
+
+// resolveGitURL resolves the ref (a tag, a branch or HEAD) of the git URL specifier to the commit SHA
+// with `git ls-remote`, so the installed package and the builds are cached by the commit.
+func resolveGitURL(specifier string) (string, error) {
+	repo, ref, subdir, ok := parseGitURL(specifier)
+	if !ok {
+		return "", fmt.Errorf("invalid git url '%s'", specifier)
+	}
+	if len(ref) == 40 && valid.IsHexString(ref) {
+		return specifier, nil
+	}
+	refs, err := listRepoRefs(repo)
+	if err != nil {
+		return "", err
+	}
+	var sha string
+	for _, r := range refs {
+		if ref == "" && r.Ref == "HEAD" {
+			sha = r.Sha
+			break
+		}
+		if r.Ref == "refs/tags/"+ref+"^{}" {
+			// the commit of the annotated tag
+			sha = r.Sha
+			break
+		}
+		if r.Ref == "refs/tags/"+ref || (r.Ref == "refs/heads/"+ref && sha == "") {
+			sha = r.Sha
+		}
+	}
+	if sha == "" {
+		return "", newRegistryError(ErrVersionNotFound, "git: ref '%s' not found in '%s'", ref, repo)
+	}
+	resolved := repo + "#" + sha
+	if subdir != "" {
+		resolved += "&path:" + subdir
+	}
+	if strings.HasPrefix(specifier, "git+") {
+		resolved = "git+" + resolved
+	}
+	return resolved, nil
+}
+
+// gitInstall clones the package from the git URL specifier into `node_modules/{name}`,
+// the dependencies of the package are installed by pnpm.
+func gitInstall(ctx context.Context, wd, name, specifier string) (err error) {
+	repo, ref, subdir, ok := parseGitURL(specifier)
+	if !ok {
+		return fmt.Errorf("invalid git url '%s'", specifier)
+	}
+	if ref == "" {
+		ref = "HEAD"
+	}
+	gitConfig, err := checkGitRepoURL(repo)
+	if err != nil {
+		return
+	}
+	ctx, cancel := withInstallTimeout(ctx)
+	defer cancel()
+
+	ensureDir(wd)
+	tmpDir, err := os.MkdirTemp(wd, ".git-")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	err = runGit(ctx, tmpDir, "init", "-q")
+	if err == nil {
+		args := append(gitConfig, "-c", "http.followRedirects=false", "fetch", "-q", "--depth", "1", "--end-of-options", repo, ref)
+		err = runGit(ctx, tmpDir, args...)
+	}
+	if err == nil {
+		err = runGit(ctx, tmpDir, "checkout", "-q", "FETCH_HEAD")
+	}
+	if err != nil {
+		return
+	}
+
+	os.RemoveAll(path.Join(tmpDir, ".git"))
+	pkgDir := path.Join(tmpDir, subdir)
+	if !existsFile(path.Join(pkgDir, "package.json")) {
+		return fmt.Errorf("git install %s: package.json not found in '%s'", specifier, subdir)
+	}
+	return installRepoPackage(ctx, wd, name, pkgDir)
+}
+
+// installRepoPackage moves the package checked out from a repository into `node_modules/{name}`,
+// the dependencies of the package are installed by pnpm. The package.json is untrusted, so only the
+// dependencies resolved by the npm registry are installed.
+func installRepoPackage(ctx context.Context, wd, name, pkgDir string) (err error) {
+	var p NpmPackageJSON
+	err = parseJSONFile(path.Join(pkgDir, "package.json"), &p)
+	if err != nil {
+		return
+	}
+
+	dependencies := filterRegistryDependencies(name, p.Dependencies)
+	deps := make([]string, 0, len(dependencies)+len(p.OptionalDependencies))
+	for depName, depVersion := range dependencies {
+		deps = append(deps, depName+"@"+depVersion)
+	}
+	deps = append(deps, filterOptionalDependencies(name, filterRegistryDependencies(name, p.OptionalDependencies))...)
+	if len(deps) > 0 {
+		err = installPackages(ctx, wd, deps...)
+		if err != nil {
+			return
+		}
+	}
+
+	rootDir := path.Join(wd, "node_modules", name)
+	os.RemoveAll(rootDir)
+	ensureDir(path.Dir(rootDir))
+	return os.Rename(pkgDir, rootDir)
+}
+
+// filterRegistryDependencies drops the dependencies that are not resolved by the npm registry, the installers
+// honor the `file:`, `link:`, git and tarball url specs that could link the server paths into `node_modules`.
+func filterRegistryDependencies(name string, dependencies map[string]string) map[string]string {
+	filtered := make(map[string]string, len(dependencies))
+	for depName, depVersion := range dependencies {
+		if !validatePackageName(depName) || !isRegistryVersion(depVersion) {
+			log.Warnf("install %s: the dependency '%s@%s' is not allowed", name, depName, depVersion)
+			continue
+		}
+		filtered[depName] = depVersion
+	}
+	return filtered
+}
+
+// filterOptionalDependencies returns the optional dependencies (e.g. "@esbuild/linux-x64@0.20.2") that are compatible
+// with the build host, the optional dependencies whose `os`/`cpu` fields don't match the build host are skipped, and
+// the ones that can't be resolved are skipped as well like npm does.
+func filterOptionalDependencies(name string, optionalDependencies map[string]string) (deps []string) {
+	platform, arch := hostPlatform(), hostArch()
+	for depName, depVersion := range optionalDependencies {
+		p, err := fetchPackageInfo(depName, depVersion)
+		if err != nil {
+			log.Warnf("install %s: skip the optional dependency %s@%s: %v", name, depName, depVersion, err)
+			continue
+		}
+		if !p.isPlatformCompatible(platform, arch) {
+			log.Debugf("install %s: skip the optional dependency %s@%s for %s-%s", name, depName, depVersion, platform, arch)
+			continue
+		}
+		deps = append(deps, depName+"@"+depVersion)
+	}
+	return
+}
+
+func runGit(ctx context.Context, dir string, args ...string) error {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(append(os.Environ(), "GIT_TERMINAL_PROMPT=0"), proxyEnv()...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("git %s: %s", strings.Join(args, " "), bytes.TrimSpace(output))
+	}
+	return nil
+}
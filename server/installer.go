@@ -0,0 +1,404 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Installer installs the npm packages into the `node_modules` of a directory.
+type Installer interface {
+	// Name returns the name of the installer, e.g. "pnpm".
+	Name() string
+	// Lockfile returns the name of the lockfile written by the installer, e.g. "pnpm-lock.yaml".
+	Lockfile() string
+	// Install adds the packages (e.g. "react@18.2.0") to the directory, or installs the dependencies
+	// of the `package.json` if no package is given.
+	Install(ctx context.Context, dir string, packages []string, opts InstallOptions) error
+	// Integrity returns the integrity (e.g. "sha512-...") of the installed package recorded in the lockfile.
+	Integrity(dir string, name string, version string) (integrity string, ok bool)
+}
+
+// InstallOptions defines the options of `Installer.Install`
+type InstallOptions struct {
+	// install strictly from the lockfile, the lockfile drift is surfaced as an error
+	FrozenLockfile bool
+	// use the packages in the local store without checking the registry
+	PreferOffline bool
+	// the stdout/stderr of the installer are streamed to the writer as they are produced
+	Output io.Writer
+}
+
+// the installers selectable by `cfg.Installer`
+var installers = map[string]Installer{
+	"pnpm": &pnpmInstaller{},
+	"npm": &commandInstaller{
+		name:     "npm",
+		lockfile: "package-lock.json",
+		args: func(packages []string, opts InstallOptions) []string {
+			args := []string{"install"}
+			if opts.FrozenLockfile {
+				args = []string{"ci"}
+			}
+			args = append(args, packages...)
+			if opts.PreferOffline {
+				args = append(args, "--prefer-offline")
+			}
+			return append(args, "--ignore-scripts", "--no-audit", "--no-fund", "--loglevel", "error")
+		},
+		integrity: readNpmLockIntegrity,
+	},
+	"yarn": &commandInstaller{
+		name:     "yarn",
+		lockfile: "yarn.lock",
+		args: func(packages []string, opts InstallOptions) []string {
+			args := []string{"install"}
+			if len(packages) > 0 {
+				args = append([]string{"add"}, packages...)
+			}
+			if opts.FrozenLockfile {
+				args = append(args, "--frozen-lockfile")
+			}
+			if opts.PreferOffline {
+				args = append(args, "--prefer-offline")
+			}
+			return append(args, "--ignore-scripts", "--non-interactive", "--silent")
+		},
+		integrity: readYarnLockIntegrity,
+	},
+	"bun": &commandInstaller{
+		name:     "bun",
+		lockfile: "bun.lock",
+		args: func(packages []string, opts InstallOptions) []string {
+			args := []string{"install"}
+			if len(packages) > 0 {
+				args = append([]string{"add"}, packages...)
+			}
+			if opts.FrozenLockfile {
+				args = append(args, "--frozen-lockfile")
+			}
+			return append(args, "--ignore-scripts", "--silent")
+		},
+		integrity: readBunLockIntegrity,
+	},
+}
+
+// getInstaller returns the installer selected by `cfg.Installer` (default is pnpm), the packages are
+// installed by the native installer firstly if `cfg.NativeInstall` is enabled. The concurrent installs
+// are limited by `cfg.InstallConcurrency`.
+func getInstaller() Installer {
+	installer := installers["pnpm"]
+	if cfg != nil {
+		if i, ok := installers[cfg.Installer]; ok {
+			installer = i
+		}
+		if cfg.NativeInstall {
+			installer = &nativeInstaller{fallback: installer}
+		}
+	}
+	if installSemaphore != nil {
+		return &limitedInstaller{installer}
+	}
+	return installer
+}
+
+// installPackages installs the packages (e.g. "react@^18.0.0") by the installer.
+func installPackages(ctx context.Context, dir string, packages ...string) error {
+	return getInstaller().Install(ctx, dir, packages, InstallOptions{})
+}
+
+// pnpmInstaller installs the packages by pnpm
+type pnpmInstaller struct{}
+
+func (*pnpmInstaller) Name() string {
+	return "pnpm"
+}
+
+func (*pnpmInstaller) Lockfile() string {
+	return "pnpm-lock.yaml"
+}
+
+func (*pnpmInstaller) Install(ctx context.Context, dir string, packages []string, opts InstallOptions) error {
+	args := append([]string{}, packages...)
+	if opts.FrozenLockfile {
+		args = append(args, "--frozen-lockfile")
+	}
+	if opts.PreferOffline {
+		args = append(args, "--prefer-offline")
+	}
+	return pnpmInstallWithOutput(ctx, dir, opts.Output, args...)
+}
+
+func (*pnpmInstaller) Integrity(dir string, name string, version string) (string, bool) {
+	return readPnpmLockIntegrity(path.Join(dir, "pnpm-lock.yaml"), name, version)
+}
+
+// commandInstaller installs the packages by a package manager command, e.g. npm, yarn or bun.
+type commandInstaller struct {
+	name      string
+	lockfile  string
+	args      func(packages []string, opts InstallOptions) []string
+	integrity func(lockfile string, name string, version string) (string, bool)
+}
+
+func (i *commandInstaller) Name() string {
+	return i.name
+}
+
+func (i *commandInstaller) Lockfile() string {
+	return i.lockfile
+}
+
+func (i *commandInstaller) Install(ctx context.Context, dir string, packages []string, opts InstallOptions) error {
+	ctx, cancel := withInstallTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	cmd := exec.CommandContext(ctx, i.name, i.args(packages, opts)...)
+	cmd.Dir = dir
+	if env := installerEnv(); len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	output := bytes.NewBuffer(nil)
+	if opts.Output != nil {
+		out := io.MultiWriter(output, opts.Output)
+		cmd.Stdout = out
+		cmd.Stderr = out
+	} else {
+		cmd.Stdout = output
+		cmd.Stderr = output
+	}
+	err := cmd.Run()
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s add %s: %w", i.name, strings.Join(packages, ","), ctx.Err())
+		}
+		return fmt.Errorf("%s add %s: %w: %s", i.name, strings.Join(packages, ","), err, bytes.TrimSpace(output.Bytes()))
+	}
+	log.Debug(i.name, "add", strings.Join(packages, ","), "in", time.Since(start))
+	return nil
+}
+
+func (i *commandInstaller) Integrity(dir string, name string, version string) (string, bool) {
+	if i.integrity == nil {
+		return "", false
+	}
+	return i.integrity(path.Join(dir, i.lockfile), name, version)
+}
+
+// nativeInstaller installs the packages without dependencies by extracting the tarballs from the registry
+// directly (see `tarballInstall`), the other packages are installed by the fallback installer.
+type nativeInstaller struct {
+	fallback Installer
+}
+
+func (i *nativeInstaller) Name() string {
+	return "native"
+}
+
+func (i *nativeInstaller) Lockfile() string {
+	return i.fallback.Lockfile()
+}
+
+func (i *nativeInstaller) Install(ctx context.Context, dir string, packages []string, opts InstallOptions) error {
+	if len(packages) == 0 || opts.FrozenLockfile {
+		return i.fallback.Install(ctx, dir, packages, opts)
+	}
+	rest := make([]string, 0, len(packages))
+	for _, spec := range packages {
+		pkg := Pkg{Name: spec}
+		if at := strings.LastIndexByte(spec, '@'); at > 0 {
+			pkg = Pkg{Name: spec[:at], Version: spec[at+1:]}
+		}
+		if !regexpFullVersion.MatchString(pkg.Version) {
+			rest = append(rest, spec)
+			continue
+		}
+		installed, err := tarballInstall(ctx, dir, pkg)
+		if err != nil {
+			if errors.Is(err, ErrIntegrityMismatch) || ctx.Err() != nil {
+				return err
+			}
+			log.Warnf("native install %s: %v, fallback to %s", pkg, err, i.fallback.Name())
+		}
+		if !installed {
+			rest = append(rest, spec)
+		}
+	}
+	if len(rest) == 0 {
+		return nil
+	}
+	return i.fallback.Install(ctx, dir, rest, opts)
+}
+
+func (i *nativeInstaller) Integrity(dir string, name string, version string) (string, bool) {
+	return i.fallback.Integrity(dir, name, version)
+}
+
+// limitedInstaller waits for a slot of the install semaphore before installing the packages,
+// so a burst of the cold requests can't spawn unlimited package manager processes.
+type limitedInstaller struct {
+	Installer
+}
+
+func (i *limitedInstaller) Install(ctx context.Context, dir string, packages []string, opts InstallOptions) error {
+	return withInstallSlot(ctx, strings.Join(packages, ","), func(ctx context.Context) error {
+		return i.Installer.Install(ctx, dir, packages, opts)
+	})
+}
+
+type installSlotKey struct{}
+
+// withInstallSlot calls the function while holding a slot of the install semaphore. The context passed to
+// the function holds the slot, so the nested installs (e.g. the dependencies of a git package) don't wait
+// for another slot, which could deadlock when all the slots are held by the outer installs.
+func withInstallSlot(ctx context.Context, name string, fn func(ctx context.Context) error) error {
+	if installSemaphore == nil || ctx.Value(installSlotKey{}) != nil {
+		return fn(ctx)
+	}
+	start := time.Now()
+	release, err := installSemaphore.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("install %s: %w", name, err)
+	}
+	defer release()
+	if d := time.Since(start); d > time.Second {
+		log.Debugf("install %s: waited %v for the install slot", name, d)
+	}
+	return fn(context.WithValue(ctx, installSlotKey{}, true))
+}
+
+// withInstallTimeout returns the context that is canceled after `cfg.InstallTimeout`, the install
+// process is killed when the context is done.
+func withInstallTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if cfg != nil && cfg.InstallTimeout > 0 {
+		return context.WithTimeout(ctx, time.Duration(cfg.InstallTimeout)*time.Second)
+	}
+	return context.WithCancel(ctx)
+}
+
+// installerEnv returns the environment variables of the credentials used by the `.npmrc`, and the proxy.
+func installerEnv() (env []string) {
+	if cfg.NpmToken != "" {
+		env = append(env, "ESM_NPM_TOKEN="+cfg.NpmToken)
+	}
+	if cfg.NpmUser != "" && cfg.NpmPassword != "" {
+		env = append(
+			env,
+			"ESM_NPM_USER="+cfg.NpmUser,
+			"ESM_NPM_PASSWORD="+base64.StdEncoding.EncodeToString([]byte(cfg.NpmPassword)),
+		)
+	}
+	if cfg.TypesRegistryToken != "" {
+		env = append(env, "ESM_TYPES_REGISTRY_TOKEN="+cfg.TypesRegistryToken)
+	}
+	if cfg.GitlabToken != "" {
+		env = append(env, "ESM_GITLAB_TOKEN="+cfg.GitlabToken)
+	}
+	return append(append(env, npmScopesEnv()...), proxyEnv()...)
+}
+
+// readNpmLockIntegrity reads the integrity of the package in the `package-lock.json` of npm.
+func readNpmLockIntegrity(lockfile string, name string, version string) (integrity string, ok bool) {
+	var lock struct {
+		Packages map[string]struct {
+			Version   string `json:"version"`
+			Integrity string `json:"integrity"`
+		} `json:"packages"`
+	}
+	if parseJSONFile(lockfile, &lock) != nil {
+		return
+	}
+	p, found := lock.Packages["node_modules/"+name]
+	if !found || p.Version != version || p.Integrity == "" {
+		return
+	}
+	return p.Integrity, true
+}
+
+// readYarnLockIntegrity reads the integrity of the package in the `yarn.lock` (v1) of yarn, e.g.
+//
+//	"lodash@^4.17.0", lodash@4.17.21:
+//	  version "4.17.21"
+//	  integrity sha512-...
+//
+// the `checksum` of the yarn berry lockfile is not a subresource integrity, so it's not supported.
+func readYarnLockIntegrity(lockfile string, name string, version string) (integrity string, ok bool) {
+	data, err := os.ReadFile(lockfile)
+	if err != nil {
+		return
+	}
+	inPackage := false
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, " ") {
+			inPackage = false
+			for _, spec := range strings.Split(strings.TrimSuffix(line, ":"), ",") {
+				spec = strings.Trim(strings.TrimSpace(spec), `"`)
+				if i := strings.LastIndexByte(spec, '@'); i > 0 && spec[:i] == name {
+					inPackage = true
+					break
+				}
+			}
+			continue
+		}
+		if !inPackage {
+			continue
+		}
+		key, value, _ := strings.Cut(strings.TrimSpace(line), " ")
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		switch key {
+		case "version":
+			if value != version {
+				inPackage = false
+			}
+		case "integrity":
+			return value, value != ""
+		}
+	}
+	return
+}
+
+var regexpTrailingComma = regexp.MustCompile(`,(\s*[\]}])`)
+
+// readBunLockIntegrity reads the integrity of the package in the text `bun.lock` of bun, e.g.
+//
+//	"packages": {
+//	  "lodash": ["lodash@4.17.21", "", {}, "sha512-..."],
+//	}
+func readBunLockIntegrity(lockfile string, name string, version string) (integrity string, ok bool) {
+	data, err := os.ReadFile(lockfile)
+	if err != nil {
+		return
+	}
+	var lock struct {
+		Packages map[string][]interface{} `json:"packages"`
+	}
+	// the lockfile of bun is JSONC with the trailing commas
+	if json.Unmarshal(regexpTrailingComma.ReplaceAll(data, []byte("$1")), &lock) != nil {
+		return
+	}
+	for _, entry := range lock.Packages {
+		if len(entry) < 4 {
+			continue
+		}
+		if id, _ := entry[0].(string); id != name+"@"+version {
+			continue
+		}
+		if integrity, _ = entry[3].(string); strings.HasPrefix(integrity, "sha") {
+			return integrity, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/config"
+)
+
+func TestInstallers(t *testing.T) {
+	// the stub package managers install the package and write the lockfile of npm
+	binDir := t.TempDir()
+	for _, name := range []string{"npm", "yarn", "bun"} {
+		script := fmt.Sprintf(`#!/bin/sh
+echo "$@" >> %s.args.txt
+spec=$2
+name=${spec%%@*}
+mkdir -p node_modules/$name
+echo "{\"name\":\"$name\",\"version\":\"1.0.0\"}" > node_modules/$name/package.json
+echo "{\"packages\":{\"node_modules/$name\":{\"version\":\"1.0.0\",\"integrity\":\"sha512-AAAA\"}}}" > package-lock.json
+`, path.Join(binDir, name))
+		if err := os.WriteFile(path.Join(binDir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", binDir+":"+os.Getenv("PATH"))
+
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/foo/1.0.0":
+			w.Write([]byte(`{"name":"foo","version":"1.0.0","dist":{"integrity":"sha512-AAAA"}}`))
+		case "/bar/1.0.0":
+			w.Write([]byte(`{"name":"bar","version":"1.0.0","dist":{"integrity":"sha512-BBBB"}}`))
+		default:
+			w.WriteHeader(404)
+		}
+	})
+
+	for name, args := range map[string]string{
+		"npm":  "install foo@1.0.0 --prefer-offline --ignore-scripts --no-audit --no-fund --loglevel error",
+		"yarn": "add foo@1.0.0 --prefer-offline --ignore-scripts --non-interactive --silent",
+		"bun":  "add foo@1.0.0 --ignore-scripts --silent",
+	} {
+		cfg.Installer = name
+		if getInstaller().Name() != name {
+			t.Fatalf("the installer should be %s", name)
+		}
+		dir := t.TempDir()
+		if err := installPackage(context.Background(), dir, Pkg{Name: "foo", Version: "1.0.0"}); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := os.ReadFile(path.Join(binDir, name+".args.txt"))
+		if strings.TrimSpace(string(data)) != args {
+			t.Fatalf("invalid arguments of %s: %q", name, data)
+		}
+	}
+
+	// the integrity recorded in the `package-lock.json` is verified
+	cfg.Installer = "npm"
+	if integrity, ok := getInstaller().Integrity(t.TempDir(), "foo", "1.0.0"); ok {
+		t.Fatalf("the integrity should not be found, got %s", integrity)
+	}
+	dir := t.TempDir()
+	err := installPackage(context.Background(), dir, Pkg{Name: "bar", Version: "1.0.0"})
+	if !errors.Is(err, ErrIntegrityMismatch) {
+		t.Fatalf("expected integrity mismatch error, got %v", err)
+	}
+	if existsFile(path.Join(dir, "package-lock.json")) {
+		t.Fatal("the lockfile of the tampered package should be removed")
+	}
+
+	// the native installer falls back to the configured installer
+	cfg.NativeInstall = true
+	installer := getInstaller()
+	if installer.Name() != "native" || installer.Lockfile() != "package-lock.json" {
+		t.Fatalf("invalid native installer %s (%s)", installer.Name(), installer.Lockfile())
+	}
+	os.Remove(path.Join(binDir, "npm.args.txt"))
+	if err := installPackages(context.Background(), t.TempDir(), "foo@^1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path.Join(binDir, "npm.args.txt"))
+	if !strings.HasPrefix(string(data), "install foo@^1.0.0 ") {
+		t.Fatalf("the range should be installed by npm, got %q", data)
+	}
+}
+
+func TestInstallerExitError(t *testing.T) {
+	cfg = &config.Config{}
+	defer func() { cfg = nil }()
+
+	binDir := t.TempDir()
+	if err := os.WriteFile(path.Join(binDir, "npm"), []byte("#!/bin/sh\necho 'npm error 404'\nexit 3\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir+":"+os.Getenv("PATH"))
+
+	output := bytes.NewBuffer(nil)
+	err := installers["npm"].Install(context.Background(), t.TempDir(), []string{"foo@1.0.0"}, InstallOptions{Output: output})
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 || !strings.Contains(err.Error(), "npm error 404") {
+		t.Fatalf("the exit error of the installer should be returned, got %v", err)
+	}
+	if output.String() != "npm error 404\n" {
+		t.Fatalf("the output of the installer should be streamed to the writer, got %q", output.String())
+	}
+}
+
+func TestLockfileIntegrity(t *testing.T) {
+	dir := t.TempDir()
+	yarnLock := `# yarn lockfile v1
+
+"foo@^1.0.0", foo@1.0.0:
+  version "1.0.0"
+  resolved "https://registry.yarnpkg.com/foo/-/foo-1.0.0.tgz"
+  integrity sha512-AAAA
+
+"@s/bar@^2.0.0":
+  version "2.1.0"
+  integrity sha512-BBBB
+`
+	bunLock := `{
+  "lockfileVersion": 1,
+  "packages": {
+    "foo": ["foo@1.0.0", "", {}, "sha512-AAAA"],
+    "@s/bar": ["@s/bar@2.1.0", "", { "dependencies": { "foo": "^1.0.0" } }, "sha512-BBBB"],
+  },
+}`
+	os.WriteFile(path.Join(dir, "yarn.lock"), []byte(yarnLock), 0644)
+	os.WriteFile(path.Join(dir, "bun.lock"), []byte(bunLock), 0644)
+
+	for _, name := range []string{"yarn", "bun"} {
+		for pkg, expected := range map[string]string{"foo@1.0.0": "sha512-AAAA", "@s/bar@2.1.0": "sha512-BBBB", "foo@2.0.0": "", "baz@1.0.0": ""} {
+			pkgName, version, _ := splitPkgPath(pkg)
+			integrity, ok := installers[name].Integrity(dir, pkgName, version)
+			if integrity != expected || ok != (expected != "") {
+				t.Fatalf("invalid integrity of %s in the %s lockfile: %q", pkg, name, integrity)
+			}
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/storage"
+)
+
+// the origin of the JSR registry, overridden by tests
+var jsrOrigin = "https://jsr.io"
+
+// JsrPackageMeta defines the `meta.json` of a JSR package
+type JsrPackageMeta struct {
+	Scope    string                     `json:"scope"`
+	Name     string                     `json:"name"`
+	Latest   string                     `json:"latest"`
+	Versions map[string]JsrVersionState `json:"versions"`
+}
+
+type JsrVersionState struct {
+	Yanked bool `json:"yanked"`
+}
+
+// JsrVersionMeta defines the `{version}_meta.json` of a JSR package
+type JsrVersionMeta struct {
+	Manifest map[string]JsrManifestEntry `json:"manifest"`
+	Exports  map[string]string           `json:"exports"`
+}
+
+type JsrManifestEntry struct {
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+}
+
+// splitJsrPackageName splits the npm bridge name of a JSR package, e.g. `@jsr/std__encoding` -> (`std`, `encoding`).
+func splitJsrPackageName(name string) (scope string, pkgName string, ok bool) {
+	if !strings.HasPrefix(name, "@jsr/") {
+		return
+	}
+	scope, pkgName, ok = strings.Cut(name[5:], "__")
+	ok = ok && scope != "" && pkgName != ""
+	return
+}
+
+// fetchJsrPackageInfo resolves the version of the JSR package with the jsr.io API directly instead of
+// the npm compatibility layer (npm.jsr.io), the yanked versions are excluded from the resolution.
+func fetchJsrPackageInfo(name string, version string) (info NpmPackageInfo, err error) {
+	scope, pkgName, ok := splitJsrPackageName(name)
+	if !ok {
+		return info, newRegistryError(ErrInvalidSpecifier, "jsr: invalid package name '%s'", name)
+	}
+
+	cacheKey := fmt.Sprintf("jsr:%s@%s", name, version)
+	unlock := fetchLocks.Lock(cacheKey)
+	defer unlock()
+
+	// check cache firstly
+	if cache != nil {
+		var data []byte
+		data, err = cache.Get(cacheKey)
+		if err == nil && json.Unmarshal(data, &info) == nil {
+			return
+		}
+		if err != nil && err != storage.ErrNotFound && err != storage.ErrExpired {
+			log.Error("cache:", err)
+		}
+	}
+
+	var meta JsrPackageMeta
+	err = fetchJsrJSON(fmt.Sprintf("/@%s/%s/meta.json", scope, pkgName), name, "", &meta)
+	if err != nil {
+		return
+	}
+	versions := make(map[string]NpmPackageInfo, len(meta.Versions))
+	for v, state := range meta.Versions {
+		if !state.Yanked {
+			versions[v] = NpmPackageInfo{Name: name, Version: v}
+		}
+	}
+	distTags := map[string]string{}
+	if meta.Latest != "" {
+		distTags["latest"] = meta.Latest
+	}
+	resolvedVersion, err := BestVersion(versions, distTags, version)
+	if err != nil {
+		if !errors.Is(err, ErrVersionNotFound) {
+			return
+		}
+		return info, newRegistryError(ErrVersionNotFound, "jsr: version %s of '@%s/%s' not found", version, scope, pkgName)
+	}
+
+	var versionMeta JsrVersionMeta
+	err = fetchJsrJSON(fmt.Sprintf("/@%s/%s/%s_meta.json", scope, pkgName, resolvedVersion), name, resolvedVersion, &versionMeta)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(versionMeta.packageJSON(name, resolvedVersion, nil), &info)
+	if err != nil {
+		return
+	}
+
+	if cache != nil {
+		ttl := getDistTagCacheTTL(version)
+		if resolvedVersion == version {
+			ttl = 7 * 24 * time.Hour
+		}
+		ttl = jitterTTL(ttl)
+		cache.Set(cacheKey, mustEncodeJSON(info), ttl)
+		recordPackageCacheKey(name, cacheKey, ttl)
+	}
+	return
+}
+
+// fetchJsrJSON fetches the JSON document of the jsr.io API.
+func fetchJsrJSON(pathname string, name string, version string, v interface{}) error {
+	req, err := http.NewRequest("GET", jsrOrigin+pathname, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := fetchRegistry(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 404 {
+		if version != "" {
+			return newRegistryError(ErrVersionNotFound, "jsr: version %s of '%s' not found", version, name)
+		}
+		return newRegistryError(ErrPackageNotFound, "jsr: package '%s' not found", name)
+	}
+	if resp.StatusCode >= 500 {
+		return newRegistryError(ErrRegistryUnavailable, "jsr: registry is unavailable for package '%s' (%s)", name, resp.Status)
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("jsr: could not get metadata of package '%s' (%s)", name, resp.Status)
+	}
+	return decodePackument(name, resp.Body, v)
+}
+
+// packageJSON generates the package.json of the JSR package, the import map of the `deno.json` (or `jsr.json`)
+// is converted to the `imports` field.
+func (m *JsrVersionMeta) packageJSON(name string, version string, imports map[string]string) []byte {
+	p := map[string]interface{}{
+		"name":    name,
+		"version": version,
+		"type":    "module",
+		"exports": m.Exports,
+	}
+	if len(imports) > 0 {
+		p["imports"] = imports
+	}
+	return mustEncodeJSON(p)
+}
+
+// jsrInstall downloads the module sources of the JSR package from jsr.io into `node_modules/{name}`,
+// the checksums of the files are verified by the manifest of the version. The downloads are stopped when the
+// context is done.
+func jsrInstall(ctx context.Context, dir string, pkg Pkg) (err error) {
+	scope, pkgName, ok := splitJsrPackageName(pkg.Name)
+	if !ok {
+		return fmt.Errorf("jsr: invalid package name '%s'", pkg.Name)
+	}
+	info, err := fetchJsrPackageInfo(pkg.Name, pkg.Version)
+	if err != nil {
+		return
+	}
+	var versionMeta JsrVersionMeta
+	err = fetchJsrJSON(fmt.Sprintf("/@%s/%s/%s_meta.json", scope, pkgName, info.Version), pkg.Name, info.Version, &versionMeta)
+	if err != nil {
+		return
+	}
+
+	nodeModulesDir := path.Join(dir, "node_modules")
+	err = ensureDir(nodeModulesDir)
+	if err != nil {
+		return
+	}
+	tmpDir, err := os.MkdirTemp(nodeModulesDir, ".jsr-")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	files := make([]string, 0, len(versionMeta.Manifest))
+	for filename := range versionMeta.Manifest {
+		files = append(files, filename)
+	}
+	sort.Strings(files)
+	for _, filename := range files {
+		fp := path.Join(tmpDir, filename)
+		if !strings.HasPrefix(fp, tmpDir+"/") {
+			continue
+		}
+		err = downloadJsrFile(ctx, fmt.Sprintf("%s/@%s/%s/%s%s", jsrOrigin, scope, pkgName, info.Version, filename), fp, versionMeta.Manifest[filename].Checksum)
+		if err != nil {
+			return
+		}
+	}
+
+	// the import map of the package
+	var imports map[string]string
+	for _, name := range []string{"deno.json", "deno.jsonc", "jsr.json"} {
+		var config struct {
+			Imports map[string]string `json:"imports"`
+		}
+		if parseJSONFile(path.Join(tmpDir, name), &config) == nil && len(config.Imports) > 0 {
+			imports = config.Imports
+			break
+		}
+	}
+	err = os.WriteFile(path.Join(tmpDir, "package.json"), versionMeta.packageJSON(pkg.Name, info.Version, imports), 0644)
+	if err != nil {
+		return
+	}
+
+	pkgDir := path.Join(nodeModulesDir, pkg.Name)
+	err = ensureDir(path.Dir(pkgDir))
+	if err != nil {
+		return
+	}
+	err = os.RemoveAll(pkgDir)
+	if err != nil {
+		return
+	}
+	// the temporary directory is created with mode 0700
+	err = os.Chmod(tmpDir, 0755)
+	if err != nil {
+		return
+	}
+	return os.Rename(tmpDir, pkgDir)
+}
+
+// downloadJsrFile downloads the file of the JSR package and verifies the `sha256-{hex}` checksum,
+// the file without checksum in the manifest is rejected.
+func downloadJsrFile(ctx context.Context, url string, savePath string, checksum string) (err error) {
+	if !strings.HasPrefix(checksum, "sha256-") {
+		return fmt.Errorf("jsr: missing checksum of %s", url)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return
+	}
+	resp, err := fetchRegistry(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("jsr: could not download %s (%s)", url, resp.Status)
+	}
+	err = ensureDir(path.Dir(savePath))
+	if err != nil {
+		return
+	}
+	f, err := os.OpenFile(savePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), &contextReader{ctx, resp.Body})
+	if err != nil {
+		return
+	}
+	if checksum != "sha256-"+hex.EncodeToString(h.Sum(nil)) {
+		return fmt.Errorf("jsr: checksum mismatch of %s", url)
+	}
+	return
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestNativeJsr(t *testing.T) {
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected npm registry request: %s", r.URL.Path)
+		w.WriteHeader(404)
+	})
+	cfg.NativeJsr = true
+
+	files := map[string]string{
+		"/mod.ts":    `export { encode } from "./hex.ts"`,
+		"/hex.ts":    `import { join } from "@std/path"; export const encode = (s: string): string => join(s)`,
+		"/deno.json": `{"name":"@std/encoding","imports":{"@std/path":"jsr:@std/path@^1.0.0"}}`,
+	}
+	manifest := []string{}
+	for name, content := range files {
+		sum := sha256.Sum256([]byte(content))
+		manifest = append(manifest, fmt.Sprintf(`"%s":{"size":%d,"checksum":"sha256-%s"}`, name, len(content), hex.EncodeToString(sum[:])))
+	}
+	var tampered int32
+	jsr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/@std/encoding/meta.json":
+			w.Write([]byte(`{"scope":"std","name":"encoding","latest":"1.0.1","versions":{"1.0.0":{},"1.0.1":{},"1.1.0":{"yanked":true}}}`))
+		case "/@std/encoding/1.0.1_meta.json":
+			fmt.Fprintf(w, `{"manifest":{%s},"exports":{".":"./mod.ts","./hex":"./hex.ts"}}`, strings.Join(manifest, ","))
+		default:
+			name := strings.TrimPrefix(r.URL.Path, "/@std/encoding/1.0.1")
+			if name == "/hex.ts" && atomic.LoadInt32(&tampered) == 1 {
+				w.Write([]byte(`export const encode = "tampered"`))
+				return
+			}
+			if content, ok := files[name]; ok {
+				w.Write([]byte(content))
+				return
+			}
+			w.WriteHeader(404)
+		}
+	}))
+	defer jsr.Close()
+	defer func(origin string) { jsrOrigin = origin }(jsrOrigin)
+	jsrOrigin = jsr.URL
+
+	// the yanked versions are excluded
+	info, err := fetchPackageInfo("@jsr/std__encoding", "^1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "1.0.1" || info.Type != "module" {
+		t.Fatalf("invalid package info %+v", info)
+	}
+	if _, err := fetchPackageInfo("@jsr/std__encoding", "1.1.0"); !errors.Is(err, ErrVersionNotFound) {
+		t.Fatalf("expected version not found error, got %v", err)
+	}
+	if _, err := fetchPackageInfo("@jsr/std__missing", "latest"); !errors.Is(err, ErrPackageNotFound) {
+		t.Fatalf("expected package not found error, got %v", err)
+	}
+
+	dir := t.TempDir()
+	err = installPackage(context.Background(), dir, Pkg{Name: "@jsr/std__encoding", Version: "1.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgDir := path.Join(dir, "node_modules/@jsr/std__encoding")
+	for name, content := range files {
+		data, err := os.ReadFile(path.Join(pkgDir, name))
+		if err != nil || string(data) != content {
+			t.Fatalf("invalid file %s: %q, %v", name, data, err)
+		}
+	}
+	var p NpmPackageInfo
+	err = parseJSONFile(path.Join(pkgDir, "package.json"), &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "@jsr/std__encoding" || p.Version != "1.0.1" || p.Imports["@std/path"] != "jsr:@std/path@^1.0.0" {
+		t.Fatalf("invalid package.json %+v", p)
+	}
+
+	// the checksum mismatch fails the install
+	atomic.StoreInt32(&tampered, 1)
+	err = jsrInstall(context.Background(), t.TempDir(), Pkg{Name: "@jsr/std__encoding", Version: "1.0.1"})
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected checksum mismatch error, got %v", err)
+	}
+
+	// the file without checksum is rejected
+	err = downloadJsrFile(context.Background(), jsr.URL+"/@std/encoding/1.0.1/mod.ts", path.Join(t.TempDir(), "mod.ts"), "")
+	if err == nil || !strings.Contains(err.Error(), "missing checksum") {
+		t.Fatalf("expected missing checksum error, got %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ije/gox/utils"
+)
+
+// BuildLockfile is the lockfile snapshot of a build, it records the resolved versions and the integrity
+// hashes of the packages installed for the build, so the consumers can audit what went into a pinned build.
+type BuildLockfile struct {
+	Package   string                          `json:"package"`
+	Installer string                          `json:"installer"`
+	Packages  map[string]BuildLockfilePackage `json:"packages"`
+}
+
+type BuildLockfilePackage struct {
+	Name      string `json:"name"`
+	Version   string `json:"version"`
+	Integrity string `json:"integrity,omitempty"`
+}
+
+// newBuildLockfile creates the lockfile snapshot of the packages that went into the build, the packages
+// are derived from the input files of the bundle (`inputs`) instead of the shared install directory that
+// may contain the packages of other builds.
+func newBuildLockfile(dir string, pkg Pkg, inputs []string) *BuildLockfile {
+	installer := getInstaller()
+	lock := &BuildLockfile{
+		Package:   pkg.VersionName(),
+		Installer: installer.Name(),
+		Packages:  map[string]BuildLockfilePackage{},
+	}
+	pkgDirs := []string{path.Join(dir, "node_modules", pkg.Name)}
+	for _, input := range inputs {
+		if pkgDir, ok := getInputPackageDir(input); ok {
+			pkgDirs = append(pkgDirs, pkgDir)
+		}
+	}
+	for _, pkgDir := range pkgDirs {
+		var p NpmPackageJSON
+		if parseJSONFile(path.Join(pkgDir, "package.json"), &p) != nil || p.Name == "" || p.Version == "" {
+			continue
+		}
+		key := p.Name + "@" + p.Version
+		if _, ok := lock.Packages[key]; ok {
+			continue
+		}
+		integrity, _ := installer.Integrity(dir, p.Name, p.Version)
+		lock.Packages[key] = BuildLockfilePackage{
+			Name:      p.Name,
+			Version:   p.Version,
+			Integrity: integrity,
+		}
+	}
+	return lock
+}
+
+// getInputPackageDir returns the package directory of the input file in the `node_modules`,
+// e.g. `/wd/node_modules/.pnpm/foo@1.0.0/node_modules/@s/bar/index.js` -> `/wd/node_modules/.pnpm/foo@1.0.0/node_modules/@s/bar`
+func getInputPackageDir(input string) (pkgDir string, ok bool) {
+	i := strings.LastIndex(input, "/node_modules/")
+	if i < 0 {
+		return
+	}
+	segs := strings.Split(input[i+14:], "/")
+	n := 1
+	if strings.HasPrefix(segs[0], "@") {
+		n = 2
+	}
+	if len(segs) <= n || strings.HasPrefix(segs[0], ".") {
+		return
+	}
+	return input[:i+14] + strings.Join(segs[:n], "/"), true
+}
+
+// getMetafileInputs returns the absolute paths of the input files of the esbuild metafile,
+// the paths of the plugin namespaces (e.g. `node-lib:__process.js`) are ignored.
+func getMetafileInputs(metafile string) (inputs []string) {
+	var meta struct {
+		Inputs map[string]json.RawMessage `json:"inputs"`
+	}
+	if json.Unmarshal([]byte(metafile), &meta) != nil {
+		return
+	}
+	cwd, _ := os.Getwd()
+	for input := range meta.Inputs {
+		if ns, _ := utils.SplitByFirstByte(input, ':'); ns != input && !strings.Contains(ns, "/") {
+			continue
+		}
+		if !filepath.IsAbs(input) {
+			input = filepath.Join(cwd, input)
+		}
+		inputs = append(inputs, filepath.ToSlash(input))
+	}
+	sort.Strings(inputs)
+	return
+}
+
+// storeLockfile saves the lockfile snapshot of the build alongside the build artifact.
+func (task *BuildTask) storeLockfile() {
+	if task.wd == "" {
+		return
+	}
+	lock := newBuildLockfile(task.wd, task.Pkg, task.inputs)
+	_, err := fs.WriteFile(task.getSavepath()+".lock.json", bytes.NewReader(mustEncodeJSON(lock)))
+	if err != nil {
+		log.Errorf("fs: %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestBuildLockfile(t *testing.T) {
+	// the install directory of pnpm, the packages are symlinked from the virtual store
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"node_modules/.pnpm/foo@1.0.0/node_modules/foo/package.json":       `{"name":"foo","version":"1.0.0"}`,
+		"node_modules/.pnpm/bar@2.0.0/node_modules/bar/package.json":       `{"name":"bar","version":"2.0.0"}`,
+		"node_modules/.pnpm/@s+baz@1.0.0/node_modules/@s/baz/package.json": `{"name":"@s/baz","version":"1.0.0"}`,
+		"pnpm-lock.yaml": "lockfileVersion: '9.0'\n\npackages:\n\n  foo@1.0.0:\n    resolution: {integrity: sha512-FOO}\n\n  bar@2.0.0:\n    resolution: {integrity: sha512-BAR}\n",
+	} {
+		ensureDir(path.Dir(path.Join(dir, name)))
+		if err := os.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"node_modules/foo": ".pnpm/foo@1.0.0/node_modules/foo",
+		"node_modules/.pnpm/foo@1.0.0/node_modules/bar":  "../../bar@2.0.0/node_modules/bar",
+		"node_modules/.pnpm/foo@1.0.0/node_modules/@s":   "../../@s+baz@1.0.0/node_modules/@s",
+		"node_modules/.pnpm/bar@2.0.0/node_modules/.bin": "../../foo@1.0.0/node_modules/foo",
+	} {
+		if err := os.Symlink(target, path.Join(dir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the `bar` package is installed but not bundled
+	metafile := fmt.Sprintf(
+		`{"inputs":{"%[1]s/node_modules/.pnpm/foo@1.0.0/node_modules/foo/index.js":{},"%[1]s/node_modules/.pnpm/@s+baz@1.0.0/node_modules/@s/baz/index.js":{},"node-lib:__process.js":{}}}`,
+		dir,
+	)
+	inputs := getMetafileInputs(metafile)
+	if len(inputs) != 2 {
+		t.Fatalf("invalid inputs: %v", inputs)
+	}
+	lock := newBuildLockfile(dir, Pkg{Name: "foo", Version: "1.0.0"}, inputs)
+	if lock.Package != "foo@1.0.0" || lock.Installer != "pnpm" || len(lock.Packages) != 2 {
+		t.Fatalf("invalid lockfile: %+v", lock)
+	}
+	for key, integrity := range map[string]string{"foo@1.0.0": "sha512-FOO", "@s/baz@1.0.0": ""} {
+		p, ok := lock.Packages[key]
+		if !ok || p.Integrity != integrity {
+			t.Fatalf("invalid package %s: %+v", key, p)
+		}
+	}
+
+	// the package itself is recorded without the bundled inputs
+	lock = newBuildLockfile(dir, Pkg{Name: "foo", Version: "1.0.0"}, nil)
+	if _, ok := lock.Packages["foo@1.0.0"]; !ok || len(lock.Packages) != 1 {
+		t.Fatalf("invalid lockfile: %+v", lock)
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the shard count of the keyed locks
+const lockShards = 32
+
+// keyedLocks locks by the key, the lock of a key is created on demand and evicted once it's
+// not held or waited by anyone, so the locks don't grow with the requested packages.
+// The zero value is ready to use.
+type keyedLocks struct {
+	shards [lockShards]lockShard
+}
+
+type lockShard struct {
+	lock  sync.Mutex
+	locks map[string]*lockEntry
+}
+
+type lockEntry struct {
+	sync.Mutex
+	// the count of the holder and the waiters
+	refs int
+}
+
+// Lock locks the key and returns the function to unlock it.
+func (kl *keyedLocks) Lock(key string) (unlock func()) {
+	shard := kl.shard(key)
+	shard.lock.Lock()
+	if shard.locks == nil {
+		shard.locks = map[string]*lockEntry{}
+	}
+	l, ok := shard.locks[key]
+	if !ok {
+		l = &lockEntry{}
+		shard.locks[key] = l
+	}
+	l.refs++
+	shard.lock.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		shard.lock.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(shard.locks, key)
+		}
+		shard.lock.Unlock()
+	}
+}
+
+// Len returns the count of the locks in use.
+func (kl *keyedLocks) Len() int {
+	n := 0
+	for i := range kl.shards {
+		shard := &kl.shards[i]
+		shard.lock.Lock()
+		n += len(shard.locks)
+		shard.lock.Unlock()
+	}
+	return n
+}
+
+func (kl *keyedLocks) shard(key string) *lockShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &kl.shards[h.Sum32()%lockShards]
+}
+
+// semaphore limits the count of the concurrent holders, the waiting count and time are recorded as the
+// queueing metrics.
+type semaphore struct {
+	c chan struct{}
+	// the count of the waiters
+	waiting int32
+	// the total count of the acquisitions and the total waiting time
+	acquired int64
+	waitTime int64
+}
+
+func newSemaphore(n int) *semaphore {
+	return &semaphore{c: make(chan struct{}, n)}
+}
+
+// Acquire blocks until a slot is available and returns the function to release the slot,
+// it returns the error of the context if the context is done before that.
+func (s *semaphore) Acquire(ctx context.Context) (release func(), err error) {
+	start := time.Now()
+	atomic.AddInt32(&s.waiting, 1)
+	select {
+	case s.c <- struct{}{}:
+		atomic.AddInt32(&s.waiting, -1)
+	case <-ctx.Done():
+		atomic.AddInt32(&s.waiting, -1)
+		return nil, ctx.Err()
+	}
+	atomic.AddInt64(&s.acquired, 1)
+	atomic.AddInt64(&s.waitTime, int64(time.Since(start)))
+	var once sync.Once
+	release = func() {
+		once.Do(func() { <-s.c })
+	}
+	return
+}
+
+// Status returns the queueing metrics of the semaphore.
+func (s *semaphore) Status() map[string]interface{} {
+	if s == nil {
+		return nil
+	}
+	acquired := atomic.LoadInt64(&s.acquired)
+	avgWait := time.Duration(0)
+	if acquired > 0 {
+		avgWait = time.Duration(atomic.LoadInt64(&s.waitTime) / acquired)
+	}
+	return map[string]interface{}{
+		"concurrency": cap(s.c),
+		"running":     len(s.c),
+		"waiting":     atomic.LoadInt32(&s.waiting),
+		"total":       acquired,
+		"avgWait":     avgWait.String(),
+	}
+}
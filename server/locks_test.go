@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKeyedLocks(t *testing.T) {
+	var locks keyedLocks
+	counters := make([]int, 4)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("pkg-%d", i%len(counters))
+			unlock := locks.Lock(key)
+			defer unlock()
+			// the counter is only updated by the holder of the key
+			counters[i%len(counters)]++
+		}(i)
+	}
+	wg.Wait()
+
+	for i, n := range counters {
+		if n != 25 {
+			t.Fatalf("counter %d should be 25, got %d", i, n)
+		}
+	}
+	if n := locks.Len(); n != 0 {
+		t.Fatalf("the unused locks should be evicted, got %d", n)
+	}
+
+	unlock := locks.Lock("foo")
+	if n := locks.Len(); n != 1 {
+		t.Fatalf("expected 1 lock in use, got %d", n)
+	}
+	unlock()
+	if n := locks.Len(); n != 0 {
+		t.Fatalf("the unused locks should be evicted, got %d", n)
+	}
+}
+
+func TestSemaphore(t *testing.T) {
+	s := newSemaphore(2)
+	var running, maxRunning int32
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := s.Acquire(context.Background())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer release()
+			n := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(&maxRunning)
+				if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		}()
+	}
+	wg.Wait()
+
+	if maxRunning > 2 {
+		t.Fatalf("the concurrency should be limited to 2, got %d", maxRunning)
+	}
+	status := s.Status()
+	if status["total"] != int64(20) || status["running"] != 0 || status["waiting"] != int32(0) {
+		t.Fatalf("invalid status: %v", status)
+	}
+
+	// the waiting is canceled by the context
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	release1, _ := s.Acquire(context.Background())
+	release2, _ := s.Acquire(context.Background())
+	if _, err := s.Acquire(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded error, got %v", err)
+	}
+	release1()
+	release2()
+
+	// the installs wait for the slot of the install semaphore
+	installSemaphore = newSemaphore(1)
+	defer func() { installSemaphore = nil }()
+	if _, ok := getInstaller().(*limitedInstaller); !ok {
+		t.Fatal("the installer should be limited by the install semaphore")
+	}
+
+	// the nested install reuses the slot of the outer install instead of waiting for another one
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := withInstallSlot(ctx, "a", func(ctx context.Context) error {
+		return withInstallSlot(ctx, "b", func(ctx context.Context) error {
+			if running := installSemaphore.Status()["running"]; running != 1 {
+				return fmt.Errorf("expected 1 running install, got %v", running)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if running := installSemaphore.Status()["running"]; running != 0 {
+		t.Fatalf("the slot should be released, got %v running", running)
+	}
+}
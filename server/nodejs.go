@@ -1,10 +1,10 @@
 package server
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
 	"os/exec"
 	"path"
@@ -80,7 +80,13 @@ var denoNextUnspportedNodeModules = map[string]bool{
 	"inspector": true,
 }
 
-func checkNodejs(installDir string) (nodeVersion string, pnpmVersion string, err error) {
+// the node builtin modules that are not implemented by bun, the polyfills are used instead
+var bunUnspportedNodeModules = map[string]bool{
+	"repl":         true,
+	"trace_events": true,
+}
+
+func checkNodejs(installDir string) (nodeVersion string, installerVersion string, err error) {
 	nodeVersion, major, err := getNodejsVersion()
 	usingSystemNodejs := err == nil && major >= nodejsMinVersion
 
@@ -107,17 +113,30 @@ func checkNodejs(installDir string) (nodeVersion string, pnpmVersion string, err
 		return
 	}
 
-	pnpmOutput, err := exec.Command("pnpm", "-v").CombinedOutput()
-	if err != nil && errors.Is(err, exec.ErrNotFound) {
-		out, e := exec.Command("npm", "install", "pnpm", "-g").CombinedOutput()
+	if cfg.Installer != "" && cfg.Installer != "pnpm" {
+		var output []byte
+		output, err = exec.Command(cfg.Installer, "-v").CombinedOutput()
+		if err != nil {
+			err = fmt.Errorf("%s not found: %v", cfg.Installer, err)
+			return
+		}
+		installerVersion = strings.TrimSpace(string(output))
+		return
+	}
+
+	pnpmOutput, err := pnpmCommand(context.Background(), "-v").CombinedOutput()
+	if err != nil && errors.Is(err, exec.ErrNotFound) && cfg.PnpmBinary == "" {
+		cmd := exec.Command("npm", "install", "pnpm", "-g")
+		cmd.Env = append(os.Environ(), proxyEnv()...)
+		out, e := cmd.CombinedOutput()
 		if e != nil {
 			err = fmt.Errorf("failed to install pnpm: %v", string(out))
 			return
 		}
-		pnpmOutput, err = exec.Command("pnpm", "-v").CombinedOutput()
+		pnpmOutput, err = pnpmCommand(context.Background(), "-v").CombinedOutput()
 	}
 	if err == nil {
-		pnpmVersion = strings.TrimSpace(string(pnpmOutput))
+		installerVersion = strings.TrimSpace(string(pnpmOutput))
 	}
 	return
 }
@@ -134,6 +153,25 @@ func getNodejsVersion() (version string, major int, err error) {
 	return
 }
 
+// hostPlatform returns the platform of the build host in the naming of node (`process.platform`).
+func hostPlatform() string {
+	if runtime.GOOS == "windows" {
+		return "win32"
+	}
+	return runtime.GOOS
+}
+
+// hostArch returns the arch of the build host in the naming of node (`process.arch`).
+func hostArch() string {
+	switch runtime.GOARCH {
+	case "amd64":
+		return "x64"
+	case "386":
+		return "ia32"
+	}
+	return runtime.GOARCH
+}
+
 func installNodejs(installDir string, version string) (err error) {
 	arch := runtime.GOARCH
 	switch arch {
@@ -143,7 +181,7 @@ func installNodejs(installDir string, version string) (err error) {
 		arch = "x86"
 	}
 	dlURL := fmt.Sprintf("https://nodejs.org/dist/v%s/node-v%s-%s-%s.tar.xz", version, version, runtime.GOOS, arch)
-	resp, err := http.Get(dlURL)
+	resp, err := newHttpClient(0).Get(dlURL)
 	if err != nil {
 		err = fmt.Errorf("download nodejs: %v", err)
 		return
@@ -1,19 +1,30 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha512"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/esm-dev/esm.sh/server/config"
 	"github.com/esm-dev/esm.sh/server/storage"
 
 	"github.com/Masterminds/semver/v3"
@@ -24,33 +35,163 @@ import (
 // ref https://github.com/npm/validate-npm-package-name
 var npmNaming = valid.Validator{valid.FromTo{'a', 'z'}, valid.FromTo{'A', 'Z'}, valid.FromTo{'0', '9'}, valid.Eq('.'), valid.Eq('-'), valid.Eq('_')}
 
+// the content type of the abbreviated package metadata
+// ref https://github.com/npm/registry/blob/main/docs/responses/package-metadata.md
+const ctNpmAbbreviatedMetadata = "application/vnd.npm.install-v1+json"
+
+var (
+	// ErrPackageNotFound is returned when the package does not exist in the registry.
+	ErrPackageNotFound = errors.New("package not found")
+	// ErrVersionNotFound is returned when no version of the package matches the requested version.
+	ErrVersionNotFound = errors.New("version not found")
+	// ErrUnauthorized is returned when the registry denies the access to the package.
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrRegistryUnavailable is returned when the registry can not be reached or fails to respond.
+	ErrRegistryUnavailable = errors.New("registry unavailable")
+	// ErrInvalidSpecifier is returned when the package name, version or sub-path is malformed.
+	ErrInvalidSpecifier = errors.New("invalid specifier")
+	// ErrPackageForbidden is returned when the package is banned by the `banList` or not in the `allowList`.
+	ErrPackageForbidden = errors.New("package forbidden")
+	// ErrIntegrityMismatch is returned when the installed tarball does not match the checksum advertised by the registry.
+	ErrIntegrityMismatch = errors.New("integrity mismatch")
+)
+
+// RegistryError is a human-readable error of the registry that wraps one of the `Err*` sentinels above.
+type RegistryError struct {
+	Err     error
+	Message string
+}
+
+func (e *RegistryError) Error() string {
+	return e.Message
+}
+
+func (e *RegistryError) Unwrap() error {
+	return e.Err
+}
+
+func newRegistryError(err error, format string, args ...interface{}) error {
+	return &RegistryError{Err: err, Message: fmt.Sprintf(format, args...)}
+}
+
+// isNotFoundError returns true if the package or the version is not found in the registry.
+func isNotFoundError(err error) bool {
+	return errors.Is(err, ErrPackageNotFound) || errors.Is(err, ErrVersionNotFound)
+}
+
+// PackageInfoPatcher patches the package info right after it's resolved from the registry or read from
+// the installed `package.json`, e.g. to fix the bad `exports` or `type` field of known packages.
+// It should be set before `Serve` is called.
+var PackageInfoPatcher func(info *NpmPackageInfo)
+
+// patchPackageInfo applies the `PackageInfoPatcher` to the package info if it's set.
+func patchPackageInfo(info *NpmPackageInfo) {
+	if PackageInfoPatcher != nil {
+		PackageInfoPatcher(info)
+	}
+}
+
+var (
+	registryClient     *http.Client
+	registryClientOnce sync.Once
+	registryBreakers   sync.Map
+	registryTokens     chan struct{}
+	registryTokensOnce sync.Once
+)
+
 // NpmPackageVerions defines versions of a NPM package
 type NpmPackageVerions struct {
 	DistTags map[string]string         `json:"dist-tags"`
 	Versions map[string]NpmPackageInfo `json:"versions"`
+	Time     map[string]string         `json:"time"`
+
+	// the original keys of the normalized versions
+	originalKeys map[string]string
+}
+
+// normalizeVersions normalizes the keys of the `versions` (and the `dist-tags` values) that some registries
+// return with the leading `v` or `=` (e.g. `v1.2.3`), the original keys are kept for the `time` lookup.
+func (h *NpmPackageVerions) normalizeVersions() {
+	versions := make(map[string]NpmPackageInfo, len(h.Versions))
+	h.originalKeys = map[string]string{}
+	for key, p := range h.Versions {
+		v := normalizeVersion(key)
+		if _, ok := versions[v]; ok && v != key {
+			// the exact key wins
+			continue
+		}
+		if normalizeVersion(p.Version) == v {
+			p.Version = v
+		}
+		versions[v] = p
+		h.originalKeys[v] = key
+	}
+	h.Versions = versions
+	for tag, v := range h.DistTags {
+		h.DistTags[tag] = normalizeVersion(v)
+	}
+}
+
+// normalizeVersion returns the normalized version string without the leading `v` or `=`,
+// the build metadata is kept, e.g. `v1.2.3+build` -> `1.2.3+build`.
+func normalizeVersion(version string) string {
+	v := strings.TrimLeft(strings.TrimSpace(version), "v=")
+	if ver, err := semver.StrictNewVersion(v); err == nil {
+		return ver.String()
+	}
+	return version
+}
+
+// isCoolingDown returns true if the version is published within the cooldown period (`cfg.VersionCooldown`),
+// the versions without the publish time are never cooling down.
+func (h *NpmPackageVerions) isCoolingDown(version string) bool {
+	if cfg == nil || cfg.VersionCooldown == 0 {
+		return false
+	}
+	t, ok := h.Time[version]
+	if !ok {
+		if key, ok := h.originalKeys[version]; ok {
+			t = h.Time[key]
+		}
+	}
+	if t == "" {
+		return false
+	}
+	published, err := time.Parse(time.RFC3339, t)
+	if err != nil {
+		return false
+	}
+	return time.Since(published) < time.Duration(cfg.VersionCooldown)*time.Hour
 }
 
 // NpmPackageJSON defines the package.json of NPM
 type NpmPackageJSON struct {
-	Name             string                 `json:"name"`
-	Version          string                 `json:"version"`
-	Type             string                 `json:"type,omitempty"`
-	Main             string                 `json:"main,omitempty"`
-	Browser          StringOrMap            `json:"browser,omitempty"`
-	Module           StringOrMap            `json:"module,omitempty"`
-	ES2015           StringOrMap            `json:"es2015,omitempty"`
-	JsNextMain       string                 `json:"jsnext:main,omitempty"`
-	Types            string                 `json:"types,omitempty"`
-	Typings          string                 `json:"typings,omitempty"`
-	SideEffects      interface{}            `json:"sideEffects,omitempty"`
-	Dependencies     map[string]string      `json:"dependencies,omitempty"`
-	PeerDependencies map[string]string      `json:"peerDependencies,omitempty"`
-	Imports          map[string]interface{} `json:"imports,omitempty"`
-	TypesVersions    map[string]interface{} `json:"typesVersions,omitempty"`
-	Exports          json.RawMessage        `json:"exports,omitempty"`
-	Files            []string               `json:"files,omitempty"`
-	Deprecated       interface{}            `json:"deprecated,omitempty"`
-	Esmsh            interface{}            `json:"esm.sh,omitempty"`
+	Name                 string                 `json:"name"`
+	Version              string                 `json:"version"`
+	Type                 string                 `json:"type,omitempty"`
+	Main                 string                 `json:"main,omitempty"`
+	Browser              StringOrMap            `json:"browser,omitempty"`
+	Module               StringOrMap            `json:"module,omitempty"`
+	ES2015               StringOrMap            `json:"es2015,omitempty"`
+	JsNextMain           string                 `json:"jsnext:main,omitempty"`
+	Types                string                 `json:"types,omitempty"`
+	Typings              string                 `json:"typings,omitempty"`
+	SideEffects          interface{}            `json:"sideEffects,omitempty"`
+	Dependencies         map[string]string      `json:"dependencies,omitempty"`
+	PeerDependencies     map[string]string      `json:"peerDependencies,omitempty"`
+	OptionalDependencies map[string]string      `json:"optionalDependencies,omitempty"`
+	Imports              map[string]interface{} `json:"imports,omitempty"`
+	TypesVersions        map[string]interface{} `json:"typesVersions,omitempty"`
+	Exports              json.RawMessage        `json:"exports,omitempty"`
+	Files                []string               `json:"files,omitempty"`
+	Deprecated           interface{}            `json:"deprecated,omitempty"`
+	Esmsh                interface{}            `json:"esm.sh,omitempty"`
+	BundleDeps           interface{}            `json:"bundleDependencies,omitempty"`
+	BundledDeps          interface{}            `json:"bundledDependencies,omitempty"`
+	Engines              interface{}            `json:"engines,omitempty"`
+	Os                   []string               `json:"os,omitempty"`
+	Cpu                  []string               `json:"cpu,omitempty"`
+	Dist                 npmDist                `json:"dist,omitempty"`
 }
 
 func (a *NpmPackageJSON) ToNpmPackage() *NpmPackageInfo {
@@ -99,6 +240,34 @@ func (a *NpmPackageJSON) ToNpmPackage() *NpmPackageInfo {
 			}
 		}
 	}
+	var bundledDependencies []string
+	for _, v := range []interface{}{a.BundleDeps, a.BundledDeps} {
+		if b, ok := v.(bool); ok && b {
+			// `true` means all dependencies are bundled
+			for name := range a.Dependencies {
+				bundledDependencies = append(bundledDependencies, name)
+			}
+			break
+		} else if m, ok := v.([]interface{}); ok && len(m) > 0 {
+			for _, v := range m {
+				if name, ok := v.(string); ok && name != "" {
+					bundledDependencies = append(bundledDependencies, name)
+				}
+			}
+			break
+		}
+	}
+	var engines map[string]string
+	if m, ok := a.Engines.(map[string]interface{}); ok {
+		for k, v := range m {
+			if s, ok := v.(string); ok {
+				if engines == nil {
+					engines = map[string]string{}
+				}
+				engines[k] = s
+			}
+		}
+	}
 	var exports interface{} = nil
 	if rawExports := a.Exports; rawExports != nil {
 		var v interface{}
@@ -116,52 +285,96 @@ func (a *NpmPackageJSON) ToNpmPackage() *NpmPackageInfo {
 		}
 	}
 	return &NpmPackageInfo{
-		Name:             a.Name,
-		Version:          a.Version,
-		Type:             a.Type,
-		Main:             a.Main,
-		Module:           a.Module.MainValue(),
-		ES2015:           a.ES2015.MainValue(),
-		JsNextMain:       a.JsNextMain,
-		Types:            a.Types,
-		Typings:          a.Typings,
-		Browser:          browser,
-		SideEffectsFalse: sideEffectsFalse,
-		SideEffects:      sideEffects,
-		Dependencies:     a.Dependencies,
-		PeerDependencies: a.PeerDependencies,
-		Imports:          a.Imports,
-		TypesVersions:    a.TypesVersions,
-		Exports:          exports,
-		Files:            a.Files,
-		Deprecated:       deprecated,
-		Esmsh:            esmsh,
+		Name:                 a.Name,
+		Version:              a.Version,
+		Type:                 a.Type,
+		Main:                 a.Main,
+		Module:               a.Module.MainValue(),
+		ES2015:               a.ES2015.MainValue(),
+		JsNextMain:           a.JsNextMain,
+		Types:                a.Types,
+		Typings:              a.Typings,
+		Browser:              browser,
+		SideEffectsFalse:     sideEffectsFalse,
+		SideEffects:          sideEffects,
+		Dependencies:         a.Dependencies,
+		PeerDependencies:     a.PeerDependencies,
+		OptionalDependencies: a.OptionalDependencies,
+		Imports:              a.Imports,
+		TypesVersions:        a.TypesVersions,
+		Exports:              exports,
+		Files:                a.Files,
+		Deprecated:           deprecated,
+		Esmsh:                esmsh,
+		BundledDependencies:  bundledDependencies,
+		Engines:              engines,
+		Os:                   a.Os,
+		Cpu:                  a.Cpu,
+		Dist:                 a.Dist,
 	}
 }
 
 // NpmPackage defines the package.json
 type NpmPackageInfo struct {
-	Name             string
-	PkgName          string
-	Version          string
-	Type             string
-	Main             string
-	Module           string
-	ES2015           string
-	JsNextMain       string
-	Types            string
-	Typings          string
-	SideEffectsFalse bool
-	SideEffects      *StringSet
-	Browser          map[string]string
-	Dependencies     map[string]string
-	PeerDependencies map[string]string
-	Imports          map[string]interface{}
-	TypesVersions    map[string]interface{}
-	Exports          interface{}
-	Files            []string
-	Deprecated       string
-	Esmsh            map[string]interface{}
+	Name                 string
+	PkgName              string
+	Version              string
+	Type                 string
+	Main                 string
+	Module               string
+	ES2015               string
+	JsNextMain           string
+	Types                string
+	Typings              string
+	SideEffectsFalse     bool
+	SideEffects          *StringSet
+	Browser              map[string]string
+	Dependencies         map[string]string
+	PeerDependencies     map[string]string
+	OptionalDependencies map[string]string
+	Imports              map[string]interface{}
+	TypesVersions        map[string]interface{}
+	Exports              interface{}
+	Files                []string
+	Deprecated           string
+	Esmsh                map[string]interface{}
+	BundledDependencies  []string
+	Engines              map[string]string
+	Os                   []string
+	Cpu                  []string
+	Dist                 npmDist
+}
+
+// isNodeCompatible returns true if the `engines.node` field of the package is compatible with the node version,
+// the package without a valid `engines.node` field is always compatible.
+func (a *NpmPackageInfo) isNodeCompatible(nodeVersion *semver.Version) bool {
+	c, err := semver.NewConstraint(a.Engines["node"])
+	if err != nil {
+		return true
+	}
+	return c.Check(nodeVersion)
+}
+
+// isPlatformCompatible returns true if the `os` and `cpu` fields of the package match the platform and the arch,
+// the values prefixed with `!` are blocked, e.g. `"os": ["!win32"]`.
+func (a *NpmPackageInfo) isPlatformCompatible(platform string, arch string) bool {
+	match := func(values []string, value string) bool {
+		allowed := true
+		for _, v := range values {
+			if strings.HasPrefix(v, "!") {
+				if v[1:] == value {
+					return false
+				}
+			} else {
+				if v == value {
+					return true
+				}
+				allowed = false
+			}
+		}
+		return allowed
+	}
+	return match(a.Os, platform) && match(a.Cpu, arch)
 }
 
 func (a *NpmPackageInfo) UnmarshalJSON(b []byte) error {
@@ -174,21 +387,33 @@ func (a *NpmPackageInfo) UnmarshalJSON(b []byte) error {
 }
 
 func getPackageInfo(wd string, name string, version string) (info NpmPackageInfo, fromPackageJSON bool, err error) {
-	if name == "@types/node" {
+	if name == "@types/node" || strings.HasPrefix(name, "@types/node/") {
 		info = NpmPackageInfo{
 			Name:    "@types/node",
 			Version: nodeTypesVersion,
 			Types:   "index.d.ts",
 		}
+		if subPath := strings.TrimPrefix(name, "@types/node/"); subPath != name {
+			info.Types = resolveNodeTypes(wd, subPath)
+		}
 		return
 	}
 
+	// the npm alias, e.g. `npm:@preact/compat@^17`
+	if aliasName, aliasVersion, ok := parseNpmAlias(version); ok {
+		name, version = aliasName, aliasVersion
+	}
+
 	if wd == "" && regexpFullVersion.MatchString(version) && cfg != nil {
-		wd = path.Join(cfg.WorkDir, "npm", name+"@"+version)
+		wd = getWorkDir(Pkg{Name: name, Version: version})
 	}
-	if wd != "" {
-		pkgJsonPath := path.Join(wd, "node_modules", name, "package.json")
-		if existsFile(pkgJsonPath) && parseJSONFile(pkgJsonPath, &info) == nil {
+	if wd != "" && validatePackageName(name) {
+		// the install directory can't be evicted by the gc during the lookup
+		defer workDirs.use(wd)()
+		// prefer the version installed in the tree over a fresh resolution of the version range
+		pkgJsonPath, ok := lookupInstalledPackage(wd, name, version)
+		if ok && parseJSONFile(pkgJsonPath, &info) == nil {
+			patchPackageInfo(&info)
 			fromPackageJSON = true
 			return
 		}
@@ -198,7 +423,153 @@ func getPackageInfo(wd string, name string, version string) (info NpmPackageInfo
 	return
 }
 
+// lookupInstalledPackage looks up the `package.json` of the installed package from the `node_modules`
+// of the directory and its ancestors like Node.js does, the transitive dependencies hoisted by pnpm
+// (`node_modules/.pnpm/node_modules`) are included. The installed version must satisfy the requested
+// version (the exact version or the semver range), the dist-tags can't be checked without the registry.
+func lookupInstalledPackage(dir string, name string, version string) (pkgJsonPath string, ok bool) {
+	for {
+		pkgJsonPath = path.Join(dir, "node_modules", name, "package.json")
+		var p NpmPackageJSON
+		if parseJSONFile(pkgJsonPath, &p) == nil && isInstalledVersionSatisfied(p.Version, version) {
+			return pkgJsonPath, true
+		}
+		// stop at the root of the install directory
+		if !strings.Contains(dir, "/node_modules") {
+			return "", false
+		}
+		dir = path.Dir(dir)
+	}
+}
+
+// isInstalledVersionSatisfied checks whether the installed version satisfies the requested version,
+// the dist-tags and the versions not from the registry (git, tarball) are always satisfied.
+func isInstalledVersionSatisfied(installed string, requested string) bool {
+	if aliasName, aliasVersion, ok := parseNpmAlias(requested); ok && aliasName != "" {
+		requested = aliasVersion
+	}
+	if requested == "" || isNonRegistryVersion(requested) {
+		return true
+	}
+	// the dist-tag
+	if _, err := semver.NewConstraint(requested); err != nil {
+		return true
+	}
+	ver, err := semver.NewVersion(installed)
+	if err != nil {
+		return false
+	}
+	if regexpFullVersion.MatchString(requested) {
+		v, err := semver.NewVersion(requested)
+		return err == nil && v.Equal(ver)
+	}
+	return semverRangeCheck(ver, requested)
+}
+
+// resolveNodeTypes resolves the declaration file of the `@types/node` subpath (e.g. `stream` -> `stream.d.ts`)
+// with the package installed in the working directory or the pinned version.
+func resolveNodeTypes(wd string, subPath string) string {
+	subPath = strings.TrimSuffix(strings.TrimPrefix(subPath, "node:"), ".d.ts")
+	dirs := []string{}
+	if wd != "" {
+		dirs = append(dirs, path.Join(wd, "node_modules", "@types/node"))
+	}
+	if cfg != nil {
+		dirs = append(dirs, path.Join(getWorkDir(Pkg{Name: "@types/node", Version: nodeTypesVersion}), "node_modules", "@types/node"))
+	}
+	for _, dir := range dirs {
+		// the install directory can't be evicted by the gc during the lookup
+		release := workDirs.use(dir)
+		for _, name := range []string{subPath + ".d.ts", path.Join(subPath, "index.d.ts")} {
+			if existsFile(path.Join(dir, name)) {
+				release()
+				return name
+			}
+		}
+		release()
+	}
+	return subPath + ".d.ts"
+}
+
+// fetchPackageInfo fetches the metadata of the package from the registry (or the cache),
+// the metadata is patched by the `PackageInfoPatcher` hook.
 func fetchPackageInfo(name string, version string) (info NpmPackageInfo, err error) {
+	if aliasName, aliasVersion, ok := parseNpmAlias(version); ok {
+		name, version = aliasName, aliasVersion
+	}
+	info, err = fetchPackageMetadata(name, version)
+	if err != nil {
+		return
+	}
+	// check the resolved version, the version range may be resolved to a banned version
+	err = checkPackagePolicy(info.Name, info.Version)
+	if err != nil {
+		return
+	}
+	patchPackageInfo(&info)
+	return
+}
+
+// checkPackagePolicy checks whether the package is allowed by the `banList` and `allowList` config.
+func checkPackagePolicy(name string, version string) error {
+	if cfg == nil {
+		return nil
+	}
+	fullName := name
+	if version != "" {
+		fullName += "@" + version
+	}
+	if cfg.BanList.IsPackageBanned(fullName) {
+		return newRegistryError(ErrPackageForbidden, "package '%s' is banned by the server", fullName)
+	}
+	if !cfg.AllowList.IsPackageAllowed(fullName) {
+		return newRegistryError(ErrPackageForbidden, "package '%s' is not in the allow list of the server", fullName)
+	}
+	return nil
+}
+
+// the max concurrent fetches of the dependency prefetcher
+const prefetchConcurrency = 8
+
+// prefetchDependencies warms the cached package info of the `dependencies` and `peerDependencies`
+// concurrently, to cut the latency of resolving the dependencies one by one in the build.
+func prefetchDependencies(info NpmPackageInfo) {
+	pkgs := []Pkg{}
+	for _, deps := range []map[string]string{info.PeerDependencies, info.Dependencies} {
+		for name, version := range deps {
+			// the alias dependency, e.g. `"foo": "npm:bar@^1.0.0"`
+			if aliasName, aliasVersion, ok := parseNpmAlias(version); ok {
+				name, version = aliasName, aliasVersion
+			}
+			if ValidateSpecifier(name, version, "") != nil || isNonRegistryVersion(version) {
+				continue
+			}
+			pkgs = append(pkgs, Pkg{Name: name, Version: version})
+		}
+	}
+
+	queue := make(chan Pkg)
+	var wg sync.WaitGroup
+	for i := 0; i < prefetchConcurrency && i < len(pkgs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pkg := range queue {
+				_, err := fetchPackageInfo(pkg.Name, pkg.Version)
+				if err != nil {
+					log.Debugf("prefetch %s@%s: %v", pkg.Name, pkg.Version, err)
+				}
+			}
+		}()
+	}
+	for _, pkg := range pkgs {
+		queue <- pkg
+	}
+	close(queue)
+	wg.Wait()
+}
+
+func fetchPackageMetadata(name string, version string) (info NpmPackageInfo, err error) {
 	a := strings.Split(strings.Trim(name, "/"), "/")
 	name = a[0]
 	if strings.HasPrefix(name, "@") && len(a) > 1 {
@@ -212,11 +583,13 @@ func fetchPackageInfo(name string, version string) (info NpmPackageInfo, err err
 		version = "latest"
 	}
 
-	cacheKey := fmt.Sprintf("npm:%s@%s", name, version)
-	lock := getFetchLock(cacheKey)
+	if cfg.NativeJsr && strings.HasPrefix(name, "@jsr/") {
+		return fetchJsrPackageInfo(name, version)
+	}
 
-	lock.Lock()
-	defer lock.Unlock()
+	cacheKey := fmt.Sprintf("npm:%s@%s", name, version)
+	unlock := fetchLocks.Lock(cacheKey)
+	defer unlock()
 
 	// check cache firstly
 	if cache != nil {
@@ -230,6 +603,45 @@ func fetchPackageInfo(name string, version string) (info NpmPackageInfo, err err
 		}
 	}
 
+	// the miss of the package (or the version) is cached for a short time to prevent
+	// the requests of nonexistent packages from hitting the registry every time
+	missKey := fmt.Sprintf("npm-miss:%s@%s", name, version)
+	if cache != nil && cfg.NotFoundCacheTTL > 0 {
+		data, e := cache.Get(missKey)
+		if e == nil {
+			var miss registryMiss
+			if json.Unmarshal(data, &miss) == nil {
+				return info, miss.Error()
+			}
+		}
+		defer func() {
+			var regErr *RegistryError
+			if errors.As(err, &regErr) && isNotFoundError(regErr) {
+				miss := registryMiss{Version: errors.Is(regErr, ErrVersionNotFound), Message: regErr.Message}
+				ttl := jitterTTL(time.Duration(cfg.NotFoundCacheTTL) * time.Second)
+				cache.Set(missKey, mustEncodeJSON(miss), ttl)
+				recordPackageCacheKey(name, missKey, ttl)
+			}
+		}()
+	}
+
+	// keep a long-lived copy of the package info to serve it when the registry is unavailable (stale-if-error),
+	// the copy is not recorded for the invalidation since it's the fallback after the purge
+	if cache != nil && cfg.StaleCacheTTL > 0 {
+		staleKey := fmt.Sprintf("npm-stale:%s@%s", name, version)
+		defer func() {
+			if err == nil {
+				cache.Set(staleKey, mustEncodeJSON(info), time.Duration(cfg.StaleCacheTTL)*time.Second)
+			} else if errors.Is(err, ErrRegistryUnavailable) {
+				data, e := cache.Get(staleKey)
+				if e == nil && json.Unmarshal(data, &info) == nil {
+					log.Warnf("%v, serve the stale package info of %s@%s", err, name, info.Version)
+					err = nil
+				}
+			}
+		}()
+	}
+
 	start := time.Now()
 	defer func() {
 		if err == nil {
@@ -237,221 +649,1680 @@ func fetchPackageInfo(name string, version string) (info NpmPackageInfo, err err
 		}
 	}()
 
-	isJsrScope := strings.HasPrefix(name, "@jsr/")
-	url := cfg.NpmRegistry + name
-	if isJsrScope {
-		url = "https://npm.jsr.io/" + name
-	} else if cfg.NpmRegistryScope != "" {
-		isInScope := strings.HasPrefix(name, cfg.NpmRegistryScope)
-		if !isInScope {
-			url = "https://registry.npmjs.org/" + name
-		}
+	req, err := newRegistryRequest(name, version)
+	if err != nil {
+		return
 	}
 
+	isJsrScope := strings.HasPrefix(name, "@jsr/")
 	isFullVersion := regexpFullVersion.MatchString(version)
-	isGithubRegistry := strings.Contains(url, "npm.pkg.github.com")
-	if isFullVersion && !isJsrScope && !isGithubRegistry {
-		url += "/" + version
-	}
 
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return
-	}
-	if cfg.NpmToken != "" && !isJsrScope {
-		req.Header.Set("Authorization", "Bearer "+cfg.NpmToken)
-	}
-	if cfg.NpmUser != "" && cfg.NpmPassword != "" && !isJsrScope {
-		req.SetBasicAuth(cfg.NpmUser, cfg.NpmPassword)
+	// send the conditional request with the validators of the previous response, the resolved version
+	// depends on the time if the version cooldown is enabled, so the 304 response can't be reused.
+	var validator *registryValidator
+	validatorKey := fmt.Sprintf("npm-validator:%s@%s", name, version)
+	if cache != nil && (!isFullVersion || isJsrScope) && cfg.VersionCooldown == 0 {
+		data, e := cache.Get(validatorKey)
+		if e == nil {
+			var v registryValidator
+			if json.Unmarshal(data, &v) == nil {
+				validator = &v
+				if v.ETag != "" {
+					req.Header.Set("If-None-Match", v.ETag)
+				}
+				if v.LastModified != "" {
+					req.Header.Set("If-Modified-Since", v.LastModified)
+				}
+			}
+		}
 	}
 
-	c := &http.Client{
-		Timeout: 15 * time.Second,
-	}
-	resp, err := c.Do(req)
+	resp, err := fetchRegistryWithFailover(req)
 	if err != nil {
 		return
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode == 404 || resp.StatusCode == 401 {
-		if isFullVersion {
-			err = fmt.Errorf("npm: version %s of '%s' not found", version, name)
-		} else {
-			err = fmt.Errorf("npm: package '%s' not found", name)
-		}
+	// the metadata is not modified, refresh the cache with the previous resolved package info
+	if resp.StatusCode == 304 && validator != nil {
+		info = validator.Info
+		ttl := jitterTTL(getDistTagCacheTTL(version))
+		cache.Set(cacheKey, mustEncodeJSON(info), ttl)
+		cache.Set(validatorKey, mustEncodeJSON(validator), jitterTTL(24*time.Hour))
+		recordPackageCacheKey(name, cacheKey, ttl)
 		return
 	}
 
-	if resp.StatusCode != 200 {
-		ret, _ := io.ReadAll(resp.Body)
-		err = fmt.Errorf("npm: could not get metadata of package '%s' (%s: %s)", name, resp.Status, string(ret))
+	err = checkRegistryResponse(resp, name, version)
+	if err != nil {
 		return
 	}
 
 	if isFullVersion && !isJsrScope {
-		err = json.NewDecoder(resp.Body).Decode(&info)
+		err = decodePackument(name, resp.Body, &info)
 		if err != nil {
 			return
 		}
 		if cache != nil {
-			cache.Set(cacheKey, mustEncodeJSON(info), 7*24*time.Hour)
+			ttl := jitterTTL(7 * 24 * time.Hour)
+			cache.Set(cacheKey, mustEncodeJSON(info), ttl)
+			recordPackageCacheKey(name, cacheKey, ttl)
 		}
 		return
 	}
 
 	var h NpmPackageVerions
-	err = json.NewDecoder(resp.Body).Decode(&h)
+	h, err = decodePackumentVersions(name, resp.Body, version)
 	if err != nil {
 		return
 	}
 
-	if len(h.Versions) == 0 {
+	if h.Versions == nil {
 		err = fmt.Errorf("npm: missing `versions` field")
 		return
 	}
+	h.normalizeVersions()
 
-	distVersion, ok := h.DistTags[version]
-	if ok {
-		info = h.Versions[distVersion]
-	} else {
-		var c *semver.Constraints
-		c, err = semver.NewConstraint(version)
-		if err != nil && version != "latest" {
-			return fetchPackageInfo(name, "latest")
-		}
-		vs := make([]*semver.Version, len(h.Versions))
-		i := 0
-		for v := range h.Versions {
-			// ignore prerelease versions
-			if !strings.ContainsRune(version, '-') && strings.ContainsRune(v, '-') {
+	// versions below the minimum version are excluded from the resolution
+	var minVersion *semver.Version
+	if v, ok := cfg.MinVersions[name]; ok {
+		minVersion, err = semver.NewVersion(v)
+		if err != nil {
+			err = fmt.Errorf("npm: invalid minimum version %s of '%s'", v, name)
+			return
+		}
+	}
+
+	// the versions below the minimum version or in the cooldown period are not eligible
+	versions := h.Versions
+	if minVersion != nil || (cfg.VersionCooldown > 0 && len(h.Time) > 0) {
+		versions = make(map[string]NpmPackageInfo, len(h.Versions))
+		for v, p := range h.Versions {
+			if ver, e := semver.NewVersion(v); e == nil && minVersion != nil && ver.LessThan(minVersion) {
 				continue
 			}
-			var ver *semver.Version
-			ver, err = semver.NewVersion(v)
-			if err != nil {
-				return
+			if h.isCoolingDown(v) {
+				continue
+			}
+			versions[v] = p
+		}
+	}
+
+	// skip the versions of the range that are incompatible with the node version of the builds,
+	// unless no version of the range is compatible
+	if _, isTag := h.DistTags[version]; !isTag && cfg.NodeVersion != "" {
+		nodeVersion, e := semver.NewVersion(cfg.NodeVersion)
+		if e == nil {
+			compatible := make(map[string]NpmPackageInfo, len(versions))
+			for v, p := range versions {
+				if p.isNodeCompatible(nodeVersion) {
+					compatible[v] = p
+				}
+			}
+			if len(compatible) < len(versions) {
+				if _, e := BestVersion(compatible, nil, version); e == nil {
+					versions = compatible
+				} else {
+					log.Warnf("npm: no version of %s@%s is compatible with node %s", name, version, cfg.NodeVersion)
+				}
+			}
+		}
+	}
+
+	bestVersion, e := BestVersion(versions, h.DistTags, version)
+	if e == nil {
+		info = h.Versions[bestVersion]
+	} else if distVersion, ok := h.DistTags[version]; ok {
+		if ver, e := semver.NewVersion(distVersion); e == nil && minVersion != nil && ver.LessThan(minVersion) {
+			// use the next stable version that meets the minimum version
+			var next *semver.Version
+			for v := range versions {
+				ver, e := semver.NewVersion(v)
+				if e != nil || ver.Prerelease() != "" {
+					continue
+				}
+				if next == nil || ver.LessThan(next) {
+					next = ver
+				}
+			}
+			if next != nil {
+				info = h.Versions[next.String()]
+			}
+		} else if e == nil && h.isCoolingDown(distVersion) {
+			// use the newest version before the tagged version that is out of the cooldown period
+			var prev *semver.Version
+			for v := range versions {
+				pv, e := semver.NewVersion(v)
+				if e != nil || !pv.LessThan(ver) || (ver.Prerelease() == "" && pv.Prerelease() != "") {
+					continue
+				}
+				if prev == nil || prev.LessThan(pv) {
+					prev = pv
+				}
 			}
-			if c.Check(ver) {
-				vs[i] = ver
-				i++
+			if prev != nil {
+				info = h.Versions[prev.String()]
 			}
 		}
-		if i > 0 {
-			vs = vs[:i]
-			if i > 1 {
-				sort.Sort(semver.Collection(vs))
+	} else if errors.Is(e, ErrInvalidSpecifier) && version != "latest" {
+		return fetchPackageMetadata(name, "latest")
+	}
+
+	// fallback to the dist-tags in order if no version matches
+	if info.Version == "" {
+		for _, tag := range cfg.FallbackDistTags {
+			distVersion, ok := h.DistTags[tag]
+			if !ok {
+				continue
+			}
+			if ver, e := semver.NewVersion(distVersion); e == nil && minVersion != nil && ver.LessThan(minVersion) {
+				continue
+			}
+			if h.isCoolingDown(distVersion) {
+				continue
+			}
+			if p, ok := h.Versions[distVersion]; ok {
+				info = p
+				break
 			}
-			info = h.Versions[vs[i-1].String()]
 		}
 	}
 
 	if info.Version == "" {
-		err = fmt.Errorf("npm: version %s of '%s' not found", version, name)
+		if minVersion != nil {
+			err = newRegistryError(ErrVersionNotFound, "npm: version %s of '%s' not found (minimum version %s)", version, name, minVersion)
+		} else {
+			err = newRegistryError(ErrVersionNotFound, "npm: version %s of '%s' not found", version, name)
+		}
 		return
 	}
 
-	// cache package info for 10 minutes
+	// the abbreviated metadata only contains the fields to install the package,
+	// fetch the full metadata of the selected version for the fields like `exports`
+	if isAbbreviatedMetadata(resp) {
+		info, err = fetchPackageMetadata(name, info.Version)
+		if err != nil {
+			return
+		}
+	}
+
+	// cache package info for 10 minutes by default
 	if cache != nil {
-		cache.Set(cacheKey, mustEncodeJSON(info), 10*time.Minute)
+		ttl := jitterTTL(getDistTagCacheTTL(version))
+		cache.Set(cacheKey, mustEncodeJSON(info), ttl)
+		recordPackageCacheKey(name, cacheKey, ttl)
+		// keep the validators of the response for a day to send the conditional request
+		// when the cached package info is expired, the validators are kept after the purge
+		// since the registry decides whether the metadata is modified
+		etag := resp.Header.Get("ETag")
+		lastModified := resp.Header.Get("Last-Modified")
+		if (etag != "" || lastModified != "") && cfg.VersionCooldown == 0 {
+			cache.Set(validatorKey, mustEncodeJSON(registryValidator{ETag: etag, LastModified: lastModified, Info: info}), jitterTTL(24*time.Hour))
+		}
 	}
 	return
 }
 
-func installPackage(dir string, pkg Pkg) (err error) {
-	pkgVersionName := pkg.VersionName()
-	lock := getInstallLock(pkgVersionName)
-
-	// only one install process allowed at the same time
-	lock.Lock()
-	defer lock.Unlock()
+// registryMiss is the cached miss of the package or the version.
+type registryMiss struct {
+	Version bool   `json:"version,omitempty"`
+	Message string `json:"message"`
+}
 
-	// skip install if pnpm lock file exists
-	if existsFile(path.Join(dir, "pnpm-lock.yaml")) && existsFile(path.Join(dir, "node_modules", pkg.Name, "package.json")) {
-		return nil
+// Error returns the not found error of the miss.
+func (m registryMiss) Error() error {
+	if m.Version {
+		return newRegistryError(ErrVersionNotFound, "%s", m.Message)
 	}
+	return newRegistryError(ErrPackageNotFound, "%s", m.Message)
+}
 
-	// ensure package.json file to prevent read up-levels
-	packageJsonFp := path.Join(dir, "package.json")
-	if !existsFile(packageJsonFp) {
-		ensureDir(dir)
-		err = os.WriteFile(packageJsonFp, []byte("{}"), 0644)
-	}
-	if err != nil {
-		return fmt.Errorf("ensure package.json failed: %s", pkgVersionName)
-	}
+// registryValidator holds the validators (`ETag` and `Last-Modified`) of the registry response,
+// with the package info resolved from the response.
+type registryValidator struct {
+	ETag         string         `json:"etag,omitempty"`
+	LastModified string         `json:"lastModified,omitempty"`
+	Info         NpmPackageInfo `json:"info"`
+}
 
-	attemptMaxTimes := 3
-	for i := 1; i <= attemptMaxTimes; i++ {
-		if pkg.FromGithub {
-			err = os.WriteFile(packageJsonFp, []byte(fmt.Sprintf(`{"dependencies":{"%s":"github:%s#%s"}}`, pkg.Name, pkg.Name, pkg.Version)), 0644)
-			if err == nil {
-				err = pnpmInstall(dir)
-			}
-			// pnpm will ignore github package which has been installed without `package.json` file
-			// so we install it manually
-			if err == nil {
-				packageJsonFp := path.Join(dir, "node_modules", pkg.Name, "package.json")
-				if !existsFile(packageJsonFp) {
-					ensureDir(path.Dir(packageJsonFp))
-					err = os.WriteFile(packageJsonFp, mustEncodeJSON(pkg), 0644)
-				} else {
-					var p NpmPackageInfo
-					err = parseJSONFile(packageJsonFp, &p)
-					if err == nil && len(p.Files) > 0 {
-						// install github package with ignoring `files` field
-						err = ghInstall(dir, pkg.Name, pkg.Version)
-					}
-				}
-			}
-		} else if regexpFullVersion.MatchString(pkg.Version) {
-			err = pnpmInstall(dir, pkgVersionName, "--prefer-offline")
-		} else {
-			err = pnpmInstall(dir, pkgVersionName)
+// BestVersion selects the best version of the package for the request from the versions and the dist-tags
+// of the package metadata, the request is a dist-tag (e.g. `latest`) or a semver range (e.g. `^1.2.0`).
+// For a range, the highest version that satisfies the range is selected, and the prerelease versions
+// only satisfy the range that has a prerelease comparator with the same [major, minor, patch] tuple.
+// It returns `ErrVersionNotFound` if no version matches, or `ErrInvalidSpecifier` if the request is
+// neither a dist-tag nor a valid semver range.
+func BestVersion(versions map[string]NpmPackageInfo, distTags map[string]string, request string) (string, error) {
+	if request == "" {
+		request = "latest"
+	}
+	if distVersion, ok := distTags[request]; ok {
+		if _, ok := versions[distVersion]; ok {
+			return distVersion, nil
 		}
-		packageJsonFp := path.Join(dir, "node_modules", pkg.Name, "package.json")
-		if err == nil && !existsFile(packageJsonFp) {
-			err = fmt.Errorf("pnpm install %s: package.json not found", pkg)
+		return "", newRegistryError(ErrVersionNotFound, "version %s (%s) not found", distVersion, request)
+	}
+	if _, err := semver.NewConstraint(request); err != nil {
+		return "", newRegistryError(ErrInvalidSpecifier, "invalid version or dist-tag '%s'", request)
+	}
+	var best *semver.Version
+	var bestVersion string
+	for v := range versions {
+		ver, err := semver.NewVersion(v)
+		if err != nil {
+			continue
 		}
-		if err == nil || i == attemptMaxTimes {
-			break
+		if semverRangeCheck(ver, request) && (best == nil || best.LessThan(ver)) {
+			best = ver
+			bestVersion = v
 		}
-		time.Sleep(time.Duration(i) * 100 * time.Millisecond)
 	}
-	return
+	if best == nil {
+		return "", newRegistryError(ErrVersionNotFound, "no version matches '%s'", request)
+	}
+	return bestVersion, nil
 }
 
-func pnpmInstall(dir string, packages ...string) (err error) {
-	var args []string
-	if len(packages) > 0 {
-		args = append([]string{"add"}, packages...)
-	} else {
-		args = []string{"install"}
-	}
-	args = append(
-		args,
-		"--ignore-scripts",
-		"--loglevel", "error",
-	)
+// newRegistryRequest creates the request to get the metadata of the package from the registry.
+func newRegistryRequest(name string, version string) (req *http.Request, err error) {
+	isJsrScope := strings.HasPrefix(name, "@jsr/")
+	isTypesScope := strings.HasPrefix(name, "@types/") && cfg.TypesRegistry != ""
+	npmScope, isNpmScope := getNpmScope(name)
+	url := cfg.NpmRegistry + name
+	if isJsrScope {
+		url = "https://npm.jsr.io/" + name
+	} else if isTypesScope {
+		url = cfg.TypesRegistry + name
+	} else if isNpmScope {
+		url = getNpmScopeRegistry(npmScope) + name
+	} else if cfg.NpmRegistryScope != "" {
+		isInScope := strings.HasPrefix(name, cfg.NpmRegistryScope)
+		if !isInScope {
+			url = "https://registry.npmjs.org/" + name
+		}
+	}
+
+	isFullVersion := regexpFullVersion.MatchString(version)
+	isGithubRegistry := strings.Contains(url, "npm.pkg.github.com")
+	if isFullVersion && !isJsrScope && !isGithubRegistry {
+		url += "/" + version
+	}
+
+	req, err = http.NewRequest("GET", url, nil)
+	if err != nil {
+		return
+	}
+	// request the abbreviated metadata (aka "corgi") to resolve the version, which is much smaller than
+	// the full metadata. The `time` field is missing in the abbreviated metadata, that is required by
+	// the version cooldown.
+	if !isFullVersion && !isJsrScope && !isGithubRegistry && cfg.VersionCooldown == 0 {
+		req.Header.Set("Accept", ctNpmAbbreviatedMetadata+"; q=1.0, application/json; q=0.8, */*")
+	}
+	if isTypesScope {
+		if cfg.TypesRegistryToken != "" {
+			req.Header.Set("Authorization", "Bearer "+cfg.TypesRegistryToken)
+		}
+	} else if isNpmScope {
+		if npmScope.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+npmScope.Token)
+		}
+		if npmScope.User != "" && npmScope.Password != "" {
+			req.SetBasicAuth(npmScope.User, npmScope.Password)
+		}
+	} else if !isJsrScope {
+		if cfg.NpmToken != "" {
+			req.Header.Set("Authorization", "Bearer "+cfg.NpmToken)
+		}
+		if cfg.NpmUser != "" && cfg.NpmPassword != "" {
+			req.SetBasicAuth(cfg.NpmUser, cfg.NpmPassword)
+		}
+	}
+	if cfg.GitlabToken != "" && req.Header.Get("Authorization") == "" && isGitlabRegistry(url) {
+		req.Header.Set("Authorization", "Bearer "+cfg.GitlabToken)
+	}
+	return
+}
+
+// getNpmScope returns the config of the scope (`cfg.NpmScopes`) that the package belongs to.
+func getNpmScope(name string) (scope config.NpmScope, ok bool) {
+	if cfg == nil || len(cfg.NpmScopes) == 0 || !strings.HasPrefix(name, "@") {
+		return
+	}
+	scopeName, _ := utils.SplitByFirstByte(name, '/')
+	scope, ok = cfg.NpmScopes[scopeName]
+	return
+}
+
+// getNpmScopeRegistry returns the registry of the scope, default is `cfg.NpmRegistry`.
+func getNpmScopeRegistry(scope config.NpmScope) string {
+	if scope.Registry != "" {
+		return scope.Registry
+	}
+	if cfg.NpmRegistry != "" {
+		return cfg.NpmRegistry
+	}
+	return "https://registry.npmjs.org/"
+}
+
+// npmScopesRc returns the `.npmrc` lines of the scoped registries and credentials, the credentials
+// are read from the environment variables that are returned by `npmScopesEnv`.
+func npmScopesRc() string {
+	var npmrc strings.Builder
+	for i, name := range sortedNpmScopes() {
+		scope := cfg.NpmScopes[name]
+		registry := getNpmScopeRegistry(scope)
+		npmrc.WriteString(fmt.Sprintf("%s:registry=%s\n", name, registry))
+		host, err := removeHttpPrefix(registry)
+		if err != nil {
+			continue
+		}
+		if scope.Token != "" {
+			npmrc.WriteString(fmt.Sprintf("//%s:_authToken=${ESM_NPM_SCOPE_TOKEN_%d}\n", host, i))
+		} else if cfg.GitlabToken != "" && isGitlabRegistry(registry) {
+			npmrc.WriteString(fmt.Sprintf("//%s:_authToken=${ESM_GITLAB_TOKEN}\n", host))
+		}
+		if scope.User != "" && scope.Password != "" {
+			npmrc.WriteString(fmt.Sprintf("//%s:username=${ESM_NPM_SCOPE_USER_%d}\n", host, i))
+			npmrc.WriteString(fmt.Sprintf("//%s:_password=${ESM_NPM_SCOPE_PASSWORD_%d}\n", host, i))
+		}
+	}
+	return npmrc.String()
+}
+
+// npmScopesEnv returns the environment variables of the scoped credentials that are used by the `.npmrc`.
+func npmScopesEnv() []string {
+	env := []string{}
+	for i, name := range sortedNpmScopes() {
+		scope := cfg.NpmScopes[name]
+		if scope.Token != "" {
+			env = append(env, fmt.Sprintf("ESM_NPM_SCOPE_TOKEN_%d=%s", i, scope.Token))
+		}
+		if scope.User != "" && scope.Password != "" {
+			password := base64.StdEncoding.EncodeToString([]byte(scope.Password))
+			env = append(env, fmt.Sprintf("ESM_NPM_SCOPE_USER_%d=%s", i, scope.User), fmt.Sprintf("ESM_NPM_SCOPE_PASSWORD_%d=%s", i, password))
+		}
+	}
+	return env
+}
+
+func sortedNpmScopes() []string {
+	names := make([]string, 0, len(cfg.NpmScopes))
+	for name := range cfg.NpmScopes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isAbbreviatedMetadata returns true if the registry responds the abbreviated metadata.
+func isAbbreviatedMetadata(resp *http.Response) bool {
+	return strings.HasPrefix(resp.Header.Get("Content-Type"), ctNpmAbbreviatedMetadata)
+}
+
+// jitterTTL adds a random jitter (±`cfg.CacheTTLJitter` percent) to the cache ttl,
+// to spread out the expirations of the entries that are created at the same time.
+func jitterTTL(ttl time.Duration) time.Duration {
+	if cfg == nil || cfg.CacheTTLJitter <= 0 {
+		return ttl
+	}
+	jitter := int64(ttl) * int64(cfg.CacheTTLJitter) / 100
+	if jitter <= 0 {
+		return ttl
+	}
+	return ttl + time.Duration(rand.Int63n(2*jitter+1)-jitter)
+}
+
+// getDistTagCacheTTL returns the cache ttl of the package info resolved by the dist-tag or the range,
+// the `*` of the `cfg.DistTagCacheTTL` applies to the other dist-tags and the ranges.
+func getDistTagCacheTTL(version string) time.Duration {
+	if cfg != nil {
+		if ttl, ok := cfg.DistTagCacheTTL[version]; ok {
+			return time.Duration(ttl) * time.Second
+		}
+		if ttl, ok := cfg.DistTagCacheTTL["*"]; ok {
+			return time.Duration(ttl) * time.Second
+		}
+	}
+	return 10 * time.Minute
+}
+
+// checkRegistryResponse returns the error of the registry response by the status code.
+func checkRegistryResponse(resp *http.Response, name string, version string) error {
+	if resp.StatusCode == 404 {
+		if regexpFullVersion.MatchString(version) {
+			return newRegistryError(ErrVersionNotFound, "npm: version %s of '%s' not found", version, name)
+		}
+		return newRegistryError(ErrPackageNotFound, "npm: package '%s' not found", name)
+	}
+
+	if resp.StatusCode == 401 || resp.StatusCode == 403 {
+		return newRegistryError(ErrUnauthorized, "npm: unauthorized to access package '%s' (%s)", name, resp.Status)
+	}
+
+	if resp.StatusCode >= 500 || resp.StatusCode == 429 {
+		return newRegistryError(ErrRegistryUnavailable, "npm: registry is unavailable for package '%s' (%s)", name, resp.Status)
+	}
+
+	if resp.StatusCode != 200 {
+		ret, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("npm: could not get metadata of package '%s' (%s: %s)", name, resp.Status, string(ret))
+	}
+	return nil
+}
+
+// SelfTest checks whether the registry is reachable and the auth is configured correctly by
+// requesting the metadata of a known package (`cfg.SelfTestPackage`), the cache is bypassed.
+func SelfTest(ctx context.Context) error {
+	name := cfg.SelfTestPackage
+	if name == "" {
+		name = "is-number"
+	}
+	req, err := newRegistryRequest(name, "latest")
+	if err != nil {
+		return err
+	}
+	resp, err := fetchRegistry(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkRegistryResponse(resp, name, "latest")
+}
+
+// InvalidatePackage deletes the cached metadata of the given package that was resolved
+// by a dist-tag or a semver range, the exact versions are kept since they are immutable.
+func InvalidatePackage(name string) error {
+	return invalidatePackage(name, false)
+}
+
+// InvalidatePackageWithVersions deletes all the cached metadata of the given package,
+// including the exact versions.
+func InvalidatePackageWithVersions(name string) error {
+	return invalidatePackage(name, true)
+}
+
+func invalidatePackage(name string, withExactVersions bool) error {
+	if cache == nil {
+		return nil
+	}
+	indexKey := "npm-keys:" + name
+	unlockIndex := fetchLocks.Lock(indexKey)
+	defer unlockIndex()
+	index := loadPackageCacheIndex(indexKey)
+	prefix := fmt.Sprintf("npm:%s@", name)
+	for key := range index {
+		if !withExactVersions && regexpFullVersion.MatchString(strings.TrimPrefix(key, prefix)) {
+			continue
+		}
+		unlock := fetchLocks.Lock(key)
+		err := cache.Delete(key)
+		unlock()
+		if err != nil {
+			return err
+		}
+		delete(index, key)
+	}
+	return savePackageCacheIndex(indexKey, index)
+}
+
+// refreshPackageInfo deletes the cached package info of the ranges and dist-tags to resolve the
+// versions just published, it's throttled to once per 10 seconds for each package.
+func refreshPackageInfo(name string) error {
+	if cache == nil {
+		return nil
+	}
+	throttleKey := "npm-fresh:" + name
+	if _, err := cache.Get(throttleKey); err == nil {
+		return nil
+	}
+	err := cache.Set(throttleKey, []byte{1}, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	return InvalidatePackage(name)
+}
+
+// recordPackageCacheKey records the cache key of the package metadata for invalidation, the index
+// is stored in the cache with the expiration of each key, so it's shared by the nodes using the
+// same cache and survives the restart, the expired keys are dropped from the index.
+func recordPackageCacheKey(name string, cacheKey string, ttl time.Duration) {
+	if cache == nil {
+		return
+	}
+	indexKey := "npm-keys:" + name
+	unlock := fetchLocks.Lock(indexKey)
+	defer unlock()
+	index := loadPackageCacheIndex(indexKey)
+	index[cacheKey] = time.Now().Add(ttl).Unix()
+	err := savePackageCacheIndex(indexKey, index)
+	if err != nil {
+		log.Error("cache:", err)
+	}
+}
+
+// loadPackageCacheIndex loads the recorded cache keys of the package without the expired ones.
+func loadPackageCacheIndex(indexKey string) map[string]int64 {
+	index := map[string]int64{}
+	data, err := cache.Get(indexKey)
+	if err == nil && json.Unmarshal(data, &index) == nil {
+		now := time.Now().Unix()
+		for key, expiresAt := range index {
+			if expiresAt <= now {
+				delete(index, key)
+			}
+		}
+	}
+	return index
+}
+
+// savePackageCacheIndex stores the index until the last recorded key is expired.
+func savePackageCacheIndex(indexKey string, index map[string]int64) error {
+	if len(index) == 0 {
+		err := cache.Delete(indexKey)
+		if err == storage.ErrNotFound {
+			err = nil
+		}
+		return err
+	}
+	var expiresAt int64
+	for _, t := range index {
+		if t > expiresAt {
+			expiresAt = t
+		}
+	}
+	return cache.Set(indexKey, mustEncodeJSON(index), time.Until(time.Unix(expiresAt, 0))+time.Second)
+}
+
+// getRegistryClient returns the http client shared by all registry requests, the connections
+// are kept alive and reused (with HTTP/2 multiplexing if the registry supports it).
+func getRegistryClient() *http.Client {
+	registryClientOnce.Do(func() {
+		maxIdleConnsPerHost := 32
+		idleConnTimeout := 90 * time.Second
+		keepAlive := 30 * time.Second
+		if cfg != nil {
+			if cfg.RegistryMaxIdleConnsPerHost > 0 {
+				maxIdleConnsPerHost = int(cfg.RegistryMaxIdleConnsPerHost)
+			}
+			if cfg.RegistryIdleConnTimeout > 0 {
+				idleConnTimeout = time.Duration(cfg.RegistryIdleConnTimeout) * time.Second
+			}
+			if cfg.RegistryKeepAlive > 0 {
+				keepAlive = time.Duration(cfg.RegistryKeepAlive) * time.Second
+			}
+		}
+		registryClient = &http.Client{
+			Timeout: 15 * time.Second,
+			Transport: &http.Transport{
+				Proxy: proxyFromConfig,
+				DialContext: (&net.Dialer{
+					Timeout:   10 * time.Second,
+					KeepAlive: keepAlive,
+				}).DialContext,
+				ForceAttemptHTTP2:   true,
+				MaxIdleConns:        maxIdleConnsPerHost * 4,
+				MaxIdleConnsPerHost: maxIdleConnsPerHost,
+				IdleConnTimeout:     idleConnTimeout,
+				TLSHandshakeTimeout: 10 * time.Second,
+			},
+		}
+	})
+	return registryClient
+}
+
+// fetchRegistry sends the request to the npm registry, it retries on transient errors like
+// connection resets and timeouts, and returns permanent errors like DNS failures immediately.
+// The requests are rejected immediately if the circuit breaker of the registry is open.
+// The rate limited requests (429) are retried after the `Retry-After` delay (or an exponential
+// backoff), and all the requests to the registry are paused meanwhile.
+func fetchRegistry(req *http.Request) (resp *http.Response, err error) {
+	registry := req.URL.Scheme + "://" + req.URL.Host
+	breaker := getRegistryBreaker(registry)
+	if !breaker.allow() {
+		return nil, newRegistryError(ErrRegistryUnavailable, "npm: registry '%s' is unavailable (circuit breaker is open)", req.URL.Host)
+	}
+	// only the outcome of the requests sent to the registry is recorded, the canceled requests
+	// and the requests paused by the rate limit are not registry failures
+	sent := false
+	defer func() {
+		if sent && req.Context().Err() == nil {
+			breaker.record(err == nil && resp.StatusCode < 500)
+		} else {
+			breaker.release()
+		}
+	}()
+
+	maxWait := 10 * time.Second
+	if cfg != nil && cfg.RegistryRetryMaxWait > 0 {
+		maxWait = time.Duration(cfg.RegistryRetryMaxWait) * time.Second
+	}
+	c := getRegistryClient()
+	attemptMaxTimes := 3
+	for i := 1; i <= attemptMaxTimes; i++ {
+		if wait := breaker.pausedFor(); wait > 0 {
+			if wait > maxWait {
+				return nil, newRegistryError(ErrRegistryUnavailable, "npm: registry '%s' is rate limited, retry after %v", req.URL.Host, wait.Round(time.Second))
+			}
+			if err = sleepContext(req.Context(), wait); err != nil {
+				return nil, err
+			}
+		}
+		err = acquireRegistryToken(req.Context())
+		if err != nil {
+			return nil, err
+		}
+		resp, err = c.Do(req)
+		sent = true
+		releaseRegistryToken()
+		if err == nil {
+			if resp.StatusCode != 429 || i == attemptMaxTimes {
+				return
+			}
+			wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"))
+			if !ok {
+				wait = time.Duration(1<<(i-1)) * 500 * time.Millisecond
+			}
+			breaker.pause(wait)
+			if wait > maxWait {
+				return
+			}
+			resp.Body.Close()
+			log.Warnf("npm: registry '%s' is rate limited, retry after %v", req.URL.Host, wait)
+			continue
+		}
+		// the canceled request is not a registry failure
+		if req.Context().Err() != nil {
+			return nil, err
+		}
+		if !isTransientError(err) {
+			var dnsErr *net.DNSError
+			if errors.As(err, &dnsErr) {
+				return nil, newRegistryError(ErrRegistryUnavailable, "npm: could not resolve the registry host '%s': %v", req.URL.Host, dnsErr)
+			}
+			return nil, newRegistryError(ErrRegistryUnavailable, "npm: could not connect to the registry '%s': %v", req.URL.Host, err)
+		}
+		if i < attemptMaxTimes {
+			if e := sleepContext(req.Context(), time.Duration(i)*100*time.Millisecond); e != nil {
+				return nil, e
+			}
+		}
+	}
+	return nil, newRegistryError(ErrRegistryUnavailable, "npm: registry '%s' is unavailable after %d attempts: %v", req.URL.Host, attemptMaxTimes, err)
+}
+
+// sleepContext pauses for the duration, it returns the error of the context if the context is done before.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// acquireRegistryToken takes a token of the registry requests, the concurrent upstream requests
+// are limited by `cfg.RegistryMaxConcurrency`. The token is held until the response headers are
+// received.
+func acquireRegistryToken(ctx context.Context) error {
+	registryTokensOnce.Do(func() {
+		maxConcurrency := 64
+		if cfg != nil && cfg.RegistryMaxConcurrency > 0 {
+			maxConcurrency = int(cfg.RegistryMaxConcurrency)
+		}
+		registryTokens = make(chan struct{}, maxConcurrency)
+	})
+	select {
+	case registryTokens <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// releaseRegistryToken returns the token taken by `acquireRegistryToken`.
+func releaseRegistryToken() {
+	<-registryTokens
+}
+
+// parseRetryAfter parses the `Retry-After` header in seconds or a http date.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// fetchRegistryWithFailover sends the request to the npm registry, and retries against the mirrors
+// (`cfg.NpmRegistryMirrors`) in order if the registry times out or returns 5xx. A dead mirror is
+// skipped by its circuit breaker until the cooldown elapses. The credentials of the registry are
+// not sent to the mirrors.
+func fetchRegistryWithFailover(req *http.Request) (resp *http.Response, err error) {
+	resp, err = fetchRegistry(req)
+	if len(cfg.NpmRegistryMirrors) == 0 || cfg.NpmRegistry == "" || !strings.HasPrefix(req.URL.String(), cfg.NpmRegistry) {
+		return
+	}
+	pathname := strings.TrimPrefix(req.URL.String(), cfg.NpmRegistry)
+	for _, mirror := range cfg.NpmRegistryMirrors {
+		if err == nil {
+			if resp.StatusCode < 500 && resp.StatusCode != 429 {
+				return
+			}
+			resp.Body.Close()
+			log.Warnf("npm: registry '%s' is unavailable (%s), fallback to the mirror '%s'", req.URL.Host, resp.Status, mirror)
+		} else if errors.Is(err, ErrRegistryUnavailable) {
+			log.Warnf("%v, fallback to the mirror '%s'", err, mirror)
+		} else {
+			return
+		}
+		var mirrorReq *http.Request
+		mirrorReq, err = http.NewRequestWithContext(req.Context(), "GET", mirror+pathname, nil)
+		if err != nil {
+			return nil, err
+		}
+		req = mirrorReq
+		resp, err = fetchRegistry(req)
+	}
+	return
+}
+
+// registryBreaker is the circuit breaker of a registry, it opens after `threshold` consecutive failures
+// and rejects the requests until the cooldown elapses, then lets one request through to probe whether
+// the registry is recovered (half-open).
+type registryBreaker struct {
+	lock      sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openedAt  time.Time
+	probing   bool
+	// the requests are paused until the time if the registry is rate limited
+	pausedUntil time.Time
+}
+
+// getRegistryBreaker returns the circuit breaker of the registry, the thresholds are read from
+// `cfg.RegistryBreakerThreshold` and `cfg.RegistryBreakerCooldown`.
+func getRegistryBreaker(registry string) *registryBreaker {
+	v, ok := registryBreakers.Load(registry)
+	if ok {
+		return v.(*registryBreaker)
+	}
+	threshold := 5
+	cooldown := 30 * time.Second
+	if cfg != nil {
+		if cfg.RegistryBreakerThreshold > 0 {
+			threshold = int(cfg.RegistryBreakerThreshold)
+		}
+		if cfg.RegistryBreakerCooldown > 0 {
+			cooldown = time.Duration(cfg.RegistryBreakerCooldown) * time.Second
+		}
+	}
+	v, _ = registryBreakers.LoadOrStore(registry, &registryBreaker{threshold: threshold, cooldown: cooldown})
+	return v.(*registryBreaker)
+}
+
+// allow returns true if the request can be sent to the registry.
+func (b *registryBreaker) allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.openedAt.IsZero() {
+		return true
+	}
+	// only one probe request is allowed in the half-open state
+	if b.probing || time.Since(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record records the result of a request, the breaker is closed on success and (re)opened
+// when the consecutive failures reach the threshold.
+func (b *registryBreaker) record(ok bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.probing = false
+	if ok {
+		b.failures = 0
+		b.openedAt = time.Time{}
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openedAt = time.Now()
+	}
+}
+
+// release releases the probe request of the half-open state without recording the result.
+func (b *registryBreaker) release() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.probing = false
+}
+
+// status returns the state of the circuit breaker: `closed`, `open` or `half-open`.
+func (b *registryBreaker) status() map[string]interface{} {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	state := "closed"
+	if !b.openedAt.IsZero() {
+		if b.probing || time.Since(b.openedAt) >= b.cooldown {
+			state = "half-open"
+		} else {
+			state = "open"
+		}
+	}
+	m := map[string]interface{}{
+		"state":    state,
+		"failures": b.failures,
+	}
+	if !b.openedAt.IsZero() {
+		m["openedAt"] = b.openedAt.Format(http.TimeFormat)
+	}
+	if time.Now().Before(b.pausedUntil) {
+		m["pausedUntil"] = b.pausedUntil.Format(http.TimeFormat)
+	}
+	return m
+}
+
+// getRegistryBreakersStatus returns the state of the circuit breakers by the registry.
+func getRegistryBreakersStatus() map[string]interface{} {
+	m := map[string]interface{}{}
+	registryBreakers.Range(func(key, value interface{}) bool {
+		m[key.(string)] = value.(*registryBreaker).status()
+		return true
+	})
+	return m
+}
+
+// pause pauses the requests to the registry for the duration.
+func (b *registryBreaker) pause(d time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if until := time.Now().Add(d); until.After(b.pausedUntil) {
+		b.pausedUntil = until
+	}
+}
+
+// pausedFor returns the remaining duration of the pause.
+func (b *registryBreaker) pausedFor() time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return time.Until(b.pausedUntil)
+}
+
+// decodePackument decodes the package metadata returned by the npm registry,
+// it fails if the metadata exceeds the `cfg.MaxPackumentBytes` limit.
+func decodePackument(name string, r io.Reader, v interface{}) error {
+	limit := cfg.MaxPackumentBytes
+	if limit <= 0 {
+		return json.NewDecoder(r).Decode(v)
+	}
+	lr := &io.LimitedReader{R: r, N: limit + 1}
+	err := json.NewDecoder(lr).Decode(v)
+	if lr.N <= 0 {
+		return fmt.Errorf("npm: metadata of package '%s' exceeds the size limit of %d bytes", name, limit)
+	}
+	return err
+}
+
+// decodePackumentVersions decodes the `dist-tags`, `versions` and `time` fields of the package metadata
+// in streaming, only the versions that may be selected for the request (the tagged versions and the versions
+// in the requested range) are materialized, to avoid the memory spikes of the packages with thousands
+// of versions (e.g. `@types/node`). The `versions` is nil if the metadata has no versions.
+func decodePackumentVersions(name string, r io.Reader, request string) (h NpmPackageVerions, err error) {
+	limit := cfg.MaxPackumentBytes
+	if limit > 0 {
+		lr := &io.LimitedReader{R: r, N: limit + 1}
+		defer func() {
+			if lr.N <= 0 {
+				err = fmt.Errorf("npm: metadata of package '%s' exceeds the size limit of %d bytes", name, limit)
+			}
+		}()
+		r = lr
+	}
+
+	// all the versions are required to resolve the fallback version of the minimum version and the version cooldown
+	_, hasMinVersion := cfg.MinVersions[name]
+	keepAll := hasMinVersion || cfg.VersionCooldown > 0
+	_, e := semver.NewConstraint(request)
+	isRange := e == nil
+	keep := func(key string) bool {
+		if keepAll {
+			return true
+		}
+		v := normalizeVersion(key)
+		for _, tagged := range h.DistTags {
+			if normalizeVersion(tagged) == v {
+				return true
+			}
+		}
+		if isRange {
+			ver, err := semver.NewVersion(v)
+			return err == nil && semverRangeCheck(ver, request)
+		}
+		return false
+	}
+
+	dec := json.NewDecoder(r)
+	if err = expectJSONDelim(dec, '{'); err != nil {
+		return
+	}
+	// the versions before the `dist-tags` field
+	var pending map[string]json.RawMessage
+	for dec.More() {
+		var t json.Token
+		t, err = dec.Token()
+		if err != nil {
+			return
+		}
+		switch t {
+		case "dist-tags":
+			err = dec.Decode(&h.DistTags)
+		case "time":
+			if cfg.VersionCooldown > 0 {
+				err = dec.Decode(&h.Time)
+			} else {
+				err = dec.Decode(&json.RawMessage{})
+			}
+		case "versions":
+			if t, err = dec.Token(); err != nil || t == nil {
+				break
+			}
+			if t != json.Delim('{') {
+				return h, fmt.Errorf("npm: invalid `versions` field of package '%s'", name)
+			}
+			n := 0
+			versions := map[string]NpmPackageInfo{}
+			for dec.More() {
+				t, err = dec.Token()
+				if err != nil {
+					return
+				}
+				key, _ := t.(string)
+				n++
+				if keep(key) {
+					var p NpmPackageInfo
+					err = dec.Decode(&p)
+					versions[key] = p
+				} else if h.DistTags == nil {
+					var raw json.RawMessage
+					err = dec.Decode(&raw)
+					if pending == nil {
+						pending = map[string]json.RawMessage{}
+					}
+					pending[key] = raw
+				} else {
+					err = dec.Decode(&json.RawMessage{})
+				}
+				if err != nil {
+					return
+				}
+			}
+			_, err = dec.Token()
+			if n > 0 {
+				h.Versions = versions
+			}
+		default:
+			err = dec.Decode(&json.RawMessage{})
+		}
+		if err != nil {
+			return
+		}
+	}
+	for key, raw := range pending {
+		if keep(key) {
+			var p NpmPackageInfo
+			err = json.Unmarshal(raw, &p)
+			if err != nil {
+				return
+			}
+			h.Versions[key] = p
+		}
+	}
+	return
+}
+
+// expectJSONDelim reads the next token of the decoder and checks it is the delimiter.
+func expectJSONDelim(dec *json.Decoder, delim json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if t != delim {
+		return fmt.Errorf("unexpected token %v, expected %v", t, delim)
+	}
+	return nil
+}
+
+// isTransientError returns true if the error of a http request is transient and worth retrying.
+func isTransientError(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// getWorkDir returns the install directory of the package, the layout can be customized
+// by `cfg.WorkDirFor`, e.g. to place large packages on a different volume.
+func getWorkDir(pkg Pkg) string {
+	if cfg.WorkDirFor != nil {
+		if dir := cfg.WorkDirFor(pkg.VersionName()); dir != "" {
+			return dir
+		}
+	}
+	return path.Join(cfg.WorkDir, "npm", pkg.VersionName())
+}
+
+func installPackage(ctx context.Context, dir string, pkg Pkg) (err error) {
+	err = checkPackagePolicy(pkg.Name, pkg.Version)
+	if err != nil {
+		return
+	}
+
+	pkgVersionName := pkg.VersionName()
+	// only one install process allowed at the same time
+	unlock := installLocks.Lock(pkgVersionName)
+	defer unlock()
+
+	// track the disk usage of the install directory for the gc after the packages are installed
+	installed := false
+	defer func() {
+		if err == nil && installed {
+			workDirs.track(getInstallDirOf(dir), dirSize(getInstallDirOf(dir), true))
+		}
+	}()
+
+	// apply the server-side patches to the installed packages
+	defer func() {
+		if err == nil && len(packagePatches) > 0 {
+			err = applyPatches(dir, packagePatches)
+		}
+	}()
+
+	// the package installed by the native installer has no lock file
+	if existsFile(path.Join(dir, "node_modules", nativeInstallMark)) && isPackageInstalled(dir, pkg) {
+		return nil
+	}
+
+	installer := getInstaller()
+	if existsFile(path.Join(dir, installer.Lockfile())) {
+		installed = isPackageInstalled(dir, pkg)
+		if !installed && existsDir(path.Join(dir, "node_modules")) {
+			// the previous install was interrupted, remove the partial `node_modules` to re-install cleanly
+			log.Warnf("install %s: the installed package is incomplete, re-installing", pkg)
+			err = os.RemoveAll(path.Join(dir, "node_modules"))
+			if err != nil {
+				return
+			}
+		}
+		// install strictly from the lock file, the lockfile drift is surfaced as an error
+		if cfg.FrozenLockfile {
+			installed = true
+			err = installer.Install(ctx, dir, nil, InstallOptions{FrozenLockfile: true})
+			if err == nil && !existsFile(path.Join(dir, "node_modules", pkg.Name, "package.json")) {
+				err = fmt.Errorf("%s install %s: package.json not found", installer.Name(), pkg)
+			}
+			return
+		}
+		// skip install if the lock file exists, the size of the install directory is tracked already
+		if installed {
+			installed = false
+			return nil
+		}
+	}
+
+	// ensure package.json file to prevent read up-levels
+	packageJsonFp := path.Join(dir, "package.json")
+	overrides := getInstallOverrides(dir, pkg)
+	if !existsFile(packageJsonFp) {
+		ensureDir(dir)
+		err = os.WriteFile(packageJsonFp, newInstallPackageJSON(nil, overrides), 0644)
+	} else if len(overrides) > 0 {
+		err = writeInstallOverrides(packageJsonFp, overrides)
+	}
+	if err != nil {
+		return fmt.Errorf("ensure package.json failed: %s", pkgVersionName)
+	}
+
+	installed = true
+	attemptMaxTimes := 3
+	for i := 1; i <= attemptMaxTimes; i++ {
+		// every backend holds a slot of the install semaphore, the slot is released between the attempts
+		err = withInstallSlot(ctx, pkgVersionName, func(ctx context.Context) error {
+			if pkg.FromGithub {
+				return ghInstall(ctx, dir, pkg)
+			} else if _, _, _, ok := parseGitURL(pkg.Version); ok {
+				return gitInstall(ctx, dir, pkg.Name, pkg.Version)
+			} else if _, _, ok := parseGitlabSpecifier(pkg.Version); ok {
+				return gitlabInstall(ctx, dir, pkg.Name, pkg.Version)
+			} else if _, ok := parseTarballVersion(pkg.Version); ok {
+				return tgzInstall(ctx, dir, pkg)
+			} else if cfg.NativeJsr && strings.HasPrefix(pkg.Name, "@jsr/") {
+				return jsrInstall(ctx, dir, pkg)
+			} else if regexpFullVersion.MatchString(pkg.Version) {
+				err := installer.Install(ctx, dir, []string{pkgVersionName}, InstallOptions{PreferOffline: true})
+				if err == nil {
+					err = verifyInstalledIntegrity(dir, pkg, installer)
+				}
+				return err
+			}
+			return installer.Install(ctx, dir, []string{pkgVersionName}, InstallOptions{})
+		})
+		if errors.Is(err, ErrIntegrityMismatch) {
+			return
+		}
+		packageJsonFp := path.Join(dir, "node_modules", pkg.Name, "package.json")
+		if err == nil && !existsFile(packageJsonFp) {
+			err = fmt.Errorf("%s install %s: package.json not found", installer.Name(), pkg)
+		}
+		// don't retry the canceled or timed out install
+		if err == nil || i == attemptMaxTimes || ctx.Err() != nil || errors.Is(err, context.DeadlineExceeded) {
+			break
+		}
+		if sleepContext(ctx, time.Duration(i)*100*time.Millisecond) != nil {
+			break
+		}
+	}
+	return
+}
+
+// getInstallOverrides returns the dependency overrides honored at install time, the overrides of the
+// deployment config (`cfg.Overrides`) are merged with the overrides declared by the package author in the
+// `"esm.sh": {"overrides": {...}}` field of the `package.json`, the deployment config wins.
+func getInstallOverrides(dir string, pkg Pkg) config.Overrides {
+	overrides := config.Overrides{}
+	if !pkg.FromGithub && regexpFullVersion.MatchString(pkg.Version) && !strings.HasPrefix(pkg.Name, "@jsr/") {
+		// prefer the `package.json` of the installed package
+		info, _, err := getPackageInfo(dir, pkg.Name, pkg.Version)
+		if err == nil && info.Esmsh["overrides"] != nil {
+			err = json.Unmarshal(mustEncodeJSON(info.Esmsh["overrides"]), &overrides)
+			if err != nil {
+				log.Warnf("install %s: invalid overrides in the `esm.sh` field: %v", pkg, err)
+				overrides = config.Overrides{}
+			}
+			// the overrides of the package author are restricted to the versions of the registry
+			overrides = filterRegistryOverrides(pkg, overrides)
+		}
+	}
+	if cfg != nil {
+		for name, ov := range cfg.Overrides {
+			overrides[name] = ov
+		}
+	}
+	return overrides
+}
+
+// filterRegistryOverrides drops the overrides that are not resolved by the npm registry, the installers honor
+// the `file:`, `link:`, git and tarball url specs that could link the server paths or bypass the fetch checks.
+func filterRegistryOverrides(pkg Pkg, overrides config.Overrides) config.Overrides {
+	filtered := config.Overrides{}
+	for name, ov := range overrides {
+		if !validatePackageName(name) {
+			log.Warnf("install %s: invalid override name '%s'", pkg, name)
+			continue
+		}
+		if ov.Version != "" && !isRegistryVersion(ov.Version) {
+			log.Warnf("install %s: the override '%s@%s' is not allowed", pkg, name, ov.Version)
+			ov.Version = ""
+		}
+		if len(ov.Deps) > 0 {
+			ov.Deps = filterRegistryOverrides(pkg, ov.Deps)
+		}
+		if ov.Version != "" || len(ov.Deps) > 0 {
+			filtered[name] = ov
+		}
+	}
+	return filtered
+}
+
+// isRegistryVersion returns true if the version is a semver range, a dist-tag or an npm alias of them.
+func isRegistryVersion(version string) bool {
+	if name, aliasVersion, ok := parseNpmAlias(version); ok {
+		return name != "" && !strings.HasPrefix(aliasVersion, "npm:") && isRegistryVersion(aliasVersion)
+	}
+	if regexpDistTag.MatchString(version) {
+		return true
+	}
+	_, err := semver.NewConstraint(version)
+	return err == nil
+}
+
+// newInstallPackageJSON returns the `package.json` of the install directory with the dependency overrides.
+func newInstallPackageJSON(dependencies map[string]string, overrides config.Overrides) []byte {
+	p := map[string]interface{}{}
+	if len(dependencies) > 0 {
+		p["dependencies"] = dependencies
+	}
+	setInstallOverrides(p, overrides)
+	return mustEncodeJSON(p)
+}
+
+// writeInstallOverrides updates the dependency overrides of the existing `package.json` of the install directory.
+func writeInstallOverrides(packageJsonFp string, overrides config.Overrides) (err error) {
+	p := map[string]interface{}{}
+	err = parseJSONFile(packageJsonFp, &p)
+	if err != nil {
+		return
+	}
+	setInstallOverrides(p, overrides)
+	return os.WriteFile(packageJsonFp, mustEncodeJSON(p), 0644)
+}
+
+// setInstallOverrides sets the overrides in the fields read by the installers: `overrides` by npm and bun,
+// `pnpm.overrides` by pnpm (`a>b>name` selectors) and `resolutions` by yarn (`a/b/name` patterns).
+func setInstallOverrides(p map[string]interface{}, overrides config.Overrides) {
+	if len(overrides) == 0 {
+		return
+	}
+	pnpmOverrides := map[string]string{}
+	resolutions := map[string]string{}
+	walkOverrides(overrides, nil, func(parents []string, name string, version string) {
+		if len(parents) == 0 {
+			pnpmOverrides[name] = version
+			resolutions["**/"+name] = version
+		} else {
+			pnpmOverrides[strings.Join(parents, ">")+">"+name] = version
+			resolutions[strings.Join(parents, "/")+"/"+name] = version
+		}
+	})
+	pnpm, _ := p["pnpm"].(map[string]interface{})
+	if pnpm == nil {
+		pnpm = map[string]interface{}{}
+	}
+	pnpm["overrides"] = pnpmOverrides
+	p["pnpm"] = pnpm
+	p["overrides"] = overrides
+	p["resolutions"] = resolutions
+}
+
+func walkOverrides(overrides config.Overrides, parents []string, fn func(parents []string, name string, version string)) {
+	for name, ov := range overrides {
+		if ov.Version != "" {
+			fn(parents, name, ov.Version)
+		}
+		if len(ov.Deps) > 0 {
+			walkOverrides(ov.Deps, append(parents[:len(parents):len(parents)], name), fn)
+		}
+	}
+}
+
+// isPackageInstalled checks the integrity of the installed package: the `package.json` is parseable
+// and the entry files declared by the `main` and `module` fields exist.
+func isPackageInstalled(dir string, pkg Pkg) bool {
+	pkgDir := path.Join(dir, "node_modules", pkg.Name)
+	var p NpmPackageInfo
+	if parseJSONFile(path.Join(pkgDir, "package.json"), &p) != nil {
+		return false
+	}
+	for _, entry := range []string{p.Main, p.Module} {
+		if entry == "" {
+			continue
+		}
+		fp := path.Join(pkgDir, entry)
+		if !existsFile(fp) && !existsDir(fp) && !existsFile(fp+".js") && !existsFile(fp+".mjs") && !existsFile(fp+".cjs") && !existsFile(fp+".json") {
+			return false
+		}
+	}
+	return true
+}
+
+// npmVersionMetadata defines the fields of the package version metadata used by the native installer
+type npmVersionMetadata struct {
+	Dependencies         map[string]string `json:"dependencies"`
+	OptionalDependencies map[string]string `json:"optionalDependencies"`
+	PeerDependencies     map[string]string `json:"peerDependencies"`
+	Dist                 npmDist           `json:"dist"`
+}
+
+// npmDist defines the `dist` field of the package version metadata
+type npmDist struct {
+	Tarball   string `json:"tarball"`
+	Shasum    string `json:"shasum"`
+	Integrity string `json:"integrity"`
+}
+
+// verify checks the checksums of the tarball by the `integrity` field (sha512 or sha1), or the `shasum` field.
+func (d *npmDist) verify(sha1sum []byte, sha512sum []byte) bool {
+	for _, s := range strings.Fields(d.Integrity) {
+		algo, digest, _ := strings.Cut(s, "-")
+		switch algo {
+		case "sha512":
+			return digest == base64.StdEncoding.EncodeToString(sha512sum)
+		case "sha1":
+			return digest == base64.StdEncoding.EncodeToString(sha1sum)
+		}
+	}
+	if d.Shasum != "" {
+		return strings.ToLower(d.Shasum) == hex.EncodeToString(sha1sum)
+	}
+	return false
+}
+
+// matchIntegrity checks the integrity recorded by the installer (e.g. `sha512-...` in the pnpm lockfile)
+// against the advertised checksums, it returns true if there is no comparable checksum.
+func (d *npmDist) matchIntegrity(integrity string) bool {
+	algo, digest, ok := strings.Cut(integrity, "-")
+	if !ok {
+		return true
+	}
+	comparable := false
+	for _, s := range strings.Fields(d.Integrity) {
+		a, v, _ := strings.Cut(s, "-")
+		if a == algo {
+			if v == digest {
+				return true
+			}
+			comparable = true
+		}
+	}
+	if algo == "sha1" && d.Shasum != "" {
+		sum, err := hex.DecodeString(d.Shasum)
+		if err == nil {
+			return base64.StdEncoding.EncodeToString(sum) == digest
+		}
+	}
+	return !comparable
+}
+
+// verifyInstalledIntegrity checks the integrity of the installed package recorded in the lockfile against
+// the `dist` metadata of the registry, the `node_modules` is removed if the integrity mismatches.
+func verifyInstalledIntegrity(dir string, pkg Pkg, installer Installer) error {
+	integrity, ok := installer.Integrity(dir, pkg.Name, pkg.Version)
+	if !ok {
+		log.Debugf("install %s: integrity not found in the %s lockfile", pkg, installer.Name())
+		return nil
+	}
+	info, err := fetchPackageInfo(pkg.Name, pkg.Version)
+	if err != nil {
+		return err
+	}
+	if info.Dist.matchIntegrity(integrity) {
+		return nil
+	}
+	// do not serve the tampered package
+	os.RemoveAll(path.Join(dir, "node_modules"))
+	os.Remove(path.Join(dir, installer.Lockfile()))
+	return newRegistryError(ErrIntegrityMismatch, "security: integrity mismatch of %s, the registry advertises '%s' but '%s' was installed", pkg, info.Dist.Integrity, integrity)
+}
+
+// readPnpmLockIntegrity reads the `resolution.integrity` of the package in the pnpm lockfile, e.g.
+//
+//	packages:
+//	  lodash@4.17.21:
+//	    resolution: {integrity: sha512-...}
+func readPnpmLockIntegrity(lockfile string, name string, version string) (integrity string, ok bool) {
+	data, err := os.ReadFile(lockfile)
+	if err != nil {
+		return
+	}
+	key := name + "@" + version
+	inPackage := false
+	for _, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasSuffix(trimmed, ":") && !strings.HasPrefix(trimmed, "resolution") {
+			// the key of the lockfile v6 is prefixed with `/`, and the peer dependencies are suffixed with `(...)`
+			k := strings.Trim(strings.TrimSuffix(trimmed, ":"), `'"`)
+			k = strings.TrimPrefix(k, "/")
+			if i := strings.IndexByte(k, '('); i > 0 {
+				k = k[:i]
+			}
+			inPackage = k == key
+			continue
+		}
+		// the resolution may be an inline map or a block map
+		if _, v, found := strings.Cut(trimmed, "integrity:"); inPackage && found {
+			v, _, _ = strings.Cut(strings.TrimSpace(v), ",")
+			return strings.Trim(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(v), "}")), `'"`), true
+		}
+	}
+	return
+}
+
+// the mark file of the install directory that is installed by the native installer
+const nativeInstallMark = ".native-install"
+
+// tarballInstall installs the package by downloading the tarball from the registry and extracting it
+// into `node_modules/<pkg>` without pnpm. Only the packages without dependencies are installed, it returns
+// false if the package is not eligible and should be installed by pnpm. The download and the extraction
+// are stopped when the context is done.
+func tarballInstall(ctx context.Context, dir string, pkg Pkg) (installed bool, err error) {
+	req, err := newRegistryRequest(pkg.Name, pkg.Version)
+	if err != nil {
+		return
+	}
+	req = req.WithContext(ctx)
+	resp, err := fetchRegistryWithFailover(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	err = checkRegistryResponse(resp, pkg.Name, pkg.Version)
+	if err != nil {
+		return
+	}
+	var meta npmVersionMetadata
+	err = decodePackument(pkg.Name, resp.Body, &meta)
+	if err != nil {
+		return
+	}
+	if meta.Dist.Tarball == "" || len(meta.Dependencies) > 0 || len(meta.OptionalDependencies) > 0 || len(meta.PeerDependencies) > 0 {
+		return false, nil
+	}
+
+	// reuse the package extracted by other builds in the store
+	storeDir, useStore := "", false
+	if cfg.PackageStore {
+		storeDir, useStore = getPackageStoreDir(meta.Dist)
+	}
+	if useStore && existsFile(path.Join(storeDir, "package.json")) {
+		err = linkStorePackage(dir, pkg, storeDir)
+		return err == nil, err
+	}
+
+	tarballReq, err := http.NewRequestWithContext(ctx, "GET", meta.Dist.Tarball, nil)
+	if err != nil {
+		return
+	}
+	// the credentials are only sent to the registry host
+	if tarballReq.URL.Host == req.URL.Host {
+		tarballReq.Header = req.Header.Clone()
+		tarballReq.Header.Del("Accept")
+	}
+	tarballResp, err := fetchRegistry(tarballReq)
+	if err != nil {
+		return
+	}
+	defer tarballResp.Body.Close()
+	if tarballResp.StatusCode != 200 {
+		return false, fmt.Errorf("could not download the tarball %s (%s)", meta.Dist.Tarball, tarballResp.Status)
+	}
+
+	nodeModulesDir := path.Join(dir, "node_modules")
+	err = ensureDir(nodeModulesDir)
+	if err != nil {
+		return
+	}
+	// extract the tarball into a temporary directory, then move it to `node_modules/<pkg>` after verified
+	tmpDir, err := os.MkdirTemp(nodeModulesDir, ".tarball-")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	sha1Hash := sha1.New()
+	sha512Hash := sha512.New()
+	body := io.TeeReader(&contextReader{ctx, tarballResp.Body}, io.MultiWriter(sha1Hash, sha512Hash))
+	err = extractTarball(body, tmpDir)
+	if err != nil {
+		return
+	}
+	// read the rest of the tarball to compute the checksums
+	_, err = io.Copy(io.Discard, body)
+	if err != nil {
+		return
+	}
+	if !meta.Dist.verify(sha1Hash.Sum(nil), sha512Hash.Sum(nil)) {
+		return false, newRegistryError(ErrIntegrityMismatch, "security: checksum mismatch of the tarball %s", meta.Dist.Tarball)
+	}
+	if !existsFile(path.Join(tmpDir, "package.json")) {
+		return false, fmt.Errorf("package.json not found in the tarball %s", meta.Dist.Tarball)
+	}
+	// the temporary directory is created with mode 0700
+	err = os.Chmod(tmpDir, 0755)
+	if err != nil {
+		return
+	}
+
+	if useStore {
+		err = ensureDir(path.Dir(storeDir))
+		if err != nil {
+			return
+		}
+		// the rename fails if the package is saved in the store by another build at the same time
+		if os.Rename(tmpDir, storeDir) == nil {
+			workDirs.track(storeDir, dirSize(storeDir, false))
+		}
+		if existsFile(path.Join(storeDir, "package.json")) {
+			err = linkStorePackage(dir, pkg, storeDir)
+			return err == nil, err
+		}
+	}
+	err = movePackage(dir, pkg, tmpDir)
+	return err == nil, err
+}
+
+// linkStorePackage links the package in the store into `node_modules/<pkg>`.
+func linkStorePackage(dir string, pkg Pkg, storeDir string) (err error) {
+	// the package can't be evicted from the store by the gc during the linking
+	defer workDirs.use(storeDir)()
+	nodeModulesDir := path.Join(dir, "node_modules")
+	err = ensureDir(nodeModulesDir)
+	if err != nil {
+		return
+	}
+	tmpDir, err := os.MkdirTemp(nodeModulesDir, ".store-")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+	err = linkTree(storeDir, tmpDir)
+	if err != nil {
+		return
+	}
+	err = os.Chmod(tmpDir, 0755)
+	if err != nil {
+		return
+	}
+	return movePackage(dir, pkg, tmpDir)
+}
+
+// movePackage moves the extracted package to `node_modules/<pkg>` and marks the install directory.
+func movePackage(dir string, pkg Pkg, srcDir string) (err error) {
+	nodeModulesDir := path.Join(dir, "node_modules")
+	pkgDir := path.Join(nodeModulesDir, pkg.Name)
+	err = ensureDir(path.Dir(pkgDir))
+	if err != nil {
+		return
+	}
+	err = os.RemoveAll(pkgDir)
+	if err != nil {
+		return
+	}
+	err = os.Rename(srcDir, pkgDir)
+	if err != nil {
+		return
+	}
+	return os.WriteFile(path.Join(nodeModulesDir, nativeInstallMark), []byte(pkg.VersionName()), 0644)
+}
+
+// pnpmCommand returns the pnpm command with the given arguments,
+// the pnpm binary and the extra arguments can be pinned by `cfg.PnpmBinary` and `cfg.PnpmArgs`.
+func pnpmCommand(ctx context.Context, args ...string) *exec.Cmd {
+	bin := "pnpm"
+	if cfg != nil && cfg.PnpmBinary != "" {
+		bin = cfg.PnpmBinary
+	}
+	if cfg != nil && len(cfg.PnpmArgs) > 0 {
+		args = append(append([]string{}, cfg.PnpmArgs...), args...)
+	}
+	return exec.CommandContext(ctx, bin, args...)
+}
+
+// pnpmInstall runs `pnpm add` for the given packages, or `pnpm install` if no package is given,
+// the arguments starting with `--` are passed to pnpm as flags.
+func pnpmInstall(ctx context.Context, dir string, packagesAndFlags ...string) (err error) {
+	return pnpmInstallWithOutput(ctx, dir, nil, packagesAndFlags...)
+}
+
+// pnpmInstallWithOutput is like pnpmInstall, the stdout/stderr of pnpm are streamed to the
+// given writer as they are produced, the full output is still returned on error.
+func pnpmInstallWithOutput(ctx context.Context, dir string, w io.Writer, packagesAndFlags ...string) (err error) {
+	var packages []string
+	var flags []string
+	for _, arg := range packagesAndFlags {
+		if strings.HasPrefix(arg, "--") {
+			flags = append(flags, arg)
+		} else {
+			packages = append(packages, arg)
+		}
+	}
+	var args []string
+	if len(packages) > 0 {
+		args = append([]string{"add"}, packages...)
+	} else {
+		args = []string{"install"}
+	}
+	args = append(args, flags...)
+	if cfg.PnpmNodeLinker != "" {
+		args = append(args, "--node-linker="+cfg.PnpmNodeLinker)
+	}
+	args = append(
+		args,
+		"--ignore-scripts",
+		"--loglevel", "error",
+	)
+	ctx, cancel := withInstallTimeout(ctx)
+	defer cancel()
 	start := time.Now()
-	cmd := exec.Command("pnpm", args...)
+	cmd := pnpmCommand(ctx, args...)
 	cmd.Dir = dir
-	if cfg.NpmToken != "" {
-		cmd.Env = append(os.Environ(), "ESM_NPM_TOKEN="+cfg.NpmToken)
+	if env := installerEnv(); len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
 	}
-	if cfg.NpmUser != "" && cfg.NpmPassword != "" {
-		data := []byte(cfg.NpmPassword)
-		password := make([]byte, base64.StdEncoding.EncodedLen(len(data)))
-		base64.StdEncoding.Encode(password, data)
-		cmd.Env = append(
-			os.Environ(),
-			"ESM_NPM_USER="+cfg.NpmUser,
-			"ESM_NPM_PASSWORD="+string(password),
-		)
+	output := bytes.NewBuffer(nil)
+	if w != nil {
+		out := io.MultiWriter(output, w)
+		cmd.Stdout = out
+		cmd.Stderr = out
+	} else {
+		cmd.Stdout = output
+		cmd.Stderr = output
 	}
-	output, err := cmd.CombinedOutput()
+	err = cmd.Run()
 	if err != nil {
-		return fmt.Errorf("pnpm add %s: %s", strings.Join(packages, ","), string(output))
+		if ctx.Err() != nil {
+			return fmt.Errorf("pnpm add %s: %w", strings.Join(packages, ","), ctx.Err())
+		}
+		return fmt.Errorf("pnpm add %s: %s", strings.Join(packages, ","), output.String())
 	}
 	if len(packages) > 0 {
 		log.Debug("pnpm add", strings.Join(packages, ","), "in", time.Since(start))
@@ -472,6 +2343,10 @@ func validatePackageName(name string) bool {
 	if (scope != "" && !npmNaming.Is(scope)) || (nameWithoutScope == "" || !npmNaming.Is(nameWithoutScope)) || len(name) > 214 {
 		return false
 	}
+	// the name can't start with a period or an underscore, e.g. `..`
+	if strings.HasPrefix(nameWithoutScope, ".") || strings.HasPrefix(nameWithoutScope, "_") || strings.HasPrefix(scope, ".") {
+		return false
+	}
 	return true
 }
 
@@ -483,16 +2358,64 @@ func toTypesPackageName(pkgName string) string {
 	return "@types/" + pkgName
 }
 
-func isTypesOnlyPackage(p NpmPackageInfo) bool {
-	return p.Main == "" && p.Module == "" && p.Types != ""
+// isPublishedFile returns true if the file is published by the `files` field of package.json,
+// the `package.json`, README and LICENSE files are always published.
+func isPublishedFile(p NpmPackageInfo, filename string) bool {
+	if len(p.Files) == 0 {
+		return true
+	}
+	filename = strings.TrimPrefix(path.Clean("/"+filename), "/")
+	if !strings.Contains(filename, "/") {
+		lower := strings.ToLower(filename)
+		if lower == "package.json" || strings.HasPrefix(lower, "readme") || strings.HasPrefix(lower, "license") || strings.HasPrefix(lower, "licence") {
+			return true
+		}
+	}
+	// the `main` and `module` entries are always published
+	for _, entry := range []string{p.Main, p.Module} {
+		if entry != "" {
+			entry = strings.TrimPrefix(path.Clean("/"+entry), "/")
+			if filename == entry || filename == entry+".js" {
+				return true
+			}
+		}
+	}
+	published := false
+	for _, pattern := range p.Files {
+		exclude := strings.HasPrefix(pattern, "!")
+		pattern = strings.Trim(strings.TrimPrefix(strings.TrimPrefix(pattern, "!"), "./"), "/")
+		if matchFilesPattern(pattern, filename) {
+			published = !exclude
+		}
+	}
+	return published
 }
 
-func getInstallLock(key string) *sync.Mutex {
-	v, _ := installLocks.LoadOrStore(key, &sync.Mutex{})
-	return v.(*sync.Mutex)
+// matchFilesPattern matches the file with a pattern of the `files` field, the pattern matches
+// the file itself or the files in the directory.
+func matchFilesPattern(pattern string, filename string) bool {
+	if pattern == "" || pattern == "*" || pattern == "**" {
+		return true
+	}
+	if prefix, rest, ok := strings.Cut(pattern, "**"); ok {
+		if !strings.HasPrefix(filename, prefix) {
+			return false
+		}
+		rest = strings.TrimPrefix(rest, "/")
+		if rest == "" {
+			return true
+		}
+		matched, _ := path.Match(rest, path.Base(filename))
+		return matched
+	}
+	for name := filename; name != "." && name != "/"; name = path.Dir(name) {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
 }
 
-func getFetchLock(key string) *sync.Mutex {
-	v, _ := fetchLocks.LoadOrStore(key, &sync.Mutex{})
-	return v.(*sync.Mutex)
+func isTypesOnlyPackage(p NpmPackageInfo) bool {
+	return p.Main == "" && p.Module == "" && p.Types != ""
 }
@@ -0,0 +1,2050 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/config"
+	"github.com/esm-dev/esm.sh/server/storage"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/ije/rex"
+)
+
+// newTestRegistry starts a fake npm registry and points the global config and cache to it
+func newTestRegistry(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	srv := httptest.NewServer(handler)
+	c, err := storage.OpenCache("memory:test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = &config.Config{NpmRegistry: srv.URL + "/"}
+	cache = c
+	t.Cleanup(func() {
+		srv.Close()
+		cfg = nil
+		cache = nil
+		registryBreakers.Range(func(key, value interface{}) bool {
+			registryBreakers.Delete(key)
+			return true
+		})
+	})
+	return srv
+}
+
+// newTestPnpm puts a stub `pnpm` command into the PATH that records the arguments of each call
+func newTestPnpm(t *testing.T) (argsFile string) {
+	binDir := t.TempDir()
+	argsFile = writeTestPnpm(t, path.Join(binDir, "pnpm"))
+	t.Setenv("PATH", binDir+":"+os.Getenv("PATH"))
+	return
+}
+
+// writeTestPnpm writes a stub pnpm binary that records the arguments of each call
+func writeTestPnpm(t *testing.T, binPath string) (argsFile string) {
+	argsFile = binPath + ".args.txt"
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %s\n", argsFile)
+	err := os.WriteFile(binPath, []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// newTestInstallDir creates an install directory that has the package installed
+func newTestInstallDir(t *testing.T, pkg Pkg, files map[string]string) string {
+	dir := t.TempDir()
+	files[path.Join("node_modules", pkg.Name, "package.json")] = fmt.Sprintf(`{"name":"%s","version":"%s"}`, pkg.Name, pkg.Version)
+	for name, content := range files {
+		ensureDir(path.Dir(path.Join(dir, name)))
+		if err := os.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestInvalidatePackage(t *testing.T) {
+	var hits int32
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if r.URL.Path == "/foo/1.0.0" {
+			w.Write([]byte(`{"name":"foo","version":"1.0.0"}`))
+			return
+		}
+		w.Write([]byte(`{"dist-tags":{"latest":"1.0.0"},"versions":{"1.0.0":{"name":"foo","version":"1.0.0"}}}`))
+	})
+
+	for _, version := range []string{"latest", "1.0.0", "latest", "1.0.0"} {
+		if _, err := fetchPackageInfo("foo", version); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Fatalf("expected 2 registry hits, got %d", n)
+	}
+
+	if err := InvalidatePackage("foo"); err != nil {
+		t.Fatal(err)
+	}
+	fetchPackageInfo("foo", "latest")
+	fetchPackageInfo("foo", "1.0.0")
+	if n := atomic.LoadInt32(&hits); n != 3 {
+		t.Fatalf("expected the `latest` tag to be re-fetched only, got %d registry hits", n)
+	}
+
+	if err := InvalidatePackageWithVersions("foo"); err != nil {
+		t.Fatal(err)
+	}
+	fetchPackageInfo("foo", "latest")
+	fetchPackageInfo("foo", "1.0.0")
+	if n := atomic.LoadInt32(&hits); n != 5 {
+		t.Fatalf("expected both entries to be re-fetched, got %d registry hits", n)
+	}
+}
+
+func TestPackageCacheIndex(t *testing.T) {
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	recordPackageCacheKey("foo", "npm:foo@latest", time.Minute)
+	recordPackageCacheKey("foo", "npm:foo@^1.0.0", -time.Minute)
+	cache.Set("npm:foo@latest", []byte("{}"), time.Minute)
+
+	// the index is stored in the cache, the expired keys are dropped
+	index := loadPackageCacheIndex("npm-keys:foo")
+	if len(index) != 1 || index["npm:foo@latest"] == 0 {
+		t.Fatalf("invalid index %v", index)
+	}
+
+	if err := InvalidatePackage("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := cache.Has("npm:foo@latest"); ok {
+		t.Fatal("the cached package info should be deleted")
+	}
+	if ok, _ := cache.Has("npm-keys:foo"); ok {
+		t.Fatal("the empty index should be deleted")
+	}
+}
+
+func TestFetchRetryOnConnectionReset(t *testing.T) {
+	var hits int32
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) == 1 {
+			// drop the connection without response
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+		w.Write([]byte(`{"name":"foo","version":"1.0.0"}`))
+	})
+
+	info, err := fetchPackageInfo("foo", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "1.0.0" {
+		t.Fatalf("invalid version %q", info.Version)
+	}
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Fatalf("expected 2 attempts, got %d", n)
+	}
+}
+
+func TestFetchNoRetryOnDNSError(t *testing.T) {
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {})
+	cfg.NpmRegistry = "http://registry.esm.invalid/"
+
+	_, err := fetchPackageInfo("foo", "1.0.0")
+	if err == nil || !strings.Contains(err.Error(), "could not resolve the registry host") {
+		t.Fatalf("expected a DNS error, got %v", err)
+	}
+
+	if isTransientError(&net.DNSError{Err: "no such host", IsNotFound: true}) {
+		t.Fatal("NXDOMAIN error should not be transient")
+	}
+	if !isTransientError(&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}) {
+		t.Fatal("connection reset error should be transient")
+	}
+}
+
+func TestInstallWithFrozenLockfile(t *testing.T) {
+	argsFile := newTestPnpm(t)
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	pkg := Pkg{Name: "foo", Version: "1.0.0"}
+	dir := newTestInstallDir(t, pkg, map[string]string{"pnpm-lock.yaml": "lockfileVersion: '6.0'"})
+
+	// skip install if the lockfile exists by default
+	if err := installPackage(context.Background(), dir, pkg); err != nil {
+		t.Fatal(err)
+	}
+	if existsFile(argsFile) {
+		t.Fatal("pnpm should not be called")
+	}
+
+	cfg.FrozenLockfile = true
+	if err := installPackage(context.Background(), dir, pkg); err != nil {
+		t.Fatal(err)
+	}
+	args, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(args), "install --frozen-lockfile") {
+		t.Fatalf("invalid pnpm args: %s", args)
+	}
+}
+
+func TestReinstallIncompletePackage(t *testing.T) {
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {})
+	// the stub pnpm records the arguments and installs the package `foo`
+	binDir := t.TempDir()
+	argsFile := path.Join(binDir, "pnpm.args.txt")
+	script := fmt.Sprintf(`#!/bin/sh
+echo "$@" >> %s
+mkdir -p node_modules/foo
+echo '{"name":"foo","version":"1.0.0","main":"index.js"}' > node_modules/foo/package.json
+echo 'module.exports = "foo"' > node_modules/foo/index.js
+`, argsFile)
+	if err := os.WriteFile(path.Join(binDir, "pnpm"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir+":"+os.Getenv("PATH"))
+
+	pkg := Pkg{Name: "foo", Version: "1.0.0"}
+	dir := newTestInstallDir(t, pkg, map[string]string{
+		"pnpm-lock.yaml":               "lockfileVersion: '6.0'",
+		"node_modules/foo/index.js":    `module.exports = "foo"`,
+		"node_modules/.pnpm/lock.yaml": "lockfileVersion: '6.0'",
+	})
+	os.WriteFile(path.Join(dir, "node_modules/foo/package.json"), []byte(`{"name":"foo","version":"1.0.0","main":"index.js"}`), 0644)
+
+	// the intact package is not re-installed
+	if err := installPackage(context.Background(), dir, pkg); err != nil {
+		t.Fatal(err)
+	}
+	if existsFile(argsFile) {
+		t.Fatal("pnpm should not be called")
+	}
+
+	for name, corrupt := range map[string]func(){
+		"missing entry":       func() { os.Remove(path.Join(dir, "node_modules/foo/index.js")) },
+		"broken package.json": func() { os.WriteFile(path.Join(dir, "node_modules/foo/package.json"), []byte(`{"name":"fo`), 0644) },
+	} {
+		os.Remove(argsFile)
+		corrupt()
+		if err := installPackage(context.Background(), dir, pkg); err != nil {
+			t.Fatal(err)
+		}
+		if !existsFile(argsFile) {
+			t.Fatalf("%s: pnpm should be called to re-install the package", name)
+		}
+		if !isPackageInstalled(dir, pkg) || existsFile(path.Join(dir, "node_modules/.pnpm/lock.yaml")) {
+			t.Fatalf("%s: the package should be re-installed cleanly", name)
+		}
+	}
+}
+
+func TestMaxPackumentBytes(t *testing.T) {
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"name":"foo","version":"1.0.0","description":"`))
+		chunk := []byte(strings.Repeat("x", 1024))
+		for i := 0; i < 1024; i++ {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+		w.Write([]byte(`"}`))
+	})
+	cfg.MaxPackumentBytes = 64 * 1024
+
+	_, err := fetchPackageInfo("foo", "1.0.0")
+	if err == nil || !strings.Contains(err.Error(), "exceeds the size limit of 65536 bytes") {
+		t.Fatalf("expected a size limit error, got %v", err)
+	}
+
+	cfg.MaxPackumentBytes = 2 * 1024 * 1024
+	info, err := fetchPackageInfo("foo", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "1.0.0" {
+		t.Fatalf("invalid version %q", info.Version)
+	}
+}
+
+func TestPnpmBinary(t *testing.T) {
+	pathArgsFile := newTestPnpm(t)
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {})
+	cfg.PnpmBinary = path.Join(t.TempDir(), "pnpm-pinned")
+	cfg.PnpmArgs = []string{"--store-dir", "/tmp/pnpm-store"}
+	argsFile := writeTestPnpm(t, cfg.PnpmBinary)
+
+	if err := pnpmInstall(context.Background(), t.TempDir(), "foo@1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if existsFile(pathArgsFile) {
+		t.Fatal("pnpm in the PATH should not be called")
+	}
+	args, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(args), "--store-dir /tmp/pnpm-store add foo@1.0.0") {
+		t.Fatalf("invalid pnpm args: %s", args)
+	}
+}
+
+func TestPnpmNodeLinker(t *testing.T) {
+	argsFile := newTestPnpm(t)
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	// use pnpm's default node-linker if not configured
+	if err := pnpmInstall(context.Background(), t.TempDir(), "foo@1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	cfg.PnpmNodeLinker = "hoisted"
+	if err := pnpmInstall(context.Background(), t.TempDir(), "foo@1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	args, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(args)), "\n")
+	if len(lines) != 2 || strings.Contains(lines[0], "--node-linker") || !strings.HasPrefix(lines[1], "add foo@1.0.0 --node-linker=hoisted") {
+		t.Fatalf("invalid pnpm args: %s", args)
+	}
+}
+
+func TestMinVersions(t *testing.T) {
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{
+			"dist-tags": {"latest": "1.1.0", "next": "2.0.0-beta.1"},
+			"versions": {
+				"1.0.0": {"name": "foo", "version": "1.0.0"},
+				"1.1.0": {"name": "foo", "version": "1.1.0"},
+				"1.1.1": {"name": "foo", "version": "1.1.1"},
+				"1.2.0": {"name": "foo", "version": "1.2.0"},
+				"2.0.0-beta.1": {"name": "foo", "version": "2.0.0-beta.1"}
+			}
+		}`))
+	})
+	cfg.MinVersions = map[string]string{"foo": "1.1.1"}
+
+	for version, expected := range map[string]string{
+		"latest": "1.1.1",
+		"^1.0.0": "1.2.0",
+		"~1.1.0": "1.1.1",
+	} {
+		info, err := fetchPackageInfo("foo", version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Version != expected {
+			t.Fatalf("invalid version of 'foo@%s', expected %s, got %s", version, expected, info.Version)
+		}
+	}
+
+	_, err := fetchPackageInfo("foo", "1.0.x")
+	if err == nil || !strings.Contains(err.Error(), "minimum version 1.1.1") {
+		t.Fatalf("expected a minimum version error, got %v", err)
+	}
+}
+
+func TestRegistryErrors(t *testing.T) {
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/foo":
+			w.Write([]byte(`{"dist-tags":{"latest":"1.0.0"},"versions":{"1.0.0":{"name":"foo","version":"1.0.0"}}}`))
+		case "/private":
+			w.WriteHeader(401)
+		case "/broken":
+			w.WriteHeader(503)
+		default:
+			w.WriteHeader(404)
+		}
+	})
+
+	for _, c := range []struct {
+		name     string
+		version  string
+		sentinel error
+		status   int
+	}{
+		{"missing", "latest", ErrPackageNotFound, 404},
+		{"foo", "2.0.0", ErrVersionNotFound, 404},
+		{"foo", "^2.0.0", ErrVersionNotFound, 404},
+		{"private", "latest", ErrUnauthorized, 403},
+		{"broken", "latest", ErrRegistryUnavailable, 502},
+	} {
+		_, err := fetchPackageInfo(c.name, c.version)
+		if !errors.Is(err, c.sentinel) {
+			t.Fatalf("expected %v for '%s@%s', got %v", c.sentinel, c.name, c.version, err)
+		}
+		if status := getErrorStatus(err); status != c.status {
+			t.Fatalf("invalid status %d of %v, should be %d", status, err, c.status)
+		}
+	}
+
+	cfg.NpmRegistry = "http://registry.esm.invalid/"
+	_, err := fetchPackageInfo("foo", "latest")
+	if !errors.Is(err, ErrRegistryUnavailable) {
+		t.Fatalf("expected %v, got %v", ErrRegistryUnavailable, err)
+	}
+}
+
+func TestTypesRegistry(t *testing.T) {
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request to the default registry: %s", r.URL.Path)
+		w.WriteHeader(404)
+	})
+	var authorization string
+	typesRegistry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.Write([]byte(`{"name":"@types/foo","version":"1.0.0","types":"index.d.ts"}`))
+	}))
+	defer typesRegistry.Close()
+	cfg.NpmToken = "npm-token"
+	cfg.TypesRegistry = typesRegistry.URL + "/"
+	cfg.TypesRegistryToken = "types-token"
+
+	info, err := fetchPackageInfo(toTypesPackageName("foo"), "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "@types/foo" {
+		t.Fatalf("invalid package %q", info.Name)
+	}
+	if authorization != "Bearer types-token" {
+		t.Fatalf("invalid authorization %q", authorization)
+	}
+}
+
+func TestRegistryConnectionReuse(t *testing.T) {
+	conns := newStringSet()
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		conns.Add(r.RemoteAddr)
+		name := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")[0]
+		fmt.Fprintf(w, `{"name":"%s","version":"1.0.0"}`, name)
+	})
+
+	for _, name := range []string{"foo", "bar", "baz"} {
+		if _, err := fetchPackageInfo(name, "1.0.0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := conns.Len(); n != 1 {
+		t.Fatalf("expected the connection to be reused, got %d connections", n)
+	}
+}
+
+func TestFallbackDistTags(t *testing.T) {
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{
+			"dist-tags": {"canary": "0.0.0-canary.2"},
+			"versions": {
+				"0.0.0-canary.1": {"name": "foo", "version": "0.0.0-canary.1"},
+				"0.0.0-canary.2": {"name": "foo", "version": "0.0.0-canary.2"}
+			}
+		}`))
+	})
+
+	_, err := fetchPackageInfo("foo", "^1.0.0")
+	if !errors.Is(err, ErrVersionNotFound) {
+		t.Fatalf("expected %v, got %v", ErrVersionNotFound, err)
+	}
+
+	cfg.FallbackDistTags = []string{"latest", "next", "canary"}
+	for _, version := range []string{"^2.0.0", "latest"} {
+		info, err := fetchPackageInfo("foo", version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Version != "0.0.0-canary.2" {
+			t.Fatalf("invalid version %q, should fallback to the `canary` tag", info.Version)
+		}
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	var status int32 = 200
+	srv := newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/is-number" {
+			t.Errorf("unexpected request: %s", r.URL.Path)
+		}
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+		w.Write([]byte(`{"dist-tags":{"latest":"1.0.0"},"versions":{"1.0.0":{"name":"is-number","version":"1.0.0"}}}`))
+	})
+
+	if err := SelfTest(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	atomic.StoreInt32(&status, 401)
+	if err := SelfTest(context.Background()); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected %v, got %v", ErrUnauthorized, err)
+	}
+
+	srv.Close()
+	if err := SelfTest(context.Background()); !errors.Is(err, ErrRegistryUnavailable) {
+		t.Fatalf("expected %v, got %v", ErrRegistryUnavailable, err)
+	}
+}
+
+func TestCompoundSemverRanges(t *testing.T) {
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{
+			"dist-tags": {"latest": "1.2.0"},
+			"versions": {
+				"1.0.0-rc.1": {"name": "foo", "version": "1.0.0-rc.1"},
+				"1.2.0": {"name": "foo", "version": "1.2.0"},
+				"1.3.0-beta.1": {"name": "foo", "version": "1.3.0-beta.1"},
+				"2.0.0-beta.1": {"name": "foo", "version": "2.0.0-beta.1"},
+				"2.0.0-beta.2": {"name": "foo", "version": "2.0.0-beta.2"},
+				"2.1.0-beta.1": {"name": "foo", "version": "2.1.0-beta.1"}
+			}
+		}`))
+	})
+
+	for semverRange, expected := range map[string]string{
+		">=1.0.0-0 <2.0.0": "1.2.0",
+		"^1 || ^2-beta":    "2.0.0-beta.2",
+		">=1.0.0-0 <1.1.0": "1.0.0-rc.1",
+		"^1.3.0-0":         "1.3.0-beta.1",
+	} {
+		info, err := fetchPackageInfo("foo", semverRange)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Version != expected {
+			t.Fatalf("invalid version of 'foo@%s': %s, should be %s", semverRange, info.Version, expected)
+		}
+	}
+
+	for _, c := range []struct {
+		semverRange string
+		version     string
+		ok          bool
+	}{
+		{">=1.0.0-0 <2.0.0", "1.0.0-rc.1", true},
+		{">=1.0.0-0 <2.0.0", "1.3.0-beta.1", false},
+		{">=1.0.0-0 <2.0.0", "2.0.0-beta.1", false},
+		{"^1 || ^2-beta", "1.2.0", true},
+		{"^1 || ^2-beta", "2.0.0-beta.1", true},
+		{"^1 || ^2-beta", "2.1.0-beta.1", false},
+		{"^1 || ^2-beta", "1.3.0-beta.1", false},
+	} {
+		if semverRangeCheck(semver.MustParse(c.version), c.semverRange) != c.ok {
+			t.Fatalf("semverRangeCheck(%s, %s) should be %v", c.version, c.semverRange, c.ok)
+		}
+	}
+}
+
+// ttlRecordingCache records the ttl of each write except the index of the cache keys
+type ttlRecordingCache struct {
+	storage.Cache
+	ttls []time.Duration
+}
+
+func (c *ttlRecordingCache) Set(key string, value []byte, ttl time.Duration) error {
+	if !strings.HasPrefix(key, "npm-keys:") {
+		c.ttls = append(c.ttls, ttl)
+	}
+	return c.Cache.Set(key, value, ttl)
+}
+
+func TestCacheTTLJitter(t *testing.T) {
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		name := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")[0]
+		fmt.Fprintf(w, `{"name":"%s","version":"1.0.0"}`, name)
+	})
+	recorder := &ttlRecordingCache{Cache: cache}
+	cache = recorder
+	cfg.CacheTTLJitter = 10
+
+	ttl := 7 * 24 * time.Hour
+	for i := 0; i < 100; i++ {
+		if _, err := fetchPackageInfo(fmt.Sprintf("pkg-%d", i), "1.0.0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(recorder.ttls) != 100 {
+		t.Fatalf("expected 100 cache writes, got %d", len(recorder.ttls))
+	}
+	distinct := map[time.Duration]bool{}
+	for _, d := range recorder.ttls {
+		if d < ttl*9/10 || d > ttl*11/10 {
+			t.Fatalf("ttl %v is out of the jitter band of %v", d, ttl)
+		}
+		distinct[d] = true
+	}
+	if len(distinct) < 50 {
+		t.Fatalf("the ttls should vary, got %d distinct values", len(distinct))
+	}
+
+	// disable the jitter
+	cfg.CacheTTLJitter = -1
+	recorder.ttls = nil
+	if _, err := fetchPackageInfo("pkg-no-jitter", "1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.ttls) != 1 || recorder.ttls[0] != ttl {
+		t.Fatalf("the ttl should be exact without the jitter: %v", recorder.ttls)
+	}
+}
+
+// signalWriter creates the signal file on the first write
+type signalWriter struct {
+	bytes.Buffer
+	signalFile string
+}
+
+func (w *signalWriter) Write(p []byte) (int, error) {
+	if !existsFile(w.signalFile) {
+		os.WriteFile(w.signalFile, nil, 0644)
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestPnpmInstallOutput(t *testing.T) {
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {})
+	dir := t.TempDir()
+	signalFile := path.Join(dir, "signal")
+	cfg.PnpmBinary = path.Join(dir, "pnpm-stub")
+	// the stub waits for the output to be received by the writer before it exits
+	script := fmt.Sprintf(`#!/bin/sh
+echo "Progress: resolved 1"
+echo "WARN deprecated" >&2
+i=0
+while [ ! -f %s ] && [ $i -lt 50 ]; do sleep 0.1; i=$((i+1)); done
+if [ -f %s ]; then echo "streamed"; else echo "buffered"; fi
+if [ "$2" = "fail@1.0.0" ]; then exit 1; fi
+`, signalFile, signalFile)
+	if err := os.WriteFile(cfg.PnpmBinary, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &signalWriter{signalFile: signalFile}
+	if err := installers["pnpm"].Install(context.Background(), t.TempDir(), []string{"foo@1.0.0"}, InstallOptions{Output: w}); err != nil {
+		t.Fatal(err)
+	}
+	if output := w.String(); output != "Progress: resolved 1\nWARN deprecated\nstreamed\n" {
+		t.Fatalf("invalid streamed output: %q", output)
+	}
+
+	// the full output is returned on error
+	os.Remove(signalFile)
+	w = &signalWriter{signalFile: signalFile}
+	err := pnpmInstallWithOutput(context.Background(), t.TempDir(), w, "fail@1.0.0")
+	if err == nil || !strings.Contains(err.Error(), "Progress: resolved 1\nWARN deprecated\nstreamed") {
+		t.Fatalf("the error should contain the full output: %v", err)
+	}
+
+	// no writer
+	os.WriteFile(signalFile, nil, 0644)
+	if err := pnpmInstall(context.Background(), t.TempDir(), "foo@1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInstallOverrides(t *testing.T) {
+	argsFile := newTestPnpm(t)
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/foo/1.0.0":
+			w.Write([]byte(`{"name":"foo","version":"1.0.0","esm.sh":{"overrides":{"bar":"1.0.0","baz":"2.0.0","a":{"b":{"c":"^1.0.0"}},"d":"npm:e@^2.0.0",` +
+				`"f1":"file:/etc","f2":"link:../../","f3":"git+ssh://git@example.com/x.git","f4":"https://example.com/x.tgz","f5":"npm:x@file:/etc","f6":"user/repo"}}}`))
+		default:
+			w.WriteHeader(404)
+		}
+	})
+	var overrides config.Overrides
+	if err := json.Unmarshal([]byte(`{"bar":"1.0.1","qux":{"bar":"3.0.0"}}`), &overrides); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Overrides = overrides
+
+	dir := t.TempDir()
+	installPackage(context.Background(), dir, Pkg{Name: "foo", Version: "1.0.0"})
+	if !existsFile(argsFile) {
+		t.Fatal("the package should be installed by pnpm")
+	}
+	var p struct {
+		Overrides   map[string]interface{} `json:"overrides"`
+		Resolutions map[string]string      `json:"resolutions"`
+		Pnpm        struct {
+			Overrides map[string]string `json:"overrides"`
+		} `json:"pnpm"`
+	}
+	if err := parseJSONFile(path.Join(dir, "package.json"), &p); err != nil {
+		t.Fatal(err)
+	}
+	// the overrides of the config win over the overrides of the package author
+	if p.Overrides["bar"] != "1.0.1" || p.Overrides["baz"] != "2.0.0" || p.Overrides["qux"].(map[string]interface{})["bar"] != "3.0.0" {
+		t.Fatalf("invalid npm overrides: %v", p.Overrides)
+	}
+	// the overrides that are not resolved by the registry are dropped
+	for _, name := range []string{"f1", "f2", "f3", "f4", "f5", "f6"} {
+		if _, ok := p.Overrides[name]; ok {
+			t.Fatalf("the override '%s' should be dropped: %v", name, p.Overrides)
+		}
+	}
+	// the nested override keeps the whole ancestor chain
+	if len(p.Pnpm.Overrides) != 5 || p.Pnpm.Overrides["bar"] != "1.0.1" || p.Pnpm.Overrides["baz"] != "2.0.0" || p.Pnpm.Overrides["qux>bar"] != "3.0.0" ||
+		p.Pnpm.Overrides["a>b>c"] != "^1.0.0" || p.Pnpm.Overrides["d"] != "npm:e@^2.0.0" {
+		t.Fatalf("invalid pnpm overrides: %v", p.Pnpm.Overrides)
+	}
+	if len(p.Resolutions) != 5 || p.Resolutions["**/bar"] != "1.0.1" || p.Resolutions["qux/bar"] != "3.0.0" || p.Resolutions["a/b/c"] != "^1.0.0" {
+		t.Fatalf("invalid yarn resolutions: %v", p.Resolutions)
+	}
+}
+
+func TestInstallCancellation(t *testing.T) {
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {})
+	cfg.PnpmBinary = path.Join(t.TempDir(), "pnpm-stub")
+	// the stub hangs until it's killed
+	if err := os.WriteFile(cfg.PnpmBinary, []byte("#!/bin/sh\nexec sleep 30\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// the install is killed when the context is canceled, e.g. the request is canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	err := pnpmInstall(ctx, t.TempDir(), "foo@1.0.0")
+	if !errors.Is(err, context.Canceled) || time.Since(start) > 10*time.Second {
+		t.Fatalf("the install should be canceled, got %v", err)
+	}
+
+	// the install is killed when the timeout is exceeded
+	cfg.InstallTimeout = 1
+	start = time.Now()
+	err = installPackage(context.Background(), t.TempDir(), Pkg{Name: "foo", Version: "^1.0.0"})
+	if !errors.Is(err, context.DeadlineExceeded) || getErrorStatus(err) != 504 {
+		t.Fatalf("expected deadline exceeded error, got %v", err)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Fatalf("the timed out install should not be retried, took %v", d)
+	}
+}
+
+func TestVersionCooldown(t *testing.T) {
+	now := time.Now().UTC()
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{
+			"dist-tags": {"latest": "1.2.0", "next": "2.0.0-beta.2"},
+			"versions": {
+				"1.0.0": {"name": "foo", "version": "1.0.0"},
+				"1.1.0": {"name": "foo", "version": "1.1.0"},
+				"1.1.1-rc.1": {"name": "foo", "version": "1.1.1-rc.1"},
+				"1.2.0": {"name": "foo", "version": "1.2.0"},
+				"2.0.0-beta.1": {"name": "foo", "version": "2.0.0-beta.1"},
+				"2.0.0-beta.2": {"name": "foo", "version": "2.0.0-beta.2"}
+			},
+			"time": {
+				"created": "%s",
+				"1.0.0": "%s",
+				"1.1.0": "%s",
+				"1.1.1-rc.1": "%s",
+				"1.2.0": "%s",
+				"2.0.0-beta.1": "%s",
+				"2.0.0-beta.2": "%s"
+			}
+		}`,
+			now.Add(-30*24*time.Hour).Format(time.RFC3339),
+			now.Add(-30*24*time.Hour).Format(time.RFC3339),
+			now.Add(-7*24*time.Hour).Format(time.RFC3339),
+			now.Add(-6*24*time.Hour).Format(time.RFC3339),
+			now.Add(-time.Hour).Format(time.RFC3339),
+			now.Add(-5*24*time.Hour).Format(time.RFC3339),
+			now.Add(-2*time.Hour).Format(time.RFC3339),
+		)
+	})
+
+	// the cooldown is disabled by default
+	info, err := fetchPackageInfo("foo", "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "1.2.0" {
+		t.Fatalf("invalid version of 'foo@latest', expected 1.2.0, got %s", info.Version)
+	}
+
+	cfg.VersionCooldown = 24
+	for version, expected := range map[string]string{
+		"latest": "1.1.0",
+		"next":   "2.0.0-beta.1",
+		"^1.0.0": "1.1.0",
+		"1.x":    "1.1.0",
+	} {
+		cache.Delete("npm:foo@" + version)
+		info, err := fetchPackageInfo("foo", version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Version != expected {
+			t.Fatalf("invalid version of 'foo@%s', expected %s, got %s", version, expected, info.Version)
+		}
+	}
+
+	// no version out of the cooldown period matches the range
+	info, err = fetchPackageInfo("foo", "~1.2.0")
+	if err == nil {
+		t.Fatalf("the version within the cooldown should be excluded, got %s", info.Version)
+	}
+}
+
+func TestNodeTypesSubpath(t *testing.T) {
+	wd := newTestInstallDir(t, Pkg{Name: "@types/node", Version: nodeTypesVersion}, map[string]string{
+		"node_modules/@types/node/index.d.ts":           `/// <reference path="stream.d.ts" />`,
+		"node_modules/@types/node/stream.d.ts":          `declare module "stream" {}`,
+		"node_modules/@types/node/stream/promises.d.ts": `declare module "stream/promises" {}`,
+		"node_modules/@types/node/inspector/index.d.ts": `declare module "inspector" {}`,
+	})
+
+	info, _, err := getPackageInfo(wd, "@types/node", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Types != "index.d.ts" || info.Version != nodeTypesVersion {
+		t.Fatalf("invalid types of '@types/node': %s@%s", info.Types, info.Version)
+	}
+
+	for name, expected := range map[string]string{
+		"@types/node/stream":          "stream.d.ts",
+		"@types/node/stream/promises": "stream/promises.d.ts",
+		"@types/node/inspector":       "inspector/index.d.ts",
+		"@types/node/node:stream":     "stream.d.ts",
+	} {
+		info, _, err := getPackageInfo(wd, name, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Name != "@types/node" || info.Types != expected {
+			t.Fatalf("invalid types of '%s': %q, should be %q", name, info.Types, expected)
+		}
+	}
+}
+
+func TestInstalledDependencyVersion(t *testing.T) {
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		fmt.Fprintf(w, `{
+			"dist-tags": {"latest": "1.2.0"},
+			"versions": {
+				"1.0.0": {"name": "%[1]s", "version": "1.0.0"},
+				"1.2.0": {"name": "%[1]s", "version": "1.2.0"}
+			}
+		}`, name)
+	})
+
+	// a pnpm-like tree: the direct dependencies are linked next to the parent package,
+	// the transitive dependencies are hoisted to `node_modules/.pnpm/node_modules`
+	wd := newTestInstallDir(t, Pkg{Name: "parent", Version: "1.0.0"}, map[string]string{
+		"node_modules/.pnpm/parent@1.0.0/node_modules/parent/package.json": `{"name":"parent","version":"1.0.0","dependencies":{"dep":"^1.0.0"}}`,
+		"node_modules/.pnpm/parent@1.0.0/node_modules/dep/package.json":    `{"name":"dep","version":"1.0.0","dependencies":{"tdep":"^1.0.0"}}`,
+		"node_modules/.pnpm/node_modules/tdep/package.json":                `{"name":"tdep","version":"1.0.0"}`,
+	})
+	resolveDir := path.Join(wd, "node_modules/.pnpm/parent@1.0.0")
+
+	// a fresh lookup of the range picks the latest version
+	info, err := fetchPackageInfo("dep", "^1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "1.2.0" {
+		t.Fatalf("invalid version of 'dep': %s, should be 1.2.0", info.Version)
+	}
+
+	for _, name := range []string{"dep", "tdep"} {
+		info, fromPackageJSON, err := getPackageInfo(resolveDir, name, "^1.0.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Version != "1.0.0" || !fromPackageJSON {
+			t.Fatalf("invalid version of '%s': %s, should be the installed version 1.0.0", name, info.Version)
+		}
+	}
+
+	// fallback to the registry if the package is not installed
+	info, fromPackageJSON, err := getPackageInfo(resolveDir, "other", "^1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "1.2.0" || fromPackageJSON {
+		t.Fatalf("invalid version of 'other': %s, should be 1.2.0", info.Version)
+	}
+}
+
+func TestRegistryCircuitBreaker(t *testing.T) {
+	var hits int32
+	var healthy int32
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"name":"foo","version":"1.0.0"}`))
+	})
+	cfg.RegistryBreakerThreshold = 3
+	cfg.RegistryBreakerCooldown = 1
+
+	for i := 0; i < 3; i++ {
+		_, err := fetchPackageInfo("foo", "1.0.0")
+		if !errors.Is(err, ErrRegistryUnavailable) {
+			t.Fatalf("expected registry unavailable error, got %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&hits); n != 3 {
+		t.Fatalf("expected 3 requests, got %d", n)
+	}
+
+	// the breaker is open, the requests fail fast without touching the registry
+	atomic.StoreInt32(&healthy, 1)
+	for i := 0; i < 3; i++ {
+		_, err := fetchPackageInfo("foo", "1.0.0")
+		if !errors.Is(err, ErrRegistryUnavailable) || !strings.Contains(err.Error(), "circuit breaker is open") {
+			t.Fatalf("expected the circuit breaker error, got %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&hits); n != 3 {
+		t.Fatalf("expected 3 requests, got %d", n)
+	}
+
+	// the breaker is half-open after the cooldown, the probe request closes it
+	time.Sleep(1100 * time.Millisecond)
+	info, err := fetchPackageInfo("foo", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "1.0.0" {
+		t.Fatalf("invalid version %q", info.Version)
+	}
+	if n := atomic.LoadInt32(&hits); n != 4 {
+		t.Fatalf("expected 4 requests, got %d", n)
+	}
+	if b := getRegistryBreaker(strings.TrimSuffix(cfg.NpmRegistry, "/")); !b.allow() {
+		t.Fatal("the circuit breaker should be closed")
+	}
+}
+
+func TestRegistryMirrors(t *testing.T) {
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	var deadHits int32
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&deadHits, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer dead.Close()
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			t.Errorf("the credentials of the registry are sent to the mirror")
+		}
+		if r.URL.Path != "/foo/1.0.0" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write([]byte(`{"name":"foo","version":"1.0.0"}`))
+	}))
+	defer mirror.Close()
+	cfg.NpmToken = "secret"
+	cfg.NpmRegistryMirrors = []string{dead.URL + "/", mirror.URL + "/"}
+	cfg.RegistryBreakerThreshold = 1
+	cfg.RegistryBreakerCooldown = 60
+
+	for i := 0; i < 2; i++ {
+		info, err := fetchPackageInfo("foo", "1.0.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Version != "1.0.0" {
+			t.Fatalf("invalid version %q", info.Version)
+		}
+		cache.Delete("npm:foo@1.0.0")
+	}
+
+	// the dead mirror is skipped by its circuit breaker after the first failure
+	if n := atomic.LoadInt32(&deadHits); n != 1 {
+		t.Fatalf("expected 1 request to the dead mirror, got %d", n)
+	}
+
+	// the error of the last mirror is returned if all the registries are unavailable
+	cfg.NpmRegistryMirrors = []string{dead.URL + "/"}
+	_, err := fetchPackageInfo("bar", "1.0.0")
+	if !errors.Is(err, ErrRegistryUnavailable) {
+		t.Fatalf("expected registry unavailable error, got %v", err)
+	}
+}
+
+func TestAbbreviatedMetadata(t *testing.T) {
+	var fullRequests int32
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/foo":
+			if !strings.Contains(r.Header.Get("Accept"), "application/vnd.npm.install-v1+json") {
+				atomic.AddInt32(&fullRequests, 1)
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"dist-tags":{"latest":"1.1.0"},"versions":{"1.0.0":{"name":"foo","version":"1.0.0","exports":"./a.js"},"1.1.0":{"name":"foo","version":"1.1.0","exports":"./b.js"}},"time":{"1.0.0":"2020-01-01T00:00:00.000Z","1.1.0":"2999-01-01T00:00:00.000Z"}}`))
+				return
+			}
+			w.Header().Set("Content-Type", "application/vnd.npm.install-v1+json")
+			w.Write([]byte(`{"dist-tags":{"latest":"1.1.0"},"versions":{"1.0.0":{"name":"foo","version":"1.0.0"},"1.1.0":{"name":"foo","version":"1.1.0"}}}`))
+		case "/foo/1.0.0":
+			w.Write([]byte(`{"name":"foo","version":"1.0.0","exports":"./a.js"}`))
+		case "/foo/1.1.0":
+			w.Write([]byte(`{"name":"foo","version":"1.1.0","exports":"./b.js"}`))
+		default:
+			w.WriteHeader(404)
+		}
+	})
+
+	// the fields missing in the abbreviated metadata are fetched from the full metadata of the version
+	info, err := fetchPackageInfo("foo", "^1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "1.1.0" || info.Exports != "./b.js" {
+		t.Fatalf("invalid package info %+v", info)
+	}
+	if n := atomic.LoadInt32(&fullRequests); n != 0 {
+		t.Fatalf("expected the abbreviated metadata, got %d full requests", n)
+	}
+
+	// the full metadata is required by the version cooldown
+	cfg.VersionCooldown = 24
+	info, err = fetchPackageInfo("foo", "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "1.0.0" || info.Exports != "./a.js" {
+		t.Fatalf("invalid package info %+v", info)
+	}
+	if n := atomic.LoadInt32(&fullRequests); n != 1 {
+		t.Fatalf("expected 1 full request, got %d", n)
+	}
+}
+
+func TestNativeInstall(t *testing.T) {
+	argsFile := newTestPnpm(t)
+
+	// pack the tarball like `npm pack` (the files are in the `package/` dir)
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for name, content := range map[string]string{
+		"package/package.json":  `{"name":"foo-native","version":"1.0.0","main":"dist/index.js"}`,
+		"package/dist/index.js": `module.exports = "foo"`,
+		"package/.npmignore":    `src`,
+		"../escape.txt":         `escape`,
+	} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	gw.Close()
+	tarball := buf.Bytes()
+	sum := sha512.Sum512(tarball)
+	integrity := "sha512-" + base64.StdEncoding.EncodeToString(sum[:])
+
+	var hits int32
+	var srvURL string
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		switch r.URL.Path {
+		case "/foo-native/1.0.0":
+			fmt.Fprintf(w, `{"name":"foo-native","version":"1.0.0","dist":{"tarball":"%s/foo-native/-/foo-native-1.0.0.tgz","integrity":"%s"}}`, srvURL, integrity)
+		case "/foo-bad/1.0.0":
+			fmt.Fprintf(w, `{"name":"foo-bad","version":"1.0.0","dist":{"tarball":"%s/foo-native/-/foo-native-1.0.0.tgz","shasum":"0000"}}`, srvURL)
+		case "/foo-deps/1.0.0":
+			fmt.Fprintf(w, `{"name":"foo-deps","version":"1.0.0","dependencies":{"bar":"^1.0.0"},"dist":{"tarball":"%s/foo-native/-/foo-native-1.0.0.tgz","integrity":"%s"}}`, srvURL, integrity)
+		case "/foo-native/-/foo-native-1.0.0.tgz":
+			w.Write(tarball)
+		default:
+			w.WriteHeader(404)
+		}
+	})
+	srvURL = strings.TrimSuffix(cfg.NpmRegistry, "/")
+	cfg.NativeInstall = true
+
+	dir := t.TempDir()
+	if err := installPackage(context.Background(), dir, Pkg{Name: "foo-native", Version: "1.0.0"}); err != nil {
+		t.Fatal(err)
+	}
+	if existsFile(argsFile) {
+		t.Fatal("the package should be installed without pnpm")
+	}
+	data, err := os.ReadFile(path.Join(dir, "node_modules/foo-native/dist/index.js"))
+	if err != nil || string(data) != `module.exports = "foo"` {
+		t.Fatalf("invalid extracted file: %q, %v", data, err)
+	}
+	if existsFile(path.Join(dir, "node_modules/foo-native/.npmignore")) || existsFile(path.Join(dir, "node_modules/escape.txt")) {
+		t.Fatal("the unneeded files should not be extracted")
+	}
+
+	// the installed package is not downloaded again
+	n := atomic.LoadInt32(&hits)
+	if err := installPackage(context.Background(), dir, Pkg{Name: "foo-native", Version: "1.0.0"}); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&hits) != n {
+		t.Fatal("the installed package should not be downloaded again")
+	}
+
+	// the checksum mismatch is a security error without the fallback to pnpm
+	dir = t.TempDir()
+	err = installPackage(context.Background(), dir, Pkg{Name: "foo-bad", Version: "1.0.0"})
+	if !errors.Is(err, ErrIntegrityMismatch) || getErrorStatus(err) != 502 {
+		t.Fatalf("expected integrity mismatch error, got %v", err)
+	}
+	if existsDir(path.Join(dir, "node_modules", "foo-bad")) || existsFile(argsFile) {
+		t.Fatal("foo-bad should not be installed")
+	}
+
+	// the canceled install is not fallback to pnpm
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	dir = t.TempDir()
+	err = getInstaller().Install(ctx, dir, []string{"foo-native@1.0.0"}, InstallOptions{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context canceled error, got %v", err)
+	}
+	if existsDir(path.Join(dir, "node_modules", "foo-native")) || existsFile(argsFile) {
+		t.Fatal("foo-native should not be installed")
+	}
+
+	// fallback to pnpm if the package has dependencies
+	for _, pkg := range []Pkg{{Name: "foo-deps", Version: "1.0.0"}} {
+		dir := t.TempDir()
+		installPackage(context.Background(), dir, pkg)
+		if existsDir(path.Join(dir, "node_modules", pkg.Name)) {
+			t.Fatalf("%s should not be installed by the native installer", pkg)
+		}
+		args, _ := os.ReadFile(argsFile)
+		if !strings.Contains(string(args), "add "+pkg.VersionName()) {
+			t.Fatalf("%s should be installed by pnpm, got %q", pkg, args)
+		}
+	}
+}
+
+func TestInstalledIntegrity(t *testing.T) {
+	// the stub pnpm installs the package and records the integrity `sha512-AAAA` in the lockfile
+	binDir := t.TempDir()
+	script := `#!/bin/sh
+name=${2%@*}
+mkdir -p node_modules/$name
+echo "{\"name\":\"$name\",\"version\":\"1.0.0\"}" > node_modules/$name/package.json
+printf "lockfileVersion: '9.0'\n\npackages:\n\n  $2:\n    resolution: {integrity: sha512-AAAA}\n" > pnpm-lock.yaml
+`
+	if err := os.WriteFile(path.Join(binDir, "pnpm"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir+":"+os.Getenv("PATH"))
+
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/foo/1.0.0":
+			w.Write([]byte(`{"name":"foo","version":"1.0.0","dist":{"integrity":"sha512-AAAA"}}`))
+		case "/bar/1.0.0":
+			w.Write([]byte(`{"name":"bar","version":"1.0.0","dist":{"integrity":"sha512-BBBB"}}`))
+		default:
+			w.WriteHeader(404)
+		}
+	})
+
+	dir := t.TempDir()
+	if err := installPackage(context.Background(), dir, Pkg{Name: "foo", Version: "1.0.0"}); err != nil {
+		t.Fatal(err)
+	}
+	dir = t.TempDir()
+	err := installPackage(context.Background(), dir, Pkg{Name: "bar", Version: "1.0.0"})
+	if !errors.Is(err, ErrIntegrityMismatch) {
+		t.Fatalf("expected integrity mismatch error, got %v", err)
+	}
+	if existsDir(path.Join(dir, "node_modules")) {
+		t.Fatal("the tampered package should be removed")
+	}
+
+	// the lockfile v6 format with the block resolution
+	lockfile := path.Join(t.TempDir(), "pnpm-lock.yaml")
+	os.WriteFile(lockfile, []byte("lockfileVersion: '6.0'\n\npackages:\n\n  /react-dom@18.2.0(react@18.2.0):\n    resolution:\n      integrity: sha512-CCCC\n    dependencies:\n      react: 18.2.0\n\n  /react@18.2.0:\n    resolution: {integrity: sha512-DDDD, tarball: https://example.com/react.tgz}\n"), 0644)
+	for name, want := range map[string]string{"react-dom": "sha512-CCCC", "react": "sha512-DDDD", "vue": ""} {
+		if integrity, _ := readPnpmLockIntegrity(lockfile, name, "18.2.0"); integrity != want {
+			t.Fatalf("invalid integrity of %s: %q", name, integrity)
+		}
+	}
+
+	// the shasum is compared if the registry does not advertise the sha1 integrity
+	d := npmDist{Shasum: "0102ff"}
+	if !d.matchIntegrity("sha1-AQL/") || d.matchIntegrity("sha1-AAAA") {
+		t.Fatal("the sha1 integrity should be compared with the shasum")
+	}
+}
+
+func TestConditionalRegistryRequest(t *testing.T) {
+	var fullResponses int32
+	var notModified int32
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/foo" {
+			w.WriteHeader(404)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt32(&fullResponses, 1)
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`{"dist-tags":{"latest":"1.0.0"},"versions":{"1.0.0":{"name":"foo","version":"1.0.0","main":"index.js"}}}`))
+	})
+
+	for i := 0; i < 3; i++ {
+		info, err := fetchPackageInfo("foo", "latest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Version != "1.0.0" || info.Main != "index.js" {
+			t.Fatalf("invalid package info %+v", info)
+		}
+		// expire the cached package info
+		cache.Delete("npm:foo@latest")
+	}
+	if n := atomic.LoadInt32(&fullResponses); n != 1 {
+		t.Fatalf("expected 1 full response, got %d", n)
+	}
+	if n := atomic.LoadInt32(&notModified); n != 2 {
+		t.Fatalf("expected 2 not modified responses, got %d", n)
+	}
+
+	// the validators are kept by the invalidation, the registry decides whether the metadata is modified
+	if err := InvalidatePackage("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fetchPackageInfo("foo", "latest"); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&fullResponses); n != 1 {
+		t.Fatalf("expected 1 full response, got %d", n)
+	}
+	if n := atomic.LoadInt32(&notModified); n != 3 {
+		t.Fatalf("expected 3 not modified responses, got %d", n)
+	}
+}
+
+func TestNpmScopes(t *testing.T) {
+	var authorization sync.Map
+	srv := newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		authorization.Store(r.URL.Path, r.Header.Get("Authorization"))
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/private"), "/1.0.0")
+		fmt.Fprintf(w, `{"name":"%s","version":"1.0.0"}`, strings.TrimPrefix(name, "/"))
+	})
+	cfg.NpmToken = "global-token"
+	cfg.NpmScopes = config.NpmScopes{
+		"@foo": {Registry: srv.URL + "/private/", Token: "foo-token"},
+		"@bar": {User: "bar", Password: "bar-password"},
+	}
+
+	for _, name := range []string{"@foo/a", "@bar/b", "@baz/c", "d"} {
+		if _, err := fetchPackageInfo(name, "1.0.0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	basicAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte("bar:bar-password"))
+	for pathname, expected := range map[string]string{
+		"/private/@foo/a/1.0.0": "Bearer foo-token",
+		"/@bar/b/1.0.0":         basicAuth,
+		"/@baz/c/1.0.0":         "Bearer global-token",
+		"/d/1.0.0":              "Bearer global-token",
+	} {
+		v, ok := authorization.Load(pathname)
+		if !ok {
+			t.Fatalf("missing request %s", pathname)
+		}
+		if v.(string) != expected {
+			t.Fatalf("invalid authorization of %s: %q, should be %q", pathname, v, expected)
+		}
+	}
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	npmrc := npmScopesRc()
+	for _, line := range []string{
+		"@bar:registry=" + cfg.NpmRegistry,
+		"//" + host + "/:username=${ESM_NPM_SCOPE_USER_0}",
+		"//" + host + "/:_password=${ESM_NPM_SCOPE_PASSWORD_0}",
+		"@foo:registry=" + srv.URL + "/private/",
+		"//" + host + "/private/:_authToken=${ESM_NPM_SCOPE_TOKEN_1}",
+	} {
+		if !strings.Contains(npmrc, line+"\n") {
+			t.Fatalf("missing %q in the .npmrc:\n%s", line, npmrc)
+		}
+	}
+	env := strings.Join(npmScopesEnv(), "\n")
+	for _, v := range []string{"ESM_NPM_SCOPE_USER_0=bar", "ESM_NPM_SCOPE_PASSWORD_0=" + base64.StdEncoding.EncodeToString([]byte("bar-password")), "ESM_NPM_SCOPE_TOKEN_1=foo-token"} {
+		if !strings.Contains(env, v) {
+			t.Fatalf("missing %q in the env:\n%s", v, env)
+		}
+	}
+}
+
+func TestWorkDirFor(t *testing.T) {
+	argsFile := newTestPnpm(t)
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected registry request: %s", r.URL.Path)
+		w.WriteHeader(404)
+	})
+	cfg.WorkDir = t.TempDir()
+	largeVolume := t.TempDir()
+	cfg.WorkDirFor = func(pkgVersionName string) string {
+		if strings.HasPrefix(pkgVersionName, "large@") {
+			return path.Join(largeVolume, pkgVersionName)
+		}
+		return ""
+	}
+
+	pkg := Pkg{Name: "large", Version: "1.0.0"}
+	dir := getWorkDir(pkg)
+	if dir != path.Join(largeVolume, "large@1.0.0") {
+		t.Fatalf("invalid work dir %q", dir)
+	}
+	if dir := getWorkDir(Pkg{Name: "small", Version: "1.0.0"}); dir != path.Join(cfg.WorkDir, "npm/small@1.0.0") {
+		t.Fatalf("invalid default work dir %q", dir)
+	}
+
+	// mock the package installed by pnpm
+	ensureDir(path.Join(dir, "node_modules/large"))
+	err := os.WriteFile(path.Join(dir, "node_modules/large/package.json"), []byte(`{"name":"large","version":"1.0.0"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := installPackage(context.Background(), dir, pkg); err != nil {
+		t.Fatal(err)
+	}
+	if !existsFile(path.Join(dir, "package.json")) || !existsFile(argsFile) || existsDir(path.Join(cfg.WorkDir, "npm")) {
+		t.Fatal("the package should be installed in the custom work dir")
+	}
+
+	info, fromPackageJSON, err := getPackageInfo("", "large", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "large" || !fromPackageJSON {
+		t.Fatal("the package should be read from the custom work dir")
+	}
+}
+
+func TestBestVersion(t *testing.T) {
+	versions := map[string]NpmPackageInfo{}
+	for _, v := range []string{"0.9.0", "1.0.0", "1.1.0", "1.2.0-beta.1", "1.2.0-beta.2", "2.0.0-rc.1"} {
+		versions[v] = NpmPackageInfo{Name: "foo", Version: v}
+	}
+	distTags := map[string]string{"latest": "1.1.0", "beta": "1.2.0-beta.2", "next": "2.0.0-rc.1", "legacy": "0.8.0"}
+
+	for _, c := range []struct {
+		request  string
+		expected string
+		err      error
+	}{
+		{"", "1.1.0", nil},
+		{"latest", "1.1.0", nil},
+		{"beta", "1.2.0-beta.2", nil},
+		{"next", "2.0.0-rc.1", nil},
+		{"legacy", "", ErrVersionNotFound},
+		{"^1.0.0", "1.1.0", nil},
+		{"~1.0.0", "1.0.0", nil},
+		{"1", "1.1.0", nil},
+		{"*", "1.1.0", nil},
+		{">=0.9.0 <1.0.0", "0.9.0", nil},
+		{"^1.2.0-beta.1", "1.2.0-beta.2", nil},
+		{"1.2.0-beta.1", "1.2.0-beta.1", nil},
+		{"^2.0.0", "", ErrVersionNotFound},
+		{"^2.0.0-rc.0", "2.0.0-rc.1", nil},
+		{"^3.0.0 || ^0.9.0", "0.9.0", nil},
+		{"^4.0.0", "", ErrVersionNotFound},
+		{"canary", "", ErrInvalidSpecifier},
+	} {
+		version, err := BestVersion(versions, distTags, c.request)
+		if c.err != nil {
+			if !errors.Is(err, c.err) {
+				t.Fatalf("BestVersion(%q): expected error %v, got %q, %v", c.request, c.err, version, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("BestVersion(%q): %v", c.request, err)
+		}
+		if version != c.expected {
+			t.Fatalf("BestVersion(%q): got %q, should be %q", c.request, version, c.expected)
+		}
+	}
+
+	// no versions
+	if _, err := BestVersion(nil, nil, "^1.0.0"); !errors.Is(err, ErrVersionNotFound) {
+		t.Fatalf("expected version not found error, got %v", err)
+	}
+}
+
+func TestNonNormalizedVersions(t *testing.T) {
+	now := time.Now().UTC()
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{
+			"dist-tags": {"latest": "v1.1.0", "next": "v2.0.0-beta.1"},
+			"versions": {
+				"v1.0.0": {"name": "foo", "version": "v1.0.0"},
+				"v1.1.0": {"name": "foo", "version": "1.1.0"},
+				"1.2.0+build.5": {"name": "foo", "version": "1.2.0+build.5"},
+				"=1.3.0-rc.1": {"name": "foo", "version": "1.3.0-rc.1"},
+				"v2.0.0-beta.1": {"name": "foo", "version": "v2.0.0-beta.1"}
+			},
+			"time": {
+				"v1.0.0": "%s",
+				"v1.1.0": "%s"
+			}
+		}`,
+			now.Add(-30*24*time.Hour).Format(time.RFC3339),
+			now.Add(-time.Hour).Format(time.RFC3339),
+		)
+	})
+
+	for version, expected := range map[string]string{
+		"latest":         "1.1.0",
+		"next":           "2.0.0-beta.1",
+		"~1.0.0":         "1.0.0",
+		"^1.0.0":         "1.2.0+build.5",
+		"^1.3.0-rc.0":    "1.3.0-rc.1",
+		">=2.0.0-beta.0": "2.0.0-beta.1",
+	} {
+		info, err := fetchPackageInfo("foo", version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Version != expected {
+			t.Fatalf("invalid version of 'foo@%s': %s, should be %s", version, info.Version, expected)
+		}
+	}
+
+	// the publish time is looked up by the original key
+	cfg.VersionCooldown = 24
+	InvalidatePackage("foo")
+	info, err := fetchPackageInfo("foo", "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "1.0.0" {
+		t.Fatalf("invalid version of 'foo@latest': %s, should be 1.0.0", info.Version)
+	}
+}
+
+func TestPackageInfoPatcher(t *testing.T) {
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{
+			"dist-tags": {"latest": "1.0.0"},
+			"versions": {"1.0.0": {"name": "foo", "version": "1.0.0", "type": "commonjs", "module": "index.mjs"}}
+		}`))
+	})
+	defer func() { PackageInfoPatcher = nil }()
+	PackageInfoPatcher = func(info *NpmPackageInfo) {
+		// `foo` ships ES modules but declares the wrong `type`
+		if info.Name == "foo" && info.Type == "commonjs" {
+			info.Type = "module"
+		}
+	}
+
+	// the cached metadata is patched as well
+	for i := 0; i < 2; i++ {
+		info, err := fetchPackageInfo("foo", "^1.0.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Type != "module" {
+			t.Fatalf("the package info should be patched: type=%q", info.Type)
+		}
+	}
+
+	wd := newTestInstallDir(t, Pkg{Name: "foo", Version: "1.0.0"}, map[string]string{})
+	os.WriteFile(path.Join(wd, "node_modules/foo/package.json"), []byte(`{"name":"foo","version":"1.0.0","type":"commonjs"}`), 0644)
+	info, fromPackageJSON, err := getPackageInfo(wd, "foo", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fromPackageJSON || info.Type != "module" {
+		t.Fatalf("the installed package.json should be patched: type=%q", info.Type)
+	}
+}
+
+func TestNotFoundCache(t *testing.T) {
+	var requests int32
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Path == "/foo" {
+			w.Write([]byte(`{"dist-tags":{"latest":"1.0.0"},"versions":{"1.0.0":{"name":"foo","version":"1.0.0"}}}`))
+			return
+		}
+		w.WriteHeader(404)
+	})
+	cfg.NotFoundCacheTTL = 60
+
+	for i := 0; i < 3; i++ {
+		if _, err := fetchPackageInfo("missing", "latest"); !errors.Is(err, ErrPackageNotFound) {
+			t.Fatalf("expected package not found error, got %v", err)
+		}
+		if _, err := fetchPackageInfo("foo", "^2.0.0"); !errors.Is(err, ErrVersionNotFound) {
+			t.Fatalf("expected version not found error, got %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Fatalf("the misses should be cached, got %d registry requests", n)
+	}
+
+	// the cached miss is invalidated by the purge
+	if err := InvalidatePackage("missing"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fetchPackageInfo("missing", "latest"); !errors.Is(err, ErrPackageNotFound) {
+		t.Fatalf("expected package not found error, got %v", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Fatalf("the purged miss should not be cached, got %d registry requests", n)
+	}
+
+	// the negative caching is disabled with a negative ttl
+	cfg.NotFoundCacheTTL = -1
+	fetchPackageInfo("missing-too", "latest")
+	fetchPackageInfo("missing-too", "latest")
+	if n := atomic.LoadInt32(&requests); n != 5 {
+		t.Fatalf("the misses should not be cached, got %d registry requests", n)
+	}
+}
+
+func TestRegistryRateLimit(t *testing.T) {
+	var requests, inflight, maxInflight int32
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		switch r.URL.Path {
+		case "/foo":
+			if n == 1 {
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(429)
+				return
+			}
+		case "/limited":
+			w.Header().Set("Retry-After", "120")
+			w.WriteHeader(429)
+			return
+		default:
+			c := atomic.AddInt32(&inflight, 1)
+			defer atomic.AddInt32(&inflight, -1)
+			for {
+				m := atomic.LoadInt32(&maxInflight)
+				if c <= m || atomic.CompareAndSwapInt32(&maxInflight, m, c) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		fmt.Fprintf(w, `{"dist-tags":{"latest":"1.0.0"},"versions":{"1.0.0":{"name":"%s","version":"1.0.0"}}}`, name)
+	})
+	resetTokens := func() { registryTokensOnce = sync.Once{} }
+	resetTokens()
+	t.Cleanup(resetTokens)
+	cfg.RegistryMaxConcurrency = 2
+
+	// the 429 response is retried after the `Retry-After` delay
+	info, err := fetchPackageInfo("foo", "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "1.0.0" || atomic.LoadInt32(&requests) != 2 {
+		t.Fatalf("the rate limited request should be retried, got %d requests", requests)
+	}
+
+	// the concurrent requests are limited
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := fetchPackageInfo(fmt.Sprintf("bar-%d", i), "latest"); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if m := atomic.LoadInt32(&maxInflight); m > 2 {
+		t.Fatalf("the concurrent requests should be limited to 2, got %d", m)
+	}
+
+	// the registry is paused if the delay exceeds the max wait
+	atomic.StoreInt32(&requests, 0)
+	if _, err := fetchPackageInfo("limited", "latest"); !errors.Is(err, ErrRegistryUnavailable) {
+		t.Fatalf("expected registry unavailable error, got %v", err)
+	}
+	if _, err := fetchPackageInfo("baz", "latest"); !errors.Is(err, ErrRegistryUnavailable) || !strings.Contains(err.Error(), "rate limited") {
+		t.Fatalf("expected rate limited error, got %v", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("the requests should be paused, got %d requests", n)
+	}
+}
+
+func TestRegistryRetryCanceled(t *testing.T) {
+	srv := newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(429)
+	})
+
+	// the retry delay is interrupted when the request is canceled
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", srv.URL+"/foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = fetchRegistry(req)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded error, got %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("the retry should be canceled, took %v", d)
+	}
+
+	// the paused requests are rejected without reaching the registry
+	cfg.RegistryRetryMaxWait = 1
+	req, _ = http.NewRequest("GET", srv.URL+"/foo", nil)
+	if _, err := fetchRegistry(req); !errors.Is(err, ErrRegistryUnavailable) {
+		t.Fatalf("expected registry unavailable error, got %v", err)
+	}
+
+	// neither the canceled nor the paused requests are registry failures
+	if status := getRegistryBreaker(srv.URL).status(); status["failures"] != 0 || status["state"] != "closed" {
+		t.Fatalf("the breaker should not record the failures: %v", status)
+	}
+}
+
+func TestDistTagCacheTTL(t *testing.T) {
+	var latest atomic.Value
+	latest.Store("1.0.0")
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		v := latest.Load().(string)
+		fmt.Fprintf(w, `{"dist-tags":{"latest":"%s","next":"2.0.0-beta.1"},"versions":{"%s":{"name":"foo","version":"%s"},"2.0.0-beta.1":{"name":"foo","version":"2.0.0-beta.1"}}}`, v, v, v)
+	})
+	recorder := &ttlRecordingCache{Cache: cache}
+	cache = recorder
+	cfg.CacheTTLJitter = -1
+	cfg.DistTagCacheTTL = map[string]int{"latest": 300}
+
+	for _, c := range []struct {
+		version string
+		ttl     time.Duration
+	}{
+		{"latest", 5 * time.Minute},
+		{"next", 10 * time.Minute},
+		{"^1.0.0", 10 * time.Minute},
+	} {
+		recorder.ttls = nil
+		if _, err := fetchPackageInfo("foo", c.version); err != nil {
+			t.Fatal(err)
+		}
+		if len(recorder.ttls) != 1 || recorder.ttls[0] != c.ttl {
+			t.Fatalf("the ttl of 'foo@%s' should be %v: %v", c.version, c.ttl, recorder.ttls)
+		}
+	}
+	cfg.DistTagCacheTTL["*"] = 3600
+	recorder.ttls = nil
+	if _, err := fetchPackageInfo("foo", "~1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.ttls) != 1 || recorder.ttls[0] != time.Hour {
+		t.Fatalf("the ttl of 'foo@~1.0.0' should be 1h: %v", recorder.ttls)
+	}
+
+	// the cached package info is bypassed by the `?fresh` query only
+	latest.Store("1.1.0")
+	router := &rex.Router{}
+	router.Use(esmHandler())
+	get := func(url string, cacheControl string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", url, nil)
+		req.Header.Set("Cache-Control", cacheControl)
+		router.ServeHTTP(w, req)
+		return w
+	}
+	if w := get("/foo", ""); !strings.HasSuffix(w.Header().Get("Location"), "/foo@1.0.0") {
+		t.Fatalf("the cached version should be used: %d %q", w.Code, w.Header().Get("Location"))
+	}
+	if w := get("/foo", "no-cache"); !strings.HasSuffix(w.Header().Get("Location"), "/foo@1.0.0") {
+		t.Fatalf("the `Cache-Control: no-cache` header should not bypass the cache: %d %q", w.Code, w.Header().Get("Location"))
+	}
+	if w := get("/foo?fresh", ""); !strings.HasSuffix(w.Header().Get("Location"), "/foo@1.1.0?fresh") {
+		t.Fatalf("the cache should be bypassed: %d %q", w.Code, w.Header().Get("Location"))
+	}
+
+	// the force-refresh is throttled
+	latest.Store("1.2.0")
+	if w := get("/foo?fresh", ""); !strings.HasSuffix(w.Header().Get("Location"), "/foo@1.1.0?fresh") {
+		t.Fatalf("the force-refresh should be throttled: %d %q", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestPrefetchDependencies(t *testing.T) {
+	var lock sync.Mutex
+	requested := map[string]int{}
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		lock.Lock()
+		requested[name]++
+		lock.Unlock()
+		fmt.Fprintf(w, `{"dist-tags":{"latest":"1.0.0"},"versions":{"1.0.0":{"name":"%s","version":"1.0.0"}}}`, name)
+	})
+
+	prefetchDependencies(NpmPackageInfo{
+		Name:    "foo",
+		Version: "1.0.0",
+		Dependencies: map[string]string{
+			"bar":    "^1.0.0",
+			"baz":    "latest",
+			"qux":    "npm:quux@^1.0.0",
+			"gitdep": "git+https://example.com/org/gitdep.git#v1.0.0",
+			"local":  "file:../local",
+		},
+		PeerDependencies: map[string]string{"react": "*"},
+	})
+	if len(requested) != 4 || requested["bar"] != 1 || requested["baz"] != 1 || requested["quux"] != 1 || requested["react"] != 1 {
+		t.Fatalf("invalid prefetched packages: %v", requested)
+	}
+
+	// the prefetched package info is cached
+	info, err := fetchPackageInfo("bar", "^1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "1.0.0" || requested["bar"] != 1 {
+		t.Fatalf("the prefetched package info should be cached: %v", requested)
+	}
+}
+
+func TestPackagePolicy(t *testing.T) {
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/lodash":
+			w.Write([]byte(`{"dist-tags":{"latest":"4.17.21"},"versions":{"4.17.20":{"name":"lodash","version":"4.17.20"},"4.17.21":{"name":"lodash","version":"4.17.21"}}}`))
+		case "/lodash/4.17.20", "/lodash/4.17.21":
+			fmt.Fprintf(w, `{"name":"lodash","version":"%s"}`, path.Base(r.URL.Path))
+		case "/react":
+			w.Write([]byte(`{"dist-tags":{"latest":"18.2.0"},"versions":{"18.2.0":{"name":"react","version":"18.2.0"}}}`))
+		default:
+			w.WriteHeader(404)
+		}
+	})
+	cfg.WorkDir = t.TempDir()
+	cfg.BanList.Packages = []string{"lodash@<4.17.21"}
+
+	_, err := fetchPackageInfo("lodash", "4.17.20")
+	if !errors.Is(err, ErrPackageForbidden) || getErrorStatus(err) != 403 {
+		t.Fatalf("expected package forbidden error, got %v", err)
+	}
+	// the range is resolved to the version that is not banned
+	info, err := fetchPackageInfo("lodash", "^4.17.0")
+	if err != nil || info.Version != "4.17.21" {
+		t.Fatalf("unexpected package info %s@%s: %v", info.Name, info.Version, err)
+	}
+	err = installPackage(context.Background(), t.TempDir(), Pkg{Name: "lodash", Version: "4.17.20"})
+	if !errors.Is(err, ErrPackageForbidden) {
+		t.Fatalf("expected package forbidden error, got %v", err)
+	}
+
+	router := &rex.Router{}
+	router.Use(esmHandler())
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		return w
+	}
+	w := get("/lodash@4.17.20")
+	if w.Code != 403 || w.Header().Get("Content-Type") != ctJavascript || !strings.Contains(w.Body.String(), `throw new Error("[esm.sh] package 'lodash@4.17.20' is banned by the server")`) {
+		t.Fatalf("invalid response %d: %s", w.Code, w.Body.String())
+	}
+
+	cfg.AllowList.Packages = []string{"react"}
+	w = get("/lodash@4.17.21")
+	if w.Code != 403 || !strings.Contains(w.Body.String(), "is not in the allow list") {
+		t.Fatalf("invalid response %d: %s", w.Code, w.Body.String())
+	}
+	if _, err := fetchPackageInfo("react", "latest"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStaleCacheFallback(t *testing.T) {
+	var healthy int32 = 1
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"dist-tags":{"latest":"1.0.0"},"versions":{"1.0.0":{"name":"foo","version":"1.0.0"}}}`))
+	})
+	cfg.StaleCacheTTL = 60
+	cfg.RegistryBreakerThreshold = 1
+	cfg.RegistryBreakerCooldown = 60
+
+	if _, err := fetchPackageInfo("foo", "latest"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the cached package info is purged and the registry is down
+	if err := InvalidatePackageWithVersions("foo"); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&healthy, 0)
+	for i := 0; i < 2; i++ {
+		info, err := fetchPackageInfo("foo", "latest")
+		if err != nil || info.Version != "1.0.0" {
+			t.Fatalf("the stale package info should be served, got %q: %v", info.Version, err)
+		}
+	}
+	// no stale package info to serve
+	if _, err := fetchPackageInfo("foo", "^2.0.0"); !errors.Is(err, ErrRegistryUnavailable) {
+		t.Fatalf("expected registry unavailable error, got %v", err)
+	}
+
+	status := getRegistryBreakersStatus()[strings.TrimSuffix(cfg.NpmRegistry, "/")]
+	if m, ok := status.(map[string]interface{}); !ok || m["state"] != "open" || m["openedAt"] == nil {
+		t.Fatalf("the circuit breaker should be open, got %v", status)
+	}
+
+	// the stale fallback is disabled with a negative ttl
+	cfg.StaleCacheTTL = -1
+	if _, err := fetchPackageInfo("foo", "latest"); !errors.Is(err, ErrRegistryUnavailable) {
+		t.Fatalf("expected registry unavailable error, got %v", err)
+	}
+}
+
+func TestDecodePackumentVersions(t *testing.T) {
+	cfg = &config.Config{}
+	defer func() { cfg = nil }()
+
+	versions := []string{}
+	for i := 0; i < 200; i++ {
+		versions = append(versions, fmt.Sprintf(`"1.0.%d":{"name":"foo","version":"1.0.%d"}`, i, i))
+	}
+	versions = append(versions, `"2.0.0-beta.1":{"name":"foo","version":"2.0.0-beta.1"}`, `"v2.1.0":{"name":"foo","version":"2.1.0"}`)
+	distTags := `"dist-tags":{"latest":"1.0.199","next":"2.0.0-beta.1"}`
+	body := `"name":"foo","readme":"# foo","versions":{` + strings.Join(versions, ",") + `},"time":{"1.0.0":"2020-01-01T00:00:00.000Z"}`
+
+	// the `dist-tags` may be before or after the `versions`
+	for _, packument := range []string{"{" + distTags + "," + body + "}", "{" + body + "," + distTags + "}"} {
+		for request, expected := range map[string][]string{
+			"latest":  {"1.0.199", "2.0.0-beta.1"},
+			"^1.0.10": {"1.0.199", "2.0.0-beta.1"},
+			"~2.1.0":  {"1.0.199", "2.0.0-beta.1", "v2.1.0"},
+			"1.0.10":  {"1.0.10", "1.0.199", "2.0.0-beta.1"},
+		} {
+			h, err := decodePackumentVersions("foo", strings.NewReader(packument), request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if request == "^1.0.10" {
+				expected = append(expected, versions[10:200]...)
+			}
+			keys := map[string]bool{}
+			for _, v := range expected {
+				key, _, _ := strings.Cut(strings.Trim(v, `"`), `"`)
+				if _, ok := h.Versions[key]; !ok {
+					t.Fatalf("%s: version %s should be decoded", request, key)
+				}
+				keys[key] = true
+			}
+			if len(h.Versions) != len(keys) {
+				t.Fatalf("%s: expected %d versions, got %d", request, len(keys), len(h.Versions))
+			}
+			if h.DistTags["latest"] != "1.0.199" || h.Time != nil {
+				t.Fatalf("%s: invalid metadata %v %v", request, h.DistTags, h.Time)
+			}
+		}
+	}
+
+	// all the versions and the publish time are decoded for the version cooldown
+	cfg.VersionCooldown = 1
+	h, err := decodePackumentVersions("foo", strings.NewReader("{"+distTags+","+body+"}"), "latest")
+	if err != nil || len(h.Versions) != len(versions) || h.Time["1.0.0"] == "" {
+		t.Fatalf("all the versions should be decoded, got %d: %v", len(h.Versions), err)
+	}
+
+	h, err = decodePackumentVersions("foo", strings.NewReader(`{"dist-tags":{},"versions":{}}`), "latest")
+	if err != nil || h.Versions != nil {
+		t.Fatalf("the empty versions should be nil: %v", err)
+	}
+}
+
+func TestNodeEngines(t *testing.T) {
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{
+			"dist-tags": {"latest": "3.0.0"},
+			"versions": {
+				"1.0.0": {"name": "foo", "version": "1.0.0", "engines": {"node": ">=12"}},
+				"1.1.0": {"name": "foo", "version": "1.1.0", "engines": {"node": ">=20"}},
+				"1.2.0": {"name": "foo", "version": "1.2.0", "engines": {"node": ">= 22 || ^20.5"}},
+				"2.0.0": {"name": "foo", "version": "2.0.0", "engines": ["node >= 0.10"]},
+				"3.0.0": {"name": "foo", "version": "3.0.0", "engines": {"node": ">=24"}}
+			}
+		}`))
+	})
+	// resolve the versions without the cache
+	cache = nil
+
+	for _, c := range []struct {
+		nodeVersion string
+		request     string
+		expected    string
+	}{
+		{"", "^1.0.0", "1.2.0"},
+		{"18.0.0", "^1.0.0", "1.0.0"},
+		{"20.1.0", "^1.0.0", "1.1.0"},
+		{"20.5.0", "^1.0.0", "1.2.0"},
+		{"18.0.0", "^2.0.0", "2.0.0"},
+		// no compatible version of the range
+		{"18.0.0", "^3.0.0", "3.0.0"},
+		// the dist-tags are not checked
+		{"18.0.0", "latest", "3.0.0"},
+	} {
+		cfg.NodeVersion = c.nodeVersion
+		info, err := fetchPackageInfo("foo", c.request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Version != c.expected {
+			t.Fatalf("node %s: %s should be resolved to %s, got %s", c.nodeVersion, c.request, c.expected, info.Version)
+		}
+	}
+}
+
+func TestOptionalDependencies(t *testing.T) {
+	platform, arch := hostPlatform(), hostArch()
+	packuments := map[string]string{
+		"@test/host":  fmt.Sprintf(`{"name":"@test/host","version":"1.0.0","os":["%s"],"cpu":["%s"]}`, platform, arch),
+		"@test/other": fmt.Sprintf(`{"name":"@test/other","version":"1.0.0","os":["!%s"]}`, platform),
+		"@test/wasm":  `{"name":"@test/wasm","version":"1.0.0"}`,
+	}
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		name = name[:strings.LastIndexByte(name, '/')]
+		if p, ok := packuments[name]; ok {
+			w.Write([]byte(p))
+			return
+		}
+		w.WriteHeader(404)
+	})
+
+	for _, c := range []struct {
+		os       []string
+		cpu      []string
+		expected bool
+	}{
+		{nil, nil, true},
+		{[]string{"linux"}, []string{"x64"}, true},
+		{[]string{"darwin", "linux"}, nil, true},
+		{[]string{"!win32"}, []string{"x64", "arm64"}, true},
+		{[]string{"!linux"}, nil, false},
+		{[]string{"win32"}, nil, false},
+		{nil, []string{"arm64"}, false},
+	} {
+		p := NpmPackageInfo{Os: c.os, Cpu: c.cpu}
+		if p.isPlatformCompatible("linux", "x64") != c.expected {
+			t.Fatalf("os=%v cpu=%v: should be %v on linux-x64", c.os, c.cpu, c.expected)
+		}
+	}
+
+	deps := filterOptionalDependencies("foo", map[string]string{
+		"@test/host":    "1.0.0",
+		"@test/other":   "1.0.0",
+		"@test/wasm":    "1.0.0",
+		"@test/missing": "1.0.0",
+	})
+	sort.Strings(deps)
+	if strings.Join(deps, ",") != "@test/host@1.0.0,@test/wasm@1.0.0" {
+		t.Fatalf("invalid optional dependencies: %v", deps)
+	}
+
+	// the optional dependency skipped by pnpm is missing in the build
+	dir := newTestInstallDir(t, Pkg{Name: "foo", Version: "1.0.0"}, map[string]string{
+		"node_modules/.pnpm/foo@1.0.0/node_modules/@test/host/package.json": `{"name":"@test/host","version":"1.0.0"}`,
+	})
+	ensureDir(path.Join(dir, "node_modules/.pnpm/foo@1.0.0/node_modules"))
+	if err := os.Rename(path.Join(dir, "node_modules/foo"), path.Join(dir, "node_modules/.pnpm/foo@1.0.0/node_modules/foo")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(".pnpm/foo@1.0.0/node_modules/foo", path.Join(dir, "node_modules/foo")); err != nil {
+		t.Fatal(err)
+	}
+	task := &BuildTask{
+		resolveDir: dir,
+		npm: NpmPackageInfo{
+			Name:                 "foo",
+			Version:              "1.0.0",
+			OptionalDependencies: map[string]string{"@test/host": "1.0.0", "@test/other": "1.0.0"},
+		},
+	}
+	for specifier, missing := range map[string]bool{
+		"@test/host":         false,
+		"@test/host/bin.js":  false,
+		"@test/other":        true,
+		"@test/other/bin.js": true,
+		"@test/not-optional": false,
+	} {
+		if task.isOptionalDependencyMissing(specifier) != missing {
+			t.Fatalf("%s: missing should be %v", specifier, missing)
+		}
+	}
+}
+
+func TestLookupInstalledPackageVersion(t *testing.T) {
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"dist-tags":{"latest":"2.0.0"},"versions":{"1.0.0":{"name":"foo","version":"1.0.0"},"2.0.0":{"name":"foo","version":"2.0.0"}}}`))
+	})
+	dir := newTestInstallDir(t, Pkg{Name: "foo", Version: "1.0.0"}, map[string]string{})
+
+	for version, expected := range map[string]bool{"1.0.0": true, "^1.0.0": true, "1": true, "latest": true, "npm:foo@~1.0.0": true, "2.0.0": false, "^2.0.0": false, ">1.0.0": false} {
+		_, ok := lookupInstalledPackage(dir, "foo", version)
+		if ok != expected {
+			t.Fatalf("invalid lookup of foo@%s: %v", version, ok)
+		}
+	}
+
+	// the version not satisfied by the installed package is resolved by the registry
+	info, fromPackageJSON, err := getPackageInfo(dir, "foo", "^2.0.0")
+	if err != nil || fromPackageJSON || info.Version != "2.0.0" {
+		t.Fatalf("invalid package info %s (fromPackageJSON: %v): %v", info.Version, fromPackageJSON, err)
+	}
+	info, fromPackageJSON, err = getPackageInfo(dir, "foo", "^1.0.0")
+	if err != nil || !fromPackageJSON || info.Version != "1.0.0" {
+		t.Fatalf("invalid package info %s (fromPackageJSON: %v): %v", info.Version, fromPackageJSON, err)
+	}
+}
@@ -0,0 +1,426 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// the mark file of the patched package, it records the patches applied to the package
+const patchMark = ".esm.sh-patches"
+
+// packagePatch is a unified diff that is applied to the installed packages matching the name and the version range,
+// the patch file is named as `name@range.patch`, e.g. `react@^18.0.0.patch` or `@scope+name@1.x.patch`.
+type packagePatch struct {
+	Name  string
+	Range *semver.Constraints
+	File  string
+	Hash  string
+	Files []filePatch
+}
+
+// filePatch is the patch of a file, the path is relative to the package root.
+type filePatch struct {
+	Path   string
+	Create bool
+	Delete bool
+	Hunks  []patchHunk
+}
+
+type patchHunk struct {
+	// the start line (1-based) of the hunk in the original file
+	OldStart int
+	// the lines of the hunk prefixed by ' ', '-' or '+'
+	Lines []string
+	// the original or the new file doesn't end with a newline
+	OldNoEOL bool
+	NewNoEOL bool
+}
+
+// loadPatches loads the patches (`*.patch`) in the directory.
+func loadPatches(dir string) (patches []*packagePatch, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".patch") {
+			continue
+		}
+		base := strings.TrimSuffix(entry.Name(), ".patch")
+		at := strings.LastIndexByte(base, '@')
+		if at <= 0 || at == len(base)-1 {
+			return nil, fmt.Errorf("invalid patch file name '%s': should be `name@range.patch`", entry.Name())
+		}
+		name, versionRange := base[:at], base[at+1:]
+		constraints, err := semver.NewConstraint(versionRange)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version range of the patch '%s': %v", entry.Name(), err)
+		}
+		data, err := os.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		files, err := parseUnifiedDiff(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid patch '%s': %v", entry.Name(), err)
+		}
+		sum := sha1.Sum(data)
+		patches = append(patches, &packagePatch{
+			Name:  strings.ReplaceAll(name, "+", "/"),
+			Range: constraints,
+			File:  entry.Name(),
+			Hash:  hex.EncodeToString(sum[:]),
+			Files: files,
+		})
+	}
+	sort.Slice(patches, func(i, j int) bool {
+		return patches[i].File < patches[j].File
+	})
+	return
+}
+
+// parseUnifiedDiff parses the unified diff, the paths are stripped of the first component (like `patch -p1`).
+func parseUnifiedDiff(data []byte) (files []filePatch, err error) {
+	var file *filePatch
+	var hunk *patchHunk
+	var oldLeft, newLeft int
+	// "\ No newline at end of file" follows the line without the newline
+	markNoEOL := func() {
+		if hunk != nil && len(hunk.Lines) > 0 {
+			switch hunk.Lines[len(hunk.Lines)-1][0] {
+			case '-':
+				hunk.OldNoEOL = true
+			case '+':
+				hunk.NewNoEOL = true
+			default:
+				hunk.OldNoEOL = true
+				hunk.NewNoEOL = true
+			}
+		}
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if hunk != nil && (oldLeft > 0 || newLeft > 0) {
+			if line == "" {
+				// the trailing space of the context line may be stripped by the editors
+				line = " "
+			}
+			switch line[0] {
+			case ' ':
+				oldLeft--
+				newLeft--
+			case '-':
+				oldLeft--
+			case '+':
+				newLeft--
+			case '\\':
+				markNoEOL()
+				continue
+			default:
+				return nil, fmt.Errorf("invalid hunk line %q", line)
+			}
+			hunk.Lines = append(hunk.Lines, line)
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, `\ `):
+			markNoEOL()
+		case strings.HasPrefix(line, "--- "):
+			oldPath := parseDiffPath(line[4:])
+			if !scanner.Scan() || !strings.HasPrefix(scanner.Text(), "+++ ") {
+				return nil, errors.New("missing `+++` line")
+			}
+			newPath := parseDiffPath(scanner.Text()[4:])
+			files = append(files, filePatch{Path: newPath, Create: oldPath == "/dev/null", Delete: newPath == "/dev/null"})
+			file = &files[len(files)-1]
+			if file.Delete {
+				file.Path = oldPath
+			}
+			if file.Path == "" || file.Path == "/dev/null" || strings.HasPrefix(file.Path, "/") || strings.Contains("/"+file.Path+"/", "/../") {
+				return nil, fmt.Errorf("invalid file path %q", file.Path)
+			}
+			hunk = nil
+		case strings.HasPrefix(line, "@@ "):
+			if file == nil {
+				return nil, errors.New("hunk without file header")
+			}
+			var oldStart int
+			oldStart, oldLeft, newLeft, err = parseHunkHeader(line)
+			if err != nil {
+				return nil, err
+			}
+			file.Hunks = append(file.Hunks, patchHunk{OldStart: oldStart})
+			hunk = &file.Hunks[len(file.Hunks)-1]
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if hunk != nil && (oldLeft > 0 || newLeft > 0) {
+		return nil, errors.New("unexpected end of hunk")
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no file found")
+	}
+	return
+}
+
+// parseDiffPath parses the path of the `---`/`+++` line, e.g. "a/index.js\t2024-01-01 00:00:00" -> "index.js"
+func parseDiffPath(s string) string {
+	s, _, _ = strings.Cut(s, "\t")
+	s = strings.TrimSpace(s)
+	if s == "/dev/null" {
+		return s
+	}
+	if _, p, ok := strings.Cut(s, "/"); ok {
+		return p
+	}
+	return s
+}
+
+// parseHunkHeader parses the hunk header, e.g. "@@ -1,3 +1,4 @@"
+func parseHunkHeader(line string) (oldStart int, oldLines int, newLines int, err error) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 || !strings.HasPrefix(fields[1], "-") || !strings.HasPrefix(fields[2], "+") {
+		err = fmt.Errorf("invalid hunk header %q", line)
+		return
+	}
+	parseRange := func(s string) (start int, n int, err error) {
+		n = 1
+		startStr, nStr, ok := strings.Cut(s, ",")
+		start, err = strconv.Atoi(startStr)
+		if err == nil && ok {
+			n, err = strconv.Atoi(nStr)
+		}
+		return
+	}
+	oldStart, oldLines, err = parseRange(fields[1][1:])
+	if err == nil {
+		_, newLines, err = parseRange(fields[2][1:])
+	}
+	if err != nil {
+		err = fmt.Errorf("invalid hunk header %q", line)
+	}
+	return
+}
+
+// applyPatches applies the patches to the matching packages installed in the directory, the applied patches
+// are recorded in the mark file of the package so a patch is applied only once.
+func applyPatches(dir string, patches []*packagePatch) error {
+	for _, patch := range patches {
+		for _, pkgDir := range findInstalledPackages(dir, patch.Name) {
+			var p NpmPackageJSON
+			if parseJSONFile(path.Join(pkgDir, "package.json"), &p) != nil {
+				continue
+			}
+			version, err := semver.NewVersion(p.Version)
+			if err != nil || !patch.Range.Check(version) {
+				continue
+			}
+			markFile := path.Join(pkgDir, patchMark)
+			mark, _ := os.ReadFile(markFile)
+			record := patch.File + " " + patch.Hash + "\n"
+			if bytes.Contains(mark, []byte(record)) {
+				continue
+			}
+			// all the hunks are checked before a file is written, so a patch that doesn't apply
+			// leaves the package untouched
+			files := make([]*patchedFile, len(patch.Files))
+			for i, fp := range patch.Files {
+				files[i], err = fp.dryRun(pkgDir)
+				if err != nil {
+					return fmt.Errorf("patch %s@%s (%s): %v", patch.Name, p.Version, patch.File, err)
+				}
+			}
+			err = writePatchedFiles(files)
+			if err != nil {
+				return fmt.Errorf("patch %s@%s (%s): %v", patch.Name, p.Version, patch.File, err)
+			}
+			err = os.WriteFile(markFile, append(mark, record...), 0644)
+			if err != nil {
+				return err
+			}
+			log.Infof("patch %s@%s: applied %s", patch.Name, p.Version, patch.File)
+		}
+	}
+	return nil
+}
+
+// findInstalledPackages returns the directories of the package installed in the directory, including
+// the copies of the dependencies in the virtual store of pnpm (`node_modules/.pnpm`).
+func findInstalledPackages(dir string, name string) (pkgDirs []string) {
+	candidates := []string{path.Join(dir, "node_modules", name)}
+	if matches, err := filepath.Glob(path.Join(dir, "node_modules", ".pnpm", "*", "node_modules", name)); err == nil {
+		candidates = append(candidates, matches...)
+	}
+	seen := map[string]bool{}
+	for _, pkgDir := range candidates {
+		realDir, err := filepath.EvalSymlinks(pkgDir)
+		if err != nil || seen[realDir] || !existsFile(path.Join(realDir, "package.json")) {
+			continue
+		}
+		seen[realDir] = true
+		pkgDirs = append(pkgDirs, realDir)
+	}
+	return
+}
+
+// patchedFile is the content of a file of the package after the patch.
+type patchedFile struct {
+	filename string
+	content  []byte
+	mode     os.FileMode
+	delete   bool
+}
+
+// dryRun applies the patch to the content of the file of the package in memory.
+func (fp *filePatch) dryRun(pkgDir string) (pf *patchedFile, err error) {
+	filename := path.Join(pkgDir, fp.Path)
+	if fp.Delete {
+		return &patchedFile{filename: filename, delete: true}, nil
+	}
+
+	var lines []string
+	eol := true
+	mode := os.FileMode(0644)
+	if !fp.Create {
+		var fi os.FileInfo
+		fi, err = os.Stat(filename)
+		if err != nil {
+			return
+		}
+		mode = fi.Mode().Perm()
+		var data []byte
+		data, err = os.ReadFile(filename)
+		if err != nil {
+			return
+		}
+		content := string(data)
+		eol = content == "" || strings.HasSuffix(content, "\n")
+		content = strings.TrimSuffix(content, "\n")
+		if content != "" {
+			lines = strings.Split(content, "\n")
+		}
+	}
+
+	offset := 0
+	for i, hunk := range fp.Hunks {
+		var oldLines, newLines []string
+		for _, line := range hunk.Lines {
+			if line[0] != '+' {
+				oldLines = append(oldLines, line[1:])
+			}
+			if line[0] != '-' {
+				newLines = append(newLines, line[1:])
+			}
+		}
+		start := hunk.OldStart - 1
+		if len(oldLines) == 0 {
+			// the hunk of an empty original file is "@@ -0,0 +1,n @@"
+			start = hunk.OldStart
+		}
+		pos, ok := findHunkPosition(lines, oldLines, start+offset)
+		if !ok {
+			return nil, fmt.Errorf("hunk #%d failed at line %d of %s", i+1, hunk.OldStart, fp.Path)
+		}
+		atEOF := pos+len(oldLines) == len(lines)
+		rest := append([]string{}, lines[pos+len(oldLines):]...)
+		lines = append(append(lines[:pos], newLines...), rest...)
+		offset += len(newLines) - len(oldLines)
+		if atEOF {
+			if hunk.NewNoEOL {
+				eol = false
+			} else if hunk.OldNoEOL {
+				eol = true
+			}
+		}
+	}
+
+	content := strings.Join(lines, "\n")
+	if eol && len(lines) > 0 {
+		content += "\n"
+	}
+	return &patchedFile{filename: filename, content: []byte(content), mode: mode}, nil
+}
+
+// writePatchedFiles writes the patched files to temporary files first and then moves them into place,
+// the files are replaced instead of written in place since they may be hard-linked to a store.
+func writePatchedFiles(files []*patchedFile) (err error) {
+	tmpFiles := make([]string, len(files))
+	defer func() {
+		for _, tmpFile := range tmpFiles {
+			if tmpFile != "" {
+				os.Remove(tmpFile)
+			}
+		}
+	}()
+	for i, pf := range files {
+		if pf.delete {
+			continue
+		}
+		err = ensureDir(path.Dir(pf.filename))
+		if err != nil {
+			return
+		}
+		tmpFile := pf.filename + ".esm.sh-patch"
+		err = os.WriteFile(tmpFile, pf.content, pf.mode)
+		if err != nil {
+			return
+		}
+		tmpFiles[i] = tmpFile
+	}
+	for i, pf := range files {
+		if pf.delete {
+			err = os.Remove(pf.filename)
+			if err != nil && !os.IsNotExist(err) {
+				return
+			}
+			err = nil
+			continue
+		}
+		err = os.Rename(tmpFiles[i], pf.filename)
+		if err != nil {
+			return
+		}
+		tmpFiles[i] = ""
+	}
+	return
+}
+
+// findHunkPosition finds the position of the lines, searching from the expected position outward.
+func findHunkPosition(lines []string, target []string, expected int) (int, bool) {
+	match := func(pos int) bool {
+		if pos < 0 || pos+len(target) > len(lines) {
+			return false
+		}
+		for i, line := range target {
+			if lines[pos+i] != line {
+				return false
+			}
+		}
+		return true
+	}
+	for d := 0; d <= len(lines); d++ {
+		if match(expected - d) {
+			return expected - d, true
+		}
+		if d > 0 && match(expected+d) {
+			return expected + d, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPatches(t *testing.T) {
+	patchesDir := t.TempDir()
+	for name, content := range map[string]string{
+		"foo@^1.0.0.patch": `diff --git a/index.js b/index.js
+--- a/index.js
++++ b/index.js
+@@ -1,3 +1,3 @@
+ const a = 1;
+-const b = require("./b");
++import b from "./b.js";
+ const c = 3;
+@@ -8,2 +8,3 @@ function foo() {
+ }
+-module.exports = foo;
+\ No newline at end of file
++export default foo;
++export { b };
+--- /dev/null
++++ b/b.js
+@@ -0,0 +1 @@
++export default 2;
+--- a/b.cjs
++++ /dev/null
+@@ -1 +0,0 @@
+-module.exports = 2;
+`,
+		"@scope+bar@2.x.patch": `--- a/index.js
++++ b/index.js
+@@ -1 +1 @@
+-bar
++baz
+`,
+	} {
+		if err := os.WriteFile(path.Join(patchesDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	patches, err := loadPatches(patchesDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patches) != 2 || patches[0].Name != "@scope/bar" || patches[1].Name != "foo" {
+		t.Fatalf("invalid patches: %v", patches)
+	}
+
+	dir := newTestInstallDir(t, Pkg{Name: "foo", Version: "1.2.0"}, map[string]string{
+		"node_modules/foo/index.js": "const a = 1;\nconst b = require(\"./b\");\nconst c = 3;\n\nfunction foo() {\n  return a + b + c;\n}\nmodule.exports = foo;",
+		"node_modules/foo/b.cjs":    "module.exports = 2;\n",
+	})
+	bar := newTestInstallDir(t, Pkg{Name: "@scope/bar", Version: "1.0.0"}, map[string]string{
+		"node_modules/@scope/bar/index.js": "bar\n",
+	})
+	// the file hard-linked to a store must not be changed
+	storeFile := path.Join(t.TempDir(), "index.js")
+	if err := os.Link(path.Join(dir, "node_modules/foo/index.js"), storeFile); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := applyPatches(dir, patches); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := os.ReadFile(path.Join(dir, "node_modules/foo/index.js"))
+		if string(data) != "const a = 1;\nimport b from \"./b.js\";\nconst c = 3;\n\nfunction foo() {\n  return a + b + c;\n}\nexport default foo;\nexport { b };\n" {
+			t.Fatalf("invalid patched file: %q", data)
+		}
+	}
+	data, _ := os.ReadFile(path.Join(dir, "node_modules/foo/b.js"))
+	if string(data) != "export default 2;\n" || existsFile(path.Join(dir, "node_modules/foo/b.cjs")) {
+		t.Fatal("the file should be created and deleted by the patch")
+	}
+	data, _ = os.ReadFile(storeFile)
+	if !strings.HasSuffix(string(data), "module.exports = foo;") {
+		t.Fatalf("the hard-linked file should not be changed: %q", data)
+	}
+
+	// the version out of the range is not patched
+	if err := applyPatches(bar, patches); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path.Join(bar, "node_modules/@scope/bar/index.js")); string(data) != "bar\n" {
+		t.Fatalf("@scope/bar@1.0.0 should not be patched: %q", data)
+	}
+
+	// the patch that doesn't apply is an error
+	dir = newTestInstallDir(t, Pkg{Name: "foo", Version: "1.3.0"}, map[string]string{
+		"node_modules/foo/index.js": "module.exports = 1;\n",
+	})
+	if err := applyPatches(dir, patches); err == nil || !strings.Contains(err.Error(), "hunk #1 failed") {
+		t.Fatalf("expected hunk failed error, got %v", err)
+	}
+
+	// the patch is not applied partially when a hunk of a file fails
+	patchesDir = t.TempDir()
+	err = os.WriteFile(path.Join(patchesDir, "qux@1.0.0.patch"), []byte(`--- a/a.js
++++ b/a.js
+@@ -1 +1 @@
+-a
++A
+--- a/b.js
++++ b/b.js
+@@ -1,2 +1,2 @@
+-b
++B
+ c
+@@ -4 +4 @@
+-e
++E
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patches, err = loadPatches(patchesDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir = newTestInstallDir(t, Pkg{Name: "qux", Version: "1.0.0"}, map[string]string{
+		"node_modules/qux/a.js": "a\n",
+		"node_modules/qux/b.js": "b\nc\nd\nx\n",
+	})
+	if err := applyPatches(dir, patches); err == nil || !strings.Contains(err.Error(), "hunk #2 failed") {
+		t.Fatalf("expected hunk failed error, got %v", err)
+	}
+	for name, content := range map[string]string{"a.js": "a\n", "b.js": "b\nc\nd\nx\n"} {
+		if data, _ := os.ReadFile(path.Join(dir, "node_modules/qux", name)); string(data) != content {
+			t.Fatalf("%s should not be patched: %q", name, data)
+		}
+	}
+	if matches, _ := filepath.Glob(path.Join(dir, "node_modules/qux/*.esm.sh-patch")); len(matches) > 0 || existsFile(path.Join(dir, "node_modules/qux", patchMark)) {
+		t.Fatal("the failed patch should leave no files")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"net/url"
 	"strings"
 
+	"github.com/Masterminds/semver/v3"
 	"github.com/ije/gox/utils"
 	"github.com/ije/gox/valid"
 )
@@ -27,34 +28,67 @@ func validatePkgPath(pathname string) (pkg Pkg, extraQuery string, err error) {
 		if len(segs) > 4 {
 			pathname += "/" + strings.Join(segs[4:], "/")
 		}
+	} else if strings.HasPrefix(pathname, "/tgz/") {
+		// the escaped tarball url, e.g. `/tgz/https%3A%2F%2Fexample.com%2Fpkg.tgz/sub/path`
+		escapedURL, subPath := utils.SplitByFirstByte(pathname[5:], '/')
+		tarballURL, e := url.PathUnescape(escapedURL)
+		if e != nil || tarballURL == "" {
+			return Pkg{}, "", newRegistryError(ErrInvalidSpecifier, "invalid tarball url '%s'", escapedURL)
+		}
+		var ref TarballRef
+		ref, err = resolveTarballURL(tarballURL)
+		if err != nil {
+			return
+		}
+		pathname = "/" + ref.Name + "@tgz:" + ref.Hash
+		if subPath != "" {
+			pathname += "/" + subPath
+		}
 	}
 
 	pkgName, maybeVersion, subPath := splitPkgPath(pathname)
-	if !validatePackageName(pkgName) {
-		return Pkg{}, "", fmt.Errorf("invalid package name '%s'", pkgName)
-	}
-
 	version, extraQuery := utils.SplitByFirstByte(maybeVersion, '&')
-	if v, e := url.QueryUnescape(version); e == nil {
-		version = v
-	}
 
-	pkg = Pkg{
-		Name:       pkgName,
-		Version:    version,
-		SubPath:    subPath,
-		SubModule:  toModuleBareName(subPath, true),
-		FromGithub: fromGithub,
+	// the version of a github package is a tag, a branch or a commit hash
+	specifier := pkgName
+	if version != "" && !fromGithub {
+		specifier += "@" + version
+	}
+	if subPath != "" {
+		specifier += "/" + subPath
+	}
+	pkg, _, err = ParseSpecifier(specifier)
+	if err != nil {
+		return Pkg{}, "", err
 	}
 
 	if fromGithub {
+		if v, e := url.QueryUnescape(version); e == nil {
+			version = v
+		}
 		// strip the leading `@`
 		pkg.Name = pkg.Name[1:]
+		pkg.Version = version
+		pkg.FromGithub = true
 		if (valid.IsHexString(pkg.Version) && len(pkg.Version) >= 10) || regexpFullVersion.MatchString(strings.TrimPrefix(pkg.Version, "v")) {
 			return
 		}
+		// the refs of the private repositories are resolved by the GitHub API
+		if cfg != nil && cfg.GithubToken != "" {
+			ref := pkg.Version
+			if ref == "" {
+				ref = "HEAD"
+			}
+			var sha string
+			sha, err = resolveGhRef(pkg.Name, ref)
+			if err != nil {
+				return
+			}
+			pkg.Version = sha[:10]
+			return
+		}
 		var refs []GitRef
-		refs, err = listRepoRefs(fmt.Sprintf("https://github.com/%s", pkg.Name))
+		refs, err = listRepoRefs(fmt.Sprintf("%s/%s", ghOrigin, pkg.Name))
 		if err != nil {
 			return
 		}
@@ -68,20 +102,53 @@ func validatePkgPath(pathname string) (pkg Pkg, extraQuery string, err error) {
 		} else if strings.HasPrefix(pkg.Version, "semver:") {
 			// TODO: support semver
 		} else {
+			// the tag or the branch is resolved to the commit for the stable caching,
+			// the annotated tag is peeled to the commit (`refs/tags/<tag>^{}`)
+			sha := ""
 			for _, ref := range refs {
-				if ref.Ref == "refs/tags/"+pkg.Version || ref.Ref == "refs/heads/"+pkg.Version {
-					pkg.Version = ref.Sha[:10]
-					return
+				if ref.Ref == "refs/tags/"+pkg.Version+"^{}" {
+					sha = ref.Sha
+					break
+				}
+				if ref.Ref == "refs/tags/"+pkg.Version || (ref.Ref == "refs/heads/"+pkg.Version && sha == "") {
+					sha = ref.Sha
 				}
 			}
+			if sha != "" {
+				pkg.Version = sha[:10]
+				return
+			}
+		}
+		err = newRegistryError(ErrVersionNotFound, "tag or branch not found")
+		return
+	}
+
+	// the git url is resolved to the commit, only the https repositories of the public hosts are allowed
+	if repo, _, _, ok := parseGitURL(pkg.Version); ok {
+		if !strings.HasPrefix(repo, "https://") {
+			return Pkg{}, "", newRegistryError(ErrInvalidSpecifier, "unsupported git url '%s'", pkg.Version)
 		}
-		err = fmt.Errorf("tag or branch not found")
+		pkg.Version, err = resolveGitURL(pkg.Version)
 		return
 	}
 
-	if !regexpFullVersion.MatchString(pkg.Version) && cfg != nil {
+	// the ref of the gitlab specifier is resolved to the commit as well
+	if repo, ref, ok := parseGitlabSpecifier(pkg.Version); ok {
+		if len(ref) == 40 && valid.IsHexString(ref) {
+			return
+		}
+		var sha string
+		sha, err = resolveGitlabRef(repo, ref)
+		if err != nil {
+			return
+		}
+		pkg.Version = "gitlab:" + repo + "#" + sha
+		return
+	}
+
+	if !regexpFullVersion.MatchString(pkg.Version) && !isNonRegistryVersion(pkg.Version) && cfg != nil {
 		var p NpmPackageInfo
-		p, err = fetchPackageInfo(pkgName, version)
+		p, err = fetchPackageInfo(pkg.Name, pkg.Version)
 		if err == nil {
 			pkg.Version = p.Version
 		}
@@ -89,6 +156,105 @@ func validatePkgPath(pathname string) (pkg Pkg, extraQuery string, err error) {
 	return
 }
 
+// ParseSpecifier parses the specifier like `react@^18.2.0/jsx-runtime`, `@scope/name@latest/sub/path`,
+// `npm:react@18` or `jsr:@std/encoding@1/hex` into the package and the subpath.
+// The specifier is validated syntactically, it doesn't touch the network or the cache.
+func ParseSpecifier(raw string) (pkg Pkg, subPath string, err error) {
+	pkgName, version, subPath := splitPkgPath(strings.TrimPrefix(strings.TrimPrefix(raw, "/"), "npm:"))
+	if v, e := url.QueryUnescape(version); e == nil {
+		version = v
+	}
+	err = ValidateSpecifier(pkgName, version, subPath)
+	if err != nil {
+		return Pkg{}, "", err
+	}
+	pkg = Pkg{
+		Name:      pkgName,
+		Version:   version,
+		SubPath:   subPath,
+		SubModule: toModuleBareName(subPath, true),
+	}
+	return pkg, subPath, nil
+}
+
+// ValidateSpecifier checks the package name, the version and the sub-path syntactically,
+// it doesn't touch the network or the cache.
+func ValidateSpecifier(name string, version string, subPath string) error {
+	if !validatePackageName(name) {
+		return newRegistryError(ErrInvalidSpecifier, "invalid package name '%s'", name)
+	}
+	if !validateVersion(version) {
+		return newRegistryError(ErrInvalidSpecifier, "invalid version '%s' of '%s'", version, name)
+	}
+	if !validateSubPath(subPath) {
+		return newRegistryError(ErrInvalidSpecifier, "invalid sub-path '%s' of '%s'", subPath, name)
+	}
+	return nil
+}
+
+// validateVersion checks whether the version is empty, a dist-tag, a semver range, a git url, a gitlab specifier,
+// a tarball version or an npm alias.
+func validateVersion(version string) bool {
+	if version == "" || regexpFullVersion.MatchString(version) || regexpDistTag.MatchString(version) || regexpTarballVersion.MatchString(version) {
+		return true
+	}
+	if _, _, _, ok := parseGitURL(version); ok {
+		return true
+	}
+	if _, _, ok := parseGitlabSpecifier(version); ok {
+		return true
+	}
+	if _, aliasVersion, ok := parseNpmAlias(version); ok {
+		return !strings.HasPrefix(aliasVersion, "npm:") && validateVersion(aliasVersion)
+	}
+	_, err := semver.NewConstraint(version)
+	return err == nil
+}
+
+// parseNpmAlias parses the version of the npm alias, e.g. `npm:@preact/compat@^17` -> (`@preact/compat`, `^17`),
+// the version is `latest` if it's omitted.
+func parseNpmAlias(version string) (name string, aliasVersion string, ok bool) {
+	if !strings.HasPrefix(version, "npm:") {
+		return
+	}
+	name, aliasVersion, _ = splitPkgPath(version[4:])
+	if aliasVersion == "" {
+		aliasVersion = "latest"
+	}
+	return name, aliasVersion, validatePackageName(name)
+}
+
+// isNonRegistryVersion returns true if the version is a git url, a gitlab specifier or a tarball version, that is
+// installed from the repository or the tarball instead of the registry.
+func isNonRegistryVersion(version string) bool {
+	if _, _, _, ok := parseGitURL(version); ok {
+		return true
+	}
+	if _, ok := parseTarballVersion(version); ok {
+		return true
+	}
+	_, _, ok := parseGitlabSpecifier(version)
+	return ok
+}
+
+// validateSubPath checks whether the sub-path is relative and doesn't escape the package directory.
+func validateSubPath(subPath string) bool {
+	if strings.HasPrefix(subPath, "/") || strings.ContainsRune(subPath, '\\') {
+		return false
+	}
+	for _, c := range subPath {
+		if c < 0x20 || c == 0x7f {
+			return false
+		}
+	}
+	for _, seg := range strings.Split(subPath, "/") {
+		if seg == ".." {
+			return false
+		}
+	}
+	return true
+}
+
 func (pkg Pkg) VersionName() string {
 	if pkg.FromGithub {
 		return "gh/" + pkg.Name + "@" + pkg.Version
@@ -122,7 +288,7 @@ func (a PkgSlice) Less(i, j int) bool { return a[i].String() < a[j].String() }
 func (a PkgSlice) Has(name string) bool {
 	for _, m := range a {
 		if m.Name == name {
-			return false
+			return true
 		}
 	}
 	return false
@@ -164,7 +330,7 @@ func toModuleBareName(path string, stripIndexSuffier bool) string {
 }
 
 func splitPkgPath(specifier string) (pkgName string, version string, subPath string) {
-	a := strings.Split(strings.TrimPrefix(specifier, "/"), "/")
+	a := strings.Split(normalizeJsrSpecifier(strings.TrimPrefix(specifier, "/")), "/")
 	pkgNameWithVersion := a[0]
 	subPath = strings.Join(a[1:], "/")
 	if strings.HasPrefix(pkgNameWithVersion, "@") && len(a) > 1 {
@@ -184,3 +350,16 @@ func getPkgName(specifier string) string {
 	name, _, _ := splitPkgPath(specifier)
 	return name
 }
+
+// normalizeJsrSpecifier converts the `jsr:` protocol specifier to the npm bridge specifier of jsr,
+// e.g. `jsr:@std/encoding@^1/hex` -> `@jsr/std__encoding@^1/hex`
+func normalizeJsrSpecifier(specifier string) string {
+	if !strings.HasPrefix(specifier, "jsr:@") {
+		return specifier
+	}
+	scope, rest := utils.SplitByFirstByte(specifier[5:], '/')
+	if scope == "" || rest == "" {
+		return specifier
+	}
+	return "@jsr/" + scope + "__" + rest
+}
@@ -2,6 +2,9 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
+	"path"
+	"strings"
 	"testing"
 )
 
@@ -86,3 +89,131 @@ func TestPkgPath(t *testing.T) {
 		t.Fatalf("invalid pkg('%v'), should be 'react-dom@18.2.0/client'", pkg)
 	}
 }
+
+func TestValidateSpecifier(t *testing.T) {
+	for _, s := range [][3]string{
+		{"react", "", ""},
+		{"react", "18.2.0", "jsx-runtime"},
+		{"react", "^18.2.0", ""},
+		{"react", ">=16.8 <19 || 19.0.0-rc.1", ""},
+		{"react", "latest", ""},
+		{"react", "next", ""},
+		{"@types/react", "~18", "index.d.ts"},
+		{"foo", "git+https://github.com/foo/foo.git#main", ""},
+		{"react-dom", "npm:@preact/compat@^17", ""},
+		{"react-dom", "npm:@preact/compat", ""},
+	} {
+		if err := ValidateSpecifier(s[0], s[1], s[2]); err != nil {
+			t.Fatalf("ValidateSpecifier(%q, %q, %q) should pass: %v", s[0], s[1], s[2], err)
+		}
+	}
+
+	for _, s := range [][3]string{
+		// invalid package name
+		{"", "", ""},
+		{"Re act", "", ""},
+		{"@scope", "", ""},
+		{"@sc ope/foo", "", ""},
+		{"react!", "", ""},
+		// invalid version
+		{"react", "!18", ""},
+		{"react", ">=>1", ""},
+		{"react", "1.2.3 <<", ""},
+		{"react", "-beta", ""},
+		{"react-dom", "npm:Pre act@^17", ""},
+		{"react-dom", "npm:preact@!17", ""},
+		{"react-dom", "npm:preact@npm:preact", ""},
+		// invalid sub-path
+		{"react", "18.2.0", "/etc/passwd"},
+		{"react", "18.2.0", "../../secret"},
+		{"react", "18.2.0", "lib/../../secret"},
+		{"react", "18.2.0", "lib\\index.js"},
+		{"react", "18.2.0", "lib/\x00index.js"},
+	} {
+		err := ValidateSpecifier(s[0], s[1], s[2])
+		if err == nil {
+			t.Fatalf("ValidateSpecifier(%q, %q, %q) should fail", s[0], s[1], s[2])
+		}
+		if !errors.Is(err, ErrInvalidSpecifier) || getErrorStatus(err) != 400 {
+			t.Fatalf("ValidateSpecifier(%q, %q, %q) should return ErrInvalidSpecifier: %v", s[0], s[1], s[2], err)
+		}
+	}
+
+	_, _, err := validatePkgPath("/react@18.2.0/../../secret")
+	if !errors.Is(err, ErrInvalidSpecifier) {
+		t.Fatalf("validatePkgPath should reject the invalid sub-path: %v", err)
+	}
+}
+
+func TestJsrSpecifier(t *testing.T) {
+	for specifier, expected := range map[string][3]string{
+		"jsr:@std/encoding@^1":         {"@jsr/std__encoding", "^1", ""},
+		"jsr:@std/encoding/hex":        {"@jsr/std__encoding", "", "hex"},
+		"jsr:@std/encoding@1.0.5/hex":  {"@jsr/std__encoding", "1.0.5", "hex"},
+		"/jsr:@std/encoding@^1/base64": {"@jsr/std__encoding", "^1", "base64"},
+		"@jsr/std__encoding@^1":        {"@jsr/std__encoding", "^1", ""},
+	} {
+		pkgName, version, subPath := splitPkgPath(specifier)
+		if pkgName != expected[0] || version != expected[1] || subPath != expected[2] {
+			t.Fatalf("invalid splitPkgPath('%s'): %q %q %q, should be %q", specifier, pkgName, version, subPath, expected)
+		}
+	}
+	if s := normalizeJsrSpecifier("jsr:@std"); s != "jsr:@std" {
+		t.Fatalf("invalid jsr specifier should be kept: %q", s)
+	}
+
+	pkg, _, err := validatePkgPath("/jsr:@std/encoding@1.0.5/hex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg.Name != "@jsr/std__encoding" || pkg.Version != "1.0.5" || pkg.SubModule != "hex" {
+		t.Fatalf("invalid pkg('%v'), should be '@jsr/std__encoding@1.0.5/hex'", pkg)
+	}
+}
+
+func FuzzParseSpecifier(f *testing.F) {
+	for _, seed := range []string{
+		"react",
+		"react@18.2.0",
+		"react-dom@^18.2.0/client",
+		"@types/react@latest/index.d.ts",
+		"@scope/name@>=1.0.0 <2.0.0/sub/path.js",
+		"jsr:@std/encoding@^1/hex",
+		"npm:preact@10/hooks",
+		"/foo@next/dist/index.mjs",
+		"foo@1.0.0/../../etc/passwd",
+		"../foo",
+		"@../foo",
+		"foo@%2E%2E/bar",
+		"foo/a\\b",
+		"foo\x00bar",
+		"@",
+		"@/",
+		"",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, raw string) {
+		pkg, subPath, err := ParseSpecifier(raw)
+		if err != nil {
+			if !errors.Is(err, ErrInvalidSpecifier) {
+				t.Fatalf("ParseSpecifier(%q) returns an unexpected error: %v", raw, err)
+			}
+			return
+		}
+		if !validatePackageName(pkg.Name) {
+			t.Fatalf("ParseSpecifier(%q) returns an invalid package name %q", raw, pkg.Name)
+		}
+		if subPath != pkg.SubPath {
+			t.Fatalf("ParseSpecifier(%q) returns the mismatched subpath %q != %q", raw, subPath, pkg.SubPath)
+		}
+		// the resolved paths never escape the package directory
+		pkgDir := path.Join("/wd/node_modules", pkg.Name)
+		if !strings.HasPrefix(pkgDir, "/wd/node_modules/") {
+			t.Fatalf("ParseSpecifier(%q): the package directory %q escapes node_modules", raw, pkgDir)
+		}
+		if fp := path.Join(pkgDir, subPath); fp != pkgDir && !strings.HasPrefix(fp, pkgDir+"/") {
+			t.Fatalf("ParseSpecifier(%q): the file %q escapes the package directory", raw, fp)
+		}
+	})
+}
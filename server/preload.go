@@ -0,0 +1,49 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// the build targets of the preloaded packages, the modern browsers and deno
+var preloadTargets = []string{"es2022", "denonext"}
+
+// preload installs and prebuilds the packages (e.g. "react@18", "lodash-es") in the background on startup,
+// so the popular modules are not served from a cold path after a deploy. The builds are queued one by one
+// to not hold up the builds of the requests.
+func preload(ctx context.Context, specifiers []string) {
+	start := time.Now()
+	n := 0
+	for _, task := range newPreloadTasks(specifiers) {
+		if _, ok := queryESMBuild(task.ID()); ok {
+			continue
+		}
+		c := buildQueue.Add(task, "preload")
+		select {
+		case output := <-c.C:
+			if output.err == nil {
+				n++
+			}
+		case <-ctx.Done():
+			buildQueue.RemoveClient(task, c)
+			return
+		}
+	}
+	log.Infof("preload: %d builds done in %v", n, time.Since(start))
+}
+
+// newPreloadTasks creates the build tasks of the preloaded packages, the invalid specifiers are skipped.
+func newPreloadTasks(specifiers []string) (tasks []*BuildTask) {
+	for _, specifier := range specifiers {
+		pkg, _, err := validatePkgPath("/" + strings.TrimPrefix(strings.TrimSpace(specifier), "/"))
+		if err != nil {
+			log.Warnf("preload %s: %v", specifier, err)
+			continue
+		}
+		for _, target := range preloadTargets {
+			tasks = append(tasks, newDefaultBuildTask(pkg, target))
+		}
+	}
+	return
+}
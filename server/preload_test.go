@@ -0,0 +1,37 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNewPreloadTasks(t *testing.T) {
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/foo" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write([]byte(`{
+			"dist-tags": {"latest": "2.0.0"},
+			"versions": {
+				"1.0.0": {"name": "foo", "version": "1.0.0"},
+				"1.2.0": {"name": "foo", "version": "1.2.0"},
+				"2.0.0": {"name": "foo", "version": "2.0.0"}
+			}
+		}`))
+	})
+	cfg.CdnOrigin = "https://esm.sh"
+
+	tasks := newPreloadTasks([]string{"foo@1", " /foo/client ", "bar", "@invalid"})
+	if len(tasks) != 2*len(preloadTargets) {
+		t.Fatalf("invalid tasks: %d", len(tasks))
+	}
+	for i, expected := range []string{"foo@1.2.0", "foo@2.0.0/client"} {
+		for j, target := range preloadTargets {
+			task := tasks[i*len(preloadTargets)+j]
+			if task.Pkg.String() != expected || task.Target != target || task.CdnOrigin != "https://esm.sh" {
+				t.Fatalf("invalid task: %s %s, should be %s %s", task.Pkg, task.Target, expected, target)
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// getProxyConfig returns the proxy config of the outbound traffic, the `cfg.Proxy` and `cfg.NoProxy`
+// override the `HTTP_PROXY`, `HTTPS_PROXY` and `NO_PROXY` environment variables.
+func getProxyConfig() *httpproxy.Config {
+	c := httpproxy.FromEnvironment()
+	if cfg != nil {
+		if cfg.Proxy != "" {
+			c.HTTPProxy = cfg.Proxy
+			c.HTTPSProxy = cfg.Proxy
+		}
+		if cfg.NoProxy != "" {
+			c.NoProxy = cfg.NoProxy
+		}
+	}
+	return c
+}
+
+// proxyFromConfig is the `Proxy` function of the http transports, the `http`, `https` and `socks5`
+// proxies are supported.
+func proxyFromConfig(req *http.Request) (*url.URL, error) {
+	return getProxyConfig().ProxyFunc()(req.URL)
+}
+
+// newHttpClient creates a http client that honors the proxy config.
+func newHttpClient(timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxyFromConfig
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+	}
+}
+
+// proxyEnv returns the proxy environment variables of the child processes (pnpm, git, etc.),
+// it returns nil if the proxy is not configured by the config.
+func proxyEnv() []string {
+	if cfg == nil || (cfg.Proxy == "" && cfg.NoProxy == "") {
+		return nil
+	}
+	c := getProxyConfig()
+	env := []string{}
+	for _, kv := range [][2]string{{"HTTP_PROXY", c.HTTPProxy}, {"HTTPS_PROXY", c.HTTPSProxy}, {"NO_PROXY", c.NoProxy}} {
+		if kv[1] != "" {
+			// some tools (e.g. curl used by git) only read the lower case variables
+			env = append(env, kv[0]+"="+kv[1], strings.ToLower(kv[0])+"="+kv[1])
+		}
+	}
+	return env
+}
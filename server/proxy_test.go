@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestProxy(t *testing.T) {
+	var proxied int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&proxied, 1)
+		if r.URL.Host != "registry.esm.invalid" || r.URL.Path != "/foo/1.0.0" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write([]byte(`{"name":"foo","version":"1.0.0"}`))
+	}))
+	defer proxy.Close()
+
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(404)
+	})
+	cfg.NpmRegistry = "http://registry.esm.invalid/"
+	cfg.Proxy = proxy.URL
+	cfg.NoProxy = "bypass.esm.invalid"
+
+	info, err := fetchPackageInfo("foo", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "1.0.0" || atomic.LoadInt32(&proxied) != 1 {
+		t.Fatalf("the registry request should be sent via the proxy")
+	}
+
+	for url, expected := range map[string]string{
+		"https://codeload.github.com/foo/bar/tar.gz/main": proxy.URL,
+		"http://bypass.esm.invalid/foo":                   "",
+	} {
+		req, _ := http.NewRequest("GET", url, nil)
+		u, err := proxyFromConfig(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (u == nil && expected != "") || (u != nil && u.String() != expected) {
+			t.Fatalf("invalid proxy of %s: %v", url, u)
+		}
+	}
+
+	cfg.Proxy = "socks5://127.0.0.1:1080"
+	req, _ := http.NewRequest("GET", "https://registry.npmjs.org/foo", nil)
+	if u, err := proxyFromConfig(req); err != nil || u == nil || u.Scheme != "socks5" {
+		t.Fatalf("invalid socks5 proxy: %v, %v", u, err)
+	}
+
+	env := strings.Join(proxyEnv(), "\n")
+	for _, v := range []string{"HTTPS_PROXY=socks5://127.0.0.1:1080", "https_proxy=socks5://127.0.0.1:1080", "NO_PROXY=bypass.esm.invalid"} {
+		if !strings.Contains(env, v) {
+			t.Fatalf("missing %q in the proxy env:\n%s", v, env)
+		}
+	}
+}
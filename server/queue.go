@@ -45,6 +45,7 @@ func (t *queueTask) run() BuildOutput {
 	} else {
 		log.Errorf("build '%s': %v", t.ID(), err)
 	}
+	recordBuildError(t.BuildTask, err)
 	return BuildOutput{meta, err}
 }
 
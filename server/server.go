@@ -4,6 +4,7 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"embed"
 	"flag"
 	"fmt"
@@ -14,8 +15,8 @@ import (
 	"os/signal"
 	"path"
 	"strings"
-	"sync"
 	"syscall"
+	"time"
 
 	"github.com/esm-dev/esm.sh/server/config"
 	"github.com/esm-dev/esm.sh/server/storage"
@@ -25,16 +26,19 @@ import (
 )
 
 var (
-	cfg          *config.Config
-	cache        storage.Cache
-	db           storage.DataBase
-	fs           storage.FileSystem
-	nodeLibs     map[string]string
-	buildQueue   *BuildQueue
-	log          *logger.Logger
-	embedFS      EmbedFS
-	fetchLocks   sync.Map
-	installLocks sync.Map
+	cfg              *config.Config
+	cache            storage.Cache
+	db               storage.DataBase
+	fs               storage.FileSystem
+	nodeLibs         map[string]string
+	buildQueue       *BuildQueue
+	log              *logger.Logger
+	embedFS          EmbedFS
+	fetchLocks       keyedLocks
+	installLocks     keyedLocks
+	installSemaphore *semaphore
+	packagePatches   []*packagePatch
+	exportsMaps      = newLRUCache(1000)
 )
 
 type EmbedFS interface {
@@ -65,6 +69,7 @@ func Serve(efs EmbedFS) {
 		fmt.Println("Config loaded from", cfile)
 	}
 	buildQueue = newBuildQueue(int(cfg.BuildConcurrency))
+	installSemaphore = newSemaphore(int(cfg.InstallConcurrency))
 
 	if isDev {
 		cfg.LogLevel = "debug"
@@ -90,6 +95,13 @@ func Serve(efs EmbedFS) {
 	if err != nil {
 		log.Fatalf("init storage(cache,%s): %v", cfg.Cache, err)
 	}
+	if cfg.CacheReplica != "" {
+		replica, err := storage.OpenCache(cfg.CacheReplica)
+		if err != nil {
+			log.Fatalf("init storage(cache,%s): %v", cfg.CacheReplica, err)
+		}
+		cache = storage.NewTieredCache(replica, cache, getReplicaFillTTL(), "npm-fresh:", "npm-miss:", "npm-keys:", "build-error:")
+	}
 
 	fs, err = storage.OpenFS(cfg.Storage)
 	if err != nil {
@@ -131,6 +143,41 @@ func Serve(efs EmbedFS) {
 	nodeLibs["node/async_hooks.js"] = string(node_async_hooks_js)
 	log.Debugf("%d node libs loaded", len(nodeLibs))
 
+	if cfg.PatchesDir != "" {
+		packagePatches, err = loadPatches(cfg.PatchesDir)
+		if err != nil {
+			log.Fatalf("load patches: %v", err)
+		}
+		log.Debugf("%d patches loaded", len(packagePatches))
+	}
+
+	if cfg.JsxImportSource != "" {
+		_, _, err = ParseSpecifier(cfg.JsxImportSource)
+		if err != nil {
+			log.Fatalf("invalid jsxImportSource: %v", err)
+		}
+	}
+
+	for name, pkg := range cfg.NodePolyfills {
+		if !nodejsInternalModules[name] {
+			log.Fatalf("invalid nodePolyfills: %s is not a node builtin module", name)
+		}
+		if pkg != "" && pkg != nodePolyfillDisabled && !validatePackageName(getPkgName(pkg)) {
+			log.Fatalf("invalid nodePolyfills: invalid package name %s", pkg)
+		}
+	}
+
+	if cfg.Es5Transform {
+		registerES5Target()
+	}
+
+	if len(cfg.Targets) > 0 {
+		err = registerCustomTargets(cfg.Targets)
+		if err != nil {
+			log.Fatalf("register targets: %v", err)
+		}
+	}
+
 	var accessLogger *logger.Logger
 	if cfg.LogDir == "" {
 		accessLogger = &logger.Logger{}
@@ -146,7 +193,7 @@ func Serve(efs EmbedFS) {
 	if nodejsInstallDir == "" {
 		nodejsInstallDir = path.Join(cfg.WorkDir, "nodejs")
 	}
-	nodeVer, pnpmVer, err := checkNodejs(nodejsInstallDir)
+	nodeVer, installerVer, err := checkNodejs(nodejsInstallDir)
 	if err != nil {
 		log.Fatalf("check nodejs: %v", err)
 	}
@@ -156,13 +203,20 @@ func Serve(efs EmbedFS) {
 			cfg.NpmRegistry = strings.TrimRight(strings.TrimSpace(string(output)), "/") + "/"
 		}
 	}
-	log.Infof("nodejs: v%s, pnpm: %s, registry: %s", nodeVer, pnpmVer, cfg.NpmRegistry)
+	log.Infof("nodejs: v%s, %s: %s, registry: %s", nodeVer, cfg.Installer, installerVer, cfg.NpmRegistry)
 
 	err = initCJSLexerWorkDirectory()
 	if err != nil {
 		log.Fatalf("init cjs-lexer: %v", err)
 	}
 
+	if cfg.Es5Transform {
+		err = initES5TransformerWorkDirectory()
+		if err != nil {
+			log.Fatalf("init es5 transformer: %v", err)
+		}
+	}
+
 	if !cfg.DisableCompression {
 		rex.Use(rex.Compression())
 	}
@@ -196,6 +250,24 @@ func Serve(efs EmbedFS) {
 
 	log.Infof("Server is ready on http://localhost:%d", cfg.Port)
 
+	// follow the changes feed of the registry to invalidate the cached metadata proactively
+	feedCtx, stopFeed := context.WithCancel(context.Background())
+	if cfg.ChangesFeed != "" {
+		go followChangesFeed(feedCtx, cfg.ChangesFeed)
+	}
+
+	// evict the least-recently-used install directories when the disk quota is exceeded
+	gcCtx, stopGC := context.WithCancel(context.Background())
+	if cfg.NpmDiskQuota > 0 {
+		go workDirs.run(gcCtx, path.Join(cfg.WorkDir, "npm"), path.Join(cfg.WorkDir, "store"), cfg.NpmDiskQuota)
+	}
+
+	// install and prebuild the popular packages in the background
+	preloadCtx, stopPreload := context.WithCancel(context.Background())
+	if len(cfg.Preload) > 0 {
+		go preload(preloadCtx, cfg.Preload)
+	}
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGHUP, syscall.SIGABRT)
 	select {
@@ -205,6 +277,9 @@ func Serve(efs EmbedFS) {
 	}
 
 	// release resources
+	stopFeed()
+	stopGC()
+	stopPreload()
 	db.Close()
 	log.FlushBuffer()
 	accessLogger.FlushBuffer()
@@ -223,3 +298,18 @@ func auth(secret string) rex.Handle {
 		return nil
 	}
 }
+
+// getReplicaFillTTL returns the ttl of the values copied from the primary cache to the cache replica, it's
+// no longer than the ttl of the package info resolved by the dist-tags.
+func getReplicaFillTTL() time.Duration {
+	if cfg.CacheReplicaFillTTL < 0 {
+		return 0
+	}
+	ttl := cfg.CacheReplicaFillTTL
+	for _, t := range cfg.DistTagCacheTTL {
+		if t < ttl {
+			ttl = t
+		}
+	}
+	return time.Duration(ttl) * time.Second
+}
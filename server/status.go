@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// the errors of the builds are kept for the status API
+const buildErrorTTL = 10 * time.Minute
+
+func getBuildErrorCacheKey(buildID string) string {
+	return "build-error:" + buildID
+}
+
+// recordBuildError records the last error of the build for the status API, the error is keyed by the
+// build id (that includes the build args) and it's cleared when the build succeeds.
+func recordBuildError(task *BuildTask, err error) {
+	if cache == nil {
+		return
+	}
+	key := getBuildErrorCacheKey(task.ID())
+	if err == nil {
+		cache.Delete(key)
+		return
+	}
+	cache.Set(key, mustEncodeJSON(map[string]interface{}{
+		"error":    err.Error(),
+		"failedAt": time.Now().UTC().Format(http.TimeFormat),
+	}), buildErrorTTL)
+}
+
+// getPackageStatus returns the status of the package for the target, which is one of:
+//   - "queued": the build of the package is waiting in the build queue
+//   - "installing": the package is being installed
+//   - "building": the package is being built
+//   - "cached": the package has been built
+//   - "errored": the last build of the package failed, the error message is reported
+//   - "none": the package is not built yet
+func getPackageStatus(pkg Pkg, target string) map[string]interface{} {
+	ret := map[string]interface{}{
+		"pkg":    pkg.VersionName(),
+		"target": target,
+		"status": "none",
+	}
+
+	// the tasks of the package in the build queue, the most advanced one is reported
+	buildQueue.lock.RLock()
+	rank := 0
+	for el := buildQueue.list.Front(); el != nil; el = el.Next() {
+		t, ok := el.Value.(*queueTask)
+		if !ok || t.Target != target || t.Pkg.Name != pkg.Name || t.Pkg.Version != pkg.Version || t.Pkg.FromGithub != pkg.FromGithub {
+			continue
+		}
+		status, r := "queued", 1
+		if t.inProcess {
+			switch t.stage {
+			case "install":
+				status, r = "installing", 2
+			case "build", "transform-dts":
+				status, r = "building", 3
+			}
+		}
+		if r > rank {
+			rank = r
+			ret["status"] = status
+			ret["stage"] = t.stage
+			ret["createdAt"] = t.createdAt.Format(http.TimeFormat)
+			if !t.startedAt.IsZero() {
+				ret["startedAt"] = t.startedAt.Format(http.TimeFormat)
+			}
+		}
+	}
+	buildQueue.lock.RUnlock()
+	if rank > 0 {
+		return ret
+	}
+
+	buildID := newDefaultBuildTask(pkg, target).ID()
+	if _, ok := queryESMBuild(buildID); ok {
+		ret["status"] = "cached"
+		return ret
+	}
+
+	if cache != nil {
+		data, err := cache.Get(getBuildErrorCacheKey(buildID))
+		if err == nil {
+			var e map[string]interface{}
+			if json.Unmarshal(data, &e) == nil {
+				ret["status"] = "errored"
+				for k, v := range e {
+					ret[k] = v
+				}
+			}
+		}
+	}
+	return ret
+}
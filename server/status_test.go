@@ -0,0 +1,75 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"path"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/storage"
+)
+
+func TestPackageStatus(t *testing.T) {
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {})
+	testDB, err := storage.OpenDB("bolt:" + path.Join(t.TempDir(), "esm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testDB.Close()
+	testFS, err := storage.OpenFS("local:" + t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(d storage.DataBase, f storage.FileSystem, q *BuildQueue) { db, fs, buildQueue = d, f, q }(db, fs, buildQueue)
+	db, fs = testDB, testFS
+	// the tasks are kept in the queue without the concurrency
+	buildQueue = newBuildQueue(0)
+
+	foo := Pkg{Name: "foo", Version: "1.0.0"}
+	if s := getPackageStatus(foo, "es2022"); s["status"] != "none" {
+		t.Fatalf("invalid status: %v", s)
+	}
+
+	task := newDefaultBuildTask(foo, "denonext")
+	buildQueue.Add(task, "")
+	for stage, status := range map[string]string{"pending": "queued", "install": "installing", "build": "building"} {
+		buildQueue.lock.Lock()
+		qt := buildQueue.tasks[task.ID()]
+		qt.inProcess = stage != "pending"
+		qt.stage = stage
+		buildQueue.lock.Unlock()
+		if s := getPackageStatus(foo, "denonext"); s["status"] != status || s["stage"] != stage {
+			t.Fatalf("invalid status of the %s stage: %v", stage, s)
+		}
+	}
+	// the task of the other target is not reported
+	if s := getPackageStatus(foo, "es2022"); s["status"] != "none" {
+		t.Fatalf("invalid status: %v", s)
+	}
+
+	bar := Pkg{Name: "bar", Version: "1.0.0"}
+	recordBuildError(newDefaultBuildTask(bar, "es2022"), errors.New("could not resolve \"baz\""))
+	if s := getPackageStatus(bar, "es2022"); s["status"] != "errored" || s["error"] != "could not resolve \"baz\"" {
+		t.Fatalf("invalid status: %v", s)
+	}
+	if s := getPackageStatus(bar, "denonext"); s["status"] != "none" {
+		t.Fatalf("invalid status: %v", s)
+	}
+	// the error of the build with the other args is not reported
+	bazDev := newDefaultBuildTask(Pkg{Name: "baz", Version: "1.0.0"}, "es2022")
+	bazDev.Dev = true
+	recordBuildError(bazDev, errors.New("unexpected token"))
+	if s := getPackageStatus(bazDev.Pkg, "es2022"); s["status"] != "none" {
+		t.Fatalf("invalid status: %v", s)
+	}
+
+	// the succeeded build clears the error
+	barTask := newDefaultBuildTask(bar, "es2022")
+	db.Put(barTask.ID(), mustEncodeJSON(ESMBuild{}))
+	fs.WriteFile(path.Join("builds", barTask.ID()), bytes.NewReader([]byte("export default 1")))
+	recordBuildError(barTask, nil)
+	if s := getPackageStatus(bar, "es2022"); s["status"] != "cached" || s["error"] != nil {
+		t.Fatalf("invalid status: %v", s)
+	}
+}
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"strings"
+	"time"
+)
+
+type tieredCache struct {
+	replica        Cache
+	primary        Cache
+	fillTTL        time.Duration
+	noFillPrefixes []string
+}
+
+// NewTieredCache returns a two-tier cache that reads from the (local) replica cache firstly
+// then the primary cache, and writes to both caches. The values read from the primary cache are
+// copied to the replica with the `fillTTL` since their remaining ttl is unknown, the keys with
+// the `noFillPrefixes` (e.g. the short-lived keys) are not copied. A zero `fillTTL` disables the copy.
+func NewTieredCache(replica Cache, primary Cache, fillTTL time.Duration, noFillPrefixes ...string) Cache {
+	return &tieredCache{replica: replica, primary: primary, fillTTL: fillTTL, noFillPrefixes: noFillPrefixes}
+}
+
+func (tc *tieredCache) Has(key string) (bool, error) {
+	ok, err := tc.replica.Has(key)
+	if err == nil && ok {
+		return true, nil
+	}
+	return tc.primary.Has(key)
+}
+
+func (tc *tieredCache) Get(key string) (value []byte, err error) {
+	value, err = tc.replica.Get(key)
+	if err == nil {
+		return
+	}
+	value, err = tc.primary.Get(key)
+	if err == nil && tc.shouldFill(key) {
+		tc.replica.Set(key, value, tc.fillTTL)
+	}
+	return
+}
+
+func (tc *tieredCache) shouldFill(key string) bool {
+	if tc.fillTTL <= 0 {
+		return false
+	}
+	for _, prefix := range tc.noFillPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+func (tc *tieredCache) Set(key string, value []byte, ttl time.Duration) error {
+	err := tc.primary.Set(key, value, ttl)
+	if err != nil {
+		return err
+	}
+	return tc.replica.Set(key, value, ttl)
+}
+
+func (tc *tieredCache) Delete(key string) error {
+	err := tc.primary.Delete(key)
+	if err != nil {
+		return err
+	}
+	return tc.replica.Delete(key)
+}
+
+func (tc *tieredCache) Flush() error {
+	err := tc.primary.Flush()
+	if err != nil {
+		return err
+	}
+	return tc.replica.Flush()
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeCache is a memory cache that records the keys read from it
+type fakeCache struct {
+	Cache
+	reads []string
+}
+
+func (fc *fakeCache) Get(key string) ([]byte, error) {
+	fc.reads = append(fc.reads, key)
+	return fc.Cache.Get(key)
+}
+
+func newFakeCache(t *testing.T) *fakeCache {
+	cache, err := OpenCache("memory:test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeCache{Cache: cache}
+}
+
+func TestTieredCache(t *testing.T) {
+	replica := newFakeCache(t)
+	primary := newFakeCache(t)
+	cache := NewTieredCache(replica, primary, time.Hour)
+
+	// write-through
+	err := cache.Set("foo", []byte("foo"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*fakeCache{replica, primary} {
+		if value, err := c.Cache.Get("foo"); err != nil || string(value) != "foo" {
+			t.Fatalf("the value should be written to both caches: %q, %v", value, err)
+		}
+	}
+
+	// read from the replica firstly
+	value, err := cache.Get("foo")
+	if err != nil || string(value) != "foo" {
+		t.Fatalf("invalid value %q: %v", value, err)
+	}
+	if len(replica.reads) != 1 || len(primary.reads) != 0 {
+		t.Fatalf("the value should be read from the replica only, replica=%v primary=%v", replica.reads, primary.reads)
+	}
+
+	// read-through the primary on a replica miss
+	primary.Cache.Set("bar", []byte("bar"), time.Hour)
+	value, err = cache.Get("bar")
+	if err != nil || string(value) != "bar" {
+		t.Fatalf("invalid value %q: %v", value, err)
+	}
+	if len(replica.reads) != 2 || len(primary.reads) != 1 {
+		t.Fatalf("the value should be read from the primary on a replica miss, replica=%v primary=%v", replica.reads, primary.reads)
+	}
+	if value, err := replica.Cache.Get("bar"); err != nil || string(value) != "bar" {
+		t.Fatalf("the value read from the primary should be copied to the replica: %q, %v", value, err)
+	}
+	if ok, _ := cache.Has("bar"); !ok {
+		t.Fatal("the cache should have 'bar'")
+	}
+
+	// missing in both caches
+	if _, err = cache.Get("baz"); err != ErrNotFound {
+		t.Fatalf("invalid error %v, should be ErrNotFound", err)
+	}
+
+	// delete from both caches
+	cache.Delete("foo")
+	for _, c := range []*fakeCache{replica, primary} {
+		if ok, _ := c.Has("foo"); ok {
+			t.Fatal("the value should be deleted from both caches")
+		}
+	}
+}
+
+func TestTieredCacheFillTTL(t *testing.T) {
+	replica := newFakeCache(t)
+	primary := newFakeCache(t)
+	cache := NewTieredCache(replica, primary, 100*time.Millisecond, "short:")
+
+	// the value copied to the replica expires with the fill ttl
+	primary.Cache.Set("foo", []byte("foo"), time.Hour)
+	if value, err := cache.Get("foo"); err != nil || string(value) != "foo" {
+		t.Fatalf("invalid value %q: %v", value, err)
+	}
+	if ok, _ := replica.Has("foo"); !ok {
+		t.Fatal("the value should be copied to the replica")
+	}
+
+	// the short-lived keys are not copied, so they expire with the primary cache
+	primary.Cache.Set("short:bar", []byte("bar"), 50*time.Millisecond)
+	if value, err := cache.Get("short:bar"); err != nil || string(value) != "bar" {
+		t.Fatalf("invalid value %q: %v", value, err)
+	}
+	if ok, _ := replica.Has("short:bar"); ok {
+		t.Fatal("the short-lived key should not be copied to the replica")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if ok, _ := replica.Has("foo"); ok {
+		t.Fatal("the value copied to the replica should expire with the fill ttl")
+	}
+	if _, err := cache.Get("short:bar"); err == nil {
+		t.Fatal("the short-lived key should be expired")
+	}
+}
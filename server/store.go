@@ -0,0 +1,77 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// getPackageStoreDir returns the directory of the package in the content-addressable store by the checksums
+// advertised by the registry, the package is only saved in the store after the checksums are verified.
+func getPackageStoreDir(dist npmDist) (dir string, ok bool) {
+	key := ""
+	for _, s := range strings.Fields(dist.Integrity) {
+		if strings.HasPrefix(s, "sha512-") {
+			key = s
+			break
+		}
+	}
+	if key == "" && dist.Shasum != "" {
+		key = "sha1-" + strings.ToLower(dist.Shasum)
+	}
+	if key == "" {
+		return
+	}
+	sum := sha256.Sum256([]byte(key))
+	return path.Join(cfg.WorkDir, "store", hex.EncodeToString(sum[:])), true
+}
+
+// linkTree hard-links the files of the source directory into the destination directory,
+// the files are copied if the hard link is not supported (e.g. across devices).
+func linkTree(src string, dst string) error {
+	return filepath.Walk(src, func(fp string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, fp)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if fi.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		if os.Link(fp, target) == nil {
+			return nil
+		}
+		return copyRegularFile(fp, target)
+	})
+}
+
+func copyRegularFile(src string, dst string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	fi, err := r.Stat()
+	if err != nil {
+		return err
+	}
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	if e := w.Close(); err == nil {
+		err = e
+	}
+	return err
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPackageStore(t *testing.T) {
+	argsFile := newTestPnpm(t)
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for name, content := range map[string]string{
+		"package/package.json":  `{"name":"foo-store","version":"1.0.0","main":"dist/index.js"}`,
+		"package/dist/index.js": `module.exports = "foo"`,
+	} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	gw.Close()
+	tarball := buf.Bytes()
+	sum := sha512.Sum512(tarball)
+	integrity := "sha512-" + base64.StdEncoding.EncodeToString(sum[:])
+
+	var downloads int32
+	var srvURL string
+	newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/foo-store/1.0.0":
+			fmt.Fprintf(w, `{"name":"foo-store","version":"1.0.0","dist":{"tarball":"%s/foo-store/-/foo-store-1.0.0.tgz","integrity":"%s"}}`, srvURL, integrity)
+		case "/foo-store/-/foo-store-1.0.0.tgz":
+			atomic.AddInt32(&downloads, 1)
+			w.Write(tarball)
+		default:
+			w.WriteHeader(404)
+		}
+	})
+	srvURL = strings.TrimSuffix(cfg.NpmRegistry, "/")
+	cfg.WorkDir = t.TempDir()
+	cfg.NativeInstall = true
+	cfg.PackageStore = true
+
+	dirs := []string{t.TempDir(), t.TempDir()}
+	for _, dir := range dirs {
+		if err := installPackage(context.Background(), dir, Pkg{Name: "foo-store", Version: "1.0.0"}); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(path.Join(dir, "node_modules/foo-store/dist/index.js"))
+		if err != nil || string(data) != `module.exports = "foo"` {
+			t.Fatalf("invalid installed file: %q, %v", data, err)
+		}
+	}
+	if existsFile(argsFile) {
+		t.Fatal("the package should be installed without pnpm")
+	}
+	if n := atomic.LoadInt32(&downloads); n != 1 {
+		t.Fatalf("the tarball should be downloaded once, got %d", n)
+	}
+
+	// the files are shared by the build directories
+	storeDir, ok := getPackageStoreDir(npmDist{Integrity: integrity})
+	if !ok || !existsFile(path.Join(storeDir, "package.json")) {
+		t.Fatal("the package should be saved in the store")
+	}
+	fi1, err1 := os.Stat(path.Join(dirs[0], "node_modules/foo-store/dist/index.js"))
+	fi2, err2 := os.Stat(path.Join(dirs[1], "node_modules/foo-store/dist/index.js"))
+	if err1 != nil || err2 != nil || !os.SameFile(fi1, fi2) {
+		t.Fatal("the files of the store should be hard-linked")
+	}
+}
@@ -177,6 +177,33 @@ func (om *orderedMap) Entry(e *list.Element) (string, interface{}) {
 	return key, om.m[key]
 }
 
+// MarshalJSON implements type json.Marshaler interface, the order of keys is preserved
+func (om *orderedMap) MarshalJSON() ([]byte, error) {
+	om.lock.RLock()
+	defer om.lock.RUnlock()
+
+	buf := bytes.NewBufferString("{")
+	for e := om.l.Front(); e != nil; e = e.Next() {
+		key := e.Value.(string)
+		if e != om.l.Front() {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(om.m[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
 // UnmarshalJSON implements type json.Unmarshaler interface, so can be called in json.Unmarshal(data, om)
 func (om *orderedMap) UnmarshalJSON(data []byte) error {
 	dec := json.NewDecoder(bytes.NewReader(data))
@@ -297,3 +324,62 @@ func handledelim(t json.Token, dec *json.Decoder) (res interface{}, err error) {
 	}
 	return t, nil
 }
+
+// lruCache is a thread-safe cache that evicts the least recently used entry when the capacity is reached
+type lruCache struct {
+	lock     sync.Mutex
+	capacity int
+	l        *list.List
+	items    map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+}
+
+func newLRUCache(capacity int) *lruCache {
+	return &lruCache{
+		capacity: capacity,
+		l:        list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// Get returns the value of the key and marks it as the most recently used
+func (c *lruCache) Get(key string) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.l.MoveToFront(e)
+	return e.Value.(*lruEntry).value, true
+}
+
+// GetOrAdd returns the existing value of the key, or adds the given value
+func (c *lruCache) GetOrAdd(key string, value interface{}) interface{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.l.MoveToFront(e)
+		return e.Value.(*lruEntry).value
+	}
+	c.items[key] = c.l.PushFront(&lruEntry{key, value})
+	for c.l.Len() > c.capacity {
+		e := c.l.Back()
+		c.l.Remove(e)
+		delete(c.items, e.Value.(*lruEntry).key)
+	}
+	return value
+}
+
+func (c *lruCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.l.Len()
+}
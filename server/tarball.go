@@ -0,0 +1,307 @@
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/storage"
+)
+
+// the max size of the tarball downloaded from an arbitrary url
+const maxTarballSize = 50 * 1024 * 1024
+
+// TarballRef is the resolved package of a tarball url
+type TarballRef struct {
+	Name string `json:"name"`
+	Hash string `json:"hash"`
+}
+
+// newTarballClient creates the http client to download the tarballs, overridden by tests
+var newTarballClient = func() *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxyFromConfig
+	transport.DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		if isProxyAddr(addr) {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		// dial the resolved public ip directly to prevent the DNS rebinding
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ips, err := lookupPublicIPs(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		return dialer.DialContext(ctx, network, net.JoinHostPort(ips[0].String(), port))
+	}
+	return &http.Client{
+		Timeout:   60 * time.Second,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("tgz: too many redirects")
+			}
+			return checkTarballURL(req.URL)
+		},
+	}
+}
+
+// parseTarballVersion returns the content hash of the tarball version, e.g. `tgz:{sha256}`.
+func parseTarballVersion(version string) (hash string, ok bool) {
+	if !regexpTarballVersion.MatchString(version) {
+		return
+	}
+	return version[4:], true
+}
+
+// getTarballSavePath returns the storage path of the tarball by the content hash
+func getTarballSavePath(hash string) string {
+	return fmt.Sprintf("tarballs/%s.tgz", hash)
+}
+
+// checkTarballURL checks the tarball url to prevent the SSRF, only the https urls of the public
+// hosts are allowed.
+func checkTarballURL(u *url.URL) error {
+	if u.Scheme != "https" || u.User != nil || u.Hostname() == "" {
+		return newRegistryError(ErrInvalidSpecifier, "tgz: invalid tarball url '%s'", u.Redacted())
+	}
+	// the host is resolved by the proxy server if the request is sent via a proxy,
+	// so we check the resolved ips beforehand
+	_, err := lookupPublicIPs(context.Background(), u.Hostname())
+	return err
+}
+
+// lookupPublicIPs resolves the host and returns an error if any of the ips is not public.
+func lookupPublicIPs(ctx context.Context, host string) (ips []net.IP, err error) {
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		var addrs []net.IPAddr
+		addrs, err = net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("tgz: could not resolve host '%s'", host)
+	}
+	for _, ip := range ips {
+		if !isPublicIP(ip) {
+			return nil, newRegistryError(ErrInvalidSpecifier, "tgz: host '%s' is not allowed", host)
+		}
+	}
+	return
+}
+
+// the shared address space (100.64.0.0/10) of the carrier-grade NAT
+var cgnatIPNet = &net.IPNet{IP: net.IP{100, 64, 0, 0}, Mask: net.CIDRMask(10, 32)}
+
+// isPublicIP returns false if the ip is a loopback, private, link-local, multicast or unspecified address,
+// overridden by tests
+var isPublicIP = func(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() && !ip.IsMulticast() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() && !cgnatIPNet.Contains(ip)
+}
+
+// isProxyAddr returns true if the address is the configured proxy server.
+func isProxyAddr(addr string) bool {
+	c := getProxyConfig()
+	for _, proxy := range []string{c.HTTPProxy, c.HTTPSProxy} {
+		if proxy == "" {
+			continue
+		}
+		u, err := url.Parse(proxy)
+		if err != nil || u.Host == "" {
+			continue
+		}
+		port := u.Port()
+		if port == "" {
+			port = map[string]string{"http": "80", "https": "443", "socks5": "1080"}[u.Scheme]
+		}
+		if net.JoinHostPort(u.Hostname(), port) == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveTarballURL downloads the tarball of the url and resolves the package name, the tarball is saved
+// in the storage by the sha256 hash of the content that is used as the package version (`tgz:{sha256}`).
+func resolveTarballURL(rawURL string) (ref TarballRef, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ref, newRegistryError(ErrInvalidSpecifier, "tgz: invalid tarball url '%s'", rawURL)
+	}
+	err = checkTarballURL(u)
+	if err != nil {
+		return
+	}
+
+	cacheKey := "tgz:" + u.String()
+	unlock := fetchLocks.Lock(cacheKey)
+	defer unlock()
+
+	// check cache firstly
+	if cache != nil {
+		var data []byte
+		data, err = cache.Get(cacheKey)
+		if err == nil && json.Unmarshal(data, &ref) == nil {
+			return
+		}
+		if err != nil && err != storage.ErrNotFound && err != storage.ErrExpired {
+			log.Error("cache:", err)
+		}
+	}
+
+	resp, err := newTarballClient().Get(u.String())
+	if err != nil {
+		var regErr *RegistryError
+		if errors.As(err, &regErr) {
+			return ref, regErr
+		}
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 404 {
+		return ref, newRegistryError(ErrPackageNotFound, "tgz: tarball '%s' not found", u.Redacted())
+	}
+	if resp.StatusCode >= 500 {
+		return ref, newRegistryError(ErrRegistryUnavailable, "tgz: could not download tarball '%s' (%s)", u.Redacted(), resp.Status)
+	}
+	if resp.StatusCode != 200 {
+		return ref, fmt.Errorf("tgz: could not download tarball '%s' (%s)", u.Redacted(), resp.Status)
+	}
+
+	f, err := os.CreateTemp("", "esm-tgz-")
+	if err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(resp.Body, maxTarballSize+1))
+	if err != nil {
+		return
+	}
+	if n > maxTarballSize {
+		return ref, fmt.Errorf("tgz: tarball '%s' exceeds the size limit of %dMB", u.Redacted(), maxTarballSize/1024/1024)
+	}
+	ref.Hash = hex.EncodeToString(h.Sum(nil))
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return
+	}
+	p, err := readTarballPackageJSON(f)
+	if err != nil {
+		return ref, fmt.Errorf("tgz: invalid tarball '%s': %v", u.Redacted(), err)
+	}
+	if !validatePackageName(p.Name) {
+		return ref, newRegistryError(ErrInvalidSpecifier, "tgz: invalid package name '%s' of tarball '%s'", p.Name, u.Redacted())
+	}
+	ref.Name = p.Name
+
+	savePath := getTarballSavePath(ref.Hash)
+	_, err = fs.Stat(savePath)
+	if err == storage.ErrNotFound {
+		_, err = f.Seek(0, io.SeekStart)
+		if err == nil {
+			_, err = fs.WriteFile(savePath, f)
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	if cache != nil {
+		// the content of the url may be changed
+		cache.Set(cacheKey, mustEncodeJSON(ref), jitterTTL(10*time.Minute))
+	}
+	return
+}
+
+// readTarballPackageJSON reads the `package.json` in the root directory of the tarball.
+func readTarballPackageJSON(r io.Reader) (p NpmPackageJSON, err error) {
+	unziped, err := gzip.NewReader(r)
+	if err != nil {
+		return
+	}
+	tr := tar.NewReader(unziped)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return p, err
+		}
+		// strip tarball root dir
+		if _, name, ok := strings.Cut(h.Name, "/"); ok && name == "package.json" && h.Typeflag == tar.TypeReg {
+			err = json.NewDecoder(io.LimitReader(tr, 1024*1024)).Decode(&p)
+			return p, err
+		}
+	}
+	return p, errors.New("package.json not found")
+}
+
+// tgzInstall installs the package from the tarball saved in the storage by `resolveTarballURL`.
+func tgzInstall(ctx context.Context, wd string, pkg Pkg) (err error) {
+	hash, ok := parseTarballVersion(pkg.Version)
+	if !ok {
+		return fmt.Errorf("invalid tarball version '%s'", pkg.Version)
+	}
+	r, err := fs.OpenFile(getTarballSavePath(hash))
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return newRegistryError(ErrVersionNotFound, "tgz: tarball %s of '%s' not found", hash, pkg.Name)
+		}
+		return
+	}
+	defer r.Close()
+
+	ensureDir(wd)
+	tmpDir, err := os.MkdirTemp(wd, ".tgz-")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	err = extractTarball(r, tmpDir)
+	if err != nil {
+		return
+	}
+	var p NpmPackageJSON
+	err = parseJSONFile(path.Join(tmpDir, "package.json"), &p)
+	if err != nil {
+		return
+	}
+	if p.Name != pkg.Name {
+		return fmt.Errorf("tgz install %s: package name mismatch '%s'", pkg, p.Name)
+	}
+	// the temporary directory is created with mode 0700
+	err = os.Chmod(tmpDir, 0755)
+	if err != nil {
+		return
+	}
+	return installRepoPackage(ctx, wd, pkg.Name, tmpDir)
+}
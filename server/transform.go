@@ -96,6 +96,7 @@ func transform(input TransofrmInput) (code string, err error) {
 		Platform:         api.PlatformBrowser,
 		Format:           api.FormatESModule,
 		Target:           target,
+		Engines:          customTargetEngines[input.Target],
 		JSX:              jsx,
 		JSXImportSource:  jsxImportSource,
 		Bundle:           true,
@@ -119,5 +120,12 @@ func transform(input TransofrmInput) (code string, err error) {
 	if len(ret.OutputFiles) == 0 {
 		return "", errors.New("<400> failed to validate code: no output files")
 	}
+	if input.Target == "es5" {
+		es5, err := transformES5(ret.OutputFiles[0].Contents, true)
+		if err != nil {
+			return "", err
+		}
+		return string(es5), nil
+	}
 	return string(ret.OutputFiles[0].Contents), nil
 }
@@ -2,9 +2,11 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -23,6 +25,15 @@ var (
 	regexpJSIdent         = regexp.MustCompile(`^[a-zA-Z_$][\w$]*$`)
 	regexpGlobalIdent     = regexp.MustCompile(`__[a-zA-Z]+\$`)
 	regexpVarEqual        = regexp.MustCompile(`var ([a-zA-Z]+)\s*=\s*[a-zA-Z]+$`)
+	regexpESMSyntax       = regexp.MustCompile(`(^|[\n;}])\s*(export\s*(\*|\{|default\b|const\b|let\b|var\b|function\b|class\b|async\b)|import\s*(\{|\*|["']|[\w$]+\s*(,|from\b)))|\bimport\.meta\b`)
+	regexpCJSExports      = regexp.MustCompile(`\bmodule\.exports\b|\bexports\.[\w$]+\s*=|\bexports\[|defineProperty\(\s*exports\b`)
+	regexpDistTag         = regexp.MustCompile(`^[a-zA-Z0-9_][\w\.\-]*$`)
+	regexpTarballVersion  = regexp.MustCompile(`^tgz:[0-9a-f]{64}$`)
+	regexpSemverVersion   = regexp.MustCompile(`v?(\d+|[xX\*])(\.(\d+|[xX\*]))?(\.(\d+|[xX\*]))?(-[0-9A-Za-z\.\-]+)?(\+[0-9A-Za-z\.\-]+)?`)
+	regexpConditionName   = regexp.MustCompile(`^[a-zA-Z0-9_\-\.:@]+$`)
+	regexpWasmURL         = regexp.MustCompile(`new\s+URL\(\s*(["'])([^"'\n]+\.wasm)["']\s*,\s*import\.meta\.url\s*\)`)
+	regexpImportFrom      = regexp.MustCompile(`\b(import|export)\s*([^;'"]*?)\s*from\s*["']([^"'\n]+)["']`)
+	regexpFromSpecifier   = regexp.MustCompile(`from\s*"([^"\n]+)"`)
 )
 
 var esExts = []string{".mjs", ".js", ".jsx", ".mts", ".ts", ".tsx", ".cjs"}
@@ -41,6 +52,42 @@ func semverLessThan(a string, b string) bool {
 	return semver.MustParse(a).LessThan(semver.MustParse(b))
 }
 
+// semverRangeCheck checks if the version satisfies the semver range with the node-semver semantics:
+// a prerelease version only satisfies a `||` clause that has a prerelease comparator with the same
+// [major, minor, patch] tuple. see https://github.com/npm/node-semver#prerelease-tags
+func semverRangeCheck(ver *semver.Version, semverRange string) bool {
+	for _, clause := range strings.Split(semverRange, "||") {
+		clause = strings.TrimSpace(clause)
+		if ver.Prerelease() != "" {
+			allowed := false
+			// the comparators without prerelease exclude all prerelease versions,
+			// append `-0` to them since the prerelease is allowed by the clause.
+			clause = regexpSemverVersion.ReplaceAllStringFunc(clause, func(s string) string {
+				v, build, _ := strings.Cut(s, "+")
+				if strings.ContainsRune(v, '-') {
+					c, err := semver.NewVersion(v)
+					if err == nil && c.Major() == ver.Major() && c.Minor() == ver.Minor() && c.Patch() == ver.Patch() {
+						allowed = true
+					}
+					return s
+				}
+				if build != "" {
+					return v + "-0+" + build
+				}
+				return v + "-0"
+			})
+			if !allowed {
+				continue
+			}
+		}
+		c, err := semver.NewConstraint(clause)
+		if err == nil && c.Check(ver) {
+			return true
+		}
+	}
+	return false
+}
+
 // includes returns true if the given string is included in the given array.
 func includes(a []string, s string) bool {
 	if len(a) == 0 {
@@ -186,6 +233,19 @@ func mustEncodeJSON(v interface{}) []byte {
 	return buf.Bytes()
 }
 
+// contextReader is a reader that stops reading when the context is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
 func parseJSONFile(filename string, v interface{}) (err error) {
 	var file *os.File
 	file, err = os.Open(filename)